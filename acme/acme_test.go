@@ -0,0 +1,579 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/engine/memng"
+	"github.com/mailgun/vulcand/plugin/registry"
+	"github.com/mailgun/vulcand/secret"
+
+	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestACME(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&ACMESuite{})
+
+type ACMESuite struct {
+	ng         *lockedEngine
+	box        *secret.Box
+	clock      *timetools.FreezedTime
+	acme       *testServer
+	challenges *httptest.Server
+}
+
+func (s *ACMESuite) SetUpSuite(c *C) {
+	log.Init([]*log.LogConfig{&log.LogConfig{Name: "console"}})
+}
+
+func (s *ACMESuite) SetUpTest(c *C) {
+	s.ng = &lockedEngine{Engine: memng.New(registry.GetRegistry())}
+	key, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	s.box, err = secret.NewBoxFromKeyString(key)
+	c.Assert(err, IsNil)
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Now().UTC()}
+
+	// Challenges are answered the way the listeners answer them, by the state of the host
+	s.challenges = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h, err := s.ng.GetHost(engine.HostKey{Name: req.Host})
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		keyAuth, ok := h.ACMEChallenge(strings.TrimPrefix(req.URL.Path, "/.well-known/acme-challenge/"))
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(keyAuth))
+	}))
+	s.acme = newTestServer(c, s.challenges.Listener.Addr().String())
+}
+
+func (s *ACMESuite) TearDownTest(c *C) {
+	s.acme.Close()
+	s.challenges.Close()
+}
+
+func (s *ACMESuite) newManager(c *C, owner string) *Manager {
+	m, err := New(s.ng, s.box, Options{
+		DirectoryURL: s.acme.URL + "/directory",
+		Owner:        owner,
+		PollInterval: 10 * time.Millisecond,
+		Clock:        s.clock,
+	})
+	c.Assert(err, IsNil)
+	return m
+}
+
+func (s *ACMESuite) upsertHost(c *C, name string, a *engine.HostACME) {
+	h, err := engine.NewHost(name, engine.HostSettings{ACME: a})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.UpsertHost(*h), IsNil)
+}
+
+func (s *ACMESuite) getHost(c *C, name string) *engine.Host {
+	h, err := s.ng.GetHost(engine.HostKey{Name: name})
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *ACMESuite) TestOrderCertificate(c *C) {
+	s.upsertHost(c, "example.com", &engine.HostACME{Enabled: true, Email: "admin@example.com"})
+	// Hosts without ACME are left as is
+	s.upsertHost(c, "manual.com", nil)
+	// Client gets the new nonce if the server rejects the nonce
+	s.acme.badNonces = 1
+
+	m := s.newManager(c, "a")
+	m.checkHosts(context.Background())
+
+	h := s.getHost(c, "example.com")
+	c.Assert(h.Settings.KeyPair, NotNil)
+	cert, err := tls.X509KeyPair(h.Settings.KeyPair.Cert, h.Settings.KeyPair.Key)
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, IsNil)
+	c.Assert(leaf.DNSNames, DeepEquals, []string{"example.com"})
+	c.Assert(leaf.CheckSignatureFrom(s.acme.caCert), IsNil)
+
+	st := h.ACME
+	c.Assert(st.KeyPair, DeepEquals, h.Settings.KeyPair)
+	c.Assert(st.Lease, IsNil)
+	c.Assert(st.Challenges, IsNil)
+	c.Assert(st.LastError, Equals, "")
+	c.Assert(st.AccountURL, Not(Equals), "")
+	// Account key is sealed
+	_, err = secret.SealedValueFromJSON(st.AccountKey)
+	c.Assert(err, IsNil)
+	c.Assert(s.acme.contacts, DeepEquals, []string{"mailto:admin@example.com"})
+
+	c.Assert(s.getHost(c, "manual.com").Settings.KeyPair, IsNil)
+
+	// Valid certificate is not ordered again
+	m.checkHosts(context.Background())
+	c.Assert(s.acme.orderCount(), Equals, 1)
+}
+
+func (s *ACMESuite) TestRenewCertificate(c *C) {
+	s.upsertHost(c, "example.com", &engine.HostACME{Enabled: true})
+	m := s.newManager(c, "a")
+	m.checkHosts(context.Background())
+	first := s.getHost(c, "example.com").Settings.KeyPair
+	c.Assert(first, NotNil)
+
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(50 * 24 * time.Hour)
+	m.checkHosts(context.Background())
+	c.Assert(s.acme.orderCount(), Equals, 1)
+
+	// Certificate is renewed 30 days before expiry with the same account
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(20 * 24 * time.Hour)
+	m.checkHosts(context.Background())
+	c.Assert(s.acme.orderCount(), Equals, 2)
+	c.Assert(len(s.acme.accounts), Equals, 1)
+	c.Assert(s.getHost(c, "example.com").Settings.KeyPair.Equals(first), Equals, false)
+}
+
+func (s *ACMESuite) TestOneInstanceOrders(c *C) {
+	s.upsertHost(c, "example.com", &engine.HostACME{Enabled: true})
+
+	var wg sync.WaitGroup
+	for _, owner := range []string{"a", "b", "c"} {
+		m := s.newManager(c, owner)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.checkHosts(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(s.acme.orderCount(), Equals, 1)
+	c.Assert(s.getHost(c, "example.com").Settings.KeyPair, NotNil)
+}
+
+func (s *ACMESuite) TestLeaseOfAnotherInstance(c *C) {
+	lease := &engine.ACMELease{Owner: "b", Expires: s.clock.CurrentTime.Add(time.Minute)}
+	s.upsertHost(c, "example.com", &engine.HostACME{Enabled: true})
+	c.Assert(s.ng.UpsertACMEState(engine.HostKey{Name: "example.com"}, engine.ACMEState{Lease: lease}), IsNil)
+
+	m := s.newManager(c, "a")
+	m.checkHosts(context.Background())
+	c.Assert(s.acme.orderCount(), Equals, 0)
+
+	// Expired lease of the instance gone is taken over
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(2 * time.Minute)
+	m.checkHosts(context.Background())
+	c.Assert(s.acme.orderCount(), Equals, 1)
+	c.Assert(s.getHost(c, "example.com").Settings.KeyPair, NotNil)
+}
+
+func (s *ACMESuite) TestFailedOrder(c *C) {
+	s.upsertHost(c, "example.com", &engine.HostACME{Enabled: true})
+	s.acme.failValidation = true
+
+	m := s.newManager(c, "a")
+	m.checkHosts(context.Background())
+
+	h := s.getHost(c, "example.com")
+	c.Assert(h.Settings.KeyPair, IsNil)
+	st := h.ACME
+	c.Assert(st.Lease, IsNil)
+	c.Assert(st.Challenges, IsNil)
+	c.Assert(strings.Contains(st.LastError, "unauthorized"), Equals, true, Commentf("%s", st.LastError))
+	c.Assert(st.RetryAt.Equal(s.clock.CurrentTime.Add(time.Hour)), Equals, true)
+
+	// Order is not retried until the retry period passes
+	m.checkHosts(context.Background())
+	c.Assert(s.acme.orderCount(), Equals, 1)
+
+	s.acme.failValidation = false
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(2 * time.Hour)
+	m.checkHosts(context.Background())
+	c.Assert(s.acme.orderCount(), Equals, 2)
+	h = s.getHost(c, "example.com")
+	c.Assert(h.Settings.KeyPair, NotNil)
+	c.Assert(h.ACME.LastError, Equals, "")
+	c.Assert(h.ACME.RetryAt, IsNil)
+}
+
+func (s *ACMESuite) TestStartStop(c *C) {
+	s.upsertHost(c, "example.com", &engine.HostACME{Enabled: true})
+
+	m := s.newManager(c, "a")
+	m.Start()
+	defer m.Stop()
+	for i := 0; i < 100 && s.getHost(c, "example.com").Settings.KeyPair == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.getHost(c, "example.com").Settings.KeyPair, NotNil)
+}
+
+func (s *ACMESuite) TestManagerNeedsBox(c *C) {
+	_, err := New(s.ng, nil, Options{})
+	c.Assert(err, NotNil)
+}
+
+// lockedEngine lets the managers share the memory engine
+type lockedEngine struct {
+	engine.Engine
+	mtx sync.Mutex
+}
+
+func (e *lockedEngine) GetHosts() ([]engine.Host, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.Engine.GetHosts()
+}
+
+func (e *lockedEngine) GetHost(hk engine.HostKey) (*engine.Host, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.Engine.GetHost(hk)
+}
+
+func (e *lockedEngine) UpsertHost(h engine.Host) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.Engine.UpsertHost(h)
+}
+
+func (e *lockedEngine) UpsertACMEState(hk engine.HostKey, st engine.ACMEState) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.Engine.UpsertACMEState(hk, st)
+}
+
+// testServer is the ACME server issuing the certificates signed by the test CA, the HTTP-01 challenges
+// are validated by the requests to the challenge address
+type testServer struct {
+	*httptest.Server
+	challengeAddr string
+	caKey         *ecdsa.PrivateKey
+	caCert        *x509.Certificate
+	caPEM         []byte
+
+	mtx      sync.Mutex
+	nonce    int
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	contacts []string
+	orders   []*testOrder
+	// badNonces is the number of the valid nonces rejected
+	badNonces      int
+	failValidation bool
+}
+
+type testOrder struct {
+	account    string
+	status     string
+	names      []string
+	authzs     []*testAuthz
+	cert       []byte
+	finalizing bool
+}
+
+type testAuthz struct {
+	name   string
+	status string
+	token  string
+	err    *Error
+}
+
+func newTestServer(c *C, challengeAddr string) *testServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	caCert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	s := &testServer{
+		challengeAddr: challengeAddr,
+		caKey:         key,
+		caCert:        caCert,
+		caPEM:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		nonces:        map[string]bool{},
+		accounts:      map[string]*ecdsa.PublicKey{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *testServer) orderCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.orders)
+}
+
+func (s *testServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.nonce++
+	nonce := fmt.Sprintf("nonce-%d", s.nonce)
+	s.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	if req.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/new-nonce",
+			"newAccount": s.URL + "/new-account",
+			"newOrder":   s.URL + "/new-order",
+		})
+		return
+	}
+	if req.URL.Path == "/new-nonce" {
+		return
+	}
+
+	payload, key, account, err := s.verify(req)
+	if err != nil {
+		writeJSON(w, err.StatusCode, err)
+		return
+	}
+	var id int
+	switch {
+	case req.URL.Path == "/new-account":
+		var r struct {
+			Contact []string `json:"contact"`
+		}
+		json.Unmarshal(payload, &r)
+		for url, k := range s.accounts {
+			if k.Equal(key) {
+				w.Header().Set("Location", url)
+				writeJSON(w, http.StatusOK, map[string]string{"status": StatusValid})
+				return
+			}
+		}
+		url := fmt.Sprintf("%s/account/%d", s.URL, len(s.accounts))
+		s.accounts[url] = key
+		s.contacts = append(s.contacts, r.Contact...)
+		w.Header().Set("Location", url)
+		writeJSON(w, http.StatusCreated, map[string]string{"status": StatusValid})
+	case req.URL.Path == "/new-order":
+		var r struct {
+			Identifiers []Identifier `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &r)
+		o := &testOrder{account: account, status: StatusPending}
+		for _, id := range r.Identifiers {
+			o.names = append(o.names, id.Value)
+			o.authzs = append(o.authzs, &testAuthz{name: id.Value, status: StatusPending, token: fmt.Sprintf("token-%d", s.nonce)})
+		}
+		s.orders = append(s.orders, o)
+		w.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.URL, len(s.orders)-1))
+		writeJSON(w, http.StatusCreated, s.orderView(len(s.orders)-1))
+	case scan(req.URL.Path, "/order/%d", &id):
+		o := s.orders[id]
+		if o.finalizing {
+			o.status = StatusValid
+		}
+		writeJSON(w, http.StatusOK, s.orderView(id))
+	case scan(req.URL.Path, "/authz/%d", &id):
+		writeJSON(w, http.StatusOK, s.authzView(id))
+	case scan(req.URL.Path, "/challenge/%d", &id):
+		a := s.orders[id].authzs[0]
+		s.validate(a, s.accounts[account])
+		writeJSON(w, http.StatusOK, s.authzView(id).Challenges[0])
+	case scan(req.URL.Path, "/finalize/%d", &id):
+		o := s.orders[id]
+		for _, a := range o.authzs {
+			if a.status != StatusValid {
+				writeJSON(w, http.StatusForbidden, &Error{Type: "urn:ietf:params:acme:error:orderNotReady"})
+				return
+			}
+		}
+		var r struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &r)
+		if o.cert, err = s.issue(r.CSR, o.names); err != nil {
+			writeJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		// Certificate is available after polling the order
+		o.status, o.finalizing = StatusProcessing, true
+		writeJSON(w, http.StatusOK, s.orderView(id))
+	case scan(req.URL.Path, "/certificate/%d", &id):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.orders[id].cert)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// verify checks the nonce and the signature of the request, returns the payload, the key and
+// the account of the request
+func (s *testServer) verify(req *http.Request) ([]byte, *ecdsa.PublicKey, string, *Error) {
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return nil, nil, "", &Error{StatusCode: http.StatusBadRequest, Type: "malformed", Detail: err.Error()}
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var header struct {
+		Alg   string
+		Nonce string
+		URL   string
+		Kid   string
+		JWK   *struct{ Crv, Kty, X, Y string }
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, nil, "", &Error{StatusCode: http.StatusBadRequest, Type: "malformed", Detail: err.Error()}
+	}
+	if s.badNonces > 0 {
+		s.badNonces--
+		return nil, nil, "", &Error{StatusCode: http.StatusBadRequest, Type: errBadNonce}
+	}
+	if !s.nonces[header.Nonce] {
+		return nil, nil, "", &Error{StatusCode: http.StatusBadRequest, Type: errBadNonce}
+	}
+	delete(s.nonces, header.Nonce)
+	if header.Alg != "ES256" || header.URL != s.URL+req.URL.Path {
+		return nil, nil, "", &Error{StatusCode: http.StatusBadRequest, Type: "malformed", Detail: "bad header"}
+	}
+
+	var key *ecdsa.PublicKey
+	if header.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if key = s.accounts[header.Kid]; key == nil {
+		return nil, nil, "", &Error{StatusCode: http.StatusBadRequest, Type: "accountDoesNotExist"}
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	sum := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, nil, "", &Error{StatusCode: http.StatusBadRequest, Type: "malformed", Detail: "bad signature"}
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, key, header.Kid, nil
+}
+
+// validate fetches the key authorization from the challenge address with the host of the identifier
+func (s *testServer) validate(a *testAuthz, key *ecdsa.PublicKey) {
+	if a.status != StatusPending {
+		return
+	}
+	thumbprint, _ := json.Marshal(map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(padded(key.X, 32)),
+		"y":   base64.RawURLEncoding.EncodeToString(padded(key.Y, 32)),
+	})
+	sum := sha256.Sum256(thumbprint)
+	expected := a.token + "." + base64.RawURLEncoding.EncodeToString(sum[:])
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s.challengeAddr+"/.well-known/acme-challenge/"+a.token, nil)
+	req.Host = a.name
+	var body []byte
+	if re, err := http.DefaultClient.Do(req); err == nil {
+		body, _ = ioutil.ReadAll(re.Body)
+		re.Body.Close()
+	}
+	if string(body) != expected || s.failValidation {
+		a.status = StatusInvalid
+		a.err = &Error{Type: "urn:ietf:params:acme:error:unauthorized", Detail: fmt.Sprintf("got %q", body)}
+		return
+	}
+	a.status = StatusValid
+}
+
+func (s *testServer) issue(csr string, names []string) ([]byte, *Error) {
+	der, _ := base64.RawURLEncoding.DecodeString(csr)
+	r, err := x509.ParseCertificateRequest(der)
+	if err != nil || r.CheckSignature() != nil || fmt.Sprint(r.DNSNames) != fmt.Sprint(names) {
+		return nil, &Error{StatusCode: http.StatusBadRequest, Type: "urn:ietf:params:acme:error:badCSR"}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(s.nonce)),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, s.caCert, r.PublicKey, s.caKey)
+	if err != nil {
+		return nil, &Error{StatusCode: http.StatusInternalServerError, Detail: err.Error()}
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), s.caPEM...), nil
+}
+
+func (s *testServer) orderView(id int) *Order {
+	o := s.orders[id]
+	out := &Order{Status: o.status, Finalize: fmt.Sprintf("%s/finalize/%d", s.URL, id)}
+	for range o.authzs {
+		out.Authorizations = append(out.Authorizations, fmt.Sprintf("%s/authz/%d", s.URL, id))
+	}
+	if o.status == StatusValid {
+		out.Certificate = fmt.Sprintf("%s/certificate/%d", s.URL, id)
+	}
+	return out
+}
+
+func (s *testServer) authzView(id int) *Authorization {
+	a := s.orders[id].authzs[0]
+	return &Authorization{
+		Status:     a.status,
+		Identifier: Identifier{Type: "dns", Value: a.name},
+		Challenges: []Challenge{{
+			Type:   ChallengeHTTP01,
+			URL:    fmt.Sprintf("%s/challenge/%d", s.URL, id),
+			Token:  a.token,
+			Status: a.status,
+			Error:  a.err,
+		}},
+	}
+}
+
+func scan(path, format string, id *int) bool {
+	_, err := fmt.Sscanf(path, format, id)
+	return err == nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code >= http.StatusBadRequest {
+		w.Header().Set("Content-Type", "application/problem+json")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
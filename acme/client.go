@@ -0,0 +1,418 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is the minimal ACME client ordering the certificates with the HTTP-01 challenges, see RFC 8555.
+// The account key is ECDSA P-256, the requests are signed with ES256.
+type Client struct {
+	// DirectoryURL is the directory of the ACME server, e.g. https://acme-v02.api.letsencrypt.org/directory
+	DirectoryURL string
+	Key          *ecdsa.PrivateKey
+	// AccountURL is the key id of the account, it is set by Register
+	AccountURL string
+	HTTPClient *http.Client
+	// PollInterval is the interval of polling the pending authorizations and orders, one second if omitted
+	PollInterval time.Duration
+
+	mtx    sync.Mutex
+	dir    *directory
+	nonces []string
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// Order is the certificate order of the account
+type Order struct {
+	URL            string   `json:"-"`
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *Error   `json:"error"`
+}
+
+// Authorization proves the control of the identifier by one of the challenges
+type Authorization struct {
+	Status     string      `json:"status"`
+	Identifier Identifier  `json:"identifier"`
+	Challenges []Challenge `json:"challenges"`
+}
+
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type Challenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+	Error  *Error `json:"error"`
+}
+
+// Error is the problem document returned by the ACME server, see RFC 7807
+type Error struct {
+	StatusCode int    `json:"-"`
+	Type       string `json:"type"`
+	Detail     string `json:"detail"`
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("acme: %s: %s", e.Type, e.Detail)
+	}
+	return fmt.Sprintf("acme: %d %s: %s", e.StatusCode, e.Type, e.Detail)
+}
+
+const (
+	StatusPending    = "pending"
+	StatusReady      = "ready"
+	StatusProcessing = "processing"
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+
+	ChallengeHTTP01 = "http-01"
+
+	errBadNonce = "urn:ietf:params:acme:error:badNonce"
+)
+
+// Register creates the account of the key or finds the existing one, the terms of service are agreed to
+func (c *Client) Register(ctx context.Context, email string) error {
+	req := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return err
+	}
+	re, err := c.post(ctx, dir.NewAccount, req, nil, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	c.AccountURL = re.Header.Get("Location")
+	if c.AccountURL == "" {
+		return fmt.Errorf("acme: account location is missing")
+	}
+	return nil
+}
+
+// NewOrder orders the certificate for the DNS names
+func (c *Client) NewOrder(ctx context.Context, names ...string) (*Order, error) {
+	ids := make([]Identifier, len(names))
+	for i, name := range names {
+		ids[i] = Identifier{Type: "dns", Value: name}
+	}
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var o Order
+	re, err := c.post(ctx, dir.NewOrder, map[string]interface{}{"identifiers": ids}, &o, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	o.URL = re.Header.Get("Location")
+	return &o, nil
+}
+
+func (c *Client) Authorization(ctx context.Context, url string) (*Authorization, error) {
+	var a Authorization
+	if _, err := c.post(ctx, url, nil, &a, http.StatusOK); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Accept tells the server the challenge is ready to be validated
+func (c *Client) Accept(ctx context.Context, ch *Challenge) error {
+	_, err := c.post(ctx, ch.URL, struct{}{}, nil, http.StatusOK)
+	return err
+}
+
+// WaitAuthorization polls the authorization until it is valid, the challenge error is returned
+// if the authorization is invalid
+func (c *Client) WaitAuthorization(ctx context.Context, url string) error {
+	for {
+		a, err := c.Authorization(ctx, url)
+		if err != nil {
+			return err
+		}
+		switch a.Status {
+		case StatusValid:
+			return nil
+		case StatusPending, StatusProcessing:
+		default:
+			for _, ch := range a.Challenges {
+				if ch.Error != nil {
+					return ch.Error
+				}
+			}
+			return fmt.Errorf("acme: authorization of %s is %s", a.Identifier.Value, a.Status)
+		}
+		if err := c.sleep(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// Finalize submits the DER encoded certificate request and waits for the certificate to be issued
+func (c *Client) Finalize(ctx context.Context, o *Order, csr []byte) (*Order, error) {
+	req := map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}
+	var out Order
+	if _, err := c.post(ctx, o.Finalize, req, &out, http.StatusOK); err != nil {
+		return nil, err
+	}
+	out.URL = o.URL
+	for {
+		switch out.Status {
+		case StatusValid:
+			return &out, nil
+		case StatusProcessing:
+		default:
+			if out.Error != nil {
+				return nil, out.Error
+			}
+			return nil, fmt.Errorf("acme: order is %s", out.Status)
+		}
+		if err := c.sleep(ctx); err != nil {
+			return nil, err
+		}
+		if _, err := c.post(ctx, o.URL, nil, &out, http.StatusOK); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Certificate downloads the PEM encoded certificate chain of the valid order
+func (c *Client) Certificate(ctx context.Context, o *Order) ([]byte, error) {
+	re, err := c.post(ctx, o.Certificate, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return re.body, nil
+}
+
+// KeyAuthorization returns the response to the HTTP-01 challenge with the token
+func (c *Client) KeyAuthorization(token string) string {
+	sum := sha256.Sum256([]byte(jwk(&c.Key.PublicKey)))
+	return token + "." + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (c *Client) sleep(ctx context.Context) error {
+	d := c.PollInterval
+	if d == 0 {
+		d = time.Second
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (c *Client) directory(ctx context.Context) (*directory, error) {
+	c.mtx.Lock()
+	dir := c.dir
+	c.mtx.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+	re, err := c.do(ctx, http.MethodGet, c.DirectoryURL, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStatus(re, http.StatusOK); err != nil {
+		return nil, err
+	}
+	dir = &directory{}
+	if err := json.Unmarshal(re.body, dir); err != nil {
+		return nil, err
+	}
+	c.mtx.Lock()
+	c.dir = dir
+	c.mtx.Unlock()
+	return dir, nil
+}
+
+// response is the response with the body read
+type response struct {
+	*http.Response
+	body []byte
+}
+
+// post sends the signed request, nil payload sends POST-as-GET request. The request is sent again
+// with the new nonce if the server rejects the nonce.
+func (c *Client) post(ctx context.Context, url string, payload interface{}, out interface{}, codes ...int) (*response, error) {
+	body := []byte{}
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := c.sign(ctx, url, body)
+		if err != nil {
+			return nil, err
+		}
+		re, err := c.do(ctx, http.MethodPost, url, req, "application/jose+json")
+		if err != nil {
+			return nil, err
+		}
+		err = checkStatus(re, codes...)
+		if e, ok := err.(*Error); ok && e.Type == errBadNonce && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if out != nil {
+			if err := json.Unmarshal(re.body, out); err != nil {
+				return nil, err
+			}
+		}
+		return re, nil
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, url string, body []byte, contentType string) (*response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	re, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(re.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if nonce := re.Header.Get("Replay-Nonce"); nonce != "" {
+		c.mtx.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.mtx.Unlock()
+	}
+	return &response{Response: re, body: data}, nil
+}
+
+func (c *Client) nonce(ctx context.Context) (string, error) {
+	c.mtx.Lock()
+	if n := len(c.nonces); n != 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.mtx.Unlock()
+		return nonce, nil
+	}
+	c.mtx.Unlock()
+
+	dir, err := c.directory(ctx)
+	if err != nil {
+		return "", err
+	}
+	re, err := c.do(ctx, http.MethodHead, dir.NewNonce, nil, "")
+	if err != nil {
+		return "", err
+	}
+	if re.Header.Get("Replay-Nonce") == "" {
+		return "", fmt.Errorf("acme: server has not sent the nonce")
+	}
+	// Nonce has been added to the pool by the response
+	return c.nonce(ctx)
+}
+
+// sign returns the flattened JWS of the payload, the account key is identified by the account URL
+// once the account is registered and by the JWK before that
+func (c *Client) sign(ctx context.Context, url string, payload []byte) ([]byte, error) {
+	nonce, err := c.nonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.AccountURL != "" {
+		header["kid"] = c.AccountURL
+	} else {
+		header["jwk"] = json.RawMessage(jwk(&c.Key.PublicKey))
+	}
+	protected, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	p := base64.RawURLEncoding.EncodeToString(protected)
+	b := base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(p + "." + b))
+	r, s, err := ecdsa.Sign(rand.Reader, c.Key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := append(padded(r, 32), padded(s, 32)...)
+	return json.Marshal(map[string]string{
+		"protected": p,
+		"payload":   b,
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// jwk returns the JSON web key of the public key with the members in the lexicographic order,
+// so it is used as is for the thumbprint, see RFC 7638
+func jwk(key *ecdsa.PublicKey) string {
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(padded(key.X, 32)),
+		base64.RawURLEncoding.EncodeToString(padded(key.Y, 32)))
+}
+
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func checkStatus(re *response, codes ...int) error {
+	for _, code := range codes {
+		if re.StatusCode == code {
+			return nil
+		}
+	}
+	e := &Error{StatusCode: re.StatusCode}
+	if strings.HasPrefix(re.Header.Get("Content-Type"), "application/problem+json") {
+		json.Unmarshal(re.body, e)
+	}
+	if e.Detail == "" {
+		e.Detail = strings.TrimSpace(string(re.body))
+	}
+	return e
+}
@@ -0,0 +1,436 @@
+// package acme obtains the certificates of the hosts from the ACME servers, e.g. Let's Encrypt, and renews them
+// before expiry. The certificates are ordered with the HTTP-01 challenges answered by the vulcand listeners.
+// ACME spec: https://tools.ietf.org/html/rfc8555
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/secret"
+)
+
+// LetsEncryptURL is the directory of the Let's Encrypt production server
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// Manager orders the certificates of the hosts with ACME turned on. The vulcand instances sharing the engine
+// coordinate through the versions of the ACME state of the hosts: the instance writing the lease to the state first
+// orders the certificate, the others skip the host until the lease expires. The challenges are published in the
+// state, so every instance answers them. The state is kept apart from the host settings, so the configuration
+// export and the history do not see it. The keys are sealed by the secret box before they are stored.
+type Manager struct {
+	ng      engine.Engine
+	box     *secret.Box
+	options Options
+
+	closeC chan struct{}
+	wg     sync.WaitGroup
+}
+
+type Options struct {
+	// DirectoryURL is the directory of the ACME server, Let's Encrypt if omitted
+	DirectoryURL string
+	// Email is the contact of the ACME accounts of the hosts without the email
+	Email string
+	// Owner identifies the instance in the leases, hostname and pid if omitted
+	Owner string
+	// RenewBefore is the time before the certificate expiry the certificate is renewed, 30 days if omitted
+	RenewBefore time.Duration
+	// CheckPeriod is the period of checking the certificates of the hosts, one hour if omitted
+	CheckPeriod time.Duration
+	// LeaseTTL limits the time of ordering the certificate, 10 minutes if omitted
+	LeaseTTL time.Duration
+	// RetryPeriod is the time the failed order is retried after, one hour if omitted
+	RetryPeriod time.Duration
+	// PropagationDelay lets the other instances receive the challenges before they are validated
+	PropagationDelay time.Duration
+	// PollInterval is the interval of polling the ACME server for the validation and the certificate
+	PollInterval time.Duration
+	HTTPClient   *http.Client
+	Clock        timetools.TimeProvider
+}
+
+func New(ng engine.Engine, box *secret.Box, o Options) (*Manager, error) {
+	if box == nil {
+		return nil, fmt.Errorf("ACME needs the seal key to store the keys sealed")
+	}
+	o, err := setDefaults(o)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{ng: ng, box: box, options: o, closeC: make(chan struct{})}, nil
+}
+
+func (m *Manager) String() string {
+	return fmt.Sprintf("acme.Manager(%s)", m.options.Owner)
+}
+
+// Start checks the certificates of the hosts periodically until the manager is stopped
+func (m *Manager) Start() {
+	log.Infof("%v start, directory %s", m, m.options.DirectoryURL)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		<-m.closeC
+		cancel()
+	}()
+	go func() {
+		defer m.wg.Done()
+		for {
+			m.checkHosts(ctx)
+			select {
+			case <-m.closeC:
+				return
+			case <-m.options.Clock.After(m.options.CheckPeriod):
+			}
+		}
+	}()
+}
+
+// Stop cancels the orders in progress and waits for the manager to exit
+func (m *Manager) Stop() {
+	close(m.closeC)
+	m.wg.Wait()
+	log.Infof("%v stop", m)
+}
+
+// checkHosts orders the certificates of the hosts missing the certificates or having them expire soon
+func (m *Manager) checkHosts(ctx context.Context) {
+	hosts, err := m.ng.GetHosts()
+	if err != nil {
+		log.Errorf("%v failed to get hosts: %v", m, err)
+		return
+	}
+	for _, h := range hosts {
+		if !m.needsCertificate(h) {
+			continue
+		}
+		if err := m.orderCertificate(ctx, h); err != nil {
+			log.Errorf("%v failed to order certificate for %v: %v", m, &h, err)
+		}
+	}
+}
+
+// needsCertificate returns true if the host has no valid certificate for the hostname or the certificate
+// expires soon, and no other instance orders the certificate
+func (m *Manager) needsCertificate(h engine.Host) bool {
+	if !h.ACMEEnabled() {
+		return false
+	}
+	now := m.options.Clock.UtcNow()
+	if st := h.ACME; st != nil {
+		if st.Lease != nil && st.Lease.Owner != m.options.Owner && now.Before(st.Lease.Expires) {
+			return false
+		}
+		if st.RetryAt != nil && now.Before(*st.RetryAt) {
+			return false
+		}
+	}
+	if h.ACME == nil || h.ACME.KeyPair == nil {
+		return true
+	}
+	kp := h.ACME.KeyPair
+	cert, err := tls.X509KeyPair(kp.Cert, kp.Key)
+	if err != nil {
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.VerifyHostname(h.Name) != nil {
+		return true
+	}
+	return now.After(leaf.NotAfter.Add(-m.options.RenewBefore))
+}
+
+// orderCertificate takes the lease of the host and orders the certificate, the error of the order
+// is recorded in the ACME state and the order is retried after the retry period
+func (m *Manager) orderCertificate(ctx context.Context, h engine.Host) error {
+	hk := engine.HostKey{Name: h.Name}
+	ok, err := m.takeLease(h)
+	if err != nil || !ok {
+		return err
+	}
+	log.Infof("%v ordering certificate for %v", m, &h)
+
+	ctx, cancel := context.WithTimeout(ctx, m.options.LeaseTTL)
+	defer cancel()
+	keyPair, err := m.order(ctx, hk)
+	if err != nil {
+		retryAt := m.options.Clock.UtcNow().Add(m.options.RetryPeriod)
+		m.update(hk, func(st *engine.ACMEState) {
+			st.Lease, st.Challenges = nil, nil
+			st.LastError, st.RetryAt = err.Error(), &retryAt
+		})
+		return err
+	}
+	err = m.update(hk, func(st *engine.ACMEState) {
+		st.KeyPair = keyPair
+		st.Lease, st.Challenges = nil, nil
+		st.LastError, st.RetryAt = "", nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("%v got certificate for %v", m, &h)
+	return nil
+}
+
+// takeLease writes the lease with the version of the state read, so only one of the instances updating
+// the state concurrently succeeds
+func (m *Manager) takeLease(h engine.Host) (bool, error) {
+	st := copyState(h.ACME)
+	st.Lease = &engine.ACMELease{Owner: m.options.Owner, Expires: m.options.Clock.UtcNow().Add(m.options.LeaseTTL)}
+	if err := m.ng.UpsertACMEState(engine.HostKey{Name: h.Name}, *st); err != nil {
+		if _, ok := err.(*engine.ConflictError); ok {
+			log.Infof("%v %v lease has been taken by another instance, skipping", m, &h)
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// update applies the changes to the state of the host holding the lease of the manager, the state is read again
+// and the changes are applied again if the state has been updated concurrently
+func (m *Manager) update(hk engine.HostKey, fn func(st *engine.ACMEState)) error {
+	for i := 0; ; i++ {
+		h, err := m.ng.GetHost(hk)
+		if err != nil {
+			return err
+		}
+		if h.ACME == nil || h.ACME.Lease == nil || h.ACME.Lease.Owner != m.options.Owner {
+			return fmt.Errorf("%v lease has been lost", h)
+		}
+		st := copyState(h.ACME)
+		fn(st)
+		err = m.ng.UpsertACMEState(hk, *st)
+		if _, ok := err.(*engine.ConflictError); ok && i < 3 {
+			continue
+		}
+		return err
+	}
+}
+
+// order registers the account of the host if the host has none, publishes the challenges
+// and returns the issued certificate
+func (m *Manager) order(ctx context.Context, hk engine.HostKey) (*engine.KeyPair, error) {
+	h, err := m.ng.GetHost(hk)
+	if err != nil {
+		return nil, err
+	}
+	client, err := m.newClient(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	o, err := client.NewOrder(ctx, h.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	challenges := map[string]string{}
+	var pending []*Challenge
+	for _, url := range o.Authorizations {
+		a, err := client.Authorization(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		if a.Status == StatusValid {
+			continue
+		}
+		ch := httpChallenge(a)
+		if ch == nil {
+			return nil, fmt.Errorf("ACME server offers no %s challenge for %s", ChallengeHTTP01, a.Identifier.Value)
+		}
+		challenges[ch.Token] = client.KeyAuthorization(ch.Token)
+		pending = append(pending, ch)
+	}
+	if len(pending) != 0 {
+		err := m.update(hk, func(st *engine.ACMEState) {
+			st.Challenges = challenges
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := sleep(ctx, m.options.PropagationDelay); err != nil {
+			return nil, err
+		}
+		for _, ch := range pending {
+			if err := client.Accept(ctx, ch); err != nil {
+				return nil, err
+			}
+		}
+		for _, url := range o.Authorizations {
+			if err := client.WaitAuthorization(ctx, url); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: h.Name},
+		DNSNames: []string{h.Name},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if o, err = client.Finalize(ctx, o, csr); err != nil {
+		return nil, err
+	}
+	chain, err := client.Certificate(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return engine.NewKeyPair(chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// newClient returns the client of the host account, the account is registered and stored in the ACME state
+// if the host has none
+func (m *Manager) newClient(ctx context.Context, h *engine.Host) (*Client, error) {
+	client := &Client{
+		DirectoryURL: m.options.DirectoryURL,
+		HTTPClient:   m.options.HTTPClient,
+		PollInterval: m.options.PollInterval,
+	}
+	if st := h.ACME; st != nil && len(st.AccountKey) != 0 {
+		key, err := m.openKey(st.AccountKey)
+		if err != nil {
+			return nil, err
+		}
+		client.Key, client.AccountURL = key, st.AccountURL
+		return client, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	client.Key = key
+	email := h.Settings.ACME.Email
+	if email == "" {
+		email = m.options.Email
+	}
+	if err := client.Register(ctx, email); err != nil {
+		return nil, err
+	}
+	sealed, err := m.sealKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = m.update(engine.HostKey{Name: h.Name}, func(st *engine.ACMEState) {
+		st.AccountURL, st.AccountKey = client.AccountURL, sealed
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (m *Manager) sealKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	v, err := m.box.Seal(der)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(v)
+}
+
+func (m *Manager) openKey(sealed []byte) (*ecdsa.PrivateKey, error) {
+	v, err := secret.SealedValueFromJSON(sealed)
+	if err != nil {
+		return nil, err
+	}
+	der, err := m.box.Open(v)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+func httpChallenge(a *Authorization) *Challenge {
+	for i := range a.Challenges {
+		if a.Challenges[i].Type == ChallengeHTTP01 {
+			return &a.Challenges[i]
+		}
+	}
+	return nil
+}
+
+// copyState returns the copy of the state, so the state read from the engine is not modified. The version
+// of the state is kept, so the copy is written only if the state has not been modified since.
+func copyState(st *engine.ACMEState) *engine.ACMEState {
+	if st == nil {
+		return &engine.ACMEState{}
+	}
+	out := *st
+	if st.Lease != nil {
+		lease := *st.Lease
+		out.Lease = &lease
+	}
+	return &out
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func setDefaults(o Options) (Options, error) {
+	if o.DirectoryURL == "" {
+		o.DirectoryURL = LetsEncryptURL
+	}
+	if o.Owner == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return o, err
+		}
+		o.Owner = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if o.RenewBefore == 0 {
+		o.RenewBefore = 30 * 24 * time.Hour
+	}
+	if o.CheckPeriod == 0 {
+		o.CheckPeriod = time.Hour
+	}
+	if o.LeaseTTL == 0 {
+		o.LeaseTTL = 10 * time.Minute
+	}
+	if o.RetryPeriod == 0 {
+		o.RetryPeriod = time.Hour
+	}
+	if o.Clock == nil {
+		o.Clock = &timetools.RealTime{}
+	}
+	return o, nil
+}
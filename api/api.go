@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
@@ -25,69 +26,76 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, app *scro
 
 	app.SetNotFoundHandler(c.handleError)
 
-	app.AddHandler(scroll.Spec{Paths: []string{"/v1/status"}, Methods: []string{"GET"}, HandlerWithBody: c.getStatus})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/status"}, Methods: []string{"GET"}, HandlerWithBody: c.getStatus})
+	c.addHandler(scroll.Spec{Paths: []string{"/v1/status"}, Methods: []string{"GET"}, HandlerWithBody: c.getStatus})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/status"}, Methods: []string{"GET"}, HandlerWithBody: c.getStatus})
 
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/log/severity"}, Methods: []string{"GET"}, Handler: c.getLogSeverity})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/log/severity"}, Methods: []string{"PUT"}, Handler: c.updateLogSeverity})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/log/severity"}, Methods: []string{"GET"}, Handler: c.getLogSeverity})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/log/severity"}, Methods: []string{"PUT"}, Handler: c.updateLogSeverity})
 
 	// Hosts
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/hosts"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertHost})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/hosts"}, Methods: []string{"GET"}, HandlerWithBody: c.getHosts})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/hosts/{hostname}"}, Methods: []string{"GET"}, Handler: c.getHost})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/hosts/{hostname}"}, Methods: []string{"DELETE"}, Handler: c.deleteHost})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/hosts"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertHost})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/hosts"}, Methods: []string{"GET"}, HandlerWithBody: c.getHosts})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/hosts/{hostname}"}, Methods: []string{"GET"}, Handler: c.getHost})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/hosts/{hostname}"}, Methods: []string{"DELETE"}, Handler: c.deleteHost})
 
 	// Listeners
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/listeners"}, Methods: []string{"GET"}, Handler: c.getListeners})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/listeners"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertListener})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/listeners/{id}"}, Methods: []string{"GET"}, Handler: c.getListener})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/listeners/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteListener})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/listeners"}, Methods: []string{"GET"}, Handler: c.getListeners})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/listeners"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertListener})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/listeners/{id}"}, Methods: []string{"GET"}, Handler: c.getListener})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/listeners/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteListener})
 
 	// Top provides top-style realtime statistics about frontends and servers
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/top/frontends"}, Methods: []string{"GET"}, Handler: c.getTopFrontends})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/top/servers"}, Methods: []string{"GET"}, Handler: c.getTopServers})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/top/frontends"}, Methods: []string{"GET"}, Handler: c.getTopFrontends})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/top/servers"}, Methods: []string{"GET"}, Handler: c.getTopServers})
 
 	// Frontends
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/frontends"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertFrontend})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/frontends/{id}"}, Methods: []string{"GET"}, Handler: c.getFrontend})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/frontends"}, Methods: []string{"GET"}, Handler: c.getFrontends})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/frontends/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteFrontend})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/frontends"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertFrontend})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/frontends/{id}"}, Methods: []string{"GET"}, Handler: c.getFrontend})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/frontends"}, Methods: []string{"GET"}, Handler: c.getFrontends})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/frontends/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteFrontend})
 
 	// Backends
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertBackend})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends"}, Methods: []string{"GET"}, Handler: c.getBackends})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteBackend})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{id}"}, Methods: []string{"GET"}, Handler: c.getBackend})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertBackend})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends"}, Methods: []string{"GET"}, Handler: c.getBackends})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteBackend})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends/{id}"}, Methods: []string{"GET"}, Handler: c.getBackend})
 
 	// Servers
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers"}, Methods: []string{"GET"}, Handler: c.getServers})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertServer})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers/{id}"}, Methods: []string{"GET"}, Handler: c.getServer})
-	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteServer})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers"}, Methods: []string{"GET"}, Handler: c.getServers})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertServer})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers/{id}"}, Methods: []string{"GET"}, Handler: c.getServer})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteServer})
+
+	// Batch
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/batch"}, Methods: []string{"POST"}, HandlerWithBody: c.applyBatch})
+
+	// History
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/history"}, Methods: []string{"GET"}, Handler: c.getHistory})
+	c.addHandler(scroll.Spec{Paths: []string{"/v2/rollback/{revision}"}, Methods: []string{"POST"}, HandlerWithBody: c.rollback})
 
 	// Middlewares
-	c.app.AddHandler(
+	c.addHandler(
 		scroll.Spec{
 			Paths:           []string{fmt.Sprintf("/v2/frontends/{frontend}/middlewares")},
 			Methods:         []string{"POST"},
 			HandlerWithBody: c.upsertMiddleware,
 		})
 
-	c.app.AddHandler(
+	c.addHandler(
 		scroll.Spec{
 			Paths:   []string{fmt.Sprintf("/v2/frontends/{frontend}/middlewares/{id}")},
 			Methods: []string{"GET"},
 			Handler: c.getMiddleware,
 		})
 
-	c.app.AddHandler(
+	c.addHandler(
 		scroll.Spec{
 			Paths:   []string{fmt.Sprintf("/v2/frontends/{frontend}/middlewares")},
 			Methods: []string{"GET"},
 			Handler: c.getMiddlewares,
 		})
 
-	c.app.AddHandler(
+	c.addHandler(
 		scroll.Spec{
 			Paths:   []string{fmt.Sprintf("/v2/frontends/{frontend}/middlewares/{id}")},
 			Methods: []string{"DELETE"},
@@ -95,6 +103,60 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, app *scro
 		})
 }
 
+// addHandler registers the handler replying to the version conflicts of the conditional requests, the requests
+// with If-Match header, with 412 Precondition Failed. Scroll has no error for the status, so the handler returns
+// the conflict and the status of the reply is replaced.
+func (c *ProxyController) addHandler(spec scroll.Spec) {
+	var h http.HandlerFunc
+	if fn := spec.Handler; fn != nil {
+		h = scroll.MakeHandler(c.app, func(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
+			out, err := fn(w, r, params)
+			return out, checkPrecondition(w, r, err)
+		}, spec)
+	} else {
+		fn := spec.HandlerWithBody
+		h = scroll.MakeHandlerWithBody(c.app, func(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+			out, err := fn(w, r, params, body)
+			return out, checkPrecondition(w, r, err)
+		}, spec)
+	}
+	spec.RawHandler = func(w http.ResponseWriter, r *http.Request) {
+		h(&preconditionWriter{ResponseWriter: w}, r)
+	}
+	c.app.AddHandler(spec)
+}
+
+// checkPrecondition returns the version conflict as the conflict error, and marks the reply to the request
+// with If-Match header failed
+func checkPrecondition(w http.ResponseWriter, r *http.Request, err error) error {
+	e, ok := err.(versionConflictError)
+	if !ok {
+		return err
+	}
+	if pw, ok := w.(*preconditionWriter); ok && r.Header.Get("If-Match") != "" {
+		pw.failed = true
+	}
+	return e.ConflictError
+}
+
+// versionConflictError is returned when the version of the request does not match the current version of the object
+type versionConflictError struct {
+	scroll.ConflictError
+}
+
+// preconditionWriter replies with 412 Precondition Failed instead of 409 Conflict if the precondition failed
+type preconditionWriter struct {
+	http.ResponseWriter
+	failed bool
+}
+
+func (w *preconditionWriter) WriteHeader(status int) {
+	if w.failed && status == http.StatusConflict {
+		status = http.StatusPreconditionFailed
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
 func (c *ProxyController) handleError(w http.ResponseWriter, r *http.Request) {
 	scroll.ReplyError(w, scroll.NotFoundError{Description: "Object not found"})
 }
@@ -175,6 +237,9 @@ func (c *ProxyController) upsertHost(w http.ResponseWriter, r *http.Request, par
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if host.Version, err = ifMatch(r, host.Version); err != nil {
+		return nil, formatError(err)
+	}
 	log.Infof("Upsert %s", host)
 	return formatResult(host, c.ng.UpsertHost(*host))
 }
@@ -191,6 +256,9 @@ func (c *ProxyController) upsertListener(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if listener.Version, err = ifMatch(r, listener.Version); err != nil {
+		return nil, formatError(err)
+	}
 	log.Infof("Upsert %s", listener)
 	return formatResult(listener, c.ng.UpsertListener(*listener))
 }
@@ -202,7 +270,11 @@ func (c *ProxyController) getListener(w http.ResponseWriter, r *http.Request, pa
 
 func (c *ProxyController) deleteListener(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	log.Infof("Delete Listener(id=%s)", params["id"])
-	if err := c.ng.DeleteListener(engine.ListenerKey{Id: params["id"]}); err != nil {
+	version, err := ifMatch(r, 0)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if err := c.ng.DeleteListener(engine.ListenerKey{Id: params["id"]}, version); err != nil {
 		return nil, formatError(err)
 	}
 	return scroll.Response{"message": "Listener deleted"}, nil
@@ -211,7 +283,11 @@ func (c *ProxyController) deleteListener(w http.ResponseWriter, r *http.Request,
 func (c *ProxyController) deleteHost(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	hostname := params["hostname"]
 	log.Infof("Delete host: %s", hostname)
-	if err := c.ng.DeleteHost(engine.HostKey{Name: hostname}); err != nil {
+	version, err := ifMatch(r, 0)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if err := c.ng.DeleteHost(engine.HostKey{Name: hostname}, version); err != nil {
 		return nil, formatError(err)
 	}
 	return scroll.Response{"message": fmt.Sprintf("Host '%s' deleted", hostname)}, nil
@@ -222,6 +298,9 @@ func (c *ProxyController) upsertBackend(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if b.Version, err = ifMatch(r, b.Version); err != nil {
+		return nil, formatError(err)
+	}
 	log.Infof("Upsert Backend: %s", b)
 	return formatResult(b, c.ng.UpsertBackend(*b))
 }
@@ -229,7 +308,11 @@ func (c *ProxyController) upsertBackend(w http.ResponseWriter, r *http.Request,
 func (c *ProxyController) deleteBackend(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	backendId := params["id"]
 	log.Infof("Delete Backend(id=%s)", backendId)
-	if err := c.ng.DeleteBackend(engine.BackendKey{Id: backendId}); err != nil {
+	version, err := ifMatch(r, 0)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if err := c.ng.DeleteBackend(engine.BackendKey{Id: backendId}, version); err != nil {
 		return nil, formatError(err)
 	}
 	return scroll.Response{"message": "Backend deleted"}, nil
@@ -275,13 +358,20 @@ func (c *ProxyController) upsertFrontend(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if frontend.Version, err = ifMatch(r, frontend.Version); err != nil {
+		return nil, formatError(err)
+	}
 	log.Infof("Upsert %s", frontend)
 	return formatResult(frontend, c.ng.UpsertFrontend(*frontend, ttl))
 }
 
 func (c *ProxyController) deleteFrontend(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	log.Infof("Delete Frontend(id=%s)", params["id"])
-	if err := c.ng.DeleteFrontend(engine.FrontendKey{Id: params["id"]}); err != nil {
+	version, err := ifMatch(r, 0)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if err := c.ng.DeleteFrontend(engine.FrontendKey{Id: params["id"]}, version); err != nil {
 		return nil, formatError(err)
 	}
 	return scroll.Response{"message": "Frontend deleted"}, nil
@@ -293,6 +383,9 @@ func (c *ProxyController) upsertServer(w http.ResponseWriter, r *http.Request, p
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if srv.Version, err = ifMatch(r, srv.Version); err != nil {
+		return nil, formatError(err)
+	}
 	bk := engine.BackendKey{Id: backendId}
 	log.Infof("Upsert %v %v", bk, srv)
 	return formatResult(srv, c.ng.UpsertServer(bk, *srv, ttl))
@@ -321,7 +414,11 @@ func (c *ProxyController) getServers(w http.ResponseWriter, r *http.Request, par
 func (c *ProxyController) deleteServer(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
 	log.Infof("Delete %v", sk)
-	if err := c.ng.DeleteServer(sk); err != nil {
+	version, err := ifMatch(r, 0)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if err := c.ng.DeleteServer(sk, version); err != nil {
 		return nil, formatError(err)
 	}
 	return scroll.Response{"message": "Server deleted"}, nil
@@ -333,6 +430,9 @@ func (c *ProxyController) upsertMiddleware(w http.ResponseWriter, r *http.Reques
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if m.Version, err = ifMatch(r, m.Version); err != nil {
+		return nil, formatError(err)
+	}
 	return formatResult(m, c.ng.UpsertMiddleware(engine.FrontendKey{Id: frontend}, *m, ttl))
 }
 
@@ -354,23 +454,98 @@ func (c *ProxyController) getMiddlewares(w http.ResponseWriter, r *http.Request,
 
 func (c *ProxyController) deleteMiddleware(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	fk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
-	if err := c.ng.DeleteMiddleware(fk); err != nil {
+	version, err := ifMatch(r, 0)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if err := c.ng.DeleteMiddleware(fk, version); err != nil {
 		return nil, formatError(err)
 	}
 	return scroll.Response{"message": "Middleware deleted"}, nil
 }
 
+// applyBatch applies the changes with the engine batch: the proxy gets the changes at once, but they are stored
+// one by one and reverted on the best effort basis if any of them fails
+func (c *ProxyController) applyBatch(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	changes, err := engine.ChangesFromJSON(body, c.ng.GetRegistry().GetSpec)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if len(changes) == 0 {
+		return nil, formatError(&scroll.MissingFieldError{Field: "Changes"})
+	}
+	log.Infof("Apply batch of %d changes", len(changes))
+	if err := c.ng.ApplyBatch(changes); err != nil {
+		return nil, formatError(err)
+	}
+	return scroll.Response{"message": fmt.Sprintf("%d changes applied", len(changes))}, nil
+}
+
+func (c *ProxyController) getHistory(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
+	v, err := c.versioned()
+	if err != nil {
+		return nil, formatError(err)
+	}
+	revisions, err := v.GetHistory()
+	if err != nil {
+		return nil, formatError(err)
+	}
+	return scroll.Response{
+		"Revision":  v.GetRevision(),
+		"Revisions": revisions,
+	}, nil
+}
+
+func (c *ProxyController) rollback(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	v, err := c.versioned()
+	if err != nil {
+		return nil, formatError(err)
+	}
+	revision, err := strconv.ParseInt(params["revision"], 10, 64)
+	if err != nil {
+		return nil, formatError(scroll.InvalidParameterError{Field: "revision", Value: params["revision"]})
+	}
+	log.Infof("Rollback to revision %d", revision)
+	if err := v.Rollback(revision); err != nil {
+		return nil, formatError(err)
+	}
+	return scroll.Response{"message": fmt.Sprintf("rolled back to revision %d", revision)}, nil
+}
+
+func (c *ProxyController) versioned() (engine.Versioned, error) {
+	v, ok := c.ng.(engine.Versioned)
+	if !ok {
+		return nil, &engine.NotFoundError{Message: "history is not enabled"}
+	}
+	return v, nil
+}
+
+// ifMatch returns the version set in the If-Match header, or the given version if the header is not set
+func ifMatch(r *http.Request, version uint64) (uint64, error) {
+	val := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if val == "" {
+		return version, nil
+	}
+	v, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return 0, scroll.InvalidParameterError{Field: "If-Match", Value: val}
+	}
+	return v, nil
+}
+
 func formatError(e error) error {
 	switch err := e.(type) {
 	case *engine.AlreadyExistsError:
 		return scroll.ConflictError{Description: err.Error()}
+	case *engine.ConflictError:
+		return versionConflictError{scroll.ConflictError{Description: err.Error()}}
 	case *engine.NotFoundError:
 		return scroll.NotFoundError{Description: err.Error()}
 	case *engine.InvalidFormatError:
 		return scroll.InvalidParameterError{Value: err.Error()}
 	case scroll.GenericAPIError, scroll.MissingFieldError,
 		scroll.InvalidFormatError, scroll.InvalidParameterError,
-		scroll.NotFoundError, scroll.ConflictError:
+		scroll.NotFoundError, scroll.ConflictError, versionConflictError:
 		return e
 	}
 	return scroll.GenericAPIError{Reason: e.Error()}
@@ -433,6 +608,10 @@ type serverReadPack struct {
 	TTL    string
 }
 
+type batchPack struct {
+	Changes []json.RawMessage
+}
+
 type serverPack struct {
 	Server engine.Server
 	TTL    string
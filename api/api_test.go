@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -10,6 +11,7 @@ import (
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/scroll"
 	"github.com/mailgun/vulcand/engine"
 	"github.com/mailgun/vulcand/engine/memng"
+	"github.com/mailgun/vulcand/engine/test"
 	"github.com/mailgun/vulcand/plugin/connlimit"
 	"github.com/mailgun/vulcand/plugin/registry"
 	"github.com/mailgun/vulcand/proxy"
@@ -23,7 +25,9 @@ import (
 func TestApi(t *testing.T) { TestingT(t) }
 
 type ApiSuite struct {
-	ng         engine.Engine
+	ng engine.Engine
+	// mem is the engine shared with the other vulcand instances
+	mem        engine.Engine
 	testServer *httptest.Server
 	client     *Client
 }
@@ -39,7 +43,8 @@ func (s *ApiSuite) SetUpTest(c *C) {
 		return proxy.New(id, stapler.New(), proxy.Options{})
 	}
 
-	s.ng = memng.New(registry.GetRegistry())
+	s.mem = memng.New(registry.GetRegistry())
+	s.ng = engine.NewVersioned(s.mem, 10)
 
 	sv := supervisor.New(newProxy, s.ng, make(chan error), supervisor.Options{})
 
@@ -106,7 +111,7 @@ func (s *ApiSuite) TestHostCRUD(c *C) {
 	out, err = s.ng.GetHost(engine.HostKey{Name: host.Name})
 	c.Assert(out.Settings.KeyPair, DeepEquals, host.Settings.KeyPair)
 
-	err = s.client.DeleteHost(engine.HostKey{Name: host.Name})
+	err = s.client.DeleteHost(engine.HostKey{Name: host.Name}, 0)
 	c.Assert(err, IsNil)
 
 	hosts, _ = s.ng.GetHosts()
@@ -118,7 +123,7 @@ func (s *ApiSuite) TestHostCRUD(c *C) {
 }
 
 func (s *ApiSuite) TestHostDeleteBad(c *C) {
-	err := s.client.DeleteHost(engine.HostKey{Name: "localhost"})
+	err := s.client.DeleteHost(engine.HostKey{Name: "localhost"}, 0)
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 }
 
@@ -130,17 +135,17 @@ func (s *ApiSuite) TestBackendCRUD(c *C) {
 
 	bs, _ := s.ng.GetBackends()
 	c.Assert(len(bs), Equals, 1)
-	c.Assert(bs[0], DeepEquals, *b)
+	c.Assert(bs[0], test.VersionedEquals, *b)
 
 	bs, err = s.client.GetBackends()
 	c.Assert(bs, NotNil)
 	c.Assert(err, IsNil)
-	c.Assert(bs[0], DeepEquals, *b)
+	c.Assert(bs[0], test.VersionedEquals, *b)
 
 	bk := engine.BackendKey{Id: b.Id}
 	out, err := s.client.GetBackend(bk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, b)
+	c.Assert(out, test.VersionedEquals, b)
 
 	settings := b.HTTPSettings()
 	settings.Timeouts.Read = "1s"
@@ -149,48 +154,77 @@ func (s *ApiSuite) TestBackendCRUD(c *C) {
 
 	out, err = s.client.GetBackend(bk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, b)
+	c.Assert(out, test.VersionedEquals, b)
 
-	err = s.client.DeleteBackend(bk)
+	err = s.client.DeleteBackend(bk, 0)
 	c.Assert(err, IsNil)
 
 	out, err = s.client.GetBackend(bk)
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 }
 
+func (s *ApiSuite) TestVersionConflict(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	bk := engine.BackendKey{Id: b.Id}
+	out, err := s.client.GetBackend(bk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Version, Not(Equals), uint64(0))
+
+	settings := out.HTTPSettings()
+	settings.Timeouts.Read = "1s"
+	out.Settings = settings
+	c.Assert(s.client.UpsertBackend(*out), IsNil)
+
+	// out has the stale version now
+	c.Assert(s.client.UpsertBackend(*out), FitsTypeOf, &engine.ConflictError{})
+	c.Assert(s.client.DeleteBackend(bk, out.Version), FitsTypeOf, &engine.ConflictError{})
+
+	re, _, err := oxytest.MakeRequest(s.testServer.URL+"/v2/backends/b1",
+		oxytest.Method("DELETE"), oxytest.Header("If-Match", fmt.Sprintf(`"%d"`, out.Version)))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusPreconditionFailed)
+
+	out, err = s.client.GetBackend(bk)
+	c.Assert(err, IsNil)
+	c.Assert(s.client.DeleteBackend(bk, out.Version), IsNil)
+}
+
 func (s *ApiSuite) TestServerCRUD(c *C) {
 	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
 	c.Assert(err, IsNil)
 
 	c.Assert(s.client.UpsertBackend(*b), IsNil)
 
-	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000", Weight: 3}
 
 	bk := engine.BackendKey{Id: b.Id}
 	c.Assert(s.client.UpsertServer(bk, srv, 0), IsNil)
 
 	srvs, _ := s.ng.GetServers(bk)
 	c.Assert(len(srvs), Equals, 1)
-	c.Assert(srvs[0], DeepEquals, srv)
+	c.Assert(srvs[0], test.VersionedEquals, srv)
 
 	srvs, err = s.client.GetServers(bk)
 	c.Assert(srvs, NotNil)
 	c.Assert(len(srvs), Equals, 1)
-	c.Assert(srvs[0], DeepEquals, srv)
+	c.Assert(srvs[0], test.VersionedEquals, srv)
 
 	sk := engine.ServerKey{Id: srv.Id, BackendKey: bk}
 	out, err := s.client.GetServer(sk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &srv)
+	c.Assert(out, test.VersionedEquals, &srv)
 
 	srv.URL = "http://localhost:5001"
 	c.Assert(s.client.UpsertServer(bk, srv, 0), IsNil)
 
 	out, err = s.client.GetServer(sk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &srv)
+	c.Assert(out, test.VersionedEquals, &srv)
 
-	err = s.client.DeleteServer(sk)
+	err = s.client.DeleteServer(sk, 0)
 	c.Assert(err, IsNil)
 
 	out, err = s.client.GetServer(sk)
@@ -211,11 +245,11 @@ func (s *ApiSuite) TestFrontendCRUD(c *C) {
 
 	fs, err := s.client.GetFrontends()
 	c.Assert(err, IsNil)
-	c.Assert(fs[0], DeepEquals, *f)
+	c.Assert(fs[0], test.VersionedEquals, *f)
 
 	out, err := s.client.GetFrontend(fk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, f)
+	c.Assert(out, test.VersionedEquals, f)
 
 	settings := f.HTTPSettings()
 	settings.Hostname = `localhost`
@@ -224,7 +258,7 @@ func (s *ApiSuite) TestFrontendCRUD(c *C) {
 
 	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
 
-	c.Assert(s.client.DeleteFrontend(fk), IsNil)
+	c.Assert(s.client.DeleteFrontend(fk, 0), IsNil)
 
 	out, err = s.client.GetFrontend(fk)
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
@@ -237,14 +271,14 @@ func (s *ApiSuite) TestListenerCRUD(c *C) {
 
 	ls, err := s.client.GetListeners()
 	c.Assert(err, IsNil)
-	c.Assert(ls[0], DeepEquals, l)
+	c.Assert(ls[0], test.VersionedEquals, l)
 
 	lk := engine.ListenerKey{Id: l.Id}
 	out, err := s.client.GetListener(lk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &l)
+	c.Assert(out, test.VersionedEquals, &l)
 
-	c.Assert(s.client.DeleteListener(lk), IsNil)
+	c.Assert(s.client.DeleteListener(lk, 0), IsNil)
 
 	out, err = s.client.GetListener(lk)
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
@@ -267,7 +301,7 @@ func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 
 	ms, err := s.client.GetMiddlewares(fk)
 	c.Assert(err, IsNil)
-	c.Assert(ms[0], DeepEquals, cl)
+	c.Assert(ms[0], test.VersionedEquals, cl)
 
 	cl = s.makeConnLimit("c1", 10, "client.ip", 3, f)
 	c.Assert(s.client.UpsertMiddleware(fk, cl, 0), IsNil)
@@ -275,15 +309,147 @@ func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 	mk := engine.MiddlewareKey{Id: cl.Id, FrontendKey: fk}
 	v, err := s.client.GetMiddleware(mk)
 	c.Assert(err, IsNil)
-	c.Assert(v, DeepEquals, &cl)
+	c.Assert(v, test.VersionedEquals, &cl)
 
-	c.Assert(s.client.DeleteMiddleware(mk), IsNil)
+	c.Assert(s.client.DeleteMiddleware(mk, 0), IsNil)
 
 	_, err = s.client.GetMiddleware(mk)
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 
 }
 
+func (s *ApiSuite) TestBatch(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	bk := engine.BackendKey{Id: b.Id}
+
+	srv, err := engine.NewServer("srv1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+
+	f, err := engine.NewHTTPFrontend("f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+
+	cl := s.makeConnLimit("c1", 10, "client.ip", 2, f)
+
+	c.Assert(s.client.ApplyBatch([]interface{}{
+		&engine.BackendUpserted{Backend: *b},
+		&engine.ServerUpserted{BackendKey: bk, Server: *srv},
+		&engine.FrontendUpserted{Frontend: *f},
+		&engine.MiddlewareUpserted{FrontendKey: fk, Middleware: cl},
+	}), IsNil)
+
+	out, err := s.client.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, test.VersionedEquals, srv)
+
+	ms, err := s.client.GetMiddlewares(fk)
+	c.Assert(err, IsNil)
+	c.Assert(ms, test.VersionedEquals, []engine.Middleware{cl})
+
+	// The batch is rolled back as the backend is still used by the frontend
+	err = s.client.ApplyBatch([]interface{}{
+		&engine.MiddlewareDeleted{MiddlewareKey: engine.MiddlewareKey{FrontendKey: fk, Id: cl.Id}},
+		&engine.BackendDeleted{BackendKey: bk},
+	})
+	c.Assert(err, NotNil)
+
+	ms, err = s.client.GetMiddlewares(fk)
+	c.Assert(err, IsNil)
+	c.Assert(ms, test.VersionedEquals, []engine.Middleware{cl})
+
+	c.Assert(s.client.ApplyBatch([]interface{}{}), NotNil)
+}
+
+func (s *ApiSuite) TestHistory(c *C) {
+	start, revisions, err := s.client.GetHistory()
+	c.Assert(err, IsNil)
+	c.Assert(len(revisions), Equals, 0)
+
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	f, err := engine.NewHTTPFrontend("f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+
+	revision, revisions, err := s.client.GetHistory()
+	c.Assert(err, IsNil)
+	c.Assert(revision, Equals, start+2)
+	c.Assert(len(revisions), Equals, 2)
+	c.Assert(revisions[1].Id, Equals, start+2)
+	c.Assert(revisions[1].Changes, DeepEquals, []interface{}{&engine.FrontendUpserted{Frontend: *f}})
+	c.Assert(revisions[1].Previous, DeepEquals, []interface{}{&engine.FrontendDeleted{FrontendKey: fk}})
+
+	// Bad route pushed by mistake
+	bad, err := engine.NewHTTPFrontend("f1", b.Id, `Path("/bad")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertFrontend(*bad, 0), IsNil)
+
+	_, revisions, err = s.client.GetHistory()
+	c.Assert(err, IsNil)
+	c.Assert(revisions[2].Previous, DeepEquals, []interface{}{&engine.FrontendUpserted{Frontend: *f}})
+
+	c.Assert(s.client.Rollback(start+2), IsNil)
+
+	out, err := s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Route, Equals, f.Route)
+
+	// Rollback is recorded as a new revision, so it can be rolled back too
+	revision, _, err = s.client.GetHistory()
+	c.Assert(err, IsNil)
+	c.Assert(revision, Equals, start+4)
+
+	c.Assert(s.client.Rollback(start), IsNil)
+	_, err = s.client.GetFrontend(fk)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	_, err = s.client.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	c.Assert(s.client.Rollback(start+100), FitsTypeOf, &engine.NotFoundError{})
+	// Revisions before the start of the instance are not in its history
+	c.Assert(s.client.Rollback(start-1), FitsTypeOf, &engine.NotFoundError{})
+	c.Assert(s.client.Rollback(0), FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ApiSuite) TestRollbackConflict(c *C) {
+	start, _, err := s.client.GetHistory()
+	c.Assert(err, IsNil)
+
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	f, err := engine.NewHTTPFrontend("f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+
+	// Frontend is updated by another instance, the history of this instance does not see the change
+	other, err := engine.NewHTTPFrontend("f1", b.Id, `Path("/other")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.mem.UpsertFrontend(*other, 0), IsNil)
+
+	c.Assert(s.client.Rollback(start+1), FitsTypeOf, &engine.ConflictError{})
+	// The rollback is not conditioned with If-Match, so the conflict is not a failed precondition
+	re, _, err := oxytest.MakeRequest(fmt.Sprintf("%s/v2/rollback/%d", s.testServer.URL, start+1), oxytest.Method("POST"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusConflict)
+
+	out, err := s.client.GetFrontend(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out.Route, Equals, other.Route)
+
+	// Changes recorded after the change made elsewhere are rolled back as usual
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+	c.Assert(s.client.Rollback(start+2), IsNil)
+	out, err = s.client.GetFrontend(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out.Route, Equals, other.Route)
+}
+
 func (s *ApiSuite) makeConnLimit(id string, connections int64, variable string, priority int, f *engine.Frontend) engine.Middleware {
 	cl, err := connlimit.NewConnLimit(connections, variable)
 	if err != nil {
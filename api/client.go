@@ -66,12 +66,12 @@ func (c *Client) GetHost(hk engine.HostKey) (*engine.Host, error) {
 }
 
 func (c *Client) UpsertHost(h engine.Host) error {
-	_, err := c.Post(c.endpoint("hosts"), hostPack{Host: h})
+	_, err := c.post(c.endpoint("hosts"), hostPack{Host: h}, h.Version)
 	return err
 }
 
 func (c *Client) UpsertListener(l engine.Listener) error {
-	_, err := c.Post(c.endpoint("listeners"), listenerPack{Listener: l})
+	_, err := c.post(c.endpoint("listeners"), listenerPack{Listener: l}, l.Version)
 	return err
 }
 
@@ -91,16 +91,16 @@ func (c *Client) GetListeners() ([]engine.Listener, error) {
 	return engine.ListenersFromJSON(data)
 }
 
-func (c *Client) DeleteListener(lk engine.ListenerKey) error {
-	return c.Delete(c.endpoint("listeners", lk.Id))
+func (c *Client) DeleteListener(lk engine.ListenerKey, version uint64) error {
+	return c.delete(c.endpoint("listeners", lk.Id), version)
 }
 
-func (c *Client) DeleteHost(hk engine.HostKey) error {
-	return c.Delete(c.endpoint("hosts", hk.Name))
+func (c *Client) DeleteHost(hk engine.HostKey, version uint64) error {
+	return c.delete(c.endpoint("hosts", hk.Name), version)
 }
 
 func (c *Client) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
-	_, err := c.Post(c.endpoint("frontends"), frontendPack{Frontend: f, TTL: ttl.String()})
+	_, err := c.post(c.endpoint("frontends"), frontendPack{Frontend: f, TTL: ttl.String()}, f.Version)
 	return err
 }
 
@@ -134,20 +134,20 @@ func (c *Client) TopFrontends(bk *engine.BackendKey, limit int) ([]engine.Fronte
 	return engine.FrontendsFromJSON(response)
 }
 
-func (c *Client) DeleteFrontend(fk engine.FrontendKey) error {
-	return c.Delete(c.endpoint("frontends", fk.Id))
+func (c *Client) DeleteFrontend(fk engine.FrontendKey, version uint64) error {
+	return c.delete(c.endpoint("frontends", fk.Id), version)
 }
 
 func (c *Client) UpsertBackend(b engine.Backend) error {
 	if b.Id == "" {
 		return fmt.Errorf("frontend id and middleware id can not be empty")
 	}
-	_, err := c.Post(c.endpoint("backends"), backendPack{Backend: b})
+	_, err := c.post(c.endpoint("backends"), backendPack{Backend: b}, b.Version)
 	return err
 }
 
-func (c *Client) DeleteBackend(bk engine.BackendKey) error {
-	return c.Delete(c.endpoint("backends", bk.Id))
+func (c *Client) DeleteBackend(bk engine.BackendKey, version uint64) error {
+	return c.delete(c.endpoint("backends", bk.Id), version)
 }
 
 func (c *Client) GetBackend(bk engine.BackendKey) (*engine.Backend, error) {
@@ -170,7 +170,7 @@ func (c *Client) UpsertServer(bk engine.BackendKey, srv engine.Server, ttl time.
 	if bk.Id == "" || srv.Id == "" {
 		return fmt.Errorf("backend id and server id can not be empty")
 	}
-	_, err := c.Post(c.endpoint("backends", bk.Id, "servers"), serverPack{Server: srv, TTL: ttl.String()})
+	_, err := c.post(c.endpoint("backends", bk.Id, "servers"), serverPack{Server: srv, TTL: ttl.String()}, srv.Version)
 	return err
 }
 
@@ -211,19 +211,19 @@ func (c *Client) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 	return engine.ServersFromJSON(data)
 }
 
-func (c *Client) DeleteServer(sk engine.ServerKey) error {
+func (c *Client) DeleteServer(sk engine.ServerKey, version uint64) error {
 	if sk.BackendKey.Id == "" {
 		return fmt.Errorf("backend id can not be empty")
 	}
-	return c.Delete(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id))
+	return c.delete(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id), version)
 }
 
 func (c *Client) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
 	if fk.Id == "" || m.Id == "" {
 		return fmt.Errorf("frontend id and middleware id can not be empty")
 	}
-	_, err := c.Post(
-		c.endpoint("frontends", fk.Id, "middlewares"), middlewarePack{Middleware: m, TTL: ttl.String()})
+	_, err := c.post(
+		c.endpoint("frontends", fk.Id, "middlewares"), middlewarePack{Middleware: m, TTL: ttl.String()}, m.Version)
 	return err
 }
 
@@ -243,8 +243,53 @@ func (c *Client) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, err
 	return engine.MiddlewaresFromJSON(data, c.Registry.GetSpec)
 }
 
-func (c *Client) DeleteMiddleware(mk engine.MiddlewareKey) error {
-	return c.Delete(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
+func (c *Client) DeleteMiddleware(mk engine.MiddlewareKey, version uint64) error {
+	return c.delete(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id), version)
+}
+
+// ApplyBatch applies the list of upsert and delete events in order, vulcand applies them to the proxy at once.
+// The events are stored one by one, see engine.Engine.ApplyBatch for the guarantees in case of failure.
+func (c *Client) ApplyBatch(changes []interface{}) error {
+	pack := batchPack{Changes: make([]json.RawMessage, len(changes))}
+	for i, change := range changes {
+		data, err := engine.ChangeToJSON(change)
+		if err != nil {
+			return err
+		}
+		pack.Changes[i] = data
+	}
+	_, err := c.Post(c.endpoint("batch"), pack)
+	return err
+}
+
+// GetHistory returns the current revision and the revisions kept in the history, the oldest first
+func (c *Client) GetHistory() (int64, []engine.Revision, error) {
+	data, err := c.Get(c.endpoint("history"), url.Values{})
+	if err != nil {
+		return 0, nil, err
+	}
+	var h struct {
+		Revision int64
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return 0, nil, err
+	}
+	revisions, err := engine.RevisionsFromJSON(data, c.Registry.GetSpec)
+	if err != nil {
+		return 0, nil, err
+	}
+	return h.Revision, revisions, nil
+}
+
+// Rollback restores the state as of the revision, ConflictError is returned if the objects restored
+// have been modified outside of the history
+func (c *Client) Rollback(revision int64) error {
+	_, err := c.Post(c.endpoint("rollback", fmt.Sprintf("%d", revision)), nil)
+	// Rollback creates no objects, so the conflicts are caused by the changes made outside of the history
+	if e, ok := err.(*engine.AlreadyExistsError); ok {
+		return &engine.ConflictError{Message: e.Message}
+	}
+	return err
 }
 
 func (c *Client) PutForm(endpoint string, values url.Values) error {
@@ -263,12 +308,23 @@ func (c *Client) PutForm(endpoint string, values url.Values) error {
 }
 
 func (c *Client) Post(endpoint string, in interface{}) ([]byte, error) {
+	return c.post(endpoint, in, 0)
+}
+
+// post sends the object and the non zero version in If-Match header, so the conflicting update fails with ConflictError
+func (c *Client) post(endpoint string, in interface{}, version uint64) ([]byte, error) {
 	return c.RoundTrip(func() (*http.Response, error) {
 		data, err := json.Marshal(in)
 		if err != nil {
 			return nil, err
 		}
-		return http.Post(endpoint, "application/json", bytes.NewBuffer(data))
+		req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		setIfMatch(req, version)
+		return http.DefaultClient.Do(req)
 	})
 }
 
@@ -289,11 +345,16 @@ func (c *Client) Put(endpoint string, in interface{}) ([]byte, error) {
 }
 
 func (c *Client) Delete(endpoint string) error {
+	return c.delete(endpoint, 0)
+}
+
+func (c *Client) delete(endpoint string, version uint64) error {
 	data, err := c.RoundTrip(func() (*http.Response, error) {
 		req, err := http.NewRequest("DELETE", endpoint, nil)
 		if err != nil {
 			return nil, err
 		}
+		setIfMatch(req, version)
 		return http.DefaultClient.Do(req)
 	})
 	if err != nil {
@@ -315,6 +376,12 @@ func (c *Client) Get(u string, params url.Values) ([]byte, error) {
 	})
 }
 
+func setIfMatch(req *http.Request, version uint64) {
+	if version != 0 {
+		req.Header.Set("If-Match", fmt.Sprintf(`"%d"`, version))
+	}
+}
+
 type RoundTripFn func() (*http.Response, error)
 
 func (c *Client) RoundTrip(fn RoundTripFn) ([]byte, error) {
@@ -335,6 +402,9 @@ func (c *Client) RoundTrip(fn RoundTripFn) ([]byte, error) {
 		if response.StatusCode == http.StatusNotFound {
 			return nil, &engine.NotFoundError{Message: status.Message}
 		}
+		if response.StatusCode == http.StatusPreconditionFailed {
+			return nil, &engine.ConflictError{Message: status.Message}
+		}
 		if response.StatusCode == http.StatusConflict {
 			return nil, &engine.AlreadyExistsError{Message: status.Message}
 		}
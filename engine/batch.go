@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"fmt"
+)
+
+// ApplyChange applies a single upsert or delete event to the engine
+func ApplyChange(e Engine, change interface{}) error {
+	switch c := change.(type) {
+	case *HostUpserted:
+		return e.UpsertHost(c.Host)
+	case *HostDeleted:
+		return e.DeleteHost(c.HostKey, 0)
+	case *ListenerUpserted:
+		return e.UpsertListener(c.Listener)
+	case *ListenerDeleted:
+		return e.DeleteListener(c.ListenerKey, 0)
+	case *BackendUpserted:
+		return e.UpsertBackend(c.Backend)
+	case *BackendDeleted:
+		return e.DeleteBackend(c.BackendKey, 0)
+	case *ServerUpserted:
+		return e.UpsertServer(c.BackendKey, c.Server, 0)
+	case *ServerDeleted:
+		return e.DeleteServer(c.ServerKey, 0)
+	case *FrontendUpserted:
+		return e.UpsertFrontend(c.Frontend, 0)
+	case *FrontendDeleted:
+		return e.DeleteFrontend(c.FrontendKey, 0)
+	case *MiddlewareUpserted:
+		return e.UpsertMiddleware(c.FrontendKey, c.Middleware, 0)
+	case *MiddlewareDeleted:
+		return e.DeleteMiddleware(c.MiddlewareKey, 0)
+	}
+	return &InvalidFormatError{Message: fmt.Sprintf("unsupported change: %v", change)}
+}
+
+// ApplyChanges applies changes one by one and in case of failure reverts the changes that have been applied.
+// It is used by the engines that can not update several objects in one transaction. The revert is not guaranteed:
+// the error of the revert is returned along with the error of the change, leaving the changes applied partially.
+// ApplyChanges returns the changes that remain applied, so the engine could report them: all the changes on success,
+// none if the revert succeeded, or the changes up to the one failed to revert followed by its reverts applied.
+func ApplyChanges(e Engine, changes []interface{}) ([]interface{}, error) {
+	undo := [][]interface{}{}
+	for i, change := range changes {
+		revert, err := revertChanges(e, change)
+		if err == nil {
+			err = ApplyChange(e, change)
+		}
+		if err != nil {
+			if applied, rerr := revertApplied(e, changes[:i], undo); rerr != nil {
+				return applied, fmt.Errorf("failed to apply %v: %v, %v", change, err, rerr)
+			}
+			return nil, err
+		}
+		undo = append(undo, revert)
+	}
+	return changes, nil
+}
+
+// revertApplied reverts the changes applied in the reverse order, undo holds the reverts of every change.
+// In case of failure it returns the changes that remain applied.
+func revertApplied(e Engine, changes []interface{}, undo [][]interface{}) ([]interface{}, error) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		for j := len(undo[i]) - 1; j >= 0; j-- {
+			if err := ApplyChange(e, undo[i][j]); err != nil {
+				applied := append([]interface{}{}, changes[:i+1]...)
+				for k := len(undo[i]) - 1; k > j; k-- {
+					applied = append(applied, undo[i][k])
+				}
+				return applied, fmt.Errorf("failed to revert %v: %v", undo[i][j], err)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// revertChanges returns the changes restoring the current state of the object modified by the change.
+// The changes are unconditional, so they do not conflict with the version set by the change itself.
+func revertChanges(e Engine, change interface{}) ([]interface{}, error) {
+	out, err := currentState(e, change)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range out {
+		resetVersion(c)
+	}
+	return out, nil
+}
+
+func currentState(e Engine, change interface{}) ([]interface{}, error) {
+	switch c := change.(type) {
+	case *HostUpserted:
+		hk := HostKey{Name: c.Host.Name}
+		h, err := e.GetHost(hk)
+		if err != nil {
+			if isNotFound(err) {
+				return []interface{}{&HostDeleted{HostKey: hk}}, nil
+			}
+			return nil, err
+		}
+		return []interface{}{&HostUpserted{Host: *h}}, nil
+	case *HostDeleted:
+		h, err := e.GetHost(c.HostKey)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{&HostUpserted{Host: *h}}, nil
+	case *ListenerUpserted:
+		lk := ListenerKey{Id: c.Listener.Id}
+		l, err := e.GetListener(lk)
+		if err != nil {
+			if isNotFound(err) {
+				return []interface{}{&ListenerDeleted{ListenerKey: lk}}, nil
+			}
+			return nil, err
+		}
+		return []interface{}{&ListenerUpserted{Listener: *l}}, nil
+	case *ListenerDeleted:
+		l, err := e.GetListener(c.ListenerKey)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{&ListenerUpserted{Listener: *l}}, nil
+	case *BackendUpserted:
+		bk := BackendKey{Id: c.Backend.Id}
+		b, err := e.GetBackend(bk)
+		if err != nil {
+			if isNotFound(err) {
+				return []interface{}{&BackendDeleted{BackendKey: bk}}, nil
+			}
+			return nil, err
+		}
+		return []interface{}{&BackendUpserted{Backend: *b}}, nil
+	case *BackendDeleted:
+		// Deleting the backend deletes its servers as well, so they have to be restored after the backend
+		b, err := e.GetBackend(c.BackendKey)
+		if err != nil {
+			return nil, err
+		}
+		servers, err := e.GetServers(c.BackendKey)
+		if err != nil {
+			return nil, err
+		}
+		out := []interface{}{}
+		for i := len(servers) - 1; i >= 0; i-- {
+			out = append(out, &ServerUpserted{BackendKey: c.BackendKey, Server: servers[i]})
+		}
+		return append(out, &BackendUpserted{Backend: *b}), nil
+	case *ServerUpserted:
+		sk := ServerKey{BackendKey: c.BackendKey, Id: c.Server.Id}
+		s, err := e.GetServer(sk)
+		if err != nil {
+			if isNotFound(err) {
+				return []interface{}{&ServerDeleted{ServerKey: sk}}, nil
+			}
+			return nil, err
+		}
+		return []interface{}{&ServerUpserted{BackendKey: c.BackendKey, Server: *s}}, nil
+	case *ServerDeleted:
+		s, err := e.GetServer(c.ServerKey)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{&ServerUpserted{BackendKey: c.ServerKey.BackendKey, Server: *s}}, nil
+	case *FrontendUpserted:
+		fk := FrontendKey{Id: c.Frontend.Id}
+		f, err := e.GetFrontend(fk)
+		if err != nil {
+			if isNotFound(err) {
+				return []interface{}{&FrontendDeleted{FrontendKey: fk}}, nil
+			}
+			return nil, err
+		}
+		return []interface{}{&FrontendUpserted{Frontend: *f}}, nil
+	case *FrontendDeleted:
+		// Deleting the frontend deletes its middlewares as well, so they have to be restored after the frontend
+		f, err := e.GetFrontend(c.FrontendKey)
+		if err != nil {
+			return nil, err
+		}
+		ms, err := e.GetMiddlewares(c.FrontendKey)
+		if err != nil {
+			return nil, err
+		}
+		out := []interface{}{}
+		for i := len(ms) - 1; i >= 0; i-- {
+			out = append(out, &MiddlewareUpserted{FrontendKey: c.FrontendKey, Middleware: ms[i]})
+		}
+		return append(out, &FrontendUpserted{Frontend: *f}), nil
+	case *MiddlewareUpserted:
+		mk := MiddlewareKey{FrontendKey: c.FrontendKey, Id: c.Middleware.Id}
+		m, err := e.GetMiddleware(mk)
+		if err != nil {
+			if isNotFound(err) {
+				return []interface{}{&MiddlewareDeleted{MiddlewareKey: mk}}, nil
+			}
+			return nil, err
+		}
+		return []interface{}{&MiddlewareUpserted{FrontendKey: c.FrontendKey, Middleware: *m}}, nil
+	case *MiddlewareDeleted:
+		m, err := e.GetMiddleware(c.MiddlewareKey)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{&MiddlewareUpserted{FrontendKey: c.MiddlewareKey.FrontendKey, Middleware: *m}}, nil
+	}
+	return nil, &InvalidFormatError{Message: fmt.Sprintf("unsupported change: %v", change)}
+}
+
+// resetVersion resets the versions of the objects and the state of the hosts maintained by vulcand,
+// so the changes restore the configuration only
+func resetVersion(change interface{}) {
+	switch c := change.(type) {
+	case *HostUpserted:
+		c.Host = hostConfig(c.Host)
+	case *ListenerUpserted:
+		c.Listener.Version = 0
+	case *BackendUpserted:
+		c.Backend.Version = 0
+	case *ServerUpserted:
+		c.Server.Version = 0
+	case *FrontendUpserted:
+		c.Frontend.Version = 0
+	case *MiddlewareUpserted:
+		c.Middleware.Version = 0
+	}
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
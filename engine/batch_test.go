@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type BatchSuite struct {
+}
+
+var _ = Suite(&BatchSuite{})
+
+// serversEngine keeps the servers only, deletes of the servers fail if failDeletes is set
+type serversEngine struct {
+	Engine
+	servers     map[ServerKey]Server
+	failDeletes bool
+}
+
+func (e *serversEngine) GetServer(sk ServerKey) (*Server, error) {
+	s, ok := e.servers[sk]
+	if !ok {
+		return nil, &NotFoundError{Message: fmt.Sprintf("%v not found", sk)}
+	}
+	return &s, nil
+}
+
+func (e *serversEngine) UpsertServer(bk BackendKey, s Server, ttl time.Duration) error {
+	e.servers[ServerKey{BackendKey: bk, Id: s.Id}] = s
+	return nil
+}
+
+func (e *serversEngine) DeleteServer(sk ServerKey, version uint64) error {
+	if e.failDeletes {
+		return fmt.Errorf("failed to delete %v", sk)
+	}
+	delete(e.servers, sk)
+	return nil
+}
+
+func (e *serversEngine) GetFrontend(fk FrontendKey) (*Frontend, error) {
+	return nil, &NotFoundError{Message: fmt.Sprintf("%v not found", fk)}
+}
+
+func (e *serversEngine) UpsertFrontend(f Frontend, ttl time.Duration) error {
+	return fmt.Errorf("failed to upsert %v", f)
+}
+
+func (s *BatchSuite) changes() []interface{} {
+	bk := BackendKey{Id: "b1"}
+	return []interface{}{
+		&ServerUpserted{BackendKey: bk, Server: Server{Id: "s1", URL: "http://localhost:5000"}},
+		&ServerUpserted{BackendKey: bk, Server: Server{Id: "s2", URL: "http://localhost:5001"}},
+		&FrontendUpserted{Frontend: Frontend{Id: "f1"}},
+	}
+}
+
+func (s *BatchSuite) TestApplyChangesReverted(c *C) {
+	e := &serversEngine{servers: map[ServerKey]Server{}}
+
+	applied, err := ApplyChanges(e, s.changes())
+	c.Assert(err, NotNil)
+	c.Assert(applied, IsNil)
+	c.Assert(e.servers, DeepEquals, map[ServerKey]Server{})
+}
+
+func (s *BatchSuite) TestApplyChangesRevertFailed(c *C) {
+	e := &serversEngine{servers: map[ServerKey]Server{}, failDeletes: true}
+
+	changes := s.changes()
+	applied, err := ApplyChanges(e, changes)
+	c.Assert(err, NotNil)
+	c.Assert(applied, DeepEquals, changes[:2])
+	c.Assert(len(e.servers), Equals, 2)
+}
@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Config is the complete configuration stored in the engine. It is used to export the configuration
+// and to converge the engine to the configuration kept elsewhere, e.g. in a version control system.
+type Config struct {
+	Hosts     []Host
+	Listeners []Listener
+	Backends  []BackendConfig
+	Frontends []FrontendConfig
+}
+
+// BackendConfig is the backend along with its servers
+type BackendConfig struct {
+	Backend Backend
+	Servers []Server
+}
+
+// FrontendConfig is the frontend along with its middlewares
+type FrontendConfig struct {
+	Frontend    Frontend
+	Middlewares []Middleware
+}
+
+// ConfigReader is implemented by the engines and by the API client
+type ConfigReader interface {
+	GetHosts() ([]Host, error)
+	GetListeners() ([]Listener, error)
+	GetBackends() ([]Backend, error)
+	GetServers(BackendKey) ([]Server, error)
+	GetFrontends() ([]Frontend, error)
+	GetMiddlewares(FrontendKey) ([]Middleware, error)
+}
+
+// ReadConfig reads the complete configuration. Versions, stats and the ACME state of the hosts, including the
+// certificates issued by ACME, are not the part of the configuration, so they are reset.
+func ReadConfig(r ConfigReader) (*Config, error) {
+	hosts, err := r.GetHosts()
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := r.GetListeners()
+	if err != nil {
+		return nil, err
+	}
+	backends, err := r.GetBackends()
+	if err != nil {
+		return nil, err
+	}
+	frontends, err := r.GetFrontends()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{
+		Hosts:     []Host{},
+		Listeners: []Listener{},
+		Backends:  []BackendConfig{},
+		Frontends: []FrontendConfig{},
+	}
+	for _, h := range hosts {
+		cfg.Hosts = append(cfg.Hosts, hostConfig(h))
+	}
+	for _, l := range listeners {
+		l.Version = 0
+		cfg.Listeners = append(cfg.Listeners, l)
+	}
+	for _, b := range backends {
+		servers, err := r.GetServers(BackendKey{Id: b.Id})
+		if err != nil {
+			return nil, err
+		}
+		b.Version, b.Stats = 0, nil
+		bc := BackendConfig{Backend: b, Servers: []Server{}}
+		for _, s := range servers {
+			s.Version, s.Stats = 0, nil
+			bc.Servers = append(bc.Servers, s)
+		}
+		cfg.Backends = append(cfg.Backends, bc)
+	}
+	for _, f := range frontends {
+		ms, err := r.GetMiddlewares(FrontendKey{Id: f.Id})
+		if err != nil {
+			return nil, err
+		}
+		f.Version, f.Stats = 0, nil
+		fc := FrontendConfig{Frontend: f, Middlewares: []Middleware{}}
+		for _, m := range ms {
+			m.Version = 0
+			fc.Middlewares = append(fc.Middlewares, m)
+		}
+		cfg.Frontends = append(cfg.Frontends, fc)
+	}
+	return cfg, nil
+}
+
+// ConfigChanges returns the upsert and delete events converging the current configuration to the desired one.
+// Objects missing in the desired configuration are deleted only if prune is set. The changes are ordered, so they
+// can be applied as a batch: upserts go first in the dependency order, e.g. backends before frontends,
+// and deletes go last in the reverse order. Servers and middlewares of the deleted backends and frontends
+// are deleted along with them, so no separate events are generated.
+func ConfigChanges(current, desired *Config, prune bool) ([]interface{}, error) {
+	upserts, deletes := []interface{}{}, []interface{}{}
+
+	hosts := map[string]Host{}
+	for _, h := range current.Hosts {
+		hosts[h.Name] = hostConfig(h)
+	}
+	for _, h := range desired.Hosts {
+		// Only the configuration is compared, the state maintained by vulcand is ignored
+		h = hostConfig(h)
+		changed, err := objectChanged(hosts[h.Name], h, hosts[h.Name].Name != "")
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			upserts = append(upserts, &HostUpserted{Host: h})
+		}
+		delete(hosts, h.Name)
+	}
+
+	listeners := map[string]Listener{}
+	for _, l := range current.Listeners {
+		listeners[l.Id] = l
+	}
+	for _, l := range desired.Listeners {
+		changed, err := objectChanged(listeners[l.Id], l, listeners[l.Id].Id != "")
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			upserts = append(upserts, &ListenerUpserted{Listener: l})
+		}
+		delete(listeners, l.Id)
+	}
+
+	backends := map[string]BackendConfig{}
+	for _, b := range current.Backends {
+		backends[b.Backend.Id] = b
+	}
+	for _, b := range desired.Backends {
+		bk := BackendKey{Id: b.Backend.Id}
+		existing, ok := backends[bk.Id]
+		changed, err := objectChanged(existing.Backend, b.Backend, ok)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			upserts = append(upserts, &BackendUpserted{Backend: b.Backend})
+		}
+		servers := map[string]Server{}
+		for _, s := range existing.Servers {
+			servers[s.Id] = s
+		}
+		for _, s := range b.Servers {
+			changed, err := objectChanged(servers[s.Id], s, servers[s.Id].Id != "")
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				upserts = append(upserts, &ServerUpserted{BackendKey: bk, Server: s})
+			}
+			delete(servers, s.Id)
+		}
+		for _, s := range existing.Servers {
+			if _, ok := servers[s.Id]; ok && prune {
+				deletes = append(deletes, &ServerDeleted{ServerKey: ServerKey{BackendKey: bk, Id: s.Id}})
+			}
+		}
+		delete(backends, bk.Id)
+	}
+
+	frontends := map[string]FrontendConfig{}
+	for _, f := range current.Frontends {
+		frontends[f.Frontend.Id] = f
+	}
+	for _, f := range desired.Frontends {
+		fk := FrontendKey{Id: f.Frontend.Id}
+		existing, ok := frontends[fk.Id]
+		changed, err := objectChanged(existing.Frontend, f.Frontend, ok)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			upserts = append(upserts, &FrontendUpserted{Frontend: f.Frontend})
+		}
+		ms := map[string]Middleware{}
+		for _, m := range existing.Middlewares {
+			ms[m.Id] = m
+		}
+		for _, m := range f.Middlewares {
+			changed, err := objectChanged(ms[m.Id], m, ms[m.Id].Id != "")
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				upserts = append(upserts, &MiddlewareUpserted{FrontendKey: fk, Middleware: m})
+			}
+			delete(ms, m.Id)
+		}
+		for _, m := range existing.Middlewares {
+			if _, ok := ms[m.Id]; ok && prune {
+				deletes = append(deletes, &MiddlewareDeleted{MiddlewareKey: MiddlewareKey{FrontendKey: fk, Id: m.Id}})
+			}
+		}
+		delete(frontends, fk.Id)
+	}
+
+	if !prune {
+		return upserts, nil
+	}
+
+	// Frontends are deleted before the backends they use, listeners before hosts they belong to
+	for _, f := range current.Frontends {
+		if _, ok := frontends[f.Frontend.Id]; ok {
+			deletes = append(deletes, &FrontendDeleted{FrontendKey: FrontendKey{Id: f.Frontend.Id}})
+		}
+	}
+	for _, b := range current.Backends {
+		if _, ok := backends[b.Backend.Id]; ok {
+			deletes = append(deletes, &BackendDeleted{BackendKey: BackendKey{Id: b.Backend.Id}})
+		}
+	}
+	for _, l := range current.Listeners {
+		if _, ok := listeners[l.Id]; ok {
+			deletes = append(deletes, &ListenerDeleted{ListenerKey: ListenerKey{Id: l.Id}})
+		}
+	}
+	for _, h := range current.Hosts {
+		if _, ok := hosts[h.Name]; ok {
+			deletes = append(deletes, &HostDeleted{HostKey: HostKey{Name: h.Name}})
+		}
+	}
+	return append(upserts, deletes...), nil
+}
+
+// objectChanged compares the JSON representation of the objects, as the objects contain interfaces
+// and pointers to the settings that can not be compared directly
+func objectChanged(current, desired interface{}, exists bool) (bool, error) {
+	if !exists {
+		return true, nil
+	}
+	c, err := json.Marshal(current)
+	if err != nil {
+		return false, err
+	}
+	d, err := json.Marshal(desired)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(c, d), nil
+}
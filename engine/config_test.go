@@ -0,0 +1,92 @@
+package engine
+
+import (
+	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type ConfigSuite struct {
+}
+
+var _ = Suite(&ConfigSuite{})
+
+func (s *ConfigSuite) config() *Config {
+	return &Config{
+		Hosts:     []Host{{Name: "localhost"}},
+		Listeners: []Listener{{Id: "l1", Protocol: HTTP, Address: Address{Network: TCP, Address: "localhost:8000"}}},
+		Backends: []BackendConfig{{
+			Backend: Backend{Id: "b1", Type: HTTP, Settings: HTTPBackendSettings{}},
+			Servers: []Server{{Id: "s1", URL: "http://localhost:5000"}},
+		}},
+		Frontends: []FrontendConfig{{
+			Frontend: Frontend{Id: "f1", Type: HTTP, BackendId: "b1", Route: `Path("/")`, Settings: HTTPFrontendSettings{}},
+		}},
+	}
+}
+
+func (s *ConfigSuite) TestNoChanges(c *C) {
+	changes, err := ConfigChanges(s.config(), s.config(), true)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []interface{}{})
+}
+
+func (s *ConfigSuite) TestUpserts(c *C) {
+	current := &Config{}
+	desired := s.config()
+
+	changes, err := ConfigChanges(current, desired, true)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []interface{}{
+		&HostUpserted{Host: desired.Hosts[0]},
+		&ListenerUpserted{Listener: desired.Listeners[0]},
+		&BackendUpserted{Backend: desired.Backends[0].Backend},
+		&ServerUpserted{BackendKey: BackendKey{Id: "b1"}, Server: desired.Backends[0].Servers[0]},
+		&FrontendUpserted{Frontend: desired.Frontends[0].Frontend},
+	})
+
+	desired.Backends[0].Servers[0].URL = "http://localhost:5001"
+	changes, err = ConfigChanges(s.config(), desired, true)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []interface{}{
+		&ServerUpserted{BackendKey: BackendKey{Id: "b1"}, Server: desired.Backends[0].Servers[0]},
+	})
+}
+
+func (s *ConfigSuite) TestPrune(c *C) {
+	current := s.config()
+	desired := &Config{
+		Backends: []BackendConfig{{Backend: current.Backends[0].Backend}},
+	}
+
+	changes, err := ConfigChanges(current, desired, false)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []interface{}{})
+
+	changes, err = ConfigChanges(current, desired, true)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []interface{}{
+		&ServerDeleted{ServerKey: ServerKey{BackendKey: BackendKey{Id: "b1"}, Id: "s1"}},
+		&FrontendDeleted{FrontendKey: FrontendKey{Id: "f1"}},
+		&ListenerDeleted{ListenerKey: ListenerKey{Id: "l1"}},
+		&HostDeleted{HostKey: HostKey{Name: "localhost"}},
+	})
+}
+
+func (s *ConfigSuite) TestACMEStateIgnored(c *C) {
+	desired := s.config()
+	desired.Hosts[0].Settings.ACME = &HostACME{Enabled: true}
+
+	current := s.config()
+	current.Hosts[0].Settings.ACME = &HostACME{Enabled: true}
+	current.Hosts[0].Settings.KeyPair = &KeyPair{Key: []byte("key"), Cert: []byte("cert")}
+	current.Hosts[0].ACME = &ACMEState{KeyPair: current.Hosts[0].Settings.KeyPair, AccountURL: "https://acme.example.com/account/1"}
+
+	changes, err := ConfigChanges(current, desired, true)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []interface{}{})
+
+	// The KeyPair supplied is the part of the configuration unless ACME is turned on
+	current.Hosts[0].Settings.ACME = nil
+	changes, err = ConfigChanges(current, desired, true)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []interface{}{&HostUpserted{Host: desired.Hosts[0]}})
+}
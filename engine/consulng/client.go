@@ -0,0 +1,304 @@
+package consulng
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcand/engine"
+)
+
+// client is a minimal client for the subset of Consul HTTP API used by the engine: KV store and sessions
+type client struct {
+	addr       *url.URL
+	token      string
+	datacenter string
+	http       *http.Client
+}
+
+// pair is a key value pair as returned by Consul KV API
+type pair struct {
+	Key         string
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Flags       uint64
+	Session     string
+}
+
+func newClient(addr, token, datacenter string) (*client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		addr:       u,
+		token:      token,
+		datacenter: datacenter,
+		http:       &http.Client{},
+	}, nil
+}
+
+// get returns the key value pair and the index of the KV store, NotFoundError is returned along with the index
+// if the key does not exist
+func (c *client) get(key string) (*pair, uint64, error) {
+	pairs, index, err := c.list(key, false, 0, 0, nil)
+	if err != nil {
+		return nil, index, err
+	}
+	if len(pairs) == 0 {
+		return nil, index, &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+	}
+	return &pairs[0], index, nil
+}
+
+// list returns all the pairs with the given prefix. If index is not 0, the call blocks until the index changes
+// or the wait time expires. The call can be interrupted by closing cancelC.
+func (c *client) list(key string, recurse bool, index uint64, wait time.Duration, cancelC chan bool) ([]pair, uint64, error) {
+	params := url.Values{}
+	if recurse {
+		params.Set("recurse", "")
+	}
+	if index != 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", wait/time.Millisecond))
+	}
+	req, err := c.newRequest("GET", c.kvPath(key), params, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cancelC != nil {
+		stopC := make(chan struct{})
+		defer close(stopC)
+		cancel := make(chan struct{})
+		req.Cancel = cancel
+		go func() {
+			select {
+			case <-cancelC:
+				close(cancel)
+			case <-stopC:
+			}
+		}()
+	}
+	re, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	newIndex, _ := strconv.ParseUint(re.Header.Get("X-Consul-Index"), 10, 64)
+	if re.StatusCode == http.StatusNotFound {
+		return nil, newIndex, nil
+	}
+	if re.StatusCode != http.StatusOK {
+		return nil, 0, newError(re, body)
+	}
+	var pairs []pair
+	if err := json.Unmarshal(body, &pairs); err != nil {
+		return nil, 0, err
+	}
+	return pairs, newIndex, nil
+}
+
+// put sets the value of the key. If session is not empty, the key is acquired by the session,
+// otherwise the key is released by the session holding it. If cas is not 0, the key is updated only if its
+// ModifyIndex matches cas. Returns false if the key can not be acquired or the index does not match.
+func (c *client) put(key string, val []byte, session string, release string, cas uint64) (bool, error) {
+	params := url.Values{}
+	if cas != 0 {
+		params.Set("cas", strconv.FormatUint(cas, 10))
+	}
+	if session != "" {
+		params.Set("acquire", session)
+	} else if release != "" {
+		params.Set("release", release)
+	}
+	var ok bool
+	if err := c.do("PUT", c.kvPath(key), params, val, &ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// putCAS sets the value of the key only if its ModifyIndex matches cas, zero cas sets the value only
+// if the key does not exist. Returns false if the index does not match.
+func (c *client) putCAS(key string, val []byte, cas uint64) (bool, error) {
+	params := url.Values{}
+	params.Set("cas", strconv.FormatUint(cas, 10))
+	var ok bool
+	if err := c.do("PUT", c.kvPath(key), params, val, &ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (c *client) delete(key string, recurse bool) error {
+	params := url.Values{}
+	if recurse {
+		params.Set("recurse", "")
+	}
+	return c.do("DELETE", c.kvPath(key), params, nil, nil)
+}
+
+// deleteCAS deletes the key only if its ModifyIndex matches cas, returns false otherwise
+func (c *client) deleteCAS(key string, cas uint64) (bool, error) {
+	params := url.Values{}
+	params.Set("cas", strconv.FormatUint(cas, 10))
+	var ok bool
+	if err := c.do("DELETE", c.kvPath(key), params, nil, &ok); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// txnOp is the operation on the KV store performed in the transaction
+type txnOp struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+// txn performs the operations atomically: either all of them are applied or none. Returns false along with
+// the reasons if any of the operations fails, e.g. the index of check-index operation does not match.
+func (c *client) txn(ops []txnOp) (bool, []string, error) {
+	in := make([]map[string]txnOp, len(ops))
+	for i, op := range ops {
+		in[i] = map[string]txnOp{"KV": op}
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return false, nil, err
+	}
+	req, err := c.newRequest("PUT", "/v1/txn", url.Values{}, body)
+	if err != nil {
+		return false, nil, err
+	}
+	re, err := c.http.Do(req)
+	if err != nil {
+		return false, nil, err
+	}
+	defer re.Body.Close()
+	data, err := ioutil.ReadAll(re.Body)
+	if err != nil {
+		return false, nil, err
+	}
+	switch re.StatusCode {
+	case http.StatusOK:
+		return true, nil, nil
+	case http.StatusConflict:
+		var out struct {
+			Errors []struct {
+				OpIndex int
+				What    string
+			}
+		}
+		if err := json.Unmarshal(data, &out); err != nil {
+			return false, nil, err
+		}
+		errors := make([]string, len(out.Errors))
+		for i, e := range out.Errors {
+			errors[i] = e.What
+			if e.OpIndex >= 0 && e.OpIndex < len(ops) {
+				errors[i] = fmt.Sprintf("%s %s: %s", ops[e.OpIndex].Verb, ops[e.OpIndex].Key, e.What)
+			}
+		}
+		return false, errors, nil
+	}
+	return false, nil, newError(re, data)
+}
+
+// createSession creates a session that deletes the keys held by it once the session expires
+func (c *client) createSession(ttl time.Duration) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"Name":      "vulcand",
+		"TTL":       ttl.String(),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	})
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		ID string
+	}
+	if err := c.do("PUT", "/v1/session/create", url.Values{}, body, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// renewSession resets the session TTL, returns NotFoundError if the session has already expired
+func (c *client) renewSession(id string) error {
+	return c.do("PUT", "/v1/session/renew/"+id, url.Values{}, nil, nil)
+}
+
+func (c *client) destroySession(id string) error {
+	return c.do("PUT", "/v1/session/destroy/"+id, url.Values{}, nil, nil)
+}
+
+func (c *client) do(method, path string, params url.Values, body []byte, out interface{}) error {
+	req, err := c.newRequest(method, path, params, body)
+	if err != nil {
+		return err
+	}
+	re, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	data, err := ioutil.ReadAll(re.Body)
+	if err != nil {
+		return err
+	}
+	if re.StatusCode != http.StatusOK {
+		return newError(re, data)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *client) newRequest(method, path string, params url.Values, body []byte) (*http.Request, error) {
+	if c.datacenter != "" {
+		params.Set("dc", c.datacenter)
+	}
+	u := *c.addr
+	u.Path = path
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	return req, nil
+}
+
+func (c *client) kvPath(key string) string {
+	return "/v1/kv/" + key
+}
+
+func newError(re *http.Response, body []byte) error {
+	message := fmt.Sprintf("%s %s: %s %s", re.Request.Method, re.Request.URL.Path, re.Status, strings.TrimSpace(string(body)))
+	if re.StatusCode == http.StatusNotFound {
+		return &engine.NotFoundError{Message: message}
+	}
+	return fmt.Errorf("%s", message)
+}
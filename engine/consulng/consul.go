@@ -0,0 +1,1298 @@
+// package consulng contains the implementation of the Consul-backed engine. It uses the same key layout as the etcd engine,
+// where all vulcand properties are stored as keys in Consul KV store. Subscribe uses Consul blocking queries to watch the changes
+// and generates events. TTLs are implemented with Consul sessions that delete the keys they hold once they expire.
+package consulng
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/plugin"
+	"github.com/mailgun/vulcand/secret"
+)
+
+type ng struct {
+	registry *plugin.Registry
+	key      string
+	client   *client
+	options  Options
+
+	mtx *sync.Mutex
+	// keys contains the last known state of the keys. Blocking queries return snapshots of the KV store, so the engine emits
+	// events for its own updates right away, and uses the known state to find the changes made by the others in the snapshots.
+	keys     map[string]keyState
+	changesC chan interface{}
+
+	// batchMtx serializes batches, batch collects the changes while the batch is being prepared
+	batchMtx *sync.Mutex
+	batch    []interface{}
+	// txn is the transaction prepared by the batch, see ApplyBatch
+	txn *txn
+}
+
+type Options struct {
+	Token      string
+	Datacenter string
+	// WatchWait is the maximum time a blocking query waits for the changes
+	WatchWait time.Duration
+	Box       *secret.Box
+}
+
+// keyState is the state of the key known to the engine
+type keyState struct {
+	// index is the ModifyIndex of the key or the index of the KV store at the moment the key was deleted
+	index   uint64
+	deleted bool
+}
+
+// minSessionTTL is the minimum session TTL accepted by Consul, shorter TTLs are rounded up to it
+var minSessionTTL = 10 * time.Second
+
+func New(addr string, key string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	options = setDefaults(options)
+	client, err := newClient(addr, options.Token, options.Datacenter)
+	if err != nil {
+		return nil, err
+	}
+	return &ng{
+		registry: registry,
+		key:      strings.Trim(key, "/"),
+		client:   client,
+		options:  options,
+		mtx:      &sync.Mutex{},
+		keys:     map[string]keyState{},
+		changesC: make(chan interface{}, 1000),
+		batchMtx: &sync.Mutex{},
+	}, nil
+}
+
+func (n *ng) Close() {
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	hosts := []engine.Host{}
+	names, err := n.getDirs("hosts")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		host, err := n.GetHost(engine.HostKey{Name: name})
+		if err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		hosts = append(hosts, *host)
+	}
+	return hosts, nil
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	bytes, version, err := n.getVal(n.path("hosts", key.Name, "host"))
+	if err != nil {
+		return nil, err
+	}
+	st, err := n.get(n.path("hosts", key.Name, "acme"))
+	if err != nil && !isNotFoundError(err) {
+		return nil, err
+	}
+	h, err := n.hostFromJSON(bytes, st, key)
+	if err != nil {
+		return nil, err
+	}
+	h.Version = version
+	return h, nil
+}
+
+// hostFromJSON returns the host along with the ACME state stored in the pair st, if any
+func (n *ng) hostFromJSON(bytes []byte, st *pair, key engine.HostKey) (*engine.Host, error) {
+	var h *host
+	if err := json.Unmarshal(bytes, &h); err != nil {
+		return nil, err
+	}
+
+	var keyPair *engine.KeyPair
+	if len(h.Settings.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPair, &keyPair); err != nil {
+			return nil, err
+		}
+	}
+	var keyPairs []engine.KeyPair
+	if len(h.Settings.KeyPairs) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPairs, &keyPairs); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := engine.NewHost(key.Name, engine.HostSettings{Default: h.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: h.Settings.OCSP, Passthrough: h.Settings.Passthrough, ErrorPages: h.Settings.ErrorPages, Maintenance: h.Settings.Maintenance, HTTPSRedirect: h.Settings.HTTPSRedirect, ACME: h.Settings.ACME})
+	if err != nil || st == nil {
+		return out, err
+	}
+	var val *acmeState
+	if err := json.Unmarshal(st.Value, &val); err != nil {
+		return nil, err
+	}
+	state := val.ACMEState
+	if len(val.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(val.KeyPair, &state.KeyPair); err != nil {
+			return nil, err
+		}
+	}
+	state.Version = st.ModifyIndex
+	out.ACME = &state
+	if out.ACMEEnabled() {
+		out.Settings.KeyPair = state.KeyPair
+	}
+	return out, nil
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if h.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	val := host{
+		Name: h.Name,
+		Settings: hostSettings{
+			Default:       h.Settings.Default,
+			OCSP:          h.Settings.OCSP,
+			Passthrough:   h.Settings.Passthrough,
+			ErrorPages:    h.Settings.ErrorPages,
+			Maintenance:   h.Settings.Maintenance,
+			HTTPSRedirect: h.Settings.HTTPSRedirect,
+			ACME:          h.Settings.ACME,
+		},
+	}
+
+	// The KeyPair issued by ACME is kept in the ACME state
+	if h.Settings.KeyPair != nil && !h.ACMEEnabled() {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPair = bytes
+	}
+	if len(h.Settings.KeyPairs) != 0 {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPairs)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPairs = bytes
+	}
+
+	return n.setJSONVal(n.path("hosts", h.Name, "host"), val, noTTL, h.Version)
+}
+
+func (n *ng) DeleteHost(key engine.HostKey, version uint64) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	return n.deleteDir(n.path("hosts", key.Name), n.path("hosts", key.Name, "host"), version)
+}
+
+func (n *ng) UpsertACMEState(key engine.HostKey, st engine.ACMEState) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	val := acmeState{ACMEState: st}
+	val.ACMEState.KeyPair, val.ACMEState.Version = nil, 0
+	if st.KeyPair != nil {
+		bytes, err := n.sealJSONVal(st.KeyPair)
+		if err != nil {
+			return err
+		}
+		val.KeyPair = bytes
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	hostKey, stateKey := n.path("hosts", key.Name, "host"), n.path("hosts", key.Name, "acme")
+	if _, _, err := n.client.get(hostKey); err != nil {
+		return err
+	}
+	// Zero version creates the state only if the host has none
+	ok, err := n.client.putCAS(stateKey, bytes, st.Version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &engine.ConflictError{Message: fmt.Sprintf("%s has been modified concurrently", stateKey)}
+	}
+	p, _, err := n.client.get(stateKey)
+	if err != nil {
+		return err
+	}
+	n.keys[stateKey] = keyState{index: p.ModifyIndex}
+	change, err := n.upsertedEvent(p, n.getPair)
+	if err != nil {
+		return err
+	}
+	if change != nil {
+		n.emit(change)
+	}
+	return nil
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	ls := []engine.Listener{}
+	ids, err := n.getVals("listeners")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		l, err := n.GetListener(engine.ListenerKey{Id: id})
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, *l)
+	}
+	return ls, nil
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	bytes, version, err := n.getVal(n.path("listeners", key.Id))
+	if err != nil {
+		return nil, err
+	}
+	l, err := engine.ListenerFromJSON(bytes, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	l.Version = version
+	return l, nil
+}
+
+func (n *ng) UpsertListener(listener engine.Listener) error {
+	if listener.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	version := listener.Version
+	listener.Version = 0
+	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL, version)
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey, version uint64) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	return n.deleteKey(n.path("listeners", key.Id), version)
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	fs := []engine.Frontend{}
+	ids, err := n.getDirs("frontends")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		f, err := n.GetFrontend(engine.FrontendKey{Id: id})
+		if err != nil {
+			// frontend has expired, but its middlewares are still there
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		fs = append(fs, *f)
+	}
+	return fs, nil
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	bytes, version, err := n.getVal(n.path("frontends", key.Id, "frontend"))
+	if err != nil {
+		return nil, err
+	}
+	f, err := engine.FrontendFromJSON(bytes, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	f.Version = version
+	return f, nil
+}
+
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if f.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	for _, id := range f.BackendIds() {
+		if _, err := n.GetBackend(engine.BackendKey{Id: id}); err != nil {
+			return err
+		}
+	}
+	version := f.Version
+	f.Version = 0
+	return n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, ttl, version)
+}
+
+func (n *ng) DeleteFrontend(fk engine.FrontendKey, version uint64) error {
+	if fk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	return n.deleteDir(n.path("frontends", fk.Id), n.path("frontends", fk.Id, "frontend"), version)
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	backends := []engine.Backend{}
+	ids, err := n.getDirs("backends")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		b, err := n.GetBackend(engine.BackendKey{Id: id})
+		if err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		backends = append(backends, *b)
+	}
+	return backends, nil
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	bytes, version, err := n.getVal(n.path("backends", key.Id, "backend"))
+	if err != nil {
+		return nil, err
+	}
+	b, err := engine.BackendFromJSON(bytes, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	b.Version = version
+	return b, nil
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	if b.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	version := b.Version
+	b.Version = 0
+	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL, version)
+}
+
+func (n *ng) DeleteBackend(bk engine.BackendKey, version uint64) error {
+	if bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	fs, err := n.backendUsedBy(bk)
+	if err != nil {
+		return err
+	}
+	if len(fs) != 0 {
+		return fmt.Errorf("can not delete backend '%v', it is in use by %v", bk, fs)
+	}
+	return n.deleteDir(n.path("backends", bk.Id), n.path("backends", bk.Id, "backend"), version)
+}
+
+func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	ms := []engine.Middleware{}
+	ids, err := n.getVals("frontends", fk.Id, "middlewares")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		m, err := n.GetMiddleware(engine.MiddlewareKey{Id: id, FrontendKey: fk})
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, *m)
+	}
+	return ms, nil
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	bytes, version, err := n.getVal(n.path("frontends", key.FrontendKey.Id, "middlewares", key.Id))
+	if err != nil {
+		return nil, err
+	}
+	m, err := engine.MiddlewareFromJSON(bytes, n.registry.GetSpec, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	m.Version = version
+	return m, nil
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if fk.Id == "" || m.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	if _, err := n.GetFrontend(fk); err != nil {
+		return err
+	}
+	version := m.Version
+	m.Version = 0
+	return n.setJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl, version)
+}
+
+func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey, version uint64) error {
+	if mk.FrontendKey.Id == "" || mk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	return n.deleteKey(n.path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id), version)
+}
+
+func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
+	svs := []engine.Server{}
+	ids, err := n.getVals("backends", bk.Id, "servers")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		srv, err := n.GetServer(engine.ServerKey{Id: id, BackendKey: bk})
+		if err != nil {
+			return nil, err
+		}
+		svs = append(svs, *srv)
+	}
+	return svs, nil
+}
+
+func (n *ng) GetServer(sk engine.ServerKey) (*engine.Server, error) {
+	bytes, version, err := n.getVal(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+	if err != nil {
+		return nil, err
+	}
+	s, err := engine.ServerFromJSON(bytes, sk.Id)
+	if err != nil {
+		return nil, err
+	}
+	s.Version = version
+	return s, nil
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if s.Id == "" || bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	if _, err := n.GetBackend(bk); err != nil {
+		return err
+	}
+	version := s.Version
+	s.Version = 0
+	return n.setJSONVal(n.path("backends", bk.Id, "servers", s.Id), s, ttl, version)
+}
+
+func (n *ng) DeleteServer(sk engine.ServerKey, version uint64) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	return n.deleteKey(n.path("backends", sk.BackendKey.Id, "servers", sk.Id), version)
+}
+
+func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
+	if n.options.Box == nil {
+		return fmt.Errorf("need secretbox to open sealed data")
+	}
+	sv, err := secret.SealedValueFromJSON([]byte(bytes))
+	if err != nil {
+		return err
+	}
+	unsealed, err := n.options.Box.Open(sv)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(unsealed, val)
+}
+
+func (n *ng) sealJSONVal(val interface{}) ([]byte, error) {
+	if n.options.Box == nil {
+		return nil, fmt.Errorf("this backend does not support encryption")
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	v, err := n.options.Box.Seal(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(v)
+}
+
+func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
+	fs, err := n.GetFrontends()
+	usedFs := []engine.Frontend{}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fs {
+		if f.UsesBackend(bk.Id) {
+			usedFs = append(usedFs, f)
+		}
+	}
+	return usedFs, nil
+}
+
+// Subscribe watches Consul changes using blocking queries and generates structured events telling vulcand to add or delete
+// frontends, hosts etc. Changes made via this engine are reported right away. It is a blocking function.
+func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
+	watchC := make(chan []interface{})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- n.watch(watchC, cancelC)
+	}()
+	for {
+		var batch []interface{}
+		select {
+		case <-cancelC:
+			log.Infof("Stop watching: graceful shutdown")
+			return nil
+		case err := <-errC:
+			if err != nil {
+				log.Errorf("unexpected error: %s, stop watching", err)
+			}
+			return err
+		case change := <-n.changesC:
+			batch = []interface{}{change}
+		case batch = <-watchC:
+		}
+		for _, change := range batch {
+			log.Infof("%v", change)
+			select {
+			case changes <- change:
+			case <-cancelC:
+				return nil
+			}
+		}
+	}
+}
+
+// watch polls the KV store using blocking queries and sends the events for the changes found in the snapshots
+func (n *ng) watch(watchC chan []interface{}, cancelC chan bool) error {
+	pairs, index, err := n.client.list(n.key, true, 0, 0, cancelC)
+	if err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	for _, p := range pairs {
+		if s, ok := n.keys[p.Key]; !ok || s.index < p.ModifyIndex {
+			n.keys[p.Key] = keyState{index: p.ModifyIndex}
+		}
+	}
+	n.mtx.Unlock()
+
+	for {
+		pairs, newIndex, err := n.client.list(n.key, true, index, n.options.WatchWait, cancelC)
+		if err != nil {
+			select {
+			case <-cancelC:
+				return nil
+			default:
+			}
+			log.Warningf("failed to watch %s: %s, retrying", n.key, err)
+			select {
+			case <-time.After(time.Second):
+			case <-cancelC:
+				return nil
+			}
+			continue
+		}
+		// index can go backwards if Consul state has been reset, start from scratch in this case
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+		changes, expired := n.diff(pairs, newIndex)
+		// Frontends expired, remove leftover middlewares as they do not belong to any frontend
+		for _, fk := range expired {
+			if err := n.client.delete(n.path("frontends", fk.Id, "middlewares")+"/", true); err != nil {
+				log.Warningf("failed to delete %v middlewares: %s", fk, err)
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		select {
+		case watchC <- changes:
+		case <-cancelC:
+			return nil
+		}
+	}
+}
+
+// diff compares the snapshot of KV store with the known state and returns the events for the changes made by the others
+// and the frontends deleted. It does not call Consul, as the engine is locked while the snapshot is compared.
+func (n *ng) diff(pairs []pair, index uint64) ([]interface{}, []engine.FrontendKey) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	snapshot := make(map[string]pair, len(pairs))
+	for _, p := range pairs {
+		snapshot[p.Key] = p
+	}
+
+	changes := []interface{}{}
+	expired := []engine.FrontendKey{}
+
+	// Deletes go first in reverse dependency order, e.g. middlewares are deleted before frontends
+	deleted, upserted := []string{}, []pair{}
+	for key, s := range n.keys {
+		if _, ok := snapshot[key]; ok || s.deleted || s.index >= index {
+			continue
+		}
+		n.keys[key] = keyState{index: index, deleted: true}
+		deleted = append(deleted, key)
+	}
+	sort.Sort(sort.Reverse(byDependency{n: n, keys: deleted}))
+	for _, key := range deleted {
+		// Deleting the frontend or backend deletes all the middlewares and servers as well
+		if parent := n.parentKey(key); parent != "" {
+			if _, ok := snapshot[parent]; !ok {
+				continue
+			}
+		}
+		// The host is upserted without the ACME state deleted
+		if hk, ok := n.parseKey(key).(acmeKey); ok {
+			if p, ok := snapshot[n.path("hosts", hk.Name, "host")]; ok {
+				upserted = append(upserted, p)
+			}
+			continue
+		}
+		if change := n.deletedEvent(key); change != nil {
+			changes = append(changes, change)
+		}
+		if fk, ok := n.parseKey(key).(engine.FrontendKey); ok {
+			expired = append(expired, fk)
+		}
+	}
+
+	// Upserts go in the order they were performed
+	for _, p := range pairs {
+		if s, ok := n.keys[p.Key]; ok && s.index >= p.ModifyIndex {
+			continue
+		}
+		n.keys[p.Key] = keyState{index: p.ModifyIndex}
+		upserted = append(upserted, p)
+	}
+	sort.Sort(byModifyIndex(upserted))
+	for _, p := range upserted {
+		change, err := n.upsertedEvent(&p, func(key string) *pair {
+			if p, ok := snapshot[key]; ok {
+				return &p
+			}
+			return nil
+		})
+		if err != nil {
+			log.Warningf("Ignore '%s', error: %s", p.Key, err)
+			continue
+		}
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes, expired
+}
+
+// ApplyBatch applies the changes in a single Consul transaction and emits a single BatchApplied event. The changes
+// are checked against the state of the store updated by the preceding changes of the batch, and either all of them
+// are written or none, so other vulcand instances watching the same keys see the whole batch at once.
+// Consul limits the number of operations in a transaction, so it rejects large batches.
+func (n *ng) ApplyBatch(changes []interface{}) error {
+	n.batchMtx.Lock()
+	defer n.batchMtx.Unlock()
+
+	// The transaction is prepared by the copy of the engine, so the other calls do not see the changes of the batch
+	// until they are written
+	tx := *n
+	tx.txn = &txn{pairs: map[string]*pair{}}
+	tx.batch = []interface{}{}
+	for _, change := range changes {
+		if err := engine.ApplyChange(&tx, change); err != nil {
+			return err
+		}
+	}
+	if len(tx.txn.ops) == 0 {
+		return nil
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	ok, errors, err := n.client.txn(tx.txn.ops)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &engine.ConflictError{Message: fmt.Sprintf("batch has not been applied: %s", strings.Join(errors, ", "))}
+	}
+	n.updateKeys(tx.txn)
+	n.emit(&engine.BatchApplied{Changes: tx.batch})
+	return nil
+}
+
+// updateKeys records the state of the keys written by the transaction, so the changes are not reported by the watch
+// once again. It is called with the mutex held.
+func (n *ng) updateKeys(t *txn) {
+	for _, dir := range t.dirs {
+		_, index, err := n.client.get(dir)
+		if err != nil && !isNotFoundError(err) {
+			log.Warningf("failed to read %s: %s", dir, err)
+			continue
+		}
+		for k := range n.keys {
+			if strings.HasPrefix(k, dir) {
+				n.keys[k] = keyState{index: index, deleted: true}
+			}
+		}
+	}
+	for key := range t.pairs {
+		p, index, err := n.client.get(key)
+		if err != nil && !isNotFoundError(err) {
+			log.Warningf("failed to read %s: %s", key, err)
+			continue
+		}
+		if p != nil {
+			n.keys[key] = keyState{index: p.ModifyIndex}
+		} else {
+			n.keys[key] = keyState{index: index, deleted: true}
+		}
+	}
+}
+
+// txn is the transaction prepared by the batch. The keys written by the transaction are read from it
+// by the engine preparing the transaction, the changes of the keys are added to it as the operations.
+type txn struct {
+	ops []txnOp
+	// pairs are the values of the keys written by the transaction, nil if the key is deleted
+	pairs map[string]*pair
+	// dirs are the directories deleted by the transaction
+	dirs []string
+}
+
+// get returns the pair written by the transaction, nil if the key is deleted by the transaction,
+// or false if the key is not written by the transaction
+func (t *txn) get(key string) (*pair, bool) {
+	if p, ok := t.pairs[key]; ok {
+		return p, true
+	}
+	for _, dir := range t.dirs {
+		if strings.HasPrefix(key, dir) {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// list returns the pairs with the given prefix, pairs are the pairs stored in Consul
+func (t *txn) list(prefix string, pairs []pair) []pair {
+	out := []pair{}
+	for _, p := range pairs {
+		if _, ok := t.get(p.Key); !ok {
+			out = append(out, p)
+		}
+	}
+	for key, p := range t.pairs {
+		if p != nil && strings.HasPrefix(key, prefix) {
+			out = append(out, *p)
+		}
+	}
+	sort.Sort(byKey(out))
+	return out
+}
+
+func (t *txn) set(key string, val []byte, existing *pair, version uint64) {
+	if version != 0 {
+		t.ops = append(t.ops, txnOp{Verb: "check-index", Key: key, Index: version})
+	}
+	// Keys with TTL are held by the session, the key written without TTL is released
+	if existing != nil && existing.Session != "" {
+		t.ops = append(t.ops, txnOp{Verb: "unlock", Key: key, Value: val, Session: existing.Session})
+	} else {
+		t.ops = append(t.ops, txnOp{Verb: "set", Key: key, Value: val})
+	}
+	t.pairs[key] = &pair{Key: key, Value: val}
+}
+
+func (t *txn) delete(dir, key string, version uint64) {
+	if version != 0 {
+		t.ops = append(t.ops, txnOp{Verb: "check-index", Key: key, Index: version})
+	}
+	if dir != "" {
+		t.ops = append(t.ops, txnOp{Verb: "delete-tree", Key: dir + "/"})
+		t.dirs = append(t.dirs, dir+"/")
+		for k := range t.pairs {
+			if strings.HasPrefix(k, dir+"/") {
+				t.pairs[k] = nil
+			}
+		}
+	} else {
+		t.ops = append(t.ops, txnOp{Verb: "delete", Key: key})
+	}
+	t.pairs[key] = nil
+}
+
+// emit sends the change to subscribers, it is called with the mutex held
+func (n *ng) emit(change interface{}) {
+	if n.batch != nil {
+		n.batch = append(n.batch, change)
+		return
+	}
+	select {
+	case n.changesC <- change:
+	default:
+		log.Errorf("changes buffer is full, dropping %v", change)
+	}
+}
+
+// parseKey returns the key of the object stored at the Consul key or nil if the key does not belong to any object
+func (n *ng) parseKey(key string) interface{} {
+	if !strings.HasPrefix(key, n.key+"/") {
+		return nil
+	}
+	vals := strings.Split(strings.TrimPrefix(key, n.key+"/"), "/")
+	switch {
+	case len(vals) == 3 && vals[0] == "hosts" && vals[2] == "host":
+		return engine.HostKey{Name: vals[1]}
+	case len(vals) == 3 && vals[0] == "hosts" && vals[2] == "acme":
+		return acmeKey{Name: vals[1]}
+	case len(vals) == 2 && vals[0] == "listeners":
+		return engine.ListenerKey{Id: vals[1]}
+	case len(vals) == 3 && vals[0] == "backends" && vals[2] == "backend":
+		return engine.BackendKey{Id: vals[1]}
+	case len(vals) == 4 && vals[0] == "backends" && vals[2] == "servers":
+		return engine.ServerKey{BackendKey: engine.BackendKey{Id: vals[1]}, Id: vals[3]}
+	case len(vals) == 3 && vals[0] == "frontends" && vals[2] == "frontend":
+		return engine.FrontendKey{Id: vals[1]}
+	case len(vals) == 4 && vals[0] == "frontends" && vals[2] == "middlewares":
+		return engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: vals[1]}, Id: vals[3]}
+	}
+	return nil
+}
+
+// parentKey returns the key of the backend or frontend the server or middleware belong to
+func (n *ng) parentKey(key string) string {
+	switch k := n.parseKey(key).(type) {
+	case engine.ServerKey:
+		return n.path("backends", k.BackendKey.Id, "backend")
+	case engine.MiddlewareKey:
+		return n.path("frontends", k.FrontendKey.Id, "frontend")
+	}
+	return ""
+}
+
+// upsertedEvent returns the event for the pair upserted, get returns the other pairs the object is stored in,
+// e.g. the ACME state of the host, or nil if the key does not exist
+func (n *ng) upsertedEvent(p *pair, get func(string) *pair) (interface{}, error) {
+	val := p.Value
+	switch k := n.parseKey(p.Key).(type) {
+	case engine.HostKey:
+		h, err := n.hostFromJSON(val, get(n.path("hosts", k.Name, "acme")), k)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	case acmeKey:
+		// The ACME state is the part of the host, the host is upserted when the state changes
+		hp := get(n.path("hosts", k.Name, "host"))
+		if hp == nil {
+			return nil, nil
+		}
+		h, err := n.hostFromJSON(hp.Value, p, engine.HostKey(k))
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	case engine.ListenerKey:
+		l, err := engine.ListenerFromJSON(val, k.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: *l}, nil
+	case engine.BackendKey:
+		b, err := engine.BackendFromJSON(val, k.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.BackendUpserted{Backend: *b}, nil
+	case engine.ServerKey:
+		s, err := engine.ServerFromJSON(val, k.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: k.BackendKey, Server: *s}, nil
+	case engine.FrontendKey:
+		f, err := engine.FrontendFromJSON(val, k.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: *f}, nil
+	case engine.MiddlewareKey:
+		m, err := engine.MiddlewareFromJSON(val, n.registry.GetSpec, k.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: k.FrontendKey, Middleware: *m}, nil
+	}
+	return nil, nil
+}
+
+func (n *ng) deletedEvent(key string) interface{} {
+	switch k := n.parseKey(key).(type) {
+	case engine.HostKey:
+		return &engine.HostDeleted{HostKey: k}
+	case engine.ListenerKey:
+		return &engine.ListenerDeleted{ListenerKey: k}
+	case engine.BackendKey:
+		return &engine.BackendDeleted{BackendKey: k}
+	case engine.ServerKey:
+		return &engine.ServerDeleted{ServerKey: k}
+	case engine.FrontendKey:
+		return &engine.FrontendDeleted{FrontendKey: k}
+	case engine.MiddlewareKey:
+		return &engine.MiddlewareDeleted{MiddlewareKey: k}
+	}
+	return nil
+}
+
+func (n *ng) path(keys ...string) string {
+	return strings.Join(append([]string{n.key}, keys...), "/")
+}
+
+func (n *ng) setJSONVal(key string, v interface{}, ttl time.Duration, version uint64) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return n.setVal(key, bytes, ttl, version)
+}
+
+// setVal sets the value and emits the event. Keys with TTL are acquired by the session with the same TTL,
+// so Consul deletes them once the session expires unless the key is updated again.
+// Non zero version is compared with the ModifyIndex of the key, and is sent as check-and-set index
+// so the concurrent updates made by other vulcand instances are detected as well.
+func (n *ng) setVal(key string, val []byte, ttl time.Duration, version uint64) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	var session, release string
+	existing, err := n.get(key)
+	if err != nil && !isNotFoundError(err) {
+		return err
+	}
+	var current uint64
+	if existing != nil {
+		current = existing.ModifyIndex
+	}
+	if err := engine.CheckVersion(key, version, current); err != nil {
+		return err
+	}
+	if n.txn != nil {
+		if ttl != noTTL {
+			return fmt.Errorf("%s can not be updated with TTL in a batch", key)
+		}
+		n.txn.set(key, val, existing, version)
+		return n.emitUpserted(n.txn.pairs[key])
+	}
+	if ttl != noTTL {
+		if session, err = n.getSession(existing, ttl); err != nil {
+			return err
+		}
+	} else if existing != nil {
+		release = existing.Session
+	}
+
+	ok, err := n.client.put(key, val, session, release, version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if version != 0 {
+			return &engine.ConflictError{Message: fmt.Sprintf("%s has been modified concurrently", key)}
+		}
+		return fmt.Errorf("failed to update %s, it is locked by another session", key)
+	}
+
+	p, _, err := n.client.get(key)
+	if err != nil {
+		return err
+	}
+	n.keys[key] = keyState{index: p.ModifyIndex}
+	return n.emitUpserted(p)
+}
+
+// emitUpserted emits the event for the pair upserted, it is called with the mutex held
+func (n *ng) emitUpserted(p *pair) error {
+	change, err := n.upsertedEvent(p, n.getPair)
+	if err != nil {
+		return err
+	}
+	if change != nil {
+		n.emit(change)
+	}
+	return nil
+}
+
+// getSession renews the session holding the key, or creates a new one if the key has no session or the session has expired
+func (n *ng) getSession(existing *pair, ttl time.Duration) (string, error) {
+	if existing != nil && existing.Session != "" {
+		err := n.client.renewSession(existing.Session)
+		if err == nil {
+			return existing.Session, nil
+		}
+		if !isNotFoundError(err) {
+			return "", err
+		}
+	}
+	if ttl < minSessionTTL {
+		ttl = minSessionTTL
+	}
+	return n.client.createSession(ttl)
+}
+
+// get returns the pair stored at the key, the keys written by the transaction being prepared are read from it
+func (n *ng) get(key string) (*pair, error) {
+	if n.txn != nil {
+		if p, ok := n.txn.get(key); ok {
+			if p == nil {
+				return nil, &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+			}
+			return p, nil
+		}
+	}
+	p, _, err := n.client.get(key)
+	return p, err
+}
+
+// list returns the pairs with the given prefix sorted by key, the keys written by the transaction being prepared
+// are read from it
+func (n *ng) list(prefix string) ([]pair, error) {
+	pairs, _, err := n.client.list(prefix, true, 0, 0, nil)
+	if err != nil || n.txn == nil {
+		return pairs, err
+	}
+	return n.txn.list(prefix, pairs), nil
+}
+
+// getPair returns the pair stored at the key or nil if the key does not exist or can not be read
+func (n *ng) getPair(key string) *pair {
+	p, err := n.get(key)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// getVal returns the value of the key and its ModifyIndex used as the version of the object
+func (n *ng) getVal(key string) ([]byte, uint64, error) {
+	p, err := n.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return p.Value, p.ModifyIndex, nil
+}
+
+// getDirs returns the names of the "directories" under the given key, e.g. frontend ids for 'frontends'
+func (n *ng) getDirs(keys ...string) ([]string, error) {
+	return n.getChildren(true, keys...)
+}
+
+// getVals returns the names of the keys under the given key, e.g. server ids for 'backends/b1/servers'
+func (n *ng) getVals(keys ...string) ([]string, error) {
+	return n.getChildren(false, keys...)
+}
+
+func (n *ng) getChildren(dirs bool, keys ...string) ([]string, error) {
+	prefix := n.path(keys...) + "/"
+	pairs, err := n.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, p := range pairs {
+		vals := strings.SplitN(strings.TrimPrefix(p.Key, prefix), "/", 2)
+		if vals[0] == "" || (len(vals) == 2) != dirs {
+			continue
+		}
+		if len(out) == 0 || out[len(out)-1] != vals[0] {
+			out = append(out, vals[0])
+		}
+	}
+	return out, nil
+}
+
+func (n *ng) deleteKey(key string, version uint64) error {
+	return n.deleteDir("", key, version)
+}
+
+// deleteDir deletes the key and all the keys in the directory, if the directory is set, and emits the event for the key.
+// If the version is not 0, the key is deleted first using it as check-and-set index.
+func (n *ng) deleteDir(dir, key string, version uint64) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	p, err := n.get(key)
+	if err != nil {
+		return err
+	}
+	if err := engine.CheckVersion(key, version, p.ModifyIndex); err != nil {
+		return err
+	}
+	if n.txn != nil {
+		n.txn.delete(dir, key, version)
+		if change := n.deletedEvent(key); change != nil {
+			n.emit(change)
+		}
+		return nil
+	}
+	if version != 0 {
+		ok, err := n.client.deleteCAS(key, version)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &engine.ConflictError{Message: fmt.Sprintf("%s has been modified concurrently", key)}
+		}
+	}
+	if dir != "" {
+		if err := n.client.delete(dir+"/", true); err != nil {
+			return err
+		}
+	} else {
+		if err := n.client.delete(key, false); err != nil {
+			return err
+		}
+	}
+	_, index, err := n.client.get(key)
+	if err == nil {
+		return fmt.Errorf("failed to delete %s", key)
+	}
+	if !isNotFoundError(err) {
+		return err
+	}
+	n.keys[key] = keyState{index: index, deleted: true}
+	for k := range n.keys {
+		if dir != "" && strings.HasPrefix(k, dir+"/") {
+			n.keys[k] = keyState{index: index, deleted: true}
+		}
+	}
+	if change := n.deletedEvent(key); change != nil {
+		n.emit(change)
+	}
+	return nil
+}
+
+// dependencyRank defines the order of the updates, so objects are deleted before the objects they depend on
+func (n *ng) dependencyRank(key string) int {
+	switch n.parseKey(key).(type) {
+	case engine.HostKey:
+		return 0
+	case engine.ListenerKey:
+		return 1
+	case engine.BackendKey:
+		return 2
+	case engine.ServerKey:
+		return 3
+	case engine.FrontendKey:
+		return 4
+	case engine.MiddlewareKey:
+		return 5
+	}
+	return 6
+}
+
+type byDependency struct {
+	n    *ng
+	keys []string
+}
+
+func (s byDependency) Len() int {
+	return len(s.keys)
+}
+
+func (s byDependency) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+func (s byDependency) Less(i, j int) bool {
+	ri, rj := s.n.dependencyRank(s.keys[i]), s.n.dependencyRank(s.keys[j])
+	if ri != rj {
+		return ri < rj
+	}
+	return s.keys[i] < s.keys[j]
+}
+
+type byKey []pair
+
+func (s byKey) Len() int {
+	return len(s)
+}
+
+func (s byKey) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byKey) Less(i, j int) bool {
+	return s[i].Key < s[j].Key
+}
+
+type byModifyIndex []pair
+
+func (s byModifyIndex) Len() int {
+	return len(s)
+}
+
+func (s byModifyIndex) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byModifyIndex) Less(i, j int) bool {
+	return s[i].ModifyIndex < s[j].ModifyIndex
+}
+
+func isNotFoundError(err error) bool {
+	_, ok := err.(*engine.NotFoundError)
+	return ok
+}
+
+const noTTL = 0
+
+func setDefaults(o Options) Options {
+	if o.WatchWait == 0 {
+		o.WatchWait = 5 * time.Minute
+	}
+	return o
+}
+
+type host struct {
+	Name     string
+	Settings hostSettings
+}
+
+type hostSettings struct {
+	Default       bool
+	KeyPair       []byte
+	KeyPairs      []byte `json:",omitempty"`
+	OCSP          engine.OCSPSettings
+	Passthrough   *engine.HostPassthrough `json:",omitempty"`
+	ErrorPages    *engine.ErrorPages      `json:",omitempty"`
+	Maintenance   *engine.Maintenance     `json:",omitempty"`
+	HTTPSRedirect *engine.HTTPSRedirect   `json:",omitempty"`
+	ACME          *engine.HostACME        `json:",omitempty"`
+}
+
+// acmeKey is the key of the ACME state of the host
+type acmeKey engine.HostKey
+
+// acmeState is the ACME state of the host with the KeyPair issued sealed like the KeyPair of the host
+type acmeState struct {
+	engine.ACMEState
+	KeyPair []byte `json:",omitempty"`
+}
@@ -0,0 +1,321 @@
+package consulng
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/engine/test"
+	"github.com/mailgun/vulcand/plugin/registry"
+	"github.com/mailgun/vulcand/secret"
+
+	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestConsul(t *testing.T) { TestingT(t) }
+
+// ConsulSuite runs against the in-process fake unless the address of Consul agent is provided
+// in VULCAND_TEST_CONSUL_ADDR environment variable
+type ConsulSuite struct {
+	ng       *ng
+	suite    test.EngineSuite
+	addr     string
+	fake     bool
+	server   *httptest.Server
+	prefix   string
+	key      string
+	changesC chan interface{}
+	stopC    chan bool
+}
+
+var _ = Suite(&ConsulSuite{
+	prefix: "vulcandtest",
+})
+
+func (s *ConsulSuite) SetUpSuite(c *C) {
+	log.Init([]*log.LogConfig{&log.LogConfig{Name: "console"}})
+
+	key, err := secret.NewKeyString()
+	if err != nil {
+		panic(err)
+	}
+	s.key = key
+
+	s.addr = os.Getenv("VULCAND_TEST_CONSUL_ADDR")
+	if s.addr == "" {
+		// fake expires sessions right away, so TTL tests do not have to wait for Consul minimum TTL
+		s.fake = true
+		minSessionTTL = 0
+	}
+}
+
+func (s *ConsulSuite) SetUpTest(c *C) {
+	if s.fake {
+		s.server = httptest.NewServer(newFakeConsul())
+		s.addr = s.server.URL
+	}
+
+	box, err := secret.NewBoxFromKeyString(s.key)
+	c.Assert(err, IsNil)
+
+	engine, err := New(s.addr, s.prefix, registry.GetRegistry(), Options{Box: box})
+	c.Assert(err, IsNil)
+	s.ng = engine.(*ng)
+
+	// Delete all values under the given prefix
+	c.Assert(s.ng.client.delete(s.prefix+"/", true), IsNil)
+
+	s.changesC = make(chan interface{})
+	s.stopC = make(chan bool)
+	go s.ng.Subscribe(s.changesC, s.stopC)
+
+	s.suite.ChangesC = s.changesC
+	s.suite.Engine = engine
+}
+
+func (s *ConsulSuite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+func (s *ConsulSuite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *ConsulSuite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *ConsulSuite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *ConsulSuite) TestHostWithKeyPairs(c *C) {
+	s.suite.HostWithKeyPairs(c)
+}
+
+func (s *ConsulSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
+func (s *ConsulSuite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *ConsulSuite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *ConsulSuite) TestHostWithPassthrough(c *C) {
+	s.suite.HostWithPassthrough(c)
+}
+
+func (s *ConsulSuite) TestHostWithErrorPages(c *C) {
+	s.suite.HostWithErrorPages(c)
+}
+
+func (s *ConsulSuite) TestHostWithMaintenance(c *C) {
+	s.suite.HostWithMaintenance(c)
+}
+
+func (s *ConsulSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
+func (s *ConsulSuite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *ConsulSuite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *ConsulSuite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *ConsulSuite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *ConsulSuite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *ConsulSuite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *ConsulSuite) TestServerExpire(c *C) {
+	s.skipRealConsul(c)
+	s.suite.ServerExpire(c)
+}
+
+func (s *ConsulSuite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *ConsulSuite) TestFrontendExpire(c *C) {
+	s.skipRealConsul(c)
+	s.suite.FrontendExpire(c)
+}
+
+func (s *ConsulSuite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *ConsulSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *ConsulSuite) TestTCPFrontendCRUD(c *C) {
+	s.suite.TCPFrontendCRUD(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareExpire(c *C) {
+	s.skipRealConsul(c)
+	s.suite.MiddlewareExpire(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+func (s *ConsulSuite) TestVersionConflict(c *C) {
+	s.suite.VersionConflict(c)
+}
+
+func (s *ConsulSuite) TestBatchCRUD(c *C) {
+	s.suite.BatchCRUD(c)
+}
+
+func (s *ConsulSuite) TestBatchRollback(c *C) {
+	s.suite.BatchRollback(c)
+}
+
+func (s *ConsulSuite) TestBatchTransaction(c *C) {
+	// Operations of the transaction are applied all or none
+	key := s.prefix + "/a"
+	ok, errors, err := s.ng.client.txn([]txnOp{
+		{Verb: "set", Key: key, Value: []byte("a")},
+		{Verb: "check-index", Key: s.prefix + "/missing", Index: 1},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	c.Assert(len(errors), Equals, 1)
+
+	_, _, err = s.ng.client.get(key)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ConsulSuite) TestBatchReleasesSession(c *C) {
+	s.skipRealConsul(c)
+
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
+
+	bk := engine.BackendKey{Id: b.Id}
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	c.Assert(s.ng.UpsertServer(bk, srv, 500*time.Millisecond), IsNil)
+	s.expectChanges(c, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+
+	// Server upserted by the batch has no TTL, so it is released by the session and does not expire
+	c.Assert(s.ng.ApplyBatch([]interface{}{&engine.ServerUpserted{BackendKey: bk, Server: srv}}), IsNil)
+	s.expectChanges(c, &engine.BatchApplied{Changes: []interface{}{&engine.ServerUpserted{BackendKey: bk, Server: srv}}})
+	time.Sleep(time.Second)
+
+	_, err := s.ng.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+}
+
+func (s *ConsulSuite) TestServerHeartbeat(c *C) {
+	s.skipRealConsul(c)
+
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
+
+	bk := engine.BackendKey{Id: b.Id}
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	for i := 0; i < 4; i += 1 {
+		c.Assert(s.ng.UpsertServer(bk, srv, 500*time.Millisecond), IsNil)
+		s.expectChanges(c, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	// Server is still there as the session has been renewed
+	out, err := s.ng.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, test.VersionedEquals, &srv)
+
+	// Server without TTL is released by the session and does not expire
+	c.Assert(s.ng.UpsertServer(bk, srv, 0), IsNil)
+	s.expectChanges(c, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+	time.Sleep(time.Second)
+
+	_, err = s.ng.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+}
+
+func (s *ConsulSuite) TestExternalChanges(c *C) {
+	// Another vulcand instance writing to the same Consul
+	other, err := New(s.addr, s.prefix, registry.GetRegistry(), Options{})
+	c.Assert(err, IsNil)
+
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(other.UpsertBackend(b), IsNil)
+
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	bk := engine.BackendKey{Id: b.Id}
+	c.Assert(other.UpsertServer(bk, srv, 0), IsNil)
+
+	s.expectChanges(c,
+		&engine.BackendUpserted{Backend: b},
+		&engine.ServerUpserted{BackendKey: bk, Server: srv},
+	)
+
+	c.Assert(other.DeleteBackend(bk, 0), IsNil)
+	s.expectChanges(c, &engine.BackendDeleted{BackendKey: bk})
+
+	// The batch of the other instance is written in one transaction
+	c.Assert(other.ApplyBatch([]interface{}{
+		&engine.BackendUpserted{Backend: b},
+		&engine.ServerUpserted{BackendKey: bk, Server: srv},
+	}), IsNil)
+	s.expectChanges(c,
+		&engine.BackendUpserted{Backend: b},
+		&engine.ServerUpserted{BackendKey: bk, Server: srv},
+	)
+}
+
+func (s *ConsulSuite) skipRealConsul(c *C) {
+	if !s.fake {
+		c.Skip("Consul does not support session TTLs shorter than 10 seconds")
+	}
+}
+
+func (s *ConsulSuite) expectChanges(c *C, expected ...interface{}) {
+	for _, e := range expected {
+		select {
+		case change := <-s.changesC:
+			c.Assert(change, DeepEquals, e)
+		case <-time.After(2 * time.Second):
+			c.Fatalf("Timeout waiting for %v", e)
+		}
+	}
+}
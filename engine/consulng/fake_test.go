@@ -0,0 +1,308 @@
+package consulng
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeConsul implements the subset of Consul HTTP API used by the engine: KV store with blocking queries, transactions
+// and sessions
+type fakeConsul struct {
+	mtx      sync.Mutex
+	index    uint64
+	lastId   int
+	kvs      map[string]*pair
+	sessions map[string]*fakeSession
+	// changeC is closed on every change to wake up the blocking queries
+	changeC chan struct{}
+}
+
+type fakeSession struct {
+	ttl   time.Duration
+	timer *time.Timer
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:    1,
+		kvs:      map[string]*pair{},
+		sessions: map[string]*fakeSession{},
+		changeC:  make(chan struct{}),
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.serveKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	case r.URL.Path == "/v1/txn":
+		f.serveTxn(w, r)
+	case r.URL.Path == "/v1/session/create":
+		f.createSession(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		f.renewSession(w, strings.TrimPrefix(r.URL.Path, "/v1/session/renew/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		f.destroySession(w, strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request, key string) {
+	q := r.URL.Query()
+	_, recurse := q["recurse"]
+	switch r.Method {
+	case "GET":
+		if q.Get("index") != "" {
+			index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+			wait, _ := time.ParseDuration(q.Get("wait"))
+			f.wait(index, wait, r.Context().Done())
+		}
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		out := []pair{}
+		for k, p := range f.kvs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				out = append(out, *p)
+			}
+		}
+		if len(out) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Sort(byKey(out))
+		writeJSON(w, out)
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		p, ok := f.kvs[key]
+		if !f.casMatches(q, p) {
+			writeJSON(w, false)
+			return
+		}
+		if !ok {
+			p = &pair{Key: key, CreateIndex: f.index + 1}
+		}
+		if session := q.Get("acquire"); session != "" {
+			if _, ok := f.sessions[session]; !ok || (p.Session != "" && p.Session != session) {
+				writeJSON(w, false)
+				return
+			}
+			p.Session = session
+			p.LockIndex++
+		}
+		if session := q.Get("release"); session != "" && p.Session == session {
+			p.Session = ""
+		}
+		p.Value = body
+		f.kvs[key] = p
+		f.changed()
+		p.ModifyIndex = f.index
+		writeJSON(w, true)
+	case "DELETE":
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		if !f.casMatches(q, f.kvs[key]) {
+			writeJSON(w, false)
+			return
+		}
+		for k := range f.kvs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				delete(f.kvs, k)
+			}
+		}
+		f.changed()
+		writeJSON(w, true)
+	}
+}
+
+// serveTxn applies the KV operations of the transaction to the copy of the store, and replaces the store
+// with the copy if all of them succeed
+func (f *fakeConsul) serveTxn(w http.ResponseWriter, r *http.Request) {
+	var in []struct {
+		KV txnOp
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	index := f.index + 1
+	kvs := make(map[string]*pair, len(f.kvs))
+	for k, p := range f.kvs {
+		c := *p
+		kvs[k] = &c
+	}
+	for i, op := range in {
+		if what := applyTxnOp(kvs, op.KV, index); what != "" {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]interface{}{
+				"Results": nil,
+				"Errors":  []map[string]interface{}{{"OpIndex": i, "What": what}},
+			})
+			return
+		}
+	}
+	f.kvs = kvs
+	f.changed()
+	writeJSON(w, map[string]interface{}{"Results": []interface{}{}, "Errors": nil})
+}
+
+// applyTxnOp applies the operation to the store, returns the reason if the operation fails
+func applyTxnOp(kvs map[string]*pair, op txnOp, index uint64) string {
+	p := kvs[op.Key]
+	switch op.Verb {
+	case "set", "unlock":
+		if op.Verb == "unlock" && (p == nil || p.Session != op.Session) {
+			return fmt.Sprintf("failed unlocking lock on %q", op.Key)
+		}
+		if p == nil {
+			p = &pair{Key: op.Key, CreateIndex: index}
+			kvs[op.Key] = p
+		}
+		if op.Verb == "unlock" {
+			p.Session = ""
+		}
+		p.Value = op.Value
+		p.ModifyIndex = index
+	case "check-index":
+		if p == nil || p.ModifyIndex != op.Index {
+			return fmt.Sprintf("current modify index %d does not match %d for %q", modifyIndex(p), op.Index, op.Key)
+		}
+	case "delete":
+		delete(kvs, op.Key)
+	case "delete-tree":
+		for k := range kvs {
+			if strings.HasPrefix(k, op.Key) {
+				delete(kvs, k)
+			}
+		}
+	default:
+		return fmt.Sprintf("unsupported verb %q", op.Verb)
+	}
+	return ""
+}
+
+func modifyIndex(p *pair) uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.ModifyIndex
+}
+
+// casMatches checks the check-and-set index: 0 means the key must not exist, otherwise it must match ModifyIndex
+func (f *fakeConsul) casMatches(q url.Values, p *pair) bool {
+	if _, ok := q["cas"]; !ok {
+		return true
+	}
+	cas, _ := strconv.ParseUint(q.Get("cas"), 10, 64)
+	if p == nil {
+		return cas == 0
+	}
+	return cas == p.ModifyIndex
+}
+
+func (f *fakeConsul) createSession(w http.ResponseWriter, r *http.Request) {
+	var s struct {
+		TTL string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(s.TTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.lastId++
+	id := fmt.Sprintf("session-%d", f.lastId)
+	f.sessions[id] = &fakeSession{ttl: ttl, timer: time.AfterFunc(ttl, func() { f.expire(id) })}
+	writeJSON(w, map[string]string{"ID": id})
+}
+
+func (f *fakeConsul) renewSession(w http.ResponseWriter, id string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	s, ok := f.sessions[id]
+	if !ok {
+		http.Error(w, "Session id '"+id+"' not found", http.StatusNotFound)
+		return
+	}
+	s.timer.Reset(s.ttl)
+	writeJSON(w, []map[string]string{{"ID": id}})
+}
+
+func (f *fakeConsul) destroySession(w http.ResponseWriter, id string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if s, ok := f.sessions[id]; ok {
+		s.timer.Stop()
+		f.invalidate(id)
+	}
+	writeJSON(w, true)
+}
+
+func (f *fakeConsul) expire(id string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if _, ok := f.sessions[id]; ok {
+		f.invalidate(id)
+	}
+}
+
+// invalidate deletes the session and the keys held by it
+func (f *fakeConsul) invalidate(id string) {
+	delete(f.sessions, id)
+	for k, p := range f.kvs {
+		if p.Session == id {
+			delete(f.kvs, k)
+		}
+	}
+	f.changed()
+}
+
+func (f *fakeConsul) changed() {
+	f.index++
+	close(f.changeC)
+	f.changeC = make(chan struct{})
+}
+
+// wait blocks until the index is greater than the given one, the wait time expires or the client goes away
+func (f *fakeConsul) wait(index uint64, wait time.Duration, doneC <-chan struct{}) {
+	timeout := time.After(wait)
+	for {
+		f.mtx.Lock()
+		current, changeC := f.index, f.changeC
+		f.mtx.Unlock()
+		if current > index {
+			return
+		}
+		select {
+		case <-changeC:
+		case <-timeout:
+			return
+		case <-doneC:
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -12,6 +12,10 @@ type NewEngineFn func() (Engine, error)
 // Simple in memory implementation is available at engine/memng package
 // Engines should pass the following acceptance suite to be compatible:
 // engine/test/suite.go, see engine/etcdng/etcd_test.go and engine/memng/mem_test.go for details
+//
+// Get* calls set the Version of the returned objects. Upserts of the objects with non zero Version and deletes
+// with non zero version succeed only if the version matches the current one, otherwise engine.ConflictError is returned.
+// Zero version means the object is written or deleted unconditionally.
 type Engine interface {
 	// GetHosts returns list of hosts registered in the sotrage engine
 	// Returns empty list in case if there are no hosts.
@@ -21,7 +25,12 @@ type Engine interface {
 	// UpsertHost updates or inserts the host, make sure to supply valid hostname
 	UpsertHost(Host) error
 	// DeleteHost deletes host by given key or returns engine.NotFoundError if it's not found
-	DeleteHost(HostKey) error
+	DeleteHost(HostKey, uint64) error
+	// UpsertACMEState updates the ACME state of the host, GetHost returns it as Host.ACME. The state is kept apart
+	// from the host settings and deleted along with the host. Unlike the other upserts, zero version creates the state
+	// only if the host has none, so the instances taking the ACME lease at once do not overwrite each other.
+	// Returns engine.NotFoundError if the host is not found.
+	UpsertACMEState(HostKey, ACMEState) error
 
 	// GetListeners returns list of listeners registered in the storage engine
 	// Returns empty list in case if there are no listeners
@@ -31,7 +40,7 @@ type Engine interface {
 	// Updates or inserts a new listener, Listener.Id should not be empty
 	UpsertListener(Listener) error
 	// DeleteListener deletes a listener by key, returns engine.NotFoundError if it's not found
-	DeleteListener(ListenerKey) error
+	DeleteListener(ListenerKey, uint64) error
 
 	// GetFrontends returns a list of frontends registered in Vulcand
 	// Returns empty list in case if there are no frontends
@@ -42,7 +51,7 @@ type Engine interface {
 	// in case if the frontend should not expire.
 	UpsertFrontend(Frontend, time.Duration) error
 	// DeleteFrontend deletes a frontend by a given key, returns engine.NotFoundError if it's not found
-	DeleteFrontend(FrontendKey) error
+	DeleteFrontend(FrontendKey, uint64) error
 
 	// GetMiddlewares retunrns middlewares registered for a given frontend
 	// Returns empty list if there are no registered middlewares
@@ -52,7 +61,7 @@ type Engine interface {
 	// UpsertMiddleware updates or inserts a middleware for a frontend. FrontendKey.Id and Middleware.Id should not be empty
 	UpsertMiddleware(FrontendKey, Middleware, time.Duration) error
 	// Delete middleware by given key, returns engine.NotFoundError if its not found
-	DeleteMiddleware(MiddlewareKey) error
+	DeleteMiddleware(MiddlewareKey, uint64) error
 
 	// GetBackends returns list of registered backends. Returns empty list if there are no backends
 	GetBackends() ([]Backend, error)
@@ -62,7 +71,7 @@ type Engine interface {
 	UpsertBackend(Backend) error
 	// DeleteBackend deletes backend by it's key. BackendKey.Id should not be empty. In case if backend is being used by frontends
 	// this method should fail to preserve integrity, otherwise it will leave frontends in broken state
-	DeleteBackend(BackendKey) error
+	DeleteBackend(BackendKey, uint64) error
 
 	// GetServers returns servers assigned to the backend. BackendKey.Id should not be empty
 	// Returns empty list if there are not assigned servers. Returns engine.NotFoundError if Backend does not exist
@@ -74,7 +83,16 @@ type Engine interface {
 	UpsertServer(BackendKey, Server, time.Duration) error
 	// DeleteServer deletes a server by given key. ServerKey.Id should not be empty.
 	// Returns engine.NotFoundError if server not found
-	DeleteServer(ServerKey) error
+	DeleteServer(ServerKey, uint64) error
+
+	// ApplyBatch applies the list of changes in order. Changes are expressed with the upsert and delete events
+	// from events.go, e.g. &HostUpserted{} or &FrontendDeleted{}. Subscribe emits a single BatchApplied event
+	// for the whole batch, so the proxy does not serve requests with the batch applied partially.
+	//
+	// Whether the batch is atomic depends on the backing store. Engines backed by the stores supporting
+	// transactions write the batch all or nothing. Other engines write the changes one by one and revert
+	// the changes applied on the best effort basis if a change fails; see the docs of the engines.
+	ApplyBatch([]interface{}) error
 
 	// Subscribe is an entry point for getting the configuration changes as well as the initial configuration.
 	// It should be a blocking function generating events from change.go to the changes channel.
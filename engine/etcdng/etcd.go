@@ -98,7 +98,11 @@ func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 	hostKey := n.path("hosts", key.Name, "host")
 
 	var host *host
-	err := n.getJSONVal(hostKey, &host)
+	version, err := n.getJSONVal(hostKey, &host)
+	if err != nil {
+		return nil, err
+	}
+	st, err := n.getACMEState(key)
 	if err != nil {
 		return nil, err
 	}
@@ -109,8 +113,43 @@ func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 			return nil, err
 		}
 	}
+	var keyPairs []engine.KeyPair
+	if len(host.Settings.KeyPairs) != 0 {
+		if err := n.openSealedJSONVal(host.Settings.KeyPairs, &keyPairs); err != nil {
+			return nil, err
+		}
+	}
+
+	h, err := engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: host.Settings.OCSP, Passthrough: host.Settings.Passthrough, ErrorPages: host.Settings.ErrorPages, Maintenance: host.Settings.Maintenance, HTTPSRedirect: host.Settings.HTTPSRedirect, ACME: host.Settings.ACME})
+	if err != nil {
+		return nil, err
+	}
+	h.ACME = st
+	if st != nil && h.ACMEEnabled() {
+		h.Settings.KeyPair = st.KeyPair
+	}
+	h.Version = version
+	return h, nil
+}
 
-	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, OCSP: host.Settings.OCSP})
+// getACMEState returns the ACME state of the host, nil if the host has none
+func (n *ng) getACMEState(key engine.HostKey) (*engine.ACMEState, error) {
+	var val *acmeState
+	version, err := n.getJSONVal(n.path("hosts", key.Name, "acme"), &val)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	st := val.ACMEState
+	if len(val.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(val.KeyPair, &st.KeyPair); err != nil {
+			return nil, err
+		}
+	}
+	st.Version = version
+	return &st, nil
 }
 
 func (n *ng) UpsertHost(h engine.Host) error {
@@ -122,27 +161,72 @@ func (n *ng) UpsertHost(h engine.Host) error {
 	val := host{
 		Name: h.Name,
 		Settings: hostSettings{
-			Default: h.Settings.Default,
-			OCSP:    h.Settings.OCSP,
+			Default:       h.Settings.Default,
+			OCSP:          h.Settings.OCSP,
+			Passthrough:   h.Settings.Passthrough,
+			ErrorPages:    h.Settings.ErrorPages,
+			Maintenance:   h.Settings.Maintenance,
+			HTTPSRedirect: h.Settings.HTTPSRedirect,
+			ACME:          h.Settings.ACME,
 		},
 	}
 
-	if h.Settings.KeyPair != nil {
+	// The KeyPair issued by ACME is kept in the ACME state
+	if h.Settings.KeyPair != nil && !h.ACMEEnabled() {
 		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
 		if err != nil {
 			return err
 		}
 		val.Settings.KeyPair = bytes
 	}
+	if len(h.Settings.KeyPairs) != 0 {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPairs)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPairs = bytes
+	}
 
-	return n.setJSONVal(hostKey, val, noTTL)
+	return n.setJSONVal(hostKey, val, noTTL, h.Version)
 }
 
-func (n *ng) DeleteHost(key engine.HostKey) error {
+func (n *ng) DeleteHost(key engine.HostKey, version uint64) error {
 	if key.Name == "" {
 		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
 	}
-	return n.deleteKey(n.path("hosts", key.Name))
+	return n.deleteDir(n.path("hosts", key.Name), n.path("hosts", key.Name, "host"), version)
+}
+
+func (n *ng) UpsertACMEState(key engine.HostKey, st engine.ACMEState) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	if err := n.checkKeyExists(n.path("hosts", key.Name, "host")); err != nil {
+		return err
+	}
+	val := acmeState{ACMEState: st}
+	val.ACMEState.KeyPair, val.ACMEState.Version = nil, 0
+	if st.KeyPair != nil {
+		bytes, err := n.sealJSONVal(st.KeyPair)
+		if err != nil {
+			return err
+		}
+		val.KeyPair = bytes
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	stateKey := n.path("hosts", key.Name, "acme")
+	if st.Version != 0 {
+		return n.setVal(stateKey, bytes, noTTL, st.Version)
+	}
+	// Zero version creates the state only if the host has none
+	_, err = n.client.Create(stateKey, string(bytes), 0)
+	if err, ok := err.(*etcd.EtcdError); ok && err.ErrorCode == 105 {
+		return &engine.ConflictError{Message: fmt.Sprintf("%s has been created concurrently", stateKey)}
+	}
+	return convertErr(err)
 }
 
 func (n *ng) GetListeners() ([]engine.Listener, error) {
@@ -162,7 +246,7 @@ func (n *ng) GetListeners() ([]engine.Listener, error) {
 }
 
 func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
-	bytes, err := n.getVal(n.path("listeners", key.Id))
+	bytes, version, err := n.getVal(n.path("listeners", key.Id))
 	if err != nil {
 		return nil, err
 	}
@@ -170,6 +254,7 @@ func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
+	l.Version = version
 	return l, nil
 }
 
@@ -177,24 +262,30 @@ func (n *ng) UpsertListener(listener engine.Listener) error {
 	if listener.Id == "" {
 		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
 	}
-	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL)
+	version := listener.Version
+	listener.Version = 0
+	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL, version)
 }
 
-func (s *ng) DeleteListener(key engine.ListenerKey) error {
+func (s *ng) DeleteListener(key engine.ListenerKey, version uint64) error {
 	if key.Id == "" {
 		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
 	}
-	return s.deleteKey(s.path("listeners", key.Id))
+	return s.deleteKey(s.path("listeners", key.Id), version)
 }
 
 func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
 	if f.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
 	}
-	if _, err := n.GetBackend(engine.BackendKey{Id: f.BackendId}); err != nil {
-		return err
+	for _, id := range f.BackendIds() {
+		if _, err := n.GetBackend(engine.BackendKey{Id: id}); err != nil {
+			return err
+		}
 	}
-	if err := n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, noTTL); err != nil {
+	version := f.Version
+	f.Version = 0
+	if err := n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, noTTL, version); err != nil {
 		return err
 	}
 	if ttl == 0 {
@@ -223,18 +314,23 @@ func (n *ng) GetFrontends() ([]engine.Frontend, error) {
 func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
 	frontendKey := n.path("frontends", key.Id, "frontend")
 
-	bytes, err := n.getVal(frontendKey)
+	bytes, version, err := n.getVal(frontendKey)
 	if err != nil {
 		return nil, err
 	}
-	return engine.FrontendFromJSON([]byte(bytes), key.Id)
+	f, err := engine.FrontendFromJSON([]byte(bytes), key.Id)
+	if err != nil {
+		return nil, err
+	}
+	f.Version = version
+	return f, nil
 }
 
-func (n *ng) DeleteFrontend(fk engine.FrontendKey) error {
+func (n *ng) DeleteFrontend(fk engine.FrontendKey, version uint64) error {
 	if fk.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
 	}
-	return n.deleteKey(n.path("frontends", fk.Id))
+	return n.deleteDir(n.path("frontends", fk.Id), n.path("frontends", fk.Id, "frontend"), version)
 }
 
 func (n *ng) GetBackends() ([]engine.Backend, error) {
@@ -256,21 +352,28 @@ func (n *ng) GetBackends() ([]engine.Backend, error) {
 func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
 	backendKey := n.path("backends", key.Id, "backend")
 
-	bytes, err := n.getVal(backendKey)
+	bytes, version, err := n.getVal(backendKey)
 	if err != nil {
 		return nil, err
 	}
-	return engine.BackendFromJSON([]byte(bytes), key.Id)
+	b, err := engine.BackendFromJSON([]byte(bytes), key.Id)
+	if err != nil {
+		return nil, err
+	}
+	b.Version = version
+	return b, nil
 }
 
 func (n *ng) UpsertBackend(b engine.Backend) error {
 	if b.Id == "" {
 		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
 	}
-	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL)
+	version := b.Version
+	b.Version = 0
+	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL, version)
 }
 
-func (n *ng) DeleteBackend(bk engine.BackendKey) error {
+func (n *ng) DeleteBackend(bk engine.BackendKey, version uint64) error {
 	if bk.Id == "" {
 		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
 	}
@@ -279,10 +382,9 @@ func (n *ng) DeleteBackend(bk engine.BackendKey) error {
 		return err
 	}
 	if len(fs) != 0 {
-		return fmt.Errorf("can not delete backend '%v', it is in use by %s", bk, fs)
+		return fmt.Errorf("can not delete backend '%v', it is in use by %v", bk, fs)
 	}
-	_, err = n.client.Delete(n.path("backends", bk.Id), true)
-	return convertErr(err)
+	return n.deleteDir(n.path("backends", bk.Id), n.path("backends", bk.Id, "backend"), version)
 }
 
 func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
@@ -303,11 +405,16 @@ func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error)
 
 func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
 	mKey := n.path("frontends", key.FrontendKey.Id, "middlewares", key.Id)
-	bytes, err := n.getVal(mKey)
+	bytes, version, err := n.getVal(mKey)
+	if err != nil {
+		return nil, err
+	}
+	m, err := engine.MiddlewareFromJSON([]byte(bytes), n.registry.GetSpec, key.Id)
 	if err != nil {
 		return nil, err
 	}
-	return engine.MiddlewareFromJSON([]byte(bytes), n.registry.GetSpec, key.Id)
+	m.Version = version
+	return m, nil
 }
 
 func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
@@ -317,14 +424,16 @@ func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl ti
 	if _, err := n.GetFrontend(fk); err != nil {
 		return err
 	}
-	return n.setJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl)
+	version := m.Version
+	m.Version = 0
+	return n.setJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl, version)
 }
 
-func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
+func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey, version uint64) error {
 	if mk.FrontendKey.Id == "" || mk.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
 	}
-	return n.deleteKey(n.path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
+	return n.deleteKey(n.path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id), version)
 }
 
 func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
@@ -334,7 +443,9 @@ func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Durati
 	if _, err := n.GetBackend(bk); err != nil {
 		return err
 	}
-	return n.setJSONVal(n.path("backends", bk.Id, "servers", s.Id), s, ttl)
+	version := s.Version
+	s.Version = 0
+	return n.setJSONVal(n.path("backends", bk.Id, "servers", s.Id), s, ttl, version)
 }
 
 func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
@@ -354,18 +465,23 @@ func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 }
 
 func (n *ng) GetServer(sk engine.ServerKey) (*engine.Server, error) {
-	bytes, err := n.getVal(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+	bytes, version, err := n.getVal(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
 	if err != nil {
 		return nil, err
 	}
-	return engine.ServerFromJSON([]byte(bytes), sk.Id)
+	s, err := engine.ServerFromJSON([]byte(bytes), sk.Id)
+	if err != nil {
+		return nil, err
+	}
+	s.Version = version
+	return s, nil
 }
 
-func (n *ng) DeleteServer(sk engine.ServerKey) error {
+func (n *ng) DeleteServer(sk engine.ServerKey, version uint64) error {
 	if sk.Id == "" || sk.BackendKey.Id == "" {
 		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
 	}
-	return n.deleteKey(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+	return n.deleteKey(n.path("backends", sk.BackendKey.Id, "servers", sk.Id), version)
 }
 
 func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
@@ -405,18 +521,83 @@ func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
 		return nil, err
 	}
 	for _, f := range fs {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk.Id) {
 			usedFs = append(usedFs, f)
 		}
 	}
 	return usedFs, nil
 }
 
+// batchTTL limits the time the batch marker is held, so the batch of the crashed instance does not block
+// other instances forever. The marker is refreshed while the batch is in progress.
+const batchTTL = 10 * time.Second
+
+// ApplyBatch applies the changes while holding the batch marker key. Watchers buffer the changes seen
+// while the marker exists and emit them as a single BatchApplied event once the marker is deleted.
+//
+// The batch is not atomic: etcd has no transactions, so the keys are written one by one and the readers
+// of the keys see the intermediate state. If a change fails, the changes applied are reverted on the best
+// effort basis, and the revert can fail as well. If the instance crashes in the middle of the batch,
+// the marker expires and the watchers emit the changes applied so far.
+func (n *ng) ApplyBatch(changes []interface{}) error {
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+	if err := n.acquireBatch(id); err != nil {
+		return err
+	}
+	stopC, doneC := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(doneC)
+		n.refreshBatch(id, stopC)
+	}()
+	_, err := engine.ApplyChanges(n, changes)
+	close(stopC)
+	<-doneC
+	if _, derr := n.client.CompareAndDelete(n.path("batch"), id, 0); derr != nil && !notFound(derr) {
+		log.Errorf("failed to release batch marker: %s", derr)
+	}
+	return err
+}
+
+// acquireBatch creates the batch marker key waiting for the batch of the other instance to finish
+func (n *ng) acquireBatch(id string) error {
+	deadline := time.Now().Add(2 * batchTTL)
+	for {
+		_, err := n.client.Create(n.path("batch"), id, uint64(batchTTL/time.Second))
+		err = convertErr(err)
+		if _, ok := err.(*engine.AlreadyExistsError); !ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for the batch in progress: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// refreshBatch extends the TTL of the batch marker until the batch is over, so the watchers do not split
+// the batch taking longer than the TTL
+func (n *ng) refreshBatch(id string, stopC chan struct{}) {
+	ticker := time.NewTicker(batchTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+			if _, err := n.client.CompareAndSwap(n.path("batch"), id, uint64(batchTTL/time.Second), id, 0); err != nil {
+				log.Errorf("failed to refresh batch marker: %s", err)
+			}
+		}
+	}
+}
+
 // Subscribe watches etcd changes and generates structured events telling vulcand to add or delete frontends, hosts etc.
 // It is a blocking function.
 func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
 	// This index helps us to get changes in sequence, as they were performed by clients.
 	waitIndex := uint64(0)
+	// batch collects the changes while the batch marker exists
+	var batch []interface{}
 	for {
 		response, err := n.client.Watch(n.etcdKey, waitIndex, true, nil, cancelC)
 		if err != nil {
@@ -431,10 +612,29 @@ func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
 		}
 		waitIndex = response.Node.ModifiedIndex + 1
 		log.Infof("%s", responseToString(response))
-		change, err := n.parseChange(response)
-		if err != nil {
-			log.Warningf("Ignore '%s', error: %s", responseToString(response), err)
-			continue
+		var change interface{}
+		if response.Node.Key == n.path("batch") {
+			switch response.Action {
+			case createA:
+				batch = []interface{}{}
+				continue
+			case cswapA: // marker of the batch in progress has been refreshed
+				continue
+			}
+			if batch == nil {
+				continue
+			}
+			change, batch = &engine.BatchApplied{Changes: batch}, nil
+		} else {
+			change, err = n.parseChange(response)
+			if err != nil {
+				log.Warningf("Ignore '%s', error: %s", responseToString(response), err)
+				continue
+			}
+			if change != nil && batch != nil {
+				batch = append(batch, change)
+				continue
+			}
 		}
 		if change != nil {
 			log.Infof("%v", change)
@@ -476,25 +676,41 @@ func (s *ng) parseChange(response *etcd.Response) (interface{}, error) {
 }
 
 func (n *ng) parseHostChange(r *etcd.Response) (interface{}, error) {
-	out := regexp.MustCompile("/hosts/([^/]+)(?:/host)?$").FindStringSubmatch(r.Node.Key)
-	if len(out) != 2 {
+	out := regexp.MustCompile("/hosts/([^/]+)(/host|/acme)?$").FindStringSubmatch(r.Node.Key)
+	if len(out) != 3 {
 		return nil, nil
 	}
 
 	hostname := out[1]
 
+	// The ACME state is the part of the host, the host is upserted when the state changes
+	if out[2] == "/acme" {
+		host, err := n.GetHost(engine.HostKey{Name: hostname})
+		if err != nil {
+			if isNotFoundError(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &engine.HostUpserted{
+			Host: *host,
+		}, nil
+	}
+
 	switch r.Action {
-	case createA, setA:
-		host, err := n.GetHost(engine.HostKey{hostname})
+	case createA, setA, cswapA:
+		host, err := n.GetHost(engine.HostKey{Name: hostname})
 		if err != nil {
 			return nil, err
 		}
 		return &engine.HostUpserted{
 			Host: *host,
 		}, nil
+	case cdelA: // deleteDir deletes the directory right after the key, the directory delete emits the change
+		return nil, nil
 	case deleteA, expireA:
 		return &engine.HostDeleted{
-			HostKey: engine.HostKey{hostname},
+			HostKey: engine.HostKey{Name: hostname},
 		}, nil
 	}
 	return nil, fmt.Errorf("unsupported action for host: %s", r.Action)
@@ -509,7 +725,7 @@ func (n *ng) parseListenerChange(r *etcd.Response) (interface{}, error) {
 	key := engine.ListenerKey{Id: out[1]}
 
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		l, err := n.GetListener(key)
 		if err != nil {
 			return nil, err
@@ -517,7 +733,7 @@ func (n *ng) parseListenerChange(r *etcd.Response) (interface{}, error) {
 		return &engine.ListenerUpserted{
 			Listener: *l,
 		}, nil
-	case deleteA, expireA:
+	case deleteA, expireA, cdelA:
 		return &engine.ListenerDeleted{
 			ListenerKey: key,
 		}, nil
@@ -532,7 +748,7 @@ func (n *ng) parseFrontendChange(r *etcd.Response) (interface{}, error) {
 	}
 	key := engine.FrontendKey{Id: out[1]}
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		f, err := n.GetFrontend(key)
 		if err != nil {
 			return nil, err
@@ -540,6 +756,8 @@ func (n *ng) parseFrontendChange(r *etcd.Response) (interface{}, error) {
 		return &engine.FrontendUpserted{
 			Frontend: *f,
 		}, nil
+	case cdelA: // deleteDir deletes the directory right after the key, the directory delete emits the change
+		return nil, nil
 	case deleteA, expireA:
 		return &engine.FrontendDeleted{
 			FrontendKey: key,
@@ -560,7 +778,7 @@ func (s *ng) parseFrontendMiddlewareChange(r *etcd.Response) (interface{}, error
 	mk := engine.MiddlewareKey{FrontendKey: fk, Id: out[2]}
 
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		m, err := s.GetMiddleware(mk)
 		if err != nil {
 			return nil, err
@@ -569,7 +787,7 @@ func (s *ng) parseFrontendMiddlewareChange(r *etcd.Response) (interface{}, error
 			FrontendKey: fk,
 			Middleware:  *m,
 		}, nil
-	case deleteA, expireA:
+	case deleteA, expireA, cdelA:
 		return &engine.MiddlewareDeleted{
 			MiddlewareKey: mk,
 		}, nil
@@ -584,7 +802,7 @@ func (n *ng) parseBackendChange(r *etcd.Response) (interface{}, error) {
 	}
 	bk := engine.BackendKey{Id: out[1]}
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		b, err := n.GetBackend(bk)
 		if err != nil {
 			return nil, err
@@ -592,6 +810,8 @@ func (n *ng) parseBackendChange(r *etcd.Response) (interface{}, error) {
 		return &engine.BackendUpserted{
 			Backend: *b,
 		}, nil
+	case cdelA: // deleteDir deletes the directory right after the key, the directory delete emits the change
+		return nil, nil
 	case deleteA, expireA:
 		return &engine.BackendDeleted{
 			BackendKey: bk,
@@ -609,7 +829,7 @@ func (n *ng) parseBackendServerChange(r *etcd.Response) (interface{}, error) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: out[1]}, Id: out[2]}
 
 	switch r.Action {
-	case setA, createA:
+	case setA, createA, cswapA:
 		srv, err := n.GetServer(sk)
 		if err != nil {
 			return nil, err
@@ -618,12 +838,10 @@ func (n *ng) parseBackendServerChange(r *etcd.Response) (interface{}, error) {
 			BackendKey: sk.BackendKey,
 			Server:     *srv,
 		}, nil
-	case deleteA, expireA:
+	case deleteA, expireA, cdelA:
 		return &engine.ServerDeleted{
 			ServerKey: sk,
 		}, nil
-	case cswapA: // ignore compare and swap attempts
-		return nil, nil
 	}
 	return nil, fmt.Errorf("unsupported action on the server: %s", r.Action)
 }
@@ -632,37 +850,47 @@ func (n ng) path(keys ...string) string {
 	return strings.Join(append([]string{n.etcdKey}, keys...), "/")
 }
 
-func (n *ng) setJSONVal(key string, v interface{}, ttl time.Duration) error {
+func (n *ng) setJSONVal(key string, v interface{}, ttl time.Duration, version uint64) error {
 	bytes, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	return n.setVal(key, bytes, ttl)
+	return n.setVal(key, bytes, ttl, version)
 }
 
-func (n *ng) setVal(key string, val []byte, ttl time.Duration) error {
-	_, err := n.client.Set(key, string(val), uint64(ttl/time.Second))
+// setVal sets the value of the key. Non zero version is used as the previous index of the key, so the value
+// is set only if the key has not been modified since.
+func (n *ng) setVal(key string, val []byte, ttl time.Duration, version uint64) error {
+	if version == 0 {
+		_, err := n.client.Set(key, string(val), uint64(ttl/time.Second))
+		return convertErr(err)
+	}
+	_, err := n.client.CompareAndSwap(key, string(val), uint64(ttl/time.Second), "", version)
+	if notFound(err) {
+		return &engine.ConflictError{Message: fmt.Sprintf("%s version %d does not match the current version 0", key, version)}
+	}
 	return convertErr(err)
 }
 
-func (n *ng) getJSONVal(key string, in interface{}) error {
-	val, err := n.getVal(key)
+func (n *ng) getJSONVal(key string, in interface{}) (uint64, error) {
+	val, version, err := n.getVal(key)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return json.Unmarshal([]byte(val), in)
+	return version, json.Unmarshal([]byte(val), in)
 }
 
-func (n *ng) getVal(key string) (string, error) {
+// getVal returns the value of the key and its modified index used as the version of the object
+func (n *ng) getVal(key string) (string, uint64, error) {
 	response, err := n.client.Get(key, false, false)
 	if err != nil {
-		return "", convertErr(err)
+		return "", 0, convertErr(err)
 	}
 
 	if isDir(response.Node) {
-		return "", &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+		return "", 0, &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
 	}
-	return response.Node.Value, nil
+	return response.Node.Value, response.Node.ModifiedIndex, nil
 }
 
 func (n *ng) getDirs(keys ...string) ([]string, error) {
@@ -714,8 +942,25 @@ func (n *ng) checkKeyExists(key string) error {
 	return convertErr(err)
 }
 
-func (n *ng) deleteKey(key string) error {
-	_, err := n.client.Delete(key, true)
+// deleteKey deletes the key, non zero version is used as the previous index of the key
+func (n *ng) deleteKey(key string, version uint64) error {
+	if version == 0 {
+		_, err := n.client.Delete(key, true)
+		return convertErr(err)
+	}
+	_, err := n.client.CompareAndDelete(key, "", version)
+	return convertErr(err)
+}
+
+// deleteDir deletes the directory of the object stored in the key. Etcd can not compare and delete directories,
+// so the key is compared and deleted with the non zero version first, and the rest of the directory is deleted after.
+func (n *ng) deleteDir(dir, key string, version uint64) error {
+	if version != 0 {
+		if _, err := n.client.CompareAndDelete(key, "", version); err != nil {
+			return convertErr(err)
+		}
+	}
+	_, err := n.client.Delete(dir, true)
 	return convertErr(err)
 }
 
@@ -747,6 +992,9 @@ func convertErr(e error) error {
 		if err.ErrorCode == 100 {
 			return &engine.NotFoundError{Message: err.Error()}
 		}
+		if err.ErrorCode == 101 {
+			return &engine.ConflictError{Message: err.Error()}
+		}
 		if err.ErrorCode == 105 {
 			return &engine.AlreadyExistsError{Message: err.Error()}
 		}
@@ -776,6 +1024,7 @@ const (
 	expireA = "expire"
 	updateA = "update"
 	cswapA  = "compareAndSwap"
+	cdelA   = "compareAndDelete"
 	noTTL   = 0
 )
 
@@ -792,7 +1041,19 @@ type host struct {
 }
 
 type hostSettings struct {
-	Default bool
-	KeyPair []byte
-	OCSP    engine.OCSPSettings
+	Default       bool
+	KeyPair       []byte
+	KeyPairs      []byte `json:",omitempty"`
+	OCSP          engine.OCSPSettings
+	Passthrough   *engine.HostPassthrough `json:",omitempty"`
+	ErrorPages    *engine.ErrorPages      `json:",omitempty"`
+	Maintenance   *engine.Maintenance     `json:",omitempty"`
+	HTTPSRedirect *engine.HTTPSRedirect   `json:",omitempty"`
+	ACME          *engine.HostACME        `json:",omitempty"`
+}
+
+// acmeState is the ACME state of the host with the KeyPair issued sealed like the KeyPair of the host
+type acmeState struct {
+	engine.ACMEState
+	KeyPair []byte `json:",omitempty"`
 }
@@ -111,6 +111,14 @@ func (s *EtcdSuite) TestHostWithKeyPair(c *C) {
 	s.suite.HostWithKeyPair(c)
 }
 
+func (s *EtcdSuite) TestHostWithKeyPairs(c *C) {
+	s.suite.HostWithKeyPairs(c)
+}
+
+func (s *EtcdSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
 func (s *EtcdSuite) TestHostUpsertKeyPair(c *C) {
 	s.suite.HostUpsertKeyPair(c)
 }
@@ -119,6 +127,22 @@ func (s *EtcdSuite) TestHostWithOCSP(c *C) {
 	s.suite.HostWithOCSP(c)
 }
 
+func (s *EtcdSuite) TestHostWithPassthrough(c *C) {
+	s.suite.HostWithPassthrough(c)
+}
+
+func (s *EtcdSuite) TestHostWithErrorPages(c *C) {
+	s.suite.HostWithErrorPages(c)
+}
+
+func (s *EtcdSuite) TestHostWithMaintenance(c *C) {
+	s.suite.HostWithMaintenance(c)
+}
+
+func (s *EtcdSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
 func (s *EtcdSuite) TestListenerCRUD(c *C) {
 	s.suite.ListenerCRUD(c)
 }
@@ -159,6 +183,14 @@ func (s *EtcdSuite) TestFrontendBadBackend(c *C) {
 	s.suite.FrontendBadBackend(c)
 }
 
+func (s *EtcdSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *EtcdSuite) TestTCPFrontendCRUD(c *C) {
+	s.suite.TCPFrontendCRUD(c)
+}
+
 func (s *EtcdSuite) TestMiddlewareCRUD(c *C) {
 	s.suite.MiddlewareCRUD(c)
 }
@@ -175,3 +207,15 @@ func (s *EtcdSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *EtcdSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+func (s *EtcdSuite) TestVersionConflict(c *C) {
+	s.suite.VersionConflict(c)
+}
+
+func (s *EtcdSuite) TestBatchCRUD(c *C) {
+	s.suite.BatchCRUD(c)
+}
+
+func (s *EtcdSuite) TestBatchRollback(c *C) {
+	s.suite.BatchRollback(c)
+}
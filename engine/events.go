@@ -100,3 +100,13 @@ type ServerDeleted struct {
 func (s *ServerDeleted) String() string {
 	return fmt.Sprintf("ServerDeleted(serverKey=%v)", &s.ServerKey)
 }
+
+// BatchApplied is emitted when a batch of changes has been applied with ApplyBatch.
+// Changes are the regular upsert and delete events in the order they were applied.
+type BatchApplied struct {
+	Changes []interface{}
+}
+
+func (b *BatchApplied) String() string {
+	return fmt.Sprintf("BatchApplied(changes=%v)", b.Changes)
+}
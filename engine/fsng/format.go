@@ -0,0 +1,98 @@
+package fsng
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/yaml.v2"
+)
+
+const (
+	extJSON = ".json"
+	extYAML = ".yaml"
+	extYML  = ".yml"
+)
+
+// extensions lists the supported file formats in the order they are looked up
+var extensions = []string{extJSON, extYAML, extYML}
+
+func isSupported(ext string) bool {
+	for _, e := range extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// IsYAML reports whether the file is a YAML document judging by its extension
+func IsYAML(p string) bool {
+	ext := path.Ext(p)
+	return ext == extYAML || ext == extYML
+}
+
+// toJSON returns the file contents as JSON, converting YAML documents if necessary,
+// so the standard engine parsers could be used for all file formats.
+func toJSON(p string, data []byte) ([]byte, error) {
+	if IsYAML(p) {
+		var err error
+		if data, err = YAMLToJSON(data); err != nil {
+			return nil, err
+		}
+	}
+	// Files can be empty while they are being written, the standard parsers do not expect empty objects
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || string(trimmed) == "null" {
+		return nil, fmt.Errorf("%s is empty", p)
+	}
+	return data, nil
+}
+
+// fromJSON converts JSON to the format of the file, so updates preserve the format chosen by the operator.
+func fromJSON(p string, data []byte) ([]byte, error) {
+	if !IsYAML(p) {
+		return data, nil
+	}
+	return JSONToYAML(data)
+}
+
+// YAMLToJSON converts the YAML document to JSON
+func YAMLToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(convertYAML(v))
+}
+
+// JSONToYAML converts the JSON document to YAML
+func JSONToYAML(data []byte) ([]byte, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// Preserve integers, otherwise large values will be formatted in exponential notation and will fail to parse back
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// convertYAML replaces maps with interface keys produced by YAML decoder with maps with string keys supported by JSON encoder
+func convertYAML(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			out[fmt.Sprint(key)] = convertYAML(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = convertYAML(val)
+		}
+		return out
+	}
+	return in
+}
@@ -0,0 +1,1216 @@
+// package fsng contains the implementation of the engine backed by a directory of JSON or YAML files,
+// where every vulcand object is stored in a separate file:
+//
+//	hosts/<name>.json
+//	acme/<name>.json
+//	listeners/<id>.json
+//	backends/<id>/backend.json
+//	backends/<id>/servers/<id>.json
+//	frontends/<id>/frontend.json
+//	frontends/<id>/middlewares/<id>.json
+//
+// Files with .yaml or .yml extensions are supported as well. The engine polls the directory and generates events
+// when files are changed on disk, so vulcand can be reconfigured by editing the files. TTLs are not supported and ignored.
+// The acme directory keeps the ACME state of the hosts maintained by vulcand, it is not meant to be edited.
+package fsng
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/plugin"
+	"github.com/mailgun/vulcand/secret"
+)
+
+type ng struct {
+	dir      string
+	registry *plugin.Registry
+	options  Options
+
+	mtx *sync.Mutex
+	// files contains the last known contents of the files indexed by the object path without extension,
+	// it is used to detect changes made on disk
+	files    map[string]file
+	changesC chan interface{}
+
+	// batchMtx serializes batches, batch collects the changes while the batch is being applied
+	batchMtx *sync.Mutex
+	batch    []interface{}
+}
+
+type Options struct {
+	// PollPeriod defines how often the directory is checked for changes
+	PollPeriod time.Duration
+	Box        *secret.Box
+}
+
+type file struct {
+	path string
+	data []byte
+}
+
+// version returns the hash of the file contents, it is used as the version of the object stored in the file
+func (f file) version() uint64 {
+	if f.data == nil {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write(f.data)
+	return h.Sum64()
+}
+
+func New(dir string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	n := &ng{
+		dir:      dir,
+		registry: registry,
+		options:  setDefaults(options),
+		mtx:      &sync.Mutex{},
+		changesC: make(chan interface{}, 1000),
+		batchMtx: &sync.Mutex{},
+	}
+	files, err := n.scan()
+	if err != nil {
+		return nil, err
+	}
+	n.files = files
+	return n, nil
+}
+
+func (n *ng) Close() {
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	hosts := []engine.Host{}
+	names, err := n.listFiles("hosts")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		h, err := n.GetHost(engine.HostKey{Name: name})
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, *h)
+	}
+	return hosts, nil
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	f, err := n.readFile(hostPath(key))
+	if err != nil {
+		return nil, err
+	}
+	st, err := n.readFile(acmePath(key))
+	if err != nil && !isNotFoundError(err) {
+		return nil, err
+	}
+	out, err := n.hostFromFile(key, f, st)
+	if err != nil {
+		return nil, err
+	}
+	out.Version = f.version()
+	return out, nil
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if err := checkId("hostname", h.Name); err != nil {
+		return err
+	}
+	val := host{
+		Name: h.Name,
+		Settings: hostSettings{
+			Default:       h.Settings.Default,
+			OCSP:          h.Settings.OCSP,
+			Passthrough:   h.Settings.Passthrough,
+			ErrorPages:    h.Settings.ErrorPages,
+			Maintenance:   h.Settings.Maintenance,
+			HTTPSRedirect: h.Settings.HTTPSRedirect,
+			ACME:          h.Settings.ACME,
+		},
+	}
+	// The KeyPair issued by ACME is kept in the ACME state
+	if h.Settings.KeyPair != nil && !h.ACMEEnabled() {
+		bytes, err := n.keyPairToJSON(h.Settings.KeyPair)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPair = bytes
+	}
+	if len(h.Settings.KeyPairs) != 0 {
+		bytes, err := n.keyPairToJSON(h.Settings.KeyPairs)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPairs = bytes
+	}
+	return n.upsert(hostPath(engine.HostKey{Name: h.Name}), val, h.Version)
+}
+
+func (n *ng) DeleteHost(key engine.HostKey, version uint64) error {
+	if err := checkId("hostname", key.Name); err != nil {
+		return err
+	}
+	if err := n.deleteFile(hostPath(key), version); err != nil {
+		return err
+	}
+	return n.deleteACMEState(key)
+}
+
+func (n *ng) UpsertACMEState(key engine.HostKey, st engine.ACMEState) error {
+	if err := checkId("hostname", key.Name); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	f, err := n.readFile(hostPath(key))
+	if err != nil {
+		return err
+	}
+	p := acmePath(key)
+	sf, err := n.readFile(p)
+	if err != nil {
+		if !isNotFoundError(err) {
+			return err
+		}
+		sf = file{path: p + extJSON}
+	}
+	if st.Version != sf.version() {
+		return &engine.ConflictError{Message: fmt.Sprintf("%v ACME state version %d does not match the current version %d", key, st.Version, sf.version())}
+	}
+	val := acmeState{ACMEState: st}
+	val.ACMEState.KeyPair, val.ACMEState.Version = nil, 0
+	if st.KeyPair != nil {
+		if val.KeyPair, err = n.keyPairToJSON(st.KeyPair); err != nil {
+			return err
+		}
+	}
+	if sf.data, err = json.Marshal(val); err != nil {
+		return err
+	}
+	h, err := n.hostFromFile(key, f, sf)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(n.dir, filepath.FromSlash(sf.path)), sf.data); err != nil {
+		return err
+	}
+	n.files[p] = sf
+	n.emit(&engine.HostUpserted{Host: *h})
+	return nil
+}
+
+// deleteACMEState deletes the ACME state of the deleted host
+func (n *ng) deleteACMEState(key engine.HostKey) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	p := acmePath(key)
+	f, err := n.readFile(p)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Remove(filepath.Join(n.dir, filepath.FromSlash(f.path))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(n.files, p)
+	return nil
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	ls := []engine.Listener{}
+	ids, err := n.listFiles("listeners")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		l, err := n.GetListener(engine.ListenerKey{Id: id})
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, *l)
+	}
+	return ls, nil
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	f, err := n.readFile(listenerPath(key))
+	if err != nil {
+		return nil, err
+	}
+	out, err := n.listenerFromFile(key, f)
+	if err != nil {
+		return nil, err
+	}
+	out.Version = f.version()
+	return out, nil
+}
+
+func (n *ng) UpsertListener(l engine.Listener) error {
+	if err := checkId("listener id", l.Id); err != nil {
+		return err
+	}
+	version := l.Version
+	l.Version = 0
+	return n.upsert(listenerPath(engine.ListenerKey{Id: l.Id}), l, version)
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey, version uint64) error {
+	if err := checkId("listener id", key.Id); err != nil {
+		return err
+	}
+	return n.deleteFile(listenerPath(key), version)
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	fs := []engine.Frontend{}
+	ids, err := n.listDirs("frontends")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		f, err := n.GetFrontend(engine.FrontendKey{Id: id})
+		if err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		fs = append(fs, *f)
+	}
+	return fs, nil
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	f, err := n.readFile(frontendPath(key))
+	if err != nil {
+		return nil, err
+	}
+	out, err := n.frontendFromFile(key, f)
+	if err != nil {
+		return nil, err
+	}
+	out.Version = f.version()
+	return out, nil
+}
+
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if err := checkId("frontend id", f.Id); err != nil {
+		return err
+	}
+	for _, id := range f.BackendIds() {
+		if _, err := n.GetBackend(engine.BackendKey{Id: id}); err != nil {
+			return err
+		}
+	}
+	version := f.Version
+	f.Version = 0
+	return n.upsert(frontendPath(engine.FrontendKey{Id: f.Id}), f, version)
+}
+
+func (n *ng) DeleteFrontend(key engine.FrontendKey, version uint64) error {
+	if err := checkId("frontend id", key.Id); err != nil {
+		return err
+	}
+	return n.deleteDir(path.Join("frontends", key.Id), frontendPath(key), version)
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	bs := []engine.Backend{}
+	ids, err := n.listDirs("backends")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		b, err := n.GetBackend(engine.BackendKey{Id: id})
+		if err != nil {
+			if isNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		bs = append(bs, *b)
+	}
+	return bs, nil
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	f, err := n.readFile(backendPath(key))
+	if err != nil {
+		return nil, err
+	}
+	out, err := n.backendFromFile(key, f)
+	if err != nil {
+		return nil, err
+	}
+	out.Version = f.version()
+	return out, nil
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	if err := checkId("backend id", b.Id); err != nil {
+		return err
+	}
+	version := b.Version
+	b.Version = 0
+	return n.upsert(backendPath(engine.BackendKey{Id: b.Id}), b, version)
+}
+
+func (n *ng) DeleteBackend(key engine.BackendKey, version uint64) error {
+	if err := checkId("backend id", key.Id); err != nil {
+		return err
+	}
+	fs, err := n.backendUsedBy(key)
+	if err != nil {
+		return err
+	}
+	if len(fs) != 0 {
+		return fmt.Errorf("can not delete backend '%v', it is in use by %v", key, fs)
+	}
+	return n.deleteDir(path.Join("backends", key.Id), backendPath(key), version)
+}
+
+func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	ms := []engine.Middleware{}
+	ids, err := n.listFiles(path.Join("frontends", fk.Id, "middlewares"))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		m, err := n.GetMiddleware(engine.MiddlewareKey{FrontendKey: fk, Id: id})
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, *m)
+	}
+	return ms, nil
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	f, err := n.readFile(middlewarePath(key))
+	if err != nil {
+		return nil, err
+	}
+	out, err := n.middlewareFromFile(key, f)
+	if err != nil {
+		return nil, err
+	}
+	out.Version = f.version()
+	return out, nil
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if err := checkId("frontend id", fk.Id); err != nil {
+		return err
+	}
+	if err := checkId("middleware id", m.Id); err != nil {
+		return err
+	}
+	if _, err := n.GetFrontend(fk); err != nil {
+		return err
+	}
+	version := m.Version
+	m.Version = 0
+	return n.upsert(middlewarePath(engine.MiddlewareKey{FrontendKey: fk, Id: m.Id}), m, version)
+}
+
+func (n *ng) DeleteMiddleware(key engine.MiddlewareKey, version uint64) error {
+	if err := checkId("frontend id", key.FrontendKey.Id); err != nil {
+		return err
+	}
+	if err := checkId("middleware id", key.Id); err != nil {
+		return err
+	}
+	return n.deleteFile(middlewarePath(key), version)
+}
+
+func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
+	svs := []engine.Server{}
+	ids, err := n.listFiles(path.Join("backends", bk.Id, "servers"))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		s, err := n.GetServer(engine.ServerKey{BackendKey: bk, Id: id})
+		if err != nil {
+			return nil, err
+		}
+		svs = append(svs, *s)
+	}
+	return svs, nil
+}
+
+func (n *ng) GetServer(key engine.ServerKey) (*engine.Server, error) {
+	f, err := n.readFile(serverPath(key))
+	if err != nil {
+		return nil, err
+	}
+	out, err := n.serverFromFile(key, f)
+	if err != nil {
+		return nil, err
+	}
+	out.Version = f.version()
+	return out, nil
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if err := checkId("backend id", bk.Id); err != nil {
+		return err
+	}
+	if err := checkId("server id", s.Id); err != nil {
+		return err
+	}
+	if _, err := n.GetBackend(bk); err != nil {
+		return err
+	}
+	version := s.Version
+	s.Version = 0
+	return n.upsert(serverPath(engine.ServerKey{BackendKey: bk, Id: s.Id}), s, version)
+}
+
+func (n *ng) DeleteServer(key engine.ServerKey, version uint64) error {
+	if err := checkId("backend id", key.BackendKey.Id); err != nil {
+		return err
+	}
+	if err := checkId("server id", key.Id); err != nil {
+		return err
+	}
+	return n.deleteFile(serverPath(key), version)
+}
+
+// Subscribe polls the directory for changes and generates structured events telling vulcand to add or delete frontends, hosts etc.
+// Changes made via the engine interface are reported immediately. It is a blocking function.
+func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
+	ticker := time.NewTicker(n.options.PollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancelC:
+			log.Infof("Stop watching: graceful shutdown")
+			return nil
+		case <-ticker.C:
+			if err := n.sync(); err != nil {
+				log.Errorf("failed to read %s: %v", n.dir, err)
+			}
+		case change := <-n.changesC:
+			log.Infof("%v", change)
+			select {
+			case changes <- change:
+			case <-cancelC:
+				return nil
+			}
+		}
+	}
+}
+
+// ApplyBatch applies the changes and emits a single BatchApplied event, changes made on disk are picked up
+// once the batch is over. The files are written one by one, and the changes applied are reverted on the best
+// effort basis in case of failure, so other vulcand instances polling the directory may see a part of the batch.
+func (n *ng) ApplyBatch(changes []interface{}) error {
+	n.batchMtx.Lock()
+	defer n.batchMtx.Unlock()
+
+	n.mtx.Lock()
+	n.batch = []interface{}{}
+	n.mtx.Unlock()
+
+	applied, err := engine.ApplyChanges(n, changes)
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	batch := n.batch
+	n.batch = nil
+	if err != nil {
+		// The events of the batch are dropped, the changes failed to revert remain in the store and are reported instead
+		if len(applied) != 0 {
+			n.emit(&engine.BatchApplied{Changes: applied})
+		}
+		return err
+	}
+	n.emit(&engine.BatchApplied{Changes: batch})
+	return nil
+}
+
+// emit sends the change to subscribers, it is called with the mutex held
+func (n *ng) emit(change interface{}) {
+	if n.batch != nil {
+		n.batch = append(n.batch, change)
+		return
+	}
+	select {
+	case n.changesC <- change:
+	default:
+		log.Errorf("changes buffer is full, dropping %v", change)
+	}
+}
+
+// sync compares the directory contents with the last known state and emits events for the objects changed on disk
+func (n *ng) sync() error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if n.batch != nil {
+		return nil
+	}
+
+	files, err := n.scan()
+	if err != nil {
+		return err
+	}
+
+	upserted, deleted := []string{}, []string{}
+	for p, f := range files {
+		if prev, ok := n.files[p]; !ok || prev.path != f.path || string(prev.data) != string(f.data) {
+			upserted = append(upserted, p)
+		}
+	}
+	for p := range n.files {
+		if _, ok := files[p]; !ok {
+			// The host is upserted without the ACME state deleted
+			if _, ok := parseACMEPath(p); ok {
+				upserted = append(upserted, p)
+				continue
+			}
+			deleted = append(deleted, p)
+		}
+	}
+	n.files = files
+	upserted = hostsOfACMEStates(upserted, files)
+
+	// Deletes go first in reverse dependency order, e.g. middlewares are deleted before frontends
+	sort.Sort(sort.Reverse(byDependency(deleted)))
+	for _, p := range deleted {
+		// Deleting the frontend or backend deletes all the middlewares and servers as well
+		if parent := parentPath(p); parent != "" && contains(deleted, parent) {
+			continue
+		}
+		log.Infof("%s deleted", p)
+		n.emit(deletedEvent(p))
+	}
+
+	// Upserts go in dependency order, e.g. backends are added before frontends
+	sort.Sort(byDependency(upserted))
+	for _, p := range upserted {
+		change, err := n.upsertedEvent(p, files[p])
+		if err != nil {
+			log.Warningf("Ignore '%s', error: %s", files[p].path, err)
+			continue
+		}
+		log.Infof("%s changed", files[p].path)
+		n.emit(change)
+	}
+	return nil
+}
+
+// scan reads all the supported files in the directory
+func (n *ng) scan() (map[string]file, error) {
+	files := map[string]file{}
+	err := filepath.Walk(n.dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(n.dir, fpath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		p, ok := objectPath(rel)
+		if !ok {
+			return nil
+		}
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if prev, ok := files[p]; ok {
+			log.Warningf("Ignore '%s', '%s' defines the same object", rel, prev.path)
+			return nil
+		}
+		files[p] = file{path: rel, data: data}
+		return nil
+	})
+	return files, err
+}
+
+func (n *ng) upsertedEvent(p string, f file) (interface{}, error) {
+	switch key := parsePath(p).(type) {
+	case engine.HostKey:
+		h, err := n.hostFromFile(key, f, n.files[acmePath(key)])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	case engine.ListenerKey:
+		l, err := n.listenerFromFile(key, f)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: *l}, nil
+	case engine.BackendKey:
+		b, err := n.backendFromFile(key, f)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.BackendUpserted{Backend: *b}, nil
+	case engine.ServerKey:
+		s, err := n.serverFromFile(key, f)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: key.BackendKey, Server: *s}, nil
+	case engine.FrontendKey:
+		fr, err := n.frontendFromFile(key, f)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: *fr}, nil
+	case engine.MiddlewareKey:
+		m, err := n.middlewareFromFile(key, f)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: key.FrontendKey, Middleware: *m}, nil
+	}
+	return nil, fmt.Errorf("unsupported path: %s", p)
+}
+
+func deletedEvent(p string) interface{} {
+	switch key := parsePath(p).(type) {
+	case engine.HostKey:
+		return &engine.HostDeleted{HostKey: key}
+	case engine.ListenerKey:
+		return &engine.ListenerDeleted{ListenerKey: key}
+	case engine.BackendKey:
+		return &engine.BackendDeleted{BackendKey: key}
+	case engine.ServerKey:
+		return &engine.ServerDeleted{ServerKey: key}
+	case engine.FrontendKey:
+		return &engine.FrontendDeleted{FrontendKey: key}
+	case engine.MiddlewareKey:
+		return &engine.MiddlewareDeleted{MiddlewareKey: key}
+	}
+	return nil
+}
+
+// hostFromFile returns the host stored in the file along with the ACME state stored in the state file, if any
+func (n *ng) hostFromFile(key engine.HostKey, f, st file) (*engine.Host, error) {
+	bytes, err := toJSON(f.path, f.data)
+	if err != nil {
+		return nil, err
+	}
+	var h *host
+	if err := json.Unmarshal(bytes, &h); err != nil {
+		return nil, err
+	}
+	var keyPair *engine.KeyPair
+	if len(h.Settings.KeyPair) != 0 && string(h.Settings.KeyPair) != "null" {
+		if err = n.keyPairFromJSON(h.Settings.KeyPair, &keyPair); err != nil {
+			return nil, err
+		}
+	}
+	var keyPairs []engine.KeyPair
+	if len(h.Settings.KeyPairs) != 0 && string(h.Settings.KeyPairs) != "null" {
+		if err = n.keyPairFromJSON(h.Settings.KeyPairs, &keyPairs); err != nil {
+			return nil, err
+		}
+	}
+	out, err := engine.NewHost(key.Name, engine.HostSettings{Default: h.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: h.Settings.OCSP, Passthrough: h.Settings.Passthrough, ErrorPages: h.Settings.ErrorPages, Maintenance: h.Settings.Maintenance, HTTPSRedirect: h.Settings.HTTPSRedirect, ACME: h.Settings.ACME})
+	if err != nil || st.data == nil {
+		return out, err
+	}
+	if out.ACME, err = n.acmeStateFromFile(st); err != nil {
+		return nil, err
+	}
+	if out.ACMEEnabled() {
+		out.Settings.KeyPair = out.ACME.KeyPair
+	}
+	return out, nil
+}
+
+func (n *ng) acmeStateFromFile(f file) (*engine.ACMEState, error) {
+	var val *acmeState
+	if err := json.Unmarshal(f.data, &val); err != nil {
+		return nil, err
+	}
+	st := val.ACMEState
+	if len(val.KeyPair) != 0 {
+		if err := n.keyPairFromJSON(val.KeyPair, &st.KeyPair); err != nil {
+			return nil, err
+		}
+	}
+	st.Version = f.version()
+	return &st, nil
+}
+
+func (n *ng) listenerFromFile(key engine.ListenerKey, f file) (*engine.Listener, error) {
+	bytes, err := toJSON(f.path, f.data)
+	if err != nil {
+		return nil, err
+	}
+	return engine.ListenerFromJSON(bytes, key.Id)
+}
+
+func (n *ng) frontendFromFile(key engine.FrontendKey, f file) (*engine.Frontend, error) {
+	bytes, err := toJSON(f.path, f.data)
+	if err != nil {
+		return nil, err
+	}
+	return engine.FrontendFromJSON(bytes, key.Id)
+}
+
+func (n *ng) middlewareFromFile(key engine.MiddlewareKey, f file) (*engine.Middleware, error) {
+	bytes, err := toJSON(f.path, f.data)
+	if err != nil {
+		return nil, err
+	}
+	return engine.MiddlewareFromJSON(bytes, n.registry.GetSpec, key.Id)
+}
+
+func (n *ng) backendFromFile(key engine.BackendKey, f file) (*engine.Backend, error) {
+	bytes, err := toJSON(f.path, f.data)
+	if err != nil {
+		return nil, err
+	}
+	return engine.BackendFromJSON(bytes, key.Id)
+}
+
+func (n *ng) serverFromFile(key engine.ServerKey, f file) (*engine.Server, error) {
+	bytes, err := toJSON(f.path, f.data)
+	if err != nil {
+		return nil, err
+	}
+	return engine.ServerFromJSON(bytes, key.Id)
+}
+
+// keyPairToJSON seals the key pair or the key pairs if the engine has a secret box, otherwise they are stored as is
+func (n *ng) keyPairToJSON(kp interface{}) ([]byte, error) {
+	bytes, err := json.Marshal(kp)
+	if err != nil {
+		return nil, err
+	}
+	if n.options.Box == nil {
+		return bytes, nil
+	}
+	v, err := n.options.Box.Seal(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(v)
+}
+
+// keyPairFromJSON opens the sealed key pair or key pairs and decodes them into kp
+func (n *ng) keyPairFromJSON(bytes []byte, kp interface{}) error {
+	var sealed struct {
+		Encryption string
+	}
+	if err := json.Unmarshal(bytes, &sealed); err != nil {
+		return err
+	}
+	if sealed.Encryption != "" {
+		if n.options.Box == nil {
+			return fmt.Errorf("need secretbox to open sealed data")
+		}
+		sv, err := secret.SealedValueFromJSON(bytes)
+		if err != nil {
+			return err
+		}
+		if bytes, err = n.options.Box.Open(sv); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(bytes, kp)
+}
+
+func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
+	fs, err := n.GetFrontends()
+	if err != nil {
+		return nil, err
+	}
+	usedFs := []engine.Frontend{}
+	for _, f := range fs {
+		if f.UsesBackend(bk.Id) {
+			usedFs = append(usedFs, f)
+		}
+	}
+	return usedFs, nil
+}
+
+// upsert writes the object to the file and emits the event right away, so updates made via the engine
+// are not merged together or missed by the polling. Non zero version has to match the version of the existing file.
+func (n *ng) upsert(p string, v interface{}, version uint64) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// Existing files keep their format, new objects are stored as JSON
+	f, err := n.readFile(p)
+	if err != nil {
+		if !isNotFoundError(err) {
+			return err
+		}
+		f = file{path: p + extJSON}
+	}
+	if err := engine.CheckVersion(p, version, f.version()); err != nil {
+		return err
+	}
+	if f.data, err = fromJSON(f.path, bytes); err != nil {
+		return err
+	}
+	change, err := n.upsertedEvent(p, f)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(n.dir, filepath.FromSlash(f.path)), f.data); err != nil {
+		return err
+	}
+	n.files[p] = f
+	n.emit(change)
+	return nil
+}
+
+func (n *ng) deleteFile(p string, version uint64) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	f, err := n.readFile(p)
+	if err != nil {
+		return err
+	}
+	if err := engine.CheckVersion(p, version, f.version()); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(n.dir, filepath.FromSlash(f.path))); err != nil {
+		return err
+	}
+	delete(n.files, p)
+	n.emit(deletedEvent(p))
+	return nil
+}
+
+// deleteDir deletes the directory with the object and all the objects that belong to it
+func (n *ng) deleteDir(dir, p string, version uint64) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	f, err := n.readFile(p)
+	if err != nil {
+		return err
+	}
+	if err := engine.CheckVersion(p, version, f.version()); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(n.dir, filepath.FromSlash(dir))); err != nil {
+		return err
+	}
+	for fp := range n.files {
+		if strings.HasPrefix(fp, dir+"/") {
+			delete(n.files, fp)
+		}
+	}
+	n.emit(deletedEvent(p))
+	return nil
+}
+
+// readFile reads the object stored at the path in any of the supported formats
+func (n *ng) readFile(p string) (file, error) {
+	for _, ext := range extensions {
+		data, err := ioutil.ReadFile(filepath.Join(n.dir, filepath.FromSlash(p+ext)))
+		if err == nil {
+			return file{path: p + ext, data: data}, nil
+		}
+		if !os.IsNotExist(err) {
+			return file{}, err
+		}
+	}
+	return file{}, &engine.NotFoundError{Message: fmt.Sprintf("%s not found", p)}
+}
+
+// listFiles returns ids of the objects stored as files in the directory
+func (n *ng) listFiles(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(n.dir, filepath.FromSlash(dir)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ids := []string{}
+	for _, fi := range fis {
+		ext := path.Ext(fi.Name())
+		if fi.IsDir() || !isSupported(ext) || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		id := strings.TrimSuffix(fi.Name(), ext)
+		if !contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// listDirs returns ids of the objects stored as directories in the directory
+func (n *ng) listDirs(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(n.dir, filepath.FromSlash(dir)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ids := []string{}
+	for _, fi := range fis {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			ids = append(ids, fi.Name())
+		}
+	}
+	return ids, nil
+}
+
+// writeFile replaces the file atomically, so the readers never see partially written files
+func writeFile(fpath string, data []byte) error {
+	dir, name := filepath.Split(fpath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fpath)
+}
+
+func hostPath(k engine.HostKey) string {
+	return path.Join("hosts", k.Name)
+}
+
+func acmePath(k engine.HostKey) string {
+	return path.Join("acme", k.Name)
+}
+
+// parseACMEPath returns the key of the host the ACME state stored at the path belongs to
+func parseACMEPath(p string) (engine.HostKey, bool) {
+	vals := strings.Split(p, "/")
+	if len(vals) == 2 && vals[0] == "acme" {
+		return engine.HostKey{Name: vals[1]}, true
+	}
+	return engine.HostKey{}, false
+}
+
+// hostsOfACMEStates replaces the paths of the ACME states with the paths of their hosts, the states
+// of the hosts that do not exist are skipped
+func hostsOfACMEStates(paths []string, files map[string]file) []string {
+	out := []string{}
+	for _, p := range paths {
+		if hk, ok := parseACMEPath(p); ok {
+			p = hostPath(hk)
+			if _, ok := files[p]; !ok {
+				continue
+			}
+		}
+		if !contains(out, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func listenerPath(k engine.ListenerKey) string {
+	return path.Join("listeners", k.Id)
+}
+
+func backendPath(k engine.BackendKey) string {
+	return path.Join("backends", k.Id, "backend")
+}
+
+func serverPath(k engine.ServerKey) string {
+	return path.Join("backends", k.BackendKey.Id, "servers", k.Id)
+}
+
+func frontendPath(k engine.FrontendKey) string {
+	return path.Join("frontends", k.Id, "frontend")
+}
+
+func middlewarePath(k engine.MiddlewareKey) string {
+	return path.Join("frontends", k.FrontendKey.Id, "middlewares", k.Id)
+}
+
+// parsePath returns the key of the object stored at the path or nil if the path does not belong to any object
+func parsePath(p string) interface{} {
+	vals := strings.Split(p, "/")
+	switch {
+	case len(vals) == 2 && vals[0] == "hosts":
+		return engine.HostKey{Name: vals[1]}
+	case len(vals) == 2 && vals[0] == "listeners":
+		return engine.ListenerKey{Id: vals[1]}
+	case len(vals) == 3 && vals[0] == "backends" && vals[2] == "backend":
+		return engine.BackendKey{Id: vals[1]}
+	case len(vals) == 4 && vals[0] == "backends" && vals[2] == "servers":
+		return engine.ServerKey{BackendKey: engine.BackendKey{Id: vals[1]}, Id: vals[3]}
+	case len(vals) == 3 && vals[0] == "frontends" && vals[2] == "frontend":
+		return engine.FrontendKey{Id: vals[1]}
+	case len(vals) == 4 && vals[0] == "frontends" && vals[2] == "middlewares":
+		return engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: vals[1]}, Id: vals[3]}
+	}
+	return nil
+}
+
+// parentPath returns the path of the backend or frontend the server or middleware belong to
+func parentPath(p string) string {
+	switch key := parsePath(p).(type) {
+	case engine.ServerKey:
+		return backendPath(key.BackendKey)
+	case engine.MiddlewareKey:
+		return frontendPath(key.FrontendKey)
+	}
+	return ""
+}
+
+// objectPath returns the object path for the file path, e.g. 'hosts/localhost' for 'hosts/localhost.yaml'
+func objectPath(rel string) (string, bool) {
+	ext := path.Ext(rel)
+	if !isSupported(ext) || strings.HasPrefix(path.Base(rel), ".") {
+		return "", false
+	}
+	p := strings.TrimSuffix(rel, ext)
+	if _, ok := parseACMEPath(p); !ok && parsePath(p) == nil {
+		return "", false
+	}
+	return p, true
+}
+
+// dependencyRank defines the order of the updates, so objects are added after the objects they depend on
+func dependencyRank(p string) int {
+	switch parsePath(p).(type) {
+	case engine.HostKey:
+		return 0
+	case engine.ListenerKey:
+		return 1
+	case engine.BackendKey:
+		return 2
+	case engine.ServerKey:
+		return 3
+	case engine.FrontendKey:
+		return 4
+	case engine.MiddlewareKey:
+		return 5
+	}
+	return 6
+}
+
+type byDependency []string
+
+func (s byDependency) Len() int {
+	return len(s)
+}
+
+func (s byDependency) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byDependency) Less(i, j int) bool {
+	ri, rj := dependencyRank(s[i]), dependencyRank(s[j])
+	if ri != rj {
+		return ri < rj
+	}
+	return s[i] < s[j]
+}
+
+func checkId(name, id string) error {
+	if id == "" {
+		return &engine.InvalidFormatError{Message: fmt.Sprintf("%s can not be empty", name)}
+	}
+	if strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return &engine.InvalidFormatError{Message: fmt.Sprintf("%s '%s' can not be used as a file name", name, id)}
+	}
+	return nil
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFoundError(err error) bool {
+	_, ok := err.(*engine.NotFoundError)
+	return ok
+}
+
+func setDefaults(o Options) Options {
+	if o.PollPeriod == 0 {
+		o.PollPeriod = time.Second
+	}
+	return o
+}
+
+type host struct {
+	Name     string
+	Settings hostSettings
+}
+
+type hostSettings struct {
+	Default       bool
+	KeyPair       json.RawMessage `json:",omitempty"`
+	KeyPairs      json.RawMessage `json:",omitempty"`
+	OCSP          engine.OCSPSettings
+	Passthrough   *engine.HostPassthrough `json:",omitempty"`
+	ErrorPages    *engine.ErrorPages      `json:",omitempty"`
+	Maintenance   *engine.Maintenance     `json:",omitempty"`
+	HTTPSRedirect *engine.HTTPSRedirect   `json:",omitempty"`
+	ACME          *engine.HostACME        `json:",omitempty"`
+}
+
+// acmeState is the ACME state of the host with the KeyPair issued sealed like the KeyPair of the host
+type acmeState struct {
+	engine.ACMEState
+	KeyPair json.RawMessage `json:",omitempty"`
+}
@@ -0,0 +1,295 @@
+package fsng
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/engine/test"
+	"github.com/mailgun/vulcand/plugin/registry"
+	"github.com/mailgun/vulcand/secret"
+
+	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestFs(t *testing.T) { TestingT(t) }
+
+type FsSuite struct {
+	ng    *ng
+	dir   string
+	suite test.EngineSuite
+	stopC chan bool
+}
+
+var _ = Suite(&FsSuite{})
+
+func (s *FsSuite) SetUpSuite(c *C) {
+	log.Init([]*log.LogConfig{&log.LogConfig{Name: "console"}})
+}
+
+func (s *FsSuite) SetUpTest(c *C) {
+	key, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+
+	box, err := secret.NewBoxFromKeyString(key)
+	c.Assert(err, IsNil)
+
+	s.dir = c.MkDir()
+	e, err := New(s.dir, registry.GetRegistry(), Options{PollPeriod: 10 * time.Millisecond, Box: box})
+	c.Assert(err, IsNil)
+	s.ng = e.(*ng)
+
+	s.suite.ChangesC = make(chan interface{})
+	s.stopC = make(chan bool)
+	go e.Subscribe(s.suite.ChangesC, s.stopC)
+	s.suite.Engine = e
+}
+
+func (s *FsSuite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.suite.Engine.Close()
+}
+
+func (s *FsSuite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *FsSuite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *FsSuite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *FsSuite) TestHostWithKeyPairs(c *C) {
+	s.suite.HostWithKeyPairs(c)
+}
+
+func (s *FsSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
+func (s *FsSuite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *FsSuite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *FsSuite) TestHostWithPassthrough(c *C) {
+	s.suite.HostWithPassthrough(c)
+}
+
+func (s *FsSuite) TestHostWithErrorPages(c *C) {
+	s.suite.HostWithErrorPages(c)
+}
+
+func (s *FsSuite) TestHostWithMaintenance(c *C) {
+	s.suite.HostWithMaintenance(c)
+}
+
+func (s *FsSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
+func (s *FsSuite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *FsSuite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *FsSuite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *FsSuite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *FsSuite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *FsSuite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *FsSuite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *FsSuite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *FsSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *FsSuite) TestTCPFrontendCRUD(c *C) {
+	s.suite.TCPFrontendCRUD(c)
+}
+
+func (s *FsSuite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *FsSuite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *FsSuite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+func (s *FsSuite) TestVersionConflict(c *C) {
+	s.suite.VersionConflict(c)
+}
+
+func (s *FsSuite) TestBatchCRUD(c *C) {
+	s.suite.BatchCRUD(c)
+}
+
+func (s *FsSuite) TestBatchRollback(c *C) {
+	s.suite.BatchRollback(c)
+}
+
+func (s *FsSuite) TestInvalidIds(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "../etc"}), FitsTypeOf, &engine.InvalidFormatError{})
+	c.Assert(s.ng.UpsertListener(engine.Listener{Id: ".hidden"}), FitsTypeOf, &engine.InvalidFormatError{})
+}
+
+func (s *FsSuite) TestFilesChanged(c *C) {
+	s.writeFile(c, "backends/b1/backend.yaml", "Type: http\n")
+	s.writeFile(c, "backends/b1/servers/s1.yml", "URL: http://localhost:5000\n")
+	s.writeFile(c, "frontends/f1/frontend.json", `{"Type": "http", "BackendId": "b1", "Route": "Path(\"/\")"}`)
+
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	srv, err := engine.NewServer("s1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+	f, err := engine.NewHTTPFrontend("f1", "b1", `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+
+	s.expectChanges(c,
+		&engine.BackendUpserted{Backend: *b},
+		&engine.ServerUpserted{BackendKey: engine.BackendKey{Id: "b1"}, Server: *srv},
+		&engine.FrontendUpserted{Frontend: *f},
+	)
+
+	fs, err := s.ng.GetFrontends()
+	c.Assert(err, IsNil)
+	c.Assert(fs, test.VersionedEquals, []engine.Frontend{*f})
+
+	srvs, err := s.ng.GetServers(engine.BackendKey{Id: "b1"})
+	c.Assert(err, IsNil)
+	c.Assert(srvs, test.VersionedEquals, []engine.Server{*srv})
+
+	// Updates of the file content are detected
+	s.writeFile(c, "backends/b1/servers/s1.yml", "URL: http://localhost:5001\n")
+	srv, err = engine.NewServer("s1", "http://localhost:5001")
+	c.Assert(err, IsNil)
+	s.expectChanges(c, &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: "b1"}, Server: *srv})
+
+	// Deleting the backend deletes all the servers as well
+	c.Assert(os.RemoveAll(filepath.Join(s.dir, "frontends", "f1")), IsNil)
+	c.Assert(os.RemoveAll(filepath.Join(s.dir, "backends", "b1")), IsNil)
+	s.expectChanges(c,
+		&engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: "f1"}},
+		&engine.BackendDeleted{BackendKey: engine.BackendKey{Id: "b1"}},
+	)
+}
+
+func (s *FsSuite) TestACMEStateChanged(c *C) {
+	s.writeFile(c, "hosts/example.com.yaml", "Settings:\n  ACME:\n    Enabled: true\n")
+	host := engine.Host{Name: "example.com", Settings: engine.HostSettings{ACME: &engine.HostACME{Enabled: true}}}
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	// Changes of the state made by other instances sharing the directory upsert the host
+	s.writeFile(c, "acme/example.com.json", `{"Challenges": {"token": "token.thumbprint"}}`)
+	out, err := s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(out.ACME.Challenges, DeepEquals, map[string]string{"token": "token.thumbprint"})
+	host.ACME = out.ACME
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	c.Assert(os.Remove(filepath.Join(s.dir, "acme", "example.com.json")), IsNil)
+	host.ACME = nil
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	// The state of the host that does not exist is ignored
+	s.writeFile(c, "acme/other.com.json", `{"LastError": "failed"}`)
+	s.writeFile(c, "listeners/l1.yaml", "Protocol: http\nAddress:\n  Network: tcp\n  Address: 127.0.0.1:9000\n")
+	l, err := engine.NewListener("l1", "http", "tcp", "127.0.0.1:9000", "", nil)
+	c.Assert(err, IsNil)
+	s.expectChanges(c, &engine.ListenerUpserted{Listener: *l})
+}
+
+func (s *FsSuite) TestBadFileIgnored(c *C) {
+	s.writeFile(c, "listeners/l1.json", "{bad json")
+	s.writeFile(c, "listeners/l2.yaml", "Protocol: http\nAddress:\n  Network: tcp\n  Address: 127.0.0.1:9000\n")
+
+	l, err := engine.NewListener("l2", "http", "tcp", "127.0.0.1:9000", "", nil)
+	c.Assert(err, IsNil)
+	s.expectChanges(c, &engine.ListenerUpserted{Listener: *l})
+
+	_, err = s.ng.GetListener(engine.ListenerKey{Id: "l1"})
+	c.Assert(err, NotNil)
+}
+
+func (s *FsSuite) TestUpsertKeepsFormat(c *C) {
+	s.writeFile(c, "hosts/localhost.yaml", "Settings:\n  Default: false\n")
+	s.expectChanges(c, &engine.HostUpserted{Host: engine.Host{Name: "localhost"}})
+
+	host := engine.Host{Name: "localhost", Settings: engine.HostSettings{Default: true}}
+	c.Assert(s.ng.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	_, err := os.Stat(filepath.Join(s.dir, "hosts", "localhost.json"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	out, err := s.ng.GetHost(engine.HostKey{Name: "localhost"})
+	c.Assert(err, IsNil)
+	c.Assert(out, test.VersionedEquals, &host)
+}
+
+func (s *FsSuite) TestKeyPairWithoutBox(c *C) {
+	ng, err := New(c.MkDir(), registry.GetRegistry(), Options{})
+	c.Assert(err, IsNil)
+
+	host := engine.Host{Name: "localhost"}
+	host.Settings.KeyPair = &engine.KeyPair{
+		Key:  []byte("hello"),
+		Cert: []byte("world"),
+	}
+	c.Assert(ng.UpsertHost(host), IsNil)
+
+	out, err := ng.GetHost(engine.HostKey{Name: "localhost"})
+	c.Assert(err, IsNil)
+	c.Assert(out, test.VersionedEquals, &host)
+}
+
+func (s *FsSuite) writeFile(c *C, name, data string) {
+	path := filepath.Join(s.dir, filepath.FromSlash(name))
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0644), IsNil)
+}
+
+func (s *FsSuite) expectChanges(c *C, expected ...interface{}) {
+	for _, e := range expected {
+		select {
+		case change := <-s.suite.ChangesC:
+			c.Assert(change, DeepEquals, e)
+		case <-time.After(2 * time.Second):
+			c.Fatalf("Timeout waiting for %v", e)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Revision is a group of changes applied to the engine along with the changes restoring the previous state
+type Revision struct {
+	Id   int64
+	Time time.Time
+	// Changes are the upsert and delete events applied in this revision
+	Changes []interface{}
+	// Previous are the events restoring the state before this revision, in the order they have to be applied
+	Previous []interface{}
+	// versions are the versions of the objects modified by this revision right after the changes, 0 if the object
+	// has been deleted. Rollback is refused if the objects have been modified since, e.g. by the other instances.
+	versions map[interface{}]uint64
+}
+
+func (r *Revision) String() string {
+	return fmt.Sprintf("Revision(id=%d, time=%v, changes=%v)", r.Id, r.Time, r.Changes)
+}
+
+// Versioned is the engine that assigns a monotonically increasing revision to every change
+// and keeps the bounded history of the previous values
+type Versioned interface {
+	Engine
+
+	// GetRevision returns the revision of the last change, or the revision of the initial state if there are no changes
+	GetRevision() int64
+
+	// GetHistory returns the revisions kept in the history, the oldest first
+	GetHistory() ([]Revision, error)
+
+	// Rollback restores the state as of the given revision. The rollback is applied as a batch
+	// and recorded as a new revision, so it can be rolled back as well. Returns ConflictError if the objects
+	// restored have been modified since the revisions rolled back, e.g. by other vulcand instances.
+	Rollback(revision int64) error
+}
+
+// NewVersioned returns the engine recording the changes made via the given engine and keeping the last size revisions.
+// The history is kept in memory of this instance, so only the changes made via this instance are recorded and the history
+// is lost on restart. Revisions are numbered from the start time of the instance in nanoseconds, so the revisions
+// recorded before the restart or by the other instances are not mistaken for the revisions of this one, and the rollback
+// to them is refused. The changes made elsewhere are detected by the object versions, and the rollback overwriting them
+// is refused as well. Upserts with TTL are not recorded as such objects are kept alive by heartbeats and expire on their own.
+func NewVersioned(e Engine, size int) Versioned {
+	start := time.Now().UnixNano()
+	return &versioned{
+		Engine:   e,
+		size:     size,
+		mtx:      &sync.Mutex{},
+		start:    start,
+		revision: start,
+	}
+}
+
+type versioned struct {
+	Engine
+	size int
+
+	mtx *sync.Mutex
+	// start is the revision of the state the instance has started with
+	start    int64
+	revision int64
+	history  []Revision
+}
+
+func (v *versioned) GetRevision() int64 {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	return v.revision
+}
+
+func (v *versioned) GetHistory() ([]Revision, error) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	out := make([]Revision, len(v.history))
+	copy(out, v.history)
+	return out, nil
+}
+
+func (v *versioned) Rollback(revision int64) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if revision == v.revision {
+		return nil
+	}
+	if revision > v.revision {
+		return &NotFoundError{Message: fmt.Sprintf("revision %d not found", revision)}
+	}
+	if revision < v.start {
+		return &NotFoundError{Message: fmt.Sprintf("revision %d precedes the start of this instance, the history is kept per instance", revision)}
+	}
+	if len(v.history) == 0 || v.history[0].Id > revision+1 {
+		return &NotFoundError{Message: fmt.Sprintf("revision %d is not in the history", revision)}
+	}
+	changes := []interface{}{}
+	expected := map[interface{}]uint64{}
+	for i := len(v.history) - 1; i >= 0 && v.history[i].Id > revision; i-- {
+		changes = append(changes, v.history[i].Previous...)
+		// The latest revision modifying the object sets the version expected
+		for key, version := range v.history[i].versions {
+			if _, ok := expected[key]; !ok {
+				expected[key] = version
+			}
+		}
+	}
+	for key, version := range expected {
+		current, err := objectVersion(v.Engine, key)
+		if err != nil {
+			return err
+		}
+		if current != version {
+			return &ConflictError{Message: fmt.Sprintf("%v has been modified outside of the history, version %d does not match the current version %d", key, version, current)}
+		}
+	}
+	return v.record(changes, func() error { return v.Engine.ApplyBatch(changes) })
+}
+
+func (v *versioned) UpsertHost(h Host) error {
+	return v.apply(&HostUpserted{Host: h})
+}
+
+func (v *versioned) DeleteHost(hk HostKey, version uint64) error {
+	return v.applyFn(&HostDeleted{HostKey: hk}, func() error { return v.Engine.DeleteHost(hk, version) })
+}
+
+func (v *versioned) UpsertListener(l Listener) error {
+	return v.apply(&ListenerUpserted{Listener: l})
+}
+
+func (v *versioned) DeleteListener(lk ListenerKey, version uint64) error {
+	return v.applyFn(&ListenerDeleted{ListenerKey: lk}, func() error { return v.Engine.DeleteListener(lk, version) })
+}
+
+func (v *versioned) UpsertFrontend(f Frontend, ttl time.Duration) error {
+	if ttl != 0 {
+		return v.Engine.UpsertFrontend(f, ttl)
+	}
+	return v.apply(&FrontendUpserted{Frontend: f})
+}
+
+func (v *versioned) DeleteFrontend(fk FrontendKey, version uint64) error {
+	return v.applyFn(&FrontendDeleted{FrontendKey: fk}, func() error { return v.Engine.DeleteFrontend(fk, version) })
+}
+
+func (v *versioned) UpsertMiddleware(fk FrontendKey, m Middleware, ttl time.Duration) error {
+	if ttl != 0 {
+		return v.Engine.UpsertMiddleware(fk, m, ttl)
+	}
+	return v.apply(&MiddlewareUpserted{FrontendKey: fk, Middleware: m})
+}
+
+func (v *versioned) DeleteMiddleware(mk MiddlewareKey, version uint64) error {
+	return v.applyFn(&MiddlewareDeleted{MiddlewareKey: mk}, func() error { return v.Engine.DeleteMiddleware(mk, version) })
+}
+
+func (v *versioned) UpsertBackend(b Backend) error {
+	return v.apply(&BackendUpserted{Backend: b})
+}
+
+func (v *versioned) DeleteBackend(bk BackendKey, version uint64) error {
+	return v.applyFn(&BackendDeleted{BackendKey: bk}, func() error { return v.Engine.DeleteBackend(bk, version) })
+}
+
+func (v *versioned) UpsertServer(bk BackendKey, s Server, ttl time.Duration) error {
+	if ttl != 0 {
+		return v.Engine.UpsertServer(bk, s, ttl)
+	}
+	return v.apply(&ServerUpserted{BackendKey: bk, Server: s})
+}
+
+func (v *versioned) DeleteServer(sk ServerKey, version uint64) error {
+	return v.applyFn(&ServerDeleted{ServerKey: sk}, func() error { return v.Engine.DeleteServer(sk, version) })
+}
+
+func (v *versioned) ApplyBatch(changes []interface{}) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	return v.record(changes, func() error { return v.Engine.ApplyBatch(changes) })
+}
+
+func (v *versioned) apply(change interface{}) error {
+	return v.applyFn(change, func() error { return ApplyChange(v.Engine, change) })
+}
+
+func (v *versioned) applyFn(change interface{}, fn func() error) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	return v.record([]interface{}{change}, fn)
+}
+
+// record captures the previous state of the objects modified by the changes, applies them and adds the new revision
+// to the history. It is called with the mutex held.
+func (v *versioned) record(changes []interface{}, apply func() error) error {
+	previous, err := previousState(v.Engine, changes)
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	versions := map[interface{}]uint64{}
+	for _, change := range changes {
+		key := changeKey(change)
+		if key == nil {
+			continue
+		}
+		if versions[key], err = objectVersion(v.Engine, key); err != nil {
+			return err
+		}
+	}
+	v.revision += 1
+	v.history = append(v.history, Revision{
+		Id:       v.revision,
+		Time:     time.Now().UTC(),
+		Changes:  changes,
+		Previous: previous,
+		versions: versions,
+	})
+	if len(v.history) > v.size {
+		v.history = v.history[len(v.history)-v.size:]
+	}
+	return nil
+}
+
+// previousState returns the changes restoring the state of the objects modified by the changes. Only the first change
+// of every object is taken into account, as the later ones do not see the state before the changes.
+func previousState(e Engine, changes []interface{}) ([]interface{}, error) {
+	seen := map[interface{}]bool{}
+	undo := []interface{}{}
+	for _, change := range changes {
+		key := changeKey(change)
+		if key != nil && seen[key] {
+			continue
+		}
+		seen[key] = true
+		revert, err := revertChanges(e, change)
+		if err != nil {
+			return nil, err
+		}
+		undo = append(undo, revert...)
+	}
+	out := make([]interface{}, len(undo))
+	for i, change := range undo {
+		out[len(undo)-1-i] = change
+	}
+	return out, nil
+}
+
+// objectVersion returns the current version of the object with the key, 0 if the object does not exist
+func objectVersion(e Engine, key interface{}) (uint64, error) {
+	var version uint64
+	var err error
+	switch k := key.(type) {
+	case HostKey:
+		var h *Host
+		if h, err = e.GetHost(k); err == nil {
+			version = h.Version
+		}
+	case ListenerKey:
+		var l *Listener
+		if l, err = e.GetListener(k); err == nil {
+			version = l.Version
+		}
+	case BackendKey:
+		var b *Backend
+		if b, err = e.GetBackend(k); err == nil {
+			version = b.Version
+		}
+	case ServerKey:
+		var s *Server
+		if s, err = e.GetServer(k); err == nil {
+			version = s.Version
+		}
+	case FrontendKey:
+		var f *Frontend
+		if f, err = e.GetFrontend(k); err == nil {
+			version = f.Version
+		}
+	case MiddlewareKey:
+		var m *Middleware
+		if m, err = e.GetMiddleware(k); err == nil {
+			version = m.Version
+		}
+	default:
+		return 0, &InvalidFormatError{Message: fmt.Sprintf("unsupported key: %v", key)}
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return version, nil
+}
+
+// changeKey returns the key of the object modified by the change
+func changeKey(change interface{}) interface{} {
+	switch c := change.(type) {
+	case *HostUpserted:
+		return HostKey{Name: c.Host.Name}
+	case *HostDeleted:
+		return c.HostKey
+	case *ListenerUpserted:
+		return ListenerKey{Id: c.Listener.Id}
+	case *ListenerDeleted:
+		return c.ListenerKey
+	case *BackendUpserted:
+		return BackendKey{Id: c.Backend.Id}
+	case *BackendDeleted:
+		return c.BackendKey
+	case *ServerUpserted:
+		return ServerKey{BackendKey: c.BackendKey, Id: c.Server.Id}
+	case *ServerDeleted:
+		return c.ServerKey
+	case *FrontendUpserted:
+		return FrontendKey{Id: c.Frontend.Id}
+	case *FrontendDeleted:
+		return c.FrontendKey
+	case *MiddlewareUpserted:
+		return MiddlewareKey{FrontendKey: c.FrontendKey, Id: c.Middleware.Id}
+	case *MiddlewareDeleted:
+		return c.MiddlewareKey
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package engine
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/mailgun/vulcand/plugin"
 )
@@ -38,6 +39,7 @@ type rawFrontend struct {
 	BackendId string
 	Settings  json.RawMessage
 	Stats     *RoundTripStats
+	Version   uint64
 }
 
 type rawBackend struct {
@@ -45,6 +47,7 @@ type rawBackend struct {
 	Type     string
 	Settings json.RawMessage
 	Stats    *RoundTripStats
+	Version  uint64
 }
 
 type RawMiddleware struct {
@@ -52,6 +55,7 @@ type RawMiddleware struct {
 	Type       string
 	Priority   int
 	Middleware json.RawMessage
+	Version    uint64
 }
 
 func HostsFromJSON(in []byte) ([]Host, error) {
@@ -99,7 +103,12 @@ func HostFromJSON(in []byte, name ...string) (*Host, error) {
 	if len(name) != 0 {
 		h.Name = name[0]
 	}
-	return NewHost(h.Name, h.Settings)
+	out, err := NewHost(h.Name, h.Settings)
+	if err != nil {
+		return nil, err
+	}
+	out.ACME, out.Version = h.ACME, h.Version
+	return out, nil
 }
 
 func ListenerFromJSON(in []byte, id ...string) (*Listener, error) {
@@ -116,7 +125,18 @@ func ListenerFromJSON(in []byte, id ...string) (*Listener, error) {
 			return nil, err
 		}
 	}
-	return NewListener(rl.Id, rl.Protocol, rl.Address.Network, rl.Address.Address, rl.Scope, rl.Settings)
+	if rl.ProxyProtocol != nil {
+		if _, err = rl.ProxyProtocol.TrustedNets(); err != nil {
+			return nil, err
+		}
+	}
+	l, err := NewListener(rl.Id, rl.Protocol, rl.Address.Network, rl.Address.Address, rl.Scope, rl.Settings)
+	if err != nil {
+		return nil, err
+	}
+	l.ProxyProtocol = rl.ProxyProtocol
+	l.Version = rl.Version
+	return l, nil
 }
 
 func ListenersFromJSON(in []byte) ([]Listener, error) {
@@ -152,23 +172,36 @@ func FrontendFromJSON(in []byte, id ...string) (*Frontend, error) {
 	if err := json.Unmarshal(in, &rf); err != nil {
 		return nil, err
 	}
-	if rf.Type != HTTP {
-		return nil, fmt.Errorf("Unsupported frontend type: %v", rf.Type)
-	}
-	var s HTTPFrontendSettings
-	if rf.Settings != nil {
-		if err := json.Unmarshal(rf.Settings, &s); err != nil {
-			return nil, err
-		}
-	}
 	if len(id) != 0 {
 		rf.Id = id[0]
 	}
-	f, err := NewHTTPFrontend(rf.Id, rf.BackendId, rf.Route, s)
+	var f *Frontend
+	var err error
+	switch rf.Type {
+	case HTTP:
+		var s HTTPFrontendSettings
+		if rf.Settings != nil {
+			if err := json.Unmarshal(rf.Settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		f, err = NewHTTPFrontend(rf.Id, rf.BackendId, rf.Route, s)
+	case TCP:
+		var s TCPFrontendSettings
+		if rf.Settings != nil {
+			if err := json.Unmarshal(rf.Settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		f, err = NewTCPFrontend(rf.Id, rf.BackendId, s)
+	default:
+		return nil, fmt.Errorf("Unsupported frontend type: %v", rf.Type)
+	}
 	if err != nil {
 		return nil, err
 	}
 	f.Stats = rf.Stats
+	f.Version = rf.Version
 	return f, nil
 }
 
@@ -194,6 +227,7 @@ func MiddlewareFromJSON(in []byte, getter plugin.SpecGetter, id ...string) (*Mid
 		Type:       ms.Type,
 		Middleware: m,
 		Priority:   ms.Priority,
+		Version:    ms.Version,
 	}, nil
 }
 
@@ -222,29 +256,41 @@ func BackendFromJSON(in []byte, id ...string) (*Backend, error) {
 	if err := json.Unmarshal(in, &rb); err != nil {
 		return nil, err
 	}
-	if rb.Type != HTTP {
-		return nil, fmt.Errorf("Unsupported backend type %v", rb.Type)
+	if len(id) != 0 {
+		rb.Id = id[0]
 	}
-
-	var s HTTPBackendSettings
-	if rb.Settings != nil {
-		if err := json.Unmarshal(rb.Settings, &s); err != nil {
-			return nil, err
+	var b *Backend
+	var err error
+	switch rb.Type {
+	case HTTP:
+		var s HTTPBackendSettings
+		if rb.Settings != nil {
+			if err := json.Unmarshal(rb.Settings, &s); err != nil {
+				return nil, err
+			}
 		}
-	}
-	if s.TLS != nil {
-		if _, err := NewTLSConfig(s.TLS); err != nil {
-			return nil, err
+		if s.TLS != nil {
+			if _, err := NewTLSConfig(s.TLS); err != nil {
+				return nil, err
+			}
 		}
+		b, err = NewHTTPBackend(rb.Id, s)
+	case TCP:
+		var s TCPBackendSettings
+		if rb.Settings != nil {
+			if err := json.Unmarshal(rb.Settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		b, err = NewTCPBackend(rb.Id, s)
+	default:
+		return nil, fmt.Errorf("Unsupported backend type %v", rb.Type)
 	}
-	if len(id) != 0 {
-		rb.Id = id[0]
-	}
-	b, err := NewHTTPBackend(rb.Id, s)
 	if err != nil {
 		return nil, err
 	}
 	b.Stats = rb.Stats
+	b.Version = rb.Version
 	return b, nil
 }
 
@@ -295,5 +341,370 @@ func ServerFromJSON(in []byte, id ...string) (*Server, error) {
 	if len(id) != 0 {
 		e.Id = id[0]
 	}
-	return NewServer(e.Id, e.URL)
+	s, err := NewWeightedServer(e.Id, e.URL, e.Weight)
+	if err != nil {
+		return nil, err
+	}
+	s.Version = e.Version
+	return s, nil
+}
+
+// rawChange is a JSON representation of the upsert or delete event, where Type is the name of the event, e.g. HostUpserted
+type rawChange struct {
+	Type          string
+	Host          json.RawMessage
+	HostKey       *HostKey
+	Listener      json.RawMessage
+	ListenerKey   *ListenerKey
+	Backend       json.RawMessage
+	BackendKey    *BackendKey
+	Server        json.RawMessage
+	ServerKey     *ServerKey
+	Frontend      json.RawMessage
+	FrontendKey   *FrontendKey
+	Middleware    json.RawMessage
+	MiddlewareKey *MiddlewareKey
+}
+
+type rawChanges struct {
+	Changes []json.RawMessage
+}
+
+// ChangeToJSON marshals the upsert or delete event adding the Type field with the name of the event
+func ChangeToJSON(change interface{}) ([]byte, error) {
+	t, err := changeType(change)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &fields); err != nil {
+		return nil, err
+	}
+	if fields["Type"], err = json.Marshal(t); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+func ChangesFromJSON(in []byte, getter plugin.SpecGetter) ([]interface{}, error) {
+	var rc *rawChanges
+	if err := json.Unmarshal(in, &rc); err != nil {
+		return nil, err
+	}
+	out := []interface{}{}
+	if rc == nil {
+		return out, nil
+	}
+	for _, raw := range rc.Changes {
+		change, err := ChangeFromJSON(raw, getter)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, change)
+	}
+	return out, nil
+}
+
+func ChangeFromJSON(in []byte, getter plugin.SpecGetter) (interface{}, error) {
+	var rc *rawChange
+	if err := json.Unmarshal(in, &rc); err != nil {
+		return nil, err
+	}
+	if rc == nil {
+		return nil, &InvalidFormatError{Message: "change can not be empty"}
+	}
+	switch rc.Type {
+	case "HostUpserted":
+		if len(rc.Host) == 0 {
+			return nil, &InvalidFormatError{Message: "missing Host"}
+		}
+		h, err := HostFromJSON(rc.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &HostUpserted{Host: *h}, nil
+	case "HostDeleted":
+		if rc.HostKey == nil {
+			return nil, &InvalidFormatError{Message: "missing HostKey"}
+		}
+		return &HostDeleted{HostKey: *rc.HostKey}, nil
+	case "ListenerUpserted":
+		if len(rc.Listener) == 0 {
+			return nil, &InvalidFormatError{Message: "missing Listener"}
+		}
+		l, err := ListenerFromJSON(rc.Listener)
+		if err != nil {
+			return nil, err
+		}
+		return &ListenerUpserted{Listener: *l}, nil
+	case "ListenerDeleted":
+		if rc.ListenerKey == nil {
+			return nil, &InvalidFormatError{Message: "missing ListenerKey"}
+		}
+		return &ListenerDeleted{ListenerKey: *rc.ListenerKey}, nil
+	case "BackendUpserted":
+		if len(rc.Backend) == 0 {
+			return nil, &InvalidFormatError{Message: "missing Backend"}
+		}
+		b, err := BackendFromJSON(rc.Backend)
+		if err != nil {
+			return nil, err
+		}
+		return &BackendUpserted{Backend: *b}, nil
+	case "BackendDeleted":
+		if rc.BackendKey == nil {
+			return nil, &InvalidFormatError{Message: "missing BackendKey"}
+		}
+		return &BackendDeleted{BackendKey: *rc.BackendKey}, nil
+	case "ServerUpserted":
+		if len(rc.Server) == 0 || rc.BackendKey == nil {
+			return nil, &InvalidFormatError{Message: "missing Server or BackendKey"}
+		}
+		s, err := ServerFromJSON(rc.Server)
+		if err != nil {
+			return nil, err
+		}
+		return &ServerUpserted{BackendKey: *rc.BackendKey, Server: *s}, nil
+	case "ServerDeleted":
+		if rc.ServerKey == nil {
+			return nil, &InvalidFormatError{Message: "missing ServerKey"}
+		}
+		return &ServerDeleted{ServerKey: *rc.ServerKey}, nil
+	case "FrontendUpserted":
+		if len(rc.Frontend) == 0 {
+			return nil, &InvalidFormatError{Message: "missing Frontend"}
+		}
+		f, err := FrontendFromJSON(rc.Frontend)
+		if err != nil {
+			return nil, err
+		}
+		return &FrontendUpserted{Frontend: *f}, nil
+	case "FrontendDeleted":
+		if rc.FrontendKey == nil {
+			return nil, &InvalidFormatError{Message: "missing FrontendKey"}
+		}
+		return &FrontendDeleted{FrontendKey: *rc.FrontendKey}, nil
+	case "MiddlewareUpserted":
+		if len(rc.Middleware) == 0 || rc.FrontendKey == nil {
+			return nil, &InvalidFormatError{Message: "missing Middleware or FrontendKey"}
+		}
+		m, err := MiddlewareFromJSON(rc.Middleware, getter)
+		if err != nil {
+			return nil, err
+		}
+		return &MiddlewareUpserted{FrontendKey: *rc.FrontendKey, Middleware: *m}, nil
+	case "MiddlewareDeleted":
+		if rc.MiddlewareKey == nil {
+			return nil, &InvalidFormatError{Message: "missing MiddlewareKey"}
+		}
+		return &MiddlewareDeleted{MiddlewareKey: *rc.MiddlewareKey}, nil
+	}
+	return nil, &InvalidFormatError{Message: fmt.Sprintf("unsupported change type: '%v'", rc.Type)}
+}
+
+func changeType(change interface{}) (string, error) {
+	switch change.(type) {
+	case *HostUpserted:
+		return "HostUpserted", nil
+	case *HostDeleted:
+		return "HostDeleted", nil
+	case *ListenerUpserted:
+		return "ListenerUpserted", nil
+	case *ListenerDeleted:
+		return "ListenerDeleted", nil
+	case *BackendUpserted:
+		return "BackendUpserted", nil
+	case *BackendDeleted:
+		return "BackendDeleted", nil
+	case *ServerUpserted:
+		return "ServerUpserted", nil
+	case *ServerDeleted:
+		return "ServerDeleted", nil
+	case *FrontendUpserted:
+		return "FrontendUpserted", nil
+	case *FrontendDeleted:
+		return "FrontendDeleted", nil
+	case *MiddlewareUpserted:
+		return "MiddlewareUpserted", nil
+	case *MiddlewareDeleted:
+		return "MiddlewareDeleted", nil
+	}
+	return "", &InvalidFormatError{Message: fmt.Sprintf("unsupported change: %v", change)}
+}
+
+type rawRevision struct {
+	Id       int64
+	Time     time.Time
+	Changes  []json.RawMessage
+	Previous []json.RawMessage
+}
+
+type rawRevisions struct {
+	Revisions []json.RawMessage
+}
+
+// MarshalJSON marshals the changes of the revision along with their types, so they can be read by RevisionFromJSON
+func (r Revision) MarshalJSON() ([]byte, error) {
+	changes, err := changesToJSON(r.Changes)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := changesToJSON(r.Previous)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rawRevision{Id: r.Id, Time: r.Time, Changes: changes, Previous: previous})
+}
+
+func RevisionsFromJSON(in []byte, getter plugin.SpecGetter) ([]Revision, error) {
+	var rr *rawRevisions
+	if err := json.Unmarshal(in, &rr); err != nil {
+		return nil, err
+	}
+	out := []Revision{}
+	if rr == nil {
+		return out, nil
+	}
+	for _, raw := range rr.Revisions {
+		r, err := RevisionFromJSON(raw, getter)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *r)
+	}
+	return out, nil
+}
+
+func RevisionFromJSON(in []byte, getter plugin.SpecGetter) (*Revision, error) {
+	var rr *rawRevision
+	if err := json.Unmarshal(in, &rr); err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, &InvalidFormatError{Message: "revision can not be empty"}
+	}
+	r := &Revision{Id: rr.Id, Time: rr.Time, Changes: []interface{}{}, Previous: []interface{}{}}
+	for _, raw := range rr.Changes {
+		change, err := ChangeFromJSON(raw, getter)
+		if err != nil {
+			return nil, err
+		}
+		r.Changes = append(r.Changes, change)
+	}
+	for _, raw := range rr.Previous {
+		change, err := ChangeFromJSON(raw, getter)
+		if err != nil {
+			return nil, err
+		}
+		r.Previous = append(r.Previous, change)
+	}
+	return r, nil
+}
+
+func changesToJSON(changes []interface{}) ([]json.RawMessage, error) {
+	out := make([]json.RawMessage, len(changes))
+	for i, change := range changes {
+		data, err := ChangeToJSON(change)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = data
+	}
+	return out, nil
+}
+
+type rawConfig struct {
+	Hosts     []json.RawMessage
+	Listeners []json.RawMessage
+	Backends  []rawBackendConfig
+	Frontends []rawFrontendConfig
+}
+
+type rawBackendConfig struct {
+	Backend json.RawMessage
+	Servers []json.RawMessage
+}
+
+type rawFrontendConfig struct {
+	Frontend    json.RawMessage
+	Middlewares []json.RawMessage
+}
+
+// ConfigFromJSON reads the configuration exported with ReadConfig. Versions are not the part of the configuration,
+// so they are ignored.
+func ConfigFromJSON(in []byte, getter plugin.SpecGetter) (*Config, error) {
+	var rc *rawConfig
+	if err := json.Unmarshal(in, &rc); err != nil {
+		return nil, err
+	}
+	cfg := &Config{
+		Hosts:     []Host{},
+		Listeners: []Listener{},
+		Backends:  []BackendConfig{},
+		Frontends: []FrontendConfig{},
+	}
+	if rc == nil {
+		return cfg, nil
+	}
+	for _, raw := range rc.Hosts {
+		h, err := HostFromJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		h.Version = 0
+		cfg.Hosts = append(cfg.Hosts, *h)
+	}
+	for _, raw := range rc.Listeners {
+		l, err := ListenerFromJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		l.Version = 0
+		cfg.Listeners = append(cfg.Listeners, *l)
+	}
+	for _, rb := range rc.Backends {
+		if len(rb.Backend) == 0 {
+			return nil, &InvalidFormatError{Message: "missing Backend"}
+		}
+		b, err := BackendFromJSON(rb.Backend)
+		if err != nil {
+			return nil, err
+		}
+		b.Version, b.Stats = 0, nil
+		bc := BackendConfig{Backend: *b, Servers: []Server{}}
+		for _, raw := range rb.Servers {
+			s, err := ServerFromJSON(raw)
+			if err != nil {
+				return nil, err
+			}
+			s.Version, s.Stats = 0, nil
+			bc.Servers = append(bc.Servers, *s)
+		}
+		cfg.Backends = append(cfg.Backends, bc)
+	}
+	for _, rf := range rc.Frontends {
+		if len(rf.Frontend) == 0 {
+			return nil, &InvalidFormatError{Message: "missing Frontend"}
+		}
+		f, err := FrontendFromJSON(rf.Frontend)
+		if err != nil {
+			return nil, err
+		}
+		f.Version, f.Stats = 0, nil
+		fc := FrontendConfig{Frontend: *f, Middlewares: []Middleware{}}
+		for _, raw := range rf.Middlewares {
+			m, err := MiddlewareFromJSON(raw, getter)
+			if err != nil {
+				return nil, err
+			}
+			m.Version = 0
+			fc.Middlewares = append(fc.Middlewares, *m)
+		}
+		cfg.Frontends = append(cfg.Frontends, fc)
+	}
+	return cfg, nil
 }
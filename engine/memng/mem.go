@@ -24,6 +24,11 @@ type Mem struct {
 	Registry *plugin.Registry
 	ChangesC chan interface{}
 	ErrorsC  chan error
+
+	// batch collects the changes while the batch is being applied
+	batch []interface{}
+	// lastVersion is the version assigned to the last upserted object
+	lastVersion uint64
 }
 
 func New(r *plugin.Registry) engine.Engine {
@@ -42,6 +47,10 @@ func New(r *plugin.Registry) engine.Engine {
 }
 
 func (m *Mem) emit(val interface{}) {
+	if m.batch != nil {
+		m.batch = append(m.batch, val)
+		return
+	}
 	select {
 	case m.ChangesC <- val:
 	default:
@@ -72,15 +81,56 @@ func (m *Mem) GetHost(k engine.HostKey) (*engine.Host, error) {
 }
 
 func (m *Mem) UpsertHost(h engine.Host) error {
-	m.Hosts[engine.HostKey{Name: h.Name}] = h
+	hk := engine.HostKey{Name: h.Name}
+	if err := engine.CheckVersion(hk, h.Version, m.Hosts[hk].Version); err != nil {
+		return err
+	}
+	// The state and the KeyPair issued by ACME are kept
+	h.ACME = m.Hosts[hk].ACME
+	if h.ACMEEnabled() {
+		h.Settings.KeyPair = nil
+		if h.ACME != nil {
+			h.Settings.KeyPair = h.ACME.KeyPair
+		}
+	}
+	h.Version = 0
+	m.emit(&engine.HostUpserted{Host: h})
+	h.Version = m.nextVersion()
+	m.Hosts[hk] = h
+	return nil
+}
+
+func (m *Mem) UpsertACMEState(hk engine.HostKey, st engine.ACMEState) error {
+	h, ok := m.Hosts[hk]
+	if !ok {
+		return &engine.NotFoundError{}
+	}
+	var current uint64
+	if h.ACME != nil {
+		current = h.ACME.Version
+	}
+	if st.Version != current {
+		return &engine.ConflictError{Message: fmt.Sprintf("%v ACME state version %d does not match the current version %d", hk, st.Version, current)}
+	}
+	st.Version = m.nextVersion()
+	h.ACME = &st
+	if h.ACMEEnabled() {
+		h.Settings.KeyPair = st.KeyPair
+	}
+	m.Hosts[hk] = h
+	h.Version = 0
 	m.emit(&engine.HostUpserted{Host: h})
 	return nil
 }
 
-func (m *Mem) DeleteHost(k engine.HostKey) error {
-	if _, ok := m.Hosts[k]; !ok {
+func (m *Mem) DeleteHost(k engine.HostKey, version uint64) error {
+	h, ok := m.Hosts[k]
+	if !ok {
 		return &engine.NotFoundError{}
 	}
+	if err := engine.CheckVersion(k, version, h.Version); err != nil {
+		return err
+	}
 	delete(m.Hosts, k)
 	m.emit(&engine.HostDeleted{HostKey: k})
 	return nil
@@ -103,18 +153,25 @@ func (m *Mem) GetListener(lk engine.ListenerKey) (*engine.Listener, error) {
 }
 
 func (m *Mem) UpsertListener(l engine.Listener) error {
-	defer func() {
-		m.emit(&engine.ListenerUpserted{Listener: l})
-	}()
 	lk := engine.ListenerKey{l.Id}
+	if err := engine.CheckVersion(lk, l.Version, m.Listeners[lk].Version); err != nil {
+		return err
+	}
+	l.Version = 0
+	m.emit(&engine.ListenerUpserted{Listener: l})
+	l.Version = m.nextVersion()
 	m.Listeners[lk] = l
 	return nil
 }
 
-func (m *Mem) DeleteListener(lk engine.ListenerKey) error {
-	if _, ok := m.Listeners[lk]; !ok {
+func (m *Mem) DeleteListener(lk engine.ListenerKey, version uint64) error {
+	l, ok := m.Listeners[lk]
+	if !ok {
 		return &engine.NotFoundError{}
 	}
+	if err := engine.CheckVersion(lk, version, l.Version); err != nil {
+		return err
+	}
 	delete(m.Listeners, lk)
 	m.emit(&engine.ListenerDeleted{ListenerKey: lk})
 	return nil
@@ -137,18 +194,30 @@ func (m *Mem) GetFrontend(k engine.FrontendKey) (*engine.Frontend, error) {
 }
 
 func (m *Mem) UpsertFrontend(f engine.Frontend, d time.Duration) error {
-	if _, ok := m.Backends[engine.BackendKey{Id: f.BackendId}]; !ok {
-		return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", f.BackendId)}
+	for _, id := range f.BackendIds() {
+		if _, ok := m.Backends[engine.BackendKey{Id: id}]; !ok {
+			return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", id)}
+		}
+	}
+	fk := engine.FrontendKey{Id: f.Id}
+	if err := engine.CheckVersion(fk, f.Version, m.Frontends[fk].Version); err != nil {
+		return err
 	}
-	m.Frontends[engine.FrontendKey{Id: f.Id}] = f
+	f.Version = 0
 	m.emit(&engine.FrontendUpserted{Frontend: f})
+	f.Version = m.nextVersion()
+	m.Frontends[fk] = f
 	return nil
 }
 
-func (m *Mem) DeleteFrontend(fk engine.FrontendKey) error {
-	if _, ok := m.Frontends[fk]; !ok {
+func (m *Mem) DeleteFrontend(fk engine.FrontendKey, version uint64) error {
+	f, ok := m.Frontends[fk]
+	if !ok {
 		return &engine.NotFoundError{}
 	}
+	if err := engine.CheckVersion(fk, version, f.Version); err != nil {
+		return err
+	}
 	m.emit(&engine.FrontendDeleted{FrontendKey: fk})
 	delete(m.Frontends, fk)
 	return nil
@@ -179,9 +248,17 @@ func (m *Mem) UpsertMiddleware(fk engine.FrontendKey, md engine.Middleware, d ti
 	if _, ok := m.Frontends[fk]; !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("'%v' not found", fk)}
 	}
-	defer func() {
-		m.emit(&engine.MiddlewareUpserted{FrontendKey: fk, Middleware: md})
-	}()
+	mk := engine.MiddlewareKey{FrontendKey: fk, Id: md.Id}
+	var current uint64
+	if existing, err := m.GetMiddleware(mk); err == nil {
+		current = existing.Version
+	}
+	if err := engine.CheckVersion(mk, md.Version, current); err != nil {
+		return err
+	}
+	md.Version = 0
+	m.emit(&engine.MiddlewareUpserted{FrontendKey: fk, Middleware: md})
+	md.Version = m.nextVersion()
 	vals, ok := m.Middlewares[fk]
 	if !ok {
 		m.Middlewares[fk] = []engine.Middleware{md}
@@ -198,13 +275,16 @@ func (m *Mem) UpsertMiddleware(fk engine.FrontendKey, md engine.Middleware, d ti
 	return nil
 }
 
-func (m *Mem) DeleteMiddleware(mk engine.MiddlewareKey) error {
+func (m *Mem) DeleteMiddleware(mk engine.MiddlewareKey, version uint64) error {
 	vals, ok := m.Middlewares[mk.FrontendKey]
 	if !ok {
 		return &engine.NotFoundError{}
 	}
 	for i, v := range vals {
 		if v.Id == mk.Id {
+			if err := engine.CheckVersion(mk, version, v.Version); err != nil {
+				return err
+			}
 			vals = append(vals[:i], vals[i+1:]...)
 			m.Middlewares[mk.FrontendKey] = vals
 			m.emit(&engine.MiddlewareDeleted{MiddlewareKey: mk})
@@ -231,20 +311,30 @@ func (m *Mem) GetBackend(bk engine.BackendKey) (*engine.Backend, error) {
 }
 
 func (m *Mem) UpsertBackend(b engine.Backend) error {
+	bk := engine.BackendKey{Id: b.Id}
+	if err := engine.CheckVersion(bk, b.Version, m.Backends[bk].Version); err != nil {
+		return err
+	}
+	b.Version = 0
 	m.emit(&engine.BackendUpserted{Backend: b})
-	m.Backends[engine.BackendKey{Id: b.Id}] = b
+	b.Version = m.nextVersion()
+	m.Backends[bk] = b
 	return nil
 }
 
-func (m *Mem) DeleteBackend(bk engine.BackendKey) error {
+func (m *Mem) DeleteBackend(bk engine.BackendKey, version uint64) error {
 	for _, f := range m.Frontends {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk.Id) {
 			return fmt.Errorf("Backend is in use by %v", f)
 		}
 	}
-	if _, ok := m.Backends[bk]; !ok {
+	b, ok := m.Backends[bk]
+	if !ok {
 		return &engine.NotFoundError{}
 	}
+	if err := engine.CheckVersion(bk, version, b.Version); err != nil {
+		return err
+	}
 	m.emit(&engine.BackendDeleted{BackendKey: bk})
 	delete(m.Backends, bk)
 	return nil
@@ -272,9 +362,17 @@ func (m *Mem) GetServer(sk engine.ServerKey) (*engine.Server, error) {
 }
 
 func (m *Mem) UpsertServer(bk engine.BackendKey, srv engine.Server, d time.Duration) error {
-	defer func() {
-		m.emit(&engine.ServerUpserted{BackendKey: bk, Server: srv})
-	}()
+	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+	var current uint64
+	if existing, err := m.GetServer(sk); err == nil {
+		current = existing.Version
+	}
+	if err := engine.CheckVersion(sk, srv.Version, current); err != nil {
+		return err
+	}
+	srv.Version = 0
+	m.emit(&engine.ServerUpserted{BackendKey: bk, Server: srv})
+	srv.Version = m.nextVersion()
 	vals, ok := m.Servers[bk]
 	if !ok {
 		m.Servers[bk] = []engine.Server{srv}
@@ -290,13 +388,16 @@ func (m *Mem) UpsertServer(bk engine.BackendKey, srv engine.Server, d time.Durat
 	return nil
 }
 
-func (m *Mem) DeleteServer(sk engine.ServerKey) error {
+func (m *Mem) DeleteServer(sk engine.ServerKey, version uint64) error {
 	vals, ok := m.Servers[sk.BackendKey]
 	if !ok {
 		return &engine.NotFoundError{}
 	}
 	for i, v := range vals {
 		if v.Id == sk.Id {
+			if err := engine.CheckVersion(sk, version, v.Version); err != nil {
+				return err
+			}
 			vals = append(vals[:i], vals[i+1:]...)
 			m.Servers[sk.BackendKey] = vals
 			m.emit(&engine.ServerDeleted{ServerKey: sk})
@@ -306,6 +407,28 @@ func (m *Mem) DeleteServer(sk engine.ServerKey) error {
 	return &engine.NotFoundError{}
 }
 
+// nextVersion returns the version for the object being upserted, versions are unique across all objects
+func (m *Mem) nextVersion() uint64 {
+	m.lastVersion += 1
+	return m.lastVersion
+}
+
+func (m *Mem) ApplyBatch(changes []interface{}) error {
+	m.batch = []interface{}{}
+	applied, err := engine.ApplyChanges(m, changes)
+	batch := m.batch
+	m.batch = nil
+	if err != nil {
+		// The events of the batch are dropped, the changes failed to revert remain in the store and are reported instead
+		if len(applied) != 0 {
+			m.emit(&engine.BatchApplied{Changes: applied})
+		}
+		return err
+	}
+	m.emit(&engine.BatchApplied{Changes: batch})
+	return nil
+}
+
 func (m *Mem) Subscribe(changes chan interface{}, cancelC chan bool) error {
 	for {
 		select {
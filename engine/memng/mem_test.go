@@ -45,6 +45,14 @@ func (s *MemSuite) TestHostWithKeyPair(c *C) {
 	s.suite.HostWithKeyPair(c)
 }
 
+func (s *MemSuite) TestHostWithKeyPairs(c *C) {
+	s.suite.HostWithKeyPairs(c)
+}
+
+func (s *MemSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
 func (s *MemSuite) TestHostUpsertKeyPair(c *C) {
 	s.suite.HostUpsertKeyPair(c)
 }
@@ -53,6 +61,22 @@ func (s *MemSuite) TestHostWithOCSP(c *C) {
 	s.suite.HostWithOCSP(c)
 }
 
+func (s *MemSuite) TestHostWithPassthrough(c *C) {
+	s.suite.HostWithPassthrough(c)
+}
+
+func (s *MemSuite) TestHostWithErrorPages(c *C) {
+	s.suite.HostWithErrorPages(c)
+}
+
+func (s *MemSuite) TestHostWithMaintenance(c *C) {
+	s.suite.HostWithMaintenance(c)
+}
+
+func (s *MemSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
 func (s *MemSuite) TestListenerCRUD(c *C) {
 	s.suite.ListenerCRUD(c)
 }
@@ -81,6 +105,14 @@ func (s *MemSuite) TestFrontendBadBackend(c *C) {
 	s.suite.FrontendBadBackend(c)
 }
 
+func (s *MemSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *MemSuite) TestTCPFrontendCRUD(c *C) {
+	s.suite.TCPFrontendCRUD(c)
+}
+
 func (s *MemSuite) TestMiddlewareCRUD(c *C) {
 	s.suite.MiddlewareCRUD(c)
 }
@@ -92,3 +124,15 @@ func (s *MemSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *MemSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+func (s *MemSuite) TestVersionConflict(c *C) {
+	s.suite.VersionConflict(c)
+}
+
+func (s *MemSuite) TestBatchCRUD(c *C) {
+	s.suite.BatchCRUD(c)
+}
+
+func (s *MemSuite) TestBatchRollback(c *C) {
+	s.suite.BatchRollback(c)
+}
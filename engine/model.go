@@ -4,14 +4,21 @@ package engine
 import (
 	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/memmetrics"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/stream"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/route"
 	"github.com/mailgun/vulcand/plugin"
 )
@@ -77,6 +84,11 @@ type Listener struct {
 	Scope string
 	// Settings provides listener-type specific settings, e.g. TLS settings for HTTPS listener
 	Settings *HTTPSListenerSettings `json:",omitempty"`
+	// ProxyProtocol accepts the PROXY protocol headers sent by the load balancers in front of the listener
+	ProxyProtocol *ListenerProxyProtocol `json:",omitempty"`
+	// Version is the resource version set by the engine on reads. Upserts with the non zero version succeed
+	// only if the version matches the current one, see ConflictError.
+	Version uint64 `json:",omitempty"`
 }
 
 func (l *Listener) TLSConfig() (*tls.Config, error) {
@@ -98,6 +110,9 @@ func (a *Address) Equals(o Address) bool {
 }
 
 func (l *Listener) SettingsEquals(o *Listener) bool {
+	if !proxyProtocolEquals(l.ProxyProtocol, o.ProxyProtocol) {
+		return false
+	}
 	if l.Settings == nil && o.Settings == nil {
 		return true
 	}
@@ -105,11 +120,75 @@ func (l *Listener) SettingsEquals(o *Listener) bool {
 	if (ls == nil && os != nil) || (ls != nil && os == nil) {
 		return false
 	}
-	return (&os.TLS).Equals(&ls.TLS)
+	return (&os.TLS).Equals(&ls.TLS) && os.HTTP2 == ls.HTTP2 && os.SNIPassthrough == ls.SNIPassthrough
+}
+
+// HTTP2 returns true if the listener negotiates HTTP/2 with the clients
+func (l *Listener) HTTP2() bool {
+	return l.Protocol == HTTPS && l.Settings != nil && l.Settings.HTTP2
+}
+
+// SNIPassthrough returns true if the listener routes the TLS connections of the passthrough hosts
+// to their backends without terminating TLS
+func (l *Listener) SNIPassthrough() bool {
+	return l.Protocol == HTTPS && l.Settings != nil && l.Settings.SNIPassthrough
+}
+
+// ListenerProxyProtocol requires the PROXY protocol header (v1 or v2) on the connections from the trusted
+// sources, the address from the header becomes the client address. Connections from the other sources
+// are served as is.
+type ListenerProxyProtocol struct {
+	// TrustedCIDRs are the addresses of the load balancers, e.g. 10.0.0.0/8
+	TrustedCIDRs []string
+}
+
+// NewListenerProxyProtocol returns the PROXY protocol settings trusting the given sources
+func NewListenerProxyProtocol(cidrs []string) (*ListenerProxyProtocol, error) {
+	p := &ListenerProxyProtocol{TrustedCIDRs: cidrs}
+	if _, err := p.TrustedNets(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// TrustedNets returns the parsed trusted sources
+func (p *ListenerProxyProtocol) TrustedNets() ([]*net.IPNet, error) {
+	if len(p.TrustedCIDRs) == 0 {
+		return nil, fmt.Errorf("supply at least one trusted CIDR for PROXY protocol, e.g. 0.0.0.0/0 to trust all")
+	}
+	out := make([]*net.IPNet, len(p.TrustedCIDRs))
+	for i, c := range p.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted CIDR: %s", err)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+func proxyProtocolEquals(a, b *ListenerProxyProtocol) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if len(a.TrustedCIDRs) != len(b.TrustedCIDRs) {
+		return false
+	}
+	for i := range a.TrustedCIDRs {
+		if a.TrustedCIDRs[i] != b.TrustedCIDRs[i] {
+			return false
+		}
+	}
+	return true
 }
 
 type HTTPSListenerSettings struct {
 	TLS TLSSettings
+	// HTTP2 enables HTTP/2 negotiated with ALPN, the clients not supporting it use HTTP/1.1
+	HTTP2 bool `json:",omitempty"`
+	// SNIPassthrough peeks at the server name sent by the clients, the connections to the hosts with
+	// passthrough settings are proxied still encrypted, the rest are terminated by the listener
+	SNIPassthrough bool `json:",omitempty"`
 }
 
 // Sets up OCSP stapling, see http://en.wikipedia.org/wiki/OCSP_stapling
@@ -161,7 +240,158 @@ func (o *OCSPSettings) Equals(other *OCSPSettings) bool {
 type HostSettings struct {
 	Default bool
 	KeyPair *KeyPair
-	OCSP    OCSPSettings
+	// KeyPairs are the additional certificates of the host, e.g. the RSA certificate for the clients
+	// not supporting the ECDSA KeyPair. OCSP staples the KeyPair only.
+	KeyPairs []KeyPair `json:",omitempty"`
+	OCSP     OCSPSettings
+	// Passthrough proxies the TLS connections to the host to the tcp backend, the servers terminate TLS
+	Passthrough *HostPassthrough `json:",omitempty"`
+	// ErrorPages replace the error responses of the requests to the host, frontend error pages take precedence
+	ErrorPages *ErrorPages `json:",omitempty"`
+	// Maintenance responds to the requests to the host with the maintenance page instead of proxying them
+	Maintenance *Maintenance `json:",omitempty"`
+	// HTTPSRedirect redirects the plain HTTP requests to the HTTPS listener, applied if the host has the KeyPair
+	HTTPSRedirect *HTTPSRedirect `json:",omitempty"`
+	// ACME obtains the KeyPair of the host from the ACME server, e.g. Let's Encrypt, and renews it before expiry
+	ACME *HostACME `json:",omitempty"`
+}
+
+// HostACME turns on the automatic certificates of the host. The certificates are ordered with the HTTP-01
+// challenges served by the plain HTTP listener on port 80, so the hostname should resolve to vulcand.
+type HostACME struct {
+	Enabled bool
+	// Email is the contact of the ACME account of the host, the contact of vulcand is used if omitted
+	Email string `json:",omitempty"`
+}
+
+// ACMEState is shared by the vulcand instances through the engine, so only one of them orders the certificate.
+// The engines keep the state apart from the host settings, so the state is not the part of the configuration.
+type ACMEState struct {
+	// KeyPair is the certificate issued, it is used as the KeyPair of the host
+	KeyPair *KeyPair `json:",omitempty"`
+	// AccountURL identifies the ACME account of the host, AccountKey is the key of the account sealed by the secret box
+	AccountURL string `json:",omitempty"`
+	AccountKey []byte `json:",omitempty"`
+	// Lease is taken by the instance ordering the certificate, the other instances skip the host until it expires
+	Lease *ACMELease `json:",omitempty"`
+	// Challenges map the tokens of the pending HTTP-01 challenges to the key authorizations served by the listeners
+	Challenges map[string]string `json:",omitempty"`
+	// LastError is the error of the last order, the order is retried after RetryAt
+	LastError string     `json:",omitempty"`
+	RetryAt   *time.Time `json:",omitempty"`
+	Version   uint64     `json:",omitempty"`
+}
+
+type ACMELease struct {
+	// Owner is the instance holding the lease
+	Owner   string
+	Expires time.Time
+}
+
+// HTTPSRedirect redirects the plain HTTP requests to the host to HTTPS
+type HTTPSRedirect struct {
+	// StatusCode of the redirect, 301, 302, 307 or 308, 301 if omitted
+	StatusCode int `json:",omitempty"`
+	// Port of the HTTPS listener, if omitted the port of the HTTPS listener is used if there is one, 443 otherwise
+	Port int `json:",omitempty"`
+	// ExcludePaths are the path prefixes served over plain HTTP, e.g. "/.well-known/acme-challenge/"
+	ExcludePaths []string `json:",omitempty"`
+	// HSTS adds the Strict-Transport-Security header to the HTTPS responses of the host if set
+	HSTS *HSTS `json:",omitempty"`
+}
+
+// HSTS are the parameters of the Strict-Transport-Security header
+type HSTS struct {
+	// MaxAge is the time in seconds the browsers use HTTPS only, e.g. 31536000 for one year
+	MaxAge            int
+	IncludeSubdomains bool `json:",omitempty"`
+	Preload           bool `json:",omitempty"`
+}
+
+// Maintenance replaces the responses with the maintenance page while enabled, the settings are kept
+// when the maintenance is turned off, so it could be turned on again with the same page
+type Maintenance struct {
+	Enabled bool
+	// StatusCode of the maintenance response, 503 if omitted
+	StatusCode int `json:",omitempty"`
+	// ContentType of the body, "text/plain; charset=utf-8" if omitted
+	ContentType string `json:",omitempty"`
+	Body        string `json:",omitempty"`
+	// RetryAfter is the value of the Retry-After header, seconds or HTTP date, e.g. "120"
+	RetryAfter string `json:",omitempty"`
+	// AllowIPs are the client IPs or networks bypassing the maintenance, e.g. "10.0.0.0/8"
+	AllowIPs []string `json:",omitempty"`
+	// AllowHeaders are the request headers bypassing the maintenance, the header name maps to the value
+	AllowHeaders map[string]string `json:",omitempty"`
+}
+
+func (m *Maintenance) Equals(o *Maintenance) bool {
+	if m == nil || o == nil {
+		return m == nil && o == nil
+	}
+	if m.Enabled != o.Enabled || m.StatusCode != o.StatusCode || m.ContentType != o.ContentType ||
+		m.Body != o.Body || m.RetryAfter != o.RetryAfter ||
+		len(m.AllowIPs) != len(o.AllowIPs) || len(m.AllowHeaders) != len(o.AllowHeaders) {
+		return false
+	}
+	for i := range m.AllowIPs {
+		if m.AllowIPs[i] != o.AllowIPs[i] {
+			return false
+		}
+	}
+	for k, v := range m.AllowHeaders {
+		if ov, ok := o.AllowHeaders[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// HostPassthrough routes the host connections accepted by the listeners in SNI passthrough mode
+type HostPassthrough struct {
+	// BackendId is the tcp backend receiving the encrypted connections
+	BackendId string
+}
+
+// ErrorPages replace the error responses with the custom pages
+type ErrorPages struct {
+	// Pages are matched in order, the first page matching the status code is used
+	Pages []ErrorPage
+	// BackendErrors applies the pages to the error responses of the servers as well,
+	// otherwise only the errors generated by the proxy are replaced
+	BackendErrors bool `json:",omitempty"`
+}
+
+// ErrorPage is the templated body of the error responses, e.g.
+// {"Codes": ["502-504"], "ContentType": "application/json", "Body": "{\"error\": {{json .StatusText}}}"}
+type ErrorPage struct {
+	// Codes are the status codes or the ranges of the codes, e.g. "404" or "500-599"
+	Codes []string
+	// ContentType of the page, HTML pages are escaped as html/template does, e.g. "text/html; charset=utf-8"
+	ContentType string
+	// Body is the Go template executed with the ErrorPageData
+	Body string
+}
+
+func (p *ErrorPages) Equals(o *ErrorPages) bool {
+	if p == nil || o == nil {
+		return p == nil && o == nil
+	}
+	if p.BackendErrors != o.BackendErrors || len(p.Pages) != len(o.Pages) {
+		return false
+	}
+	for i := range p.Pages {
+		a, b := p.Pages[i], o.Pages[i]
+		if a.ContentType != b.ContentType || a.Body != b.Body || len(a.Codes) != len(b.Codes) {
+			return false
+		}
+		for j := range a.Codes {
+			if a.Codes[j] != b.Codes[j] {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 type HostKey struct {
@@ -177,12 +407,42 @@ func (h HostKey) String() string {
 type Host struct {
 	Name     string
 	Settings HostSettings
+	// ACME is the state of the automatic certificates maintained by vulcand, it is updated with UpsertACMEState
+	// and ignored by UpsertHost
+	ACME    *ACMEState `json:",omitempty"`
+	Version uint64     `json:",omitempty"`
 }
 
 func NewHost(name string, settings HostSettings) (*Host, error) {
 	if name == "" {
 		return nil, fmt.Errorf("Hostname can not be empty")
 	}
+	if strings.Contains(name, "*") && !IsWildcardHostname(name) {
+		return nil, fmt.Errorf("wildcard should be the leftmost label of the hostname followed by the domain, e.g. *.example.com, got %s", name)
+	}
+	if settings.KeyPair == nil && len(settings.KeyPairs) != 0 {
+		return nil, fmt.Errorf("supply the key pair of the host along with the additional key pairs")
+	}
+	if p := settings.Passthrough; p != nil {
+		if p.BackendId == "" {
+			return nil, fmt.Errorf("supply the backend id for the passthrough host")
+		}
+		if settings.KeyPair != nil || settings.OCSP.Enabled || settings.ACME != nil {
+			return nil, fmt.Errorf("passthrough host can not have key pair, OCSP or ACME, the servers terminate TLS")
+		}
+	}
+	if settings.ACME != nil && IsWildcardHostname(name) {
+		return nil, fmt.Errorf("ACME HTTP-01 challenges can not validate the wildcard host %s", name)
+	}
+	if _, err := errorPageSettings(settings.ErrorPages); err != nil {
+		return nil, err
+	}
+	if _, err := maintenanceSettings(settings.Maintenance); err != nil {
+		return nil, err
+	}
+	if _, err := httpsRedirectSettings(settings.HTTPSRedirect); err != nil {
+		return nil, err
+	}
 	return &Host{
 		Name:     name,
 		Settings: settings,
@@ -190,7 +450,63 @@ func NewHost(name string, settings HostSettings) (*Host, error) {
 }
 
 func (h *Host) String() string {
-	return fmt.Sprintf("Host(%s, keyPair=%t, ocsp=%t)", h.Name, h.Settings.KeyPair != nil, h.Settings.OCSP.Enabled)
+	if p := h.Settings.Passthrough; p != nil {
+		return fmt.Sprintf("Host(%s, passthrough=%s)", h.Name, p.BackendId)
+	}
+	return fmt.Sprintf("Host(%s, keyPairs=%d, ocsp=%t)", h.Name, len(h.KeyPairs()), h.Settings.OCSP.Enabled)
+}
+
+// KeyPairs returns the KeyPair of the host followed by the additional key pairs, nil if the host has no KeyPair
+func (h *Host) KeyPairs() []KeyPair {
+	if h.Settings.KeyPair == nil {
+		return nil
+	}
+	return append([]KeyPair{*h.Settings.KeyPair}, h.Settings.KeyPairs...)
+}
+
+// ACMEEnabled returns true if the KeyPair of the host is issued by ACME. The engines keep such KeyPair
+// in the ACME state of the host and set it as the KeyPair of the host read.
+func (h *Host) ACMEEnabled() bool {
+	return h.Settings.ACME != nil && h.Settings.ACME.Enabled
+}
+
+// ACMEChallenge returns the key authorization of the pending HTTP-01 challenge of the host
+func (h *Host) ACMEChallenge(token string) (string, bool) {
+	if h.ACME == nil {
+		return "", false
+	}
+	keyAuth, ok := h.ACME.Challenges[token]
+	return keyAuth, ok
+}
+
+// hostConfig returns the host without the state maintained by vulcand: the version, the ACME state
+// and the KeyPair issued by ACME
+func hostConfig(h Host) Host {
+	h.Version, h.ACME = 0, nil
+	if h.ACMEEnabled() {
+		h.Settings.KeyPair = nil
+	}
+	return h
+}
+
+// IsWildcardHostname returns true if the hostname is the wildcard matching one label, e.g. *.example.com
+func IsWildcardHostname(name string) bool {
+	if !strings.HasPrefix(name, "*.") {
+		return false
+	}
+	domain := name[2:]
+	return strings.Contains(domain, ".") && !strings.ContainsAny(domain, "*") &&
+		!strings.HasPrefix(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+// WildcardHostname returns the wildcard hostname matching the hostname, e.g. *.example.com
+// for a.example.com, empty string is returned if the hostname has less than three labels
+func WildcardHostname(name string) string {
+	i := strings.Index(name, ".")
+	if i <= 0 || !strings.Contains(name[i+1:], ".") {
+		return ""
+	}
+	return "*" + name[i:]
 }
 
 func (h *Host) GetId() string {
@@ -206,6 +522,7 @@ type Frontend struct {
 
 	Stats    *RoundTripStats `json:",omitempty"`
 	Settings interface{}     `json:",omitempty"`
+	Version  uint64          `json:",omitempty"`
 }
 
 // Limits contains various limits one can supply for a location.
@@ -224,6 +541,129 @@ type HTTPFrontendSettings struct {
 	Hostname string
 	// In this case appends new forward info to the existing header
 	TrustForwardHeader bool
+	// TrafficSplit sends the share of the requests to the other backends, e.g. canary releases
+	TrafficSplit *HTTPFrontendTrafficSplit `json:",omitempty"`
+	// Mirror copies the share of the requests to the shadow backend
+	Mirror *HTTPFrontendMirror `json:",omitempty"`
+	// Retry retries the failed requests, can not be used with the FailoverPredicate
+	Retry *HTTPFrontendRetry `json:",omitempty"`
+	// Timeouts limit the frontend requests in addition to the backend transport timeouts
+	Timeouts *HTTPFrontendTimeouts `json:",omitempty"`
+	// ErrorPages replace the error responses of the frontend, the host error pages are used if not set
+	ErrorPages *ErrorPages `json:",omitempty"`
+	// Maintenance responds to the frontend requests with the maintenance page instead of proxying them
+	Maintenance *Maintenance `json:",omitempty"`
+}
+
+// HTTPFrontendTimeouts limit the frontend requests, the timed out requests get 504 if the response has not
+// been sent yet, otherwise the client connection is closed. Timeouts are not set if empty.
+type HTTPFrontendTimeouts struct {
+	// ResponseHeader limits the wait for the response headers of every attempt, e.g. 5s
+	ResponseHeader string `json:",omitempty"`
+	// Total limits the whole request including the retries and the response body, e.g. 2m.
+	// It extends the server write timeout if longer, so the slow frontends can take longer.
+	Total string `json:",omitempty"`
+	// BodyIdle limits the time the response body streaming can stay idle, e.g. 30s
+	BodyIdle string `json:",omitempty"`
+}
+
+// HTTPFrontendRetry retries the failed requests of the frontend. Network errors, i.e. failed connections
+// and timed out attempts, are always retried. The request body is buffered to be sent again.
+type HTTPFrontendRetry struct {
+	// Attempts is the maximum number of attempts including the first one
+	Attempts int
+	// TryTimeout limits every attempt, e.g. 2s, attempts are limited only by the backend timeouts if not set
+	TryTimeout string `json:",omitempty"`
+	// Backoff is the delay before the first retry doubled before every next one, 25ms if not set
+	Backoff string `json:",omitempty"`
+	// MaxBackoff caps the delay between the retries, 250ms if not set
+	MaxBackoff string `json:",omitempty"`
+	// Methods are the retried request methods, GET, HEAD and OPTIONS if not set
+	Methods []string `json:",omitempty"`
+	// StatusCodes are the response codes retried in addition to the network errors, e.g. 503
+	StatusCodes []int `json:",omitempty"`
+	// Budget limits the retries sent to the frontend backend at the same time
+	Budget HTTPFrontendRetryBudget
+}
+
+// HTTPFrontendRetryBudget stops the retry storms when the backend fails. The budget is shared by all the frontends
+// of the backend, every frontend checks its own percent against the requests of the backend in flight.
+type HTTPFrontendRetryBudget struct {
+	// Percent is the share of the backend requests in flight that can be retries, 20 if not set
+	Percent int `json:",omitempty"`
+	// MinRetries are allowed at the same time regardless of the percent, so the requests are retried under
+	// the low load, 3 if not set
+	MinRetries int `json:",omitempty"`
+}
+
+// Equals returns true if the retry settings are the same
+func (r *HTTPFrontendRetry) Equals(o *HTTPFrontendRetry) bool {
+	if r == nil || o == nil {
+		return r == nil && o == nil
+	}
+	if r.Attempts != o.Attempts || r.TryTimeout != o.TryTimeout || r.Backoff != o.Backoff ||
+		r.MaxBackoff != o.MaxBackoff || r.Budget != o.Budget ||
+		len(r.Methods) != len(o.Methods) || len(r.StatusCodes) != len(o.StatusCodes) {
+		return false
+	}
+	for i := range r.Methods {
+		if r.Methods[i] != o.Methods[i] {
+			return false
+		}
+	}
+	for i := range r.StatusCodes {
+		if r.StatusCodes[i] != o.StatusCodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TCPFrontendSettings bind the frontend to the tcp listener, every connection accepted by the listener
+// is proxied to one of the frontend backend servers
+type TCPFrontendSettings struct {
+	ListenerId string
+}
+
+// HTTPFrontendMirror copies the percentage of the frontend requests to the shadow backend, e.g. to try
+// the new version of the service with the production traffic. Shadow responses are discarded.
+type HTTPFrontendMirror struct {
+	BackendId string
+	// Percent is the percentage of the requests copied to the shadow backend
+	Percent int
+}
+
+// HTTPFrontendSplit sends the percentage of the frontend requests to the backend
+type HTTPFrontendSplit struct {
+	BackendId string
+	// Weight is the percentage of the requests, zero weight gets the requests only via the override
+	Weight int
+}
+
+// HTTPFrontendTrafficSplit distributes the frontend requests between the backends. The frontend backend
+// gets the requests that are not sent to the split backends.
+type HTTPFrontendTrafficSplit struct {
+	Splits []HTTPFrontendSplit
+	// Header and Cookie name the request header and cookie forcing the backend, the value is the backend id.
+	// Requests with the values that do not match any of the frontend backends are split as usual.
+	Header string `json:",omitempty"`
+	Cookie string `json:",omitempty"`
+}
+
+// Equals returns true if the splits have the same backends and weights in the same order
+func (t *HTTPFrontendTrafficSplit) Equals(o *HTTPFrontendTrafficSplit) bool {
+	if t == nil || o == nil {
+		return t == nil && o == nil
+	}
+	if t.Header != o.Header || t.Cookie != o.Cookie || len(t.Splits) != len(o.Splits) {
+		return false
+	}
+	for i := range t.Splits {
+		if t.Splits[i] != o.Splits[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func NewAddress(network, address string) (*Address, error) {
@@ -241,11 +681,14 @@ func NewAddress(network, address string) (*Address, error) {
 
 func NewListener(id, protocol, network, address, scope string, settings *HTTPSListenerSettings) (*Listener, error) {
 	protocol = strings.ToLower(protocol)
-	if protocol != HTTP && protocol != HTTPS {
-		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http and https", protocol)
+	if protocol != HTTP && protocol != HTTPS && protocol != TCP {
+		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http, https and tcp", protocol)
 	}
 
 	if scope != "" {
+		if protocol == TCP {
+			return nil, fmt.Errorf("scope is not supported by tcp listeners")
+		}
 		if !route.IsValid(scope) {
 			return nil, fmt.Errorf("Scope should be a valid route expression")
 		}
@@ -279,6 +722,34 @@ func NewHTTPFrontend(id, backendId string, routeExpr string, settings HTTPFronte
 		return nil, fmt.Errorf("invalid failover predicate")
 	}
 
+	if settings.Retry != nil && settings.FailoverPredicate != "" {
+		return nil, fmt.Errorf("use either failover predicate or retry settings")
+	}
+
+	if _, err := retrySettings(settings); err != nil {
+		return nil, err
+	}
+
+	if _, err := frontendTimeouts(settings); err != nil {
+		return nil, err
+	}
+
+	if _, err := errorPageSettings(settings.ErrorPages); err != nil {
+		return nil, err
+	}
+
+	if _, err := maintenanceSettings(settings.Maintenance); err != nil {
+		return nil, err
+	}
+
+	if err := checkTrafficSplit(backendId, settings.TrafficSplit); err != nil {
+		return nil, err
+	}
+
+	if err := checkMirror(backendId, settings); err != nil {
+		return nil, err
+	}
+
 	return &Frontend{
 		Id:        id,
 		BackendId: backendId,
@@ -292,12 +763,129 @@ func (f *Frontend) HTTPSettings() HTTPFrontendSettings {
 	return (f.Settings).(HTTPFrontendSettings)
 }
 
+// NewTCPFrontend creates the frontend proxying the connections accepted by the tcp listener to the backend
+func NewTCPFrontend(id, backendId string, settings TCPFrontendSettings) (*Frontend, error) {
+	if len(id) == 0 || len(backendId) == 0 {
+		return nil, fmt.Errorf("supply valid id and backendId")
+	}
+	if len(settings.ListenerId) == 0 {
+		return nil, fmt.Errorf("supply valid listener id")
+	}
+	return &Frontend{
+		Id:        id,
+		BackendId: backendId,
+		Type:      TCP,
+		Settings:  settings,
+	}, nil
+}
+
+func (f *Frontend) TCPSettings() TCPFrontendSettings {
+	return (f.Settings).(TCPFrontendSettings)
+}
+
 func (l HTTPFrontendSettings) Equals(o HTTPFrontendSettings) bool {
 	return (l.Limits.MaxMemBodyBytes == o.Limits.MaxMemBodyBytes &&
 		l.Limits.MaxBodyBytes == o.Limits.MaxBodyBytes &&
 		l.FailoverPredicate == o.FailoverPredicate &&
 		l.Hostname == o.Hostname &&
-		l.TrustForwardHeader == o.TrustForwardHeader)
+		l.TrustForwardHeader == o.TrustForwardHeader &&
+		l.TrafficSplit.Equals(o.TrafficSplit) &&
+		l.Retry.Equals(o.Retry) &&
+		((l.Timeouts == nil && o.Timeouts == nil) ||
+			((l.Timeouts != nil && o.Timeouts != nil) && *l.Timeouts == *o.Timeouts)) &&
+		l.ErrorPages.Equals(o.ErrorPages) &&
+		l.Maintenance.Equals(o.Maintenance) &&
+		((l.Mirror == nil && o.Mirror == nil) ||
+			((l.Mirror != nil && o.Mirror != nil) && *l.Mirror == *o.Mirror)))
+}
+
+// BackendIds returns the ids of the backends used by the frontend, the frontend backend goes first
+// followed by the split backends and the shadow backend
+func (f *Frontend) BackendIds() []string {
+	ids := []string{f.BackendId}
+	s, ok := f.Settings.(HTTPFrontendSettings)
+	if !ok {
+		return ids
+	}
+	if s.TrafficSplit != nil {
+		for _, sp := range s.TrafficSplit.Splits {
+			ids = append(ids, sp.BackendId)
+		}
+	}
+	if s.Mirror != nil {
+		ids = append(ids, s.Mirror.BackendId)
+	}
+	return ids
+}
+
+// UsesBackend returns true if the frontend sends any of the requests to the backend
+func (f *Frontend) UsesBackend(id string) bool {
+	for _, bid := range f.BackendIds() {
+		if bid == id {
+			return true
+		}
+	}
+	return false
+}
+
+func checkMirror(backendId string, s HTTPFrontendSettings) error {
+	m := s.Mirror
+	if m == nil {
+		return nil
+	}
+	if m.BackendId == "" {
+		return fmt.Errorf("shadow backend id can not be empty")
+	}
+	// Shadow backend should not serve the frontend requests, otherwise the copies would mix with them
+	used := []string{backendId}
+	if s.TrafficSplit != nil {
+		for _, sp := range s.TrafficSplit.Splits {
+			used = append(used, sp.BackendId)
+		}
+	}
+	for _, id := range used {
+		if id == m.BackendId {
+			return fmt.Errorf("shadow backend '%s' can not serve the frontend requests", m.BackendId)
+		}
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror percent should be between 0 and 100, got %d", m.Percent)
+	}
+	return nil
+}
+
+func checkTrafficSplit(backendId string, t *HTTPFrontendTrafficSplit) error {
+	if t == nil {
+		return nil
+	}
+	if len(t.Splits) == 0 {
+		return fmt.Errorf("traffic split should have at least one split")
+	}
+	seen := map[string]bool{backendId: true}
+	total := 0
+	for _, sp := range t.Splits {
+		if sp.BackendId == "" {
+			return fmt.Errorf("split backend id can not be empty")
+		}
+		if seen[sp.BackendId] {
+			return fmt.Errorf("backend '%s' is used by the frontend more than once", sp.BackendId)
+		}
+		seen[sp.BackendId] = true
+		if sp.Weight < 0 || sp.Weight > 100 {
+			return fmt.Errorf("split weight should be between 0 and 100, got %d", sp.Weight)
+		}
+		total += sp.Weight
+	}
+	if total > 100 {
+		return fmt.Errorf("total weight of the splits should not exceed 100, got %d", total)
+	}
+	if t.Header != "" && !isToken(t.Header) {
+		return fmt.Errorf("traffic split header '%s' is not valid", t.Header)
+	}
+	if t.Cookie != "" && !isToken(t.Cookie) {
+		return fmt.Errorf("traffic split cookie '%s' is not valid", t.Cookie)
+	}
+	return nil
 }
 
 func (f *Frontend) String() string {
@@ -319,6 +907,8 @@ type HTTPBackendTimeouts struct {
 	Dial string
 	// TLS handshake timeout
 	TLSHandshake string
+	// Idle timeout of the upgraded connections, e.g. WebSockets, 10m if not set
+	UpgradeIdle string `json:",omitempty"`
 }
 
 type HTTPBackendKeepAlive struct {
@@ -328,6 +918,71 @@ type HTTPBackendKeepAlive struct {
 	MaxIdleConnsPerHost int
 }
 
+// Load balancing strategies supported by the backends
+const (
+	// RoundRobinLB distributes the requests in proportion to the server weights and adjusts the weights
+	// of the failing servers, it is the default strategy
+	RoundRobinLB = "roundrobin"
+	// LeastConnLB sends the request to the server with the least in-flight requests per weight
+	LeastConnLB = "leastconn"
+	// PowerOfTwoLB picks two random servers and sends the request to the one with less in-flight requests
+	PowerOfTwoLB = "p2c"
+	// HashLB selects the server by the consistent hash of the request variable, so the same value
+	// gets to the same server unless the set of servers changes
+	HashLB = "hash"
+)
+
+type HTTPBackendLoadBalancer struct {
+	// Strategy is the load balancing strategy, round robin if not set
+	Strategy string `json:",omitempty"`
+	// Variable is the request variable hashed by the hash strategy, e.g. 'client.ip' or 'request.header.X-User'
+	Variable string `json:",omitempty"`
+}
+
+// HTTPBackendHealthCheck configures active health checks of the backend servers,
+// the servers failing the checks are taken out of the rotation until they pass the checks again
+type HTTPBackendHealthCheck struct {
+	// Path requested on every server, e.g. /health
+	Path string
+	// Interval between the checks, 10s if not set
+	Interval string `json:",omitempty"`
+	// Timeout of the check request, 2s if not set
+	Timeout string `json:",omitempty"`
+	// MinStatus and MaxStatus set the inclusive range of the response codes of the healthy server, 200-399 if not set
+	MinStatus int `json:",omitempty"`
+	MaxStatus int `json:",omitempty"`
+	// HealthyThreshold is the number of consecutive passed checks bringing the server back, 2 if not set
+	HealthyThreshold int `json:",omitempty"`
+	// UnhealthyThreshold is the number of consecutive failed checks taking the server out, 3 if not set
+	UnhealthyThreshold int `json:",omitempty"`
+}
+
+// HTTPBackendOutlierEjection enables ejection of the servers marked as anomalous by the anomaly detection,
+// e.g. servers with the error rate or latency standing out. Every consecutive ejection of the server doubles
+// the ejection period.
+type HTTPBackendOutlierEjection struct {
+	// Interval between the anomaly detection runs, 10s if not set
+	Interval string `json:",omitempty"`
+	// BaseEjectionTime is the period of the first ejection, 30s if not set
+	BaseEjectionTime string `json:",omitempty"`
+	// MaxEjectionTime caps the ejection period, 5m if not set
+	MaxEjectionTime string `json:",omitempty"`
+	// MaxEjectionPercent caps the share of the backend servers ejected at the same time, 50 if not set.
+	// At least one server can be ejected regardless of the percent.
+	MaxEjectionPercent int `json:",omitempty"`
+}
+
+// HTTPBackendStickySession pins the client to the server with a cookie. If the server is removed
+// or taken out of the rotation, the client is pinned to another server chosen by the load balancer.
+type HTTPBackendStickySession struct {
+	// CookieName is the name of the cookie set by the proxy
+	CookieName string
+	// Secure limits the cookie to HTTPS requests
+	Secure bool `json:",omitempty"`
+	// HTTPOnly hides the cookie from the scripts
+	HTTPOnly bool `json:",omitempty"`
+}
+
 type HTTPBackendSettings struct {
 	// Timeouts provides timeout settings for backend servers
 	Timeouts HTTPBackendTimeouts
@@ -335,14 +990,55 @@ type HTTPBackendSettings struct {
 	KeepAlive HTTPBackendKeepAlive
 	// TLS provides optional TLS settings for HTTP backend
 	TLS *TLSSettings `json:",omitempty"`
+	// LoadBalancer selects the strategy distributing the requests among the backend servers
+	LoadBalancer HTTPBackendLoadBalancer
+	// HealthCheck enables active health checks of the backend servers
+	HealthCheck *HTTPBackendHealthCheck `json:",omitempty"`
+	// OutlierEjection enables ejection of the anomalous servers
+	OutlierEjection *HTTPBackendOutlierEjection `json:",omitempty"`
+	// StickySession enables cookie based session affinity
+	StickySession *HTTPBackendStickySession `json:",omitempty"`
+	// Protocol is the HTTP protocol spoken to the servers, HTTP/1.1 by default
+	Protocol string `json:",omitempty"`
+	// ProxyProtocol sends the PROXY protocol header with the client address to the servers, ProxyProtocolV1 or ProxyProtocolV2
+	ProxyProtocol string `json:",omitempty"`
+}
+
+// TCPBackendTimeouts contains timeout settings of the tcp backend servers
+type TCPBackendTimeouts struct {
+	// Dial is the timeout of the connection to the server
+	Dial string `json:",omitempty"`
+	// Idle closes the connections with no data sent in either direction
+	Idle string `json:",omitempty"`
+}
+
+type TCPBackendSettings struct {
+	// Timeouts provides timeout settings for backend servers
+	Timeouts TCPBackendTimeouts
+	// ProxyProtocol sends the PROXY protocol header with the client address to the servers, ProxyProtocolV1 or ProxyProtocolV2
+	ProxyProtocol string `json:",omitempty"`
+}
+
+func (s *TCPBackendSettings) Equals(o TCPBackendSettings) bool {
+	return s.Timeouts == o.Timeouts && s.ProxyProtocol == o.ProxyProtocol
 }
 
 func (s *HTTPBackendSettings) Equals(o HTTPBackendSettings) bool {
 	return (s.Timeouts.Read == o.Timeouts.Read &&
 		s.Timeouts.Dial == o.Timeouts.Dial &&
 		s.Timeouts.TLSHandshake == o.Timeouts.TLSHandshake &&
+		s.Timeouts.UpgradeIdle == o.Timeouts.UpgradeIdle &&
 		s.KeepAlive.Period == o.KeepAlive.Period &&
 		s.KeepAlive.MaxIdleConnsPerHost == o.KeepAlive.MaxIdleConnsPerHost &&
+		s.LoadBalancer == o.LoadBalancer &&
+		s.Protocol == o.Protocol &&
+		s.ProxyProtocol == o.ProxyProtocol &&
+		((s.HealthCheck == nil && o.HealthCheck == nil) ||
+			((s.HealthCheck != nil && o.HealthCheck != nil) && *s.HealthCheck == *o.HealthCheck)) &&
+		((s.OutlierEjection == nil && o.OutlierEjection == nil) ||
+			((s.OutlierEjection != nil && o.OutlierEjection != nil) && *s.OutlierEjection == *o.OutlierEjection)) &&
+		((s.StickySession == nil && o.StickySession == nil) ||
+			((s.StickySession != nil && o.StickySession != nil) && *s.StickySession == *o.StickySession)) &&
 		((s.TLS == nil && o.TLS == nil) ||
 			((s.TLS != nil && o.TLS != nil) && s.TLS.Equals(o.TLS))))
 }
@@ -362,6 +1058,7 @@ type Middleware struct {
 	Priority   int
 	Type       string
 	Middleware plugin.Middleware
+	Version    uint64 `json:",omitempty"`
 }
 
 // Backend is a collection of endpoints. Each location is assigned an backend. Changing assigned backend
@@ -371,6 +1068,7 @@ type Backend struct {
 	Type     string
 	Stats    *RoundTripStats `json:",omitempty"`
 	Settings interface{}
+	Version  uint64 `json:",omitempty"`
 }
 
 // NewBackend creates a new instance of the backend object
@@ -378,6 +1076,18 @@ func NewHTTPBackend(id string, s HTTPBackendSettings) (*Backend, error) {
 	if _, err := transportSettings(s); err != nil {
 		return nil, err
 	}
+	if err := checkLoadBalancer(s.LoadBalancer); err != nil {
+		return nil, err
+	}
+	if _, err := healthCheckSettings(s); err != nil {
+		return nil, err
+	}
+	if _, err := outlierEjectionSettings(s); err != nil {
+		return nil, err
+	}
+	if err := checkStickySession(s.StickySession); err != nil {
+		return nil, err
+	}
 	return &Backend{
 		Id:       id,
 		Type:     HTTP,
@@ -389,6 +1099,50 @@ func (b *Backend) HTTPSettings() HTTPBackendSettings {
 	return b.Settings.(HTTPBackendSettings)
 }
 
+// NewTCPBackend creates the backend proxying the raw tcp connections to its servers
+func NewTCPBackend(id string, s TCPBackendSettings) (*Backend, error) {
+	if _, err := tcpTransportSettings(s); err != nil {
+		return nil, err
+	}
+	return &Backend{
+		Id:       id,
+		Type:     TCP,
+		Settings: s,
+	}, nil
+}
+
+func (b *Backend) TCPSettings() TCPBackendSettings {
+	return b.Settings.(TCPBackendSettings)
+}
+
+// TCPTransportSettings returns the parsed tcp backend timeouts, zero dial timeout means the default one
+func (b *Backend) TCPTransportSettings() (*TCPTransportSettings, error) {
+	return tcpTransportSettings(b.Settings.(TCPBackendSettings))
+}
+
+func tcpTransportSettings(s TCPBackendSettings) (*TCPTransportSettings, error) {
+	t := &TCPTransportSettings{}
+	var err error
+	if len(s.Timeouts.Dial) != 0 {
+		if t.Timeouts.Dial, err = time.ParseDuration(s.Timeouts.Dial); err != nil {
+			return nil, fmt.Errorf("invalid dial timeout: %s", err)
+		}
+	}
+	if len(s.Timeouts.Idle) != 0 {
+		if t.Timeouts.Idle, err = time.ParseDuration(s.Timeouts.Idle); err != nil {
+			return nil, fmt.Errorf("invalid idle timeout: %s", err)
+		}
+	}
+	if t.Timeouts.Idle <= 0 {
+		t.Timeouts.Idle = DefaultTCPIdleTimeout
+	}
+	if err := checkProxyProtocol(s.ProxyProtocol); err != nil {
+		return nil, err
+	}
+	t.ProxyProtocol = s.ProxyProtocol
+	return t, nil
+}
+
 func (b *Backend) String() string {
 	return fmt.Sprintf("Backend(id=%s)", b.Id)
 }
@@ -424,6 +1178,14 @@ func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
 			return nil, fmt.Errorf("invalid tls handshake timeout: %s", err)
 		}
 	}
+	if len(s.Timeouts.UpgradeIdle) != 0 {
+		if t.Timeouts.UpgradeIdle, err = time.ParseDuration(s.Timeouts.UpgradeIdle); err != nil {
+			return nil, fmt.Errorf("invalid upgrade idle timeout: %s", err)
+		}
+	}
+	if t.Timeouts.UpgradeIdle <= 0 {
+		t.Timeouts.UpgradeIdle = DefaultUpgradeIdleTimeout
+	}
 
 	// Keep Alive parameters
 	if len(s.KeepAlive.Period) != 0 {
@@ -433,6 +1195,24 @@ func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
 	}
 	t.KeepAlive.MaxIdleConnsPerHost = s.KeepAlive.MaxIdleConnsPerHost
 
+	switch s.Protocol {
+	case "", HTTP1Protocol:
+		t.Protocol = HTTP1Protocol
+	case H2Protocol, H2CProtocol:
+		t.Protocol = s.Protocol
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are %s, %s and %s", s.Protocol, HTTP1Protocol, H2Protocol, H2CProtocol)
+	}
+
+	if err := checkProxyProtocol(s.ProxyProtocol); err != nil {
+		return nil, err
+	}
+	// PROXY protocol header carries the address of one client, so the connection can not be shared by the HTTP/2 streams
+	if s.ProxyProtocol != "" && t.Protocol != HTTP1Protocol {
+		return nil, fmt.Errorf("PROXY protocol is supported with %s only", HTTP1Protocol)
+	}
+	t.ProxyProtocol = s.ProxyProtocol
+
 	if s.TLS != nil {
 		config, err := NewTLSConfig(s.TLS)
 		if err != nil {
@@ -443,11 +1223,466 @@ func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
 	return t, nil
 }
 
+func checkProxyProtocol(v string) error {
+	switch v {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return nil
+	}
+	return fmt.Errorf("unsupported PROXY protocol version '%s', supported versions are %s and %s", v, ProxyProtocolV1, ProxyProtocolV2)
+}
+
+// HealthCheckSettings returns the parsed health check settings with defaults applied,
+// nil is returned if the health checks are not enabled
+func (b *Backend) HealthCheckSettings() (*HealthCheckSettings, error) {
+	return healthCheckSettings(b.Settings.(HTTPBackendSettings))
+}
+
+func healthCheckSettings(s HTTPBackendSettings) (*HealthCheckSettings, error) {
+	if s.HealthCheck == nil {
+		return nil, nil
+	}
+	c := s.HealthCheck
+	if !strings.HasPrefix(c.Path, "/") {
+		return nil, fmt.Errorf("health check path should start with /, got '%s'", c.Path)
+	}
+	h := &HealthCheckSettings{
+		Path:               c.Path,
+		Interval:           DefaultHealthCheckInterval,
+		Timeout:            DefaultHealthCheckTimeout,
+		MinStatus:          http.StatusOK,
+		MaxStatus:          http.StatusBadRequest - 1,
+		HealthyThreshold:   DefaultHealthyThreshold,
+		UnhealthyThreshold: DefaultUnhealthyThreshold,
+	}
+	var err error
+	if len(c.Interval) != 0 {
+		if h.Interval, err = time.ParseDuration(c.Interval); err != nil {
+			return nil, fmt.Errorf("invalid health check interval: %s", err)
+		}
+		if h.Interval <= 0 {
+			return nil, fmt.Errorf("health check interval should be > 0, got %s", c.Interval)
+		}
+	}
+	if len(c.Timeout) != 0 {
+		if h.Timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid health check timeout: %s", err)
+		}
+	}
+	if c.MinStatus != 0 {
+		h.MinStatus = c.MinStatus
+	}
+	if c.MaxStatus != 0 {
+		h.MaxStatus = c.MaxStatus
+	}
+	if h.MinStatus > h.MaxStatus {
+		return nil, fmt.Errorf("health check status range %d-%d is empty", h.MinStatus, h.MaxStatus)
+	}
+	if c.HealthyThreshold < 0 || c.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("health check thresholds should be >= 0")
+	}
+	if c.HealthyThreshold != 0 {
+		h.HealthyThreshold = c.HealthyThreshold
+	}
+	if c.UnhealthyThreshold != 0 {
+		h.UnhealthyThreshold = c.UnhealthyThreshold
+	}
+	return h, nil
+}
+
+// RetrySettings returns the parsed retry settings with defaults applied,
+// nil is returned if the retries are not enabled
+func (f *Frontend) RetrySettings() (*RetrySettings, error) {
+	return retrySettings(f.HTTPSettings())
+}
+
+func retrySettings(s HTTPFrontendSettings) (*RetrySettings, error) {
+	if s.Retry == nil {
+		return nil, nil
+	}
+	r := s.Retry
+	if r.Attempts < 1 || r.Attempts > MaxRetryAttempts {
+		return nil, fmt.Errorf("retry attempts should be in range 1-%d, got %d", MaxRetryAttempts, r.Attempts)
+	}
+	o := &RetrySettings{
+		Attempts:         r.Attempts,
+		Backoff:          DefaultRetryBackoff,
+		MaxBackoff:       DefaultRetryMaxBackoff,
+		Methods:          []string{"GET", "HEAD", "OPTIONS"},
+		StatusCodes:      r.StatusCodes,
+		BudgetPercent:    DefaultRetryBudgetPercent,
+		BudgetMinRetries: DefaultRetryBudgetMinRetries,
+	}
+	var err error
+	if len(r.TryTimeout) != 0 {
+		if o.TryTimeout, err = time.ParseDuration(r.TryTimeout); err != nil {
+			return nil, fmt.Errorf("invalid retry try timeout: %s", err)
+		}
+		if o.TryTimeout <= 0 {
+			return nil, fmt.Errorf("retry try timeout should be > 0, got %s", r.TryTimeout)
+		}
+	}
+	if len(r.Backoff) != 0 {
+		if o.Backoff, err = time.ParseDuration(r.Backoff); err != nil {
+			return nil, fmt.Errorf("invalid retry backoff: %s", err)
+		}
+	}
+	if len(r.MaxBackoff) != 0 {
+		if o.MaxBackoff, err = time.ParseDuration(r.MaxBackoff); err != nil {
+			return nil, fmt.Errorf("invalid retry max backoff: %s", err)
+		}
+	}
+	if o.Backoff < 0 || o.MaxBackoff < o.Backoff {
+		return nil, fmt.Errorf("retry backoff should be >= 0 and <= max backoff, got %s and %s", o.Backoff, o.MaxBackoff)
+	}
+	if len(r.Methods) != 0 {
+		o.Methods = make([]string, len(r.Methods))
+		for i, m := range r.Methods {
+			if m == "" {
+				return nil, fmt.Errorf("retry method can not be empty")
+			}
+			o.Methods[i] = strings.ToUpper(m)
+		}
+	}
+	for _, c := range r.StatusCodes {
+		if c < 100 || c > 599 {
+			return nil, fmt.Errorf("retry status code should be in range 100-599, got %d", c)
+		}
+	}
+	b := r.Budget
+	if b.Percent < 0 || b.Percent > 100 {
+		return nil, fmt.Errorf("retry budget percent should be in range 0-100, got %d", b.Percent)
+	}
+	if b.MinRetries < 0 {
+		return nil, fmt.Errorf("retry budget min retries should be >= 0, got %d", b.MinRetries)
+	}
+	if b.Percent != 0 {
+		o.BudgetPercent = b.Percent
+	}
+	if b.MinRetries != 0 {
+		o.BudgetMinRetries = b.MinRetries
+	}
+	return o, nil
+}
+
+// ErrorPageSettings returns the parsed host error pages, nil is returned if the host has no error pages
+func (h *Host) ErrorPageSettings() (*ErrorPageSettings, error) {
+	return errorPageSettings(h.Settings.ErrorPages)
+}
+
+// ErrorPageSettings returns the parsed frontend error pages, nil is returned if the frontend has no error pages
+func (f *Frontend) ErrorPageSettings() (*ErrorPageSettings, error) {
+	return errorPageSettings(f.HTTPSettings().ErrorPages)
+}
+
+func errorPageSettings(p *ErrorPages) (*ErrorPageSettings, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if len(p.Pages) == 0 {
+		return nil, fmt.Errorf("supply at least one error page")
+	}
+	s := &ErrorPageSettings{BackendErrors: p.BackendErrors}
+	for i, page := range p.Pages {
+		if len(page.Codes) == 0 {
+			return nil, fmt.Errorf("error page %d: supply at least one status code", i)
+		}
+		if page.ContentType == "" {
+			return nil, fmt.Errorf("error page %d: supply the content type", i)
+		}
+		parsed := ParsedErrorPage{ContentType: page.ContentType}
+		for _, c := range page.Codes {
+			r, err := parseStatusCodeRange(c)
+			if err != nil {
+				return nil, fmt.Errorf("error page %d: %s", i, err)
+			}
+			parsed.Codes = append(parsed.Codes, r)
+		}
+		var err error
+		if strings.Contains(page.ContentType, "html") {
+			parsed.Template, err = htmltemplate.New("page").Funcs(htmltemplate.FuncMap{"json": toJSON}).Parse(page.Body)
+		} else {
+			parsed.Template, err = template.New("page").Funcs(template.FuncMap{"json": toJSON}).Parse(page.Body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error page %d: %s", i, err)
+		}
+		s.Pages = append(s.Pages, parsed)
+	}
+	return s, nil
+}
+
+// parseStatusCodeRange parses the status code or the range of the codes, e.g. "404" or "500-599"
+func parseStatusCodeRange(v string) (StatusCodeRange, error) {
+	vals := strings.SplitN(v, "-", 2)
+	if len(vals) == 1 {
+		vals = append(vals, vals[0])
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(vals[0]))
+	if err != nil {
+		return StatusCodeRange{}, fmt.Errorf("invalid status code range '%s'", v)
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(vals[1]))
+	if err != nil {
+		return StatusCodeRange{}, fmt.Errorf("invalid status code range '%s'", v)
+	}
+	if from < 400 || to > 599 || from > to {
+		return StatusCodeRange{}, fmt.Errorf("status code range should be within 400-599, got '%s'", v)
+	}
+	return StatusCodeRange{From: from, To: to}, nil
+}
+
+// toJSON lets the templates quote the values in the JSON pages
+func toJSON(v interface{}) (string, error) {
+	out, err := json.Marshal(v)
+	return string(out), err
+}
+
+// HTTPSRedirectSettings returns the parsed HTTPS redirect of the host, nil is returned if the host has no redirect
+// or no KeyPair
+func (h *Host) HTTPSRedirectSettings() (*HTTPSRedirectSettings, error) {
+	if h.Settings.KeyPair == nil {
+		return nil, nil
+	}
+	return httpsRedirectSettings(h.Settings.HTTPSRedirect)
+}
+
+func httpsRedirectSettings(r *HTTPSRedirect) (*HTTPSRedirectSettings, error) {
+	if r == nil {
+		return nil, nil
+	}
+	s := &HTTPSRedirectSettings{StatusCode: r.StatusCode, Port: r.Port, ExcludePaths: r.ExcludePaths}
+	switch s.StatusCode {
+	case 0:
+		s.StatusCode = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("HTTPS redirect status code should be 301, 302, 307 or 308, got %d", s.StatusCode)
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return nil, fmt.Errorf("HTTPS redirect port should be in range 1-65535, got %d", s.Port)
+	}
+	for _, p := range s.ExcludePaths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("HTTPS redirect excluded path should start with '/', got '%s'", p)
+		}
+	}
+	if h := r.HSTS; h != nil {
+		if h.MaxAge <= 0 {
+			return nil, fmt.Errorf("HSTS max age should be > 0, got %d", h.MaxAge)
+		}
+		if h.Preload && !h.IncludeSubdomains {
+			return nil, fmt.Errorf("HSTS preload requires including the subdomains")
+		}
+		s.HSTS = fmt.Sprintf("max-age=%d", h.MaxAge)
+		if h.IncludeSubdomains {
+			s.HSTS += "; includeSubDomains"
+		}
+		if h.Preload {
+			s.HSTS += "; preload"
+		}
+	}
+	return s, nil
+}
+
+// MaintenanceSettings returns the parsed host maintenance, nil is returned if the maintenance is off
+func (h *Host) MaintenanceSettings() (*MaintenanceSettings, error) {
+	return maintenanceSettings(h.Settings.Maintenance)
+}
+
+// MaintenanceSettings returns the parsed frontend maintenance, nil is returned if the maintenance is off
+func (f *Frontend) MaintenanceSettings() (*MaintenanceSettings, error) {
+	return maintenanceSettings(f.HTTPSettings().Maintenance)
+}
+
+// maintenanceSettings validates the maintenance settings even if the maintenance is off,
+// so the invalid settings are rejected before the maintenance is turned on
+func maintenanceSettings(m *Maintenance) (*MaintenanceSettings, error) {
+	if m == nil {
+		return nil, nil
+	}
+	s := &MaintenanceSettings{
+		StatusCode:   m.StatusCode,
+		ContentType:  m.ContentType,
+		Body:         m.Body,
+		RetryAfter:   m.RetryAfter,
+		AllowHeaders: m.AllowHeaders,
+	}
+	if s.StatusCode == 0 {
+		s.StatusCode = http.StatusServiceUnavailable
+	}
+	if s.StatusCode < 200 || s.StatusCode > 599 {
+		return nil, fmt.Errorf("maintenance status code should be in range 200-599, got %d", s.StatusCode)
+	}
+	if s.ContentType == "" {
+		s.ContentType = "text/plain; charset=utf-8"
+	}
+	if s.RetryAfter != "" {
+		if _, err := strconv.ParseUint(s.RetryAfter, 10, 32); err != nil {
+			if _, err := http.ParseTime(s.RetryAfter); err != nil {
+				return nil, fmt.Errorf("maintenance retry after should be seconds or HTTP date, got '%s'", s.RetryAfter)
+			}
+		}
+	}
+	for _, v := range m.AllowIPs {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid maintenance allowed IP '%s'", v)
+			}
+			s.AllowNets = append(s.AllowNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance allowed network '%s': %s", v, err)
+		}
+		s.AllowNets = append(s.AllowNets, n)
+	}
+	for k, v := range m.AllowHeaders {
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("maintenance allowed header name and value can not be empty")
+		}
+	}
+	if !m.Enabled {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// TimeoutSettings returns the parsed frontend timeouts, nil is returned if the timeouts are not set
+func (f *Frontend) TimeoutSettings() (*FrontendTimeouts, error) {
+	return frontendTimeouts(f.HTTPSettings())
+}
+
+func frontendTimeouts(s HTTPFrontendSettings) (*FrontendTimeouts, error) {
+	if s.Timeouts == nil {
+		return nil, nil
+	}
+	t := &FrontendTimeouts{}
+	vals := []struct {
+		name string
+		in   string
+		out  *time.Duration
+	}{
+		{"response header", s.Timeouts.ResponseHeader, &t.ResponseHeader},
+		{"total", s.Timeouts.Total, &t.Total},
+		{"body idle", s.Timeouts.BodyIdle, &t.BodyIdle},
+	}
+	for _, v := range vals {
+		if len(v.in) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(v.in)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s timeout: %s", v.name, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("%s timeout should be > 0, got %s", v.name, v.in)
+		}
+		*v.out = d
+	}
+	return t, nil
+}
+
+// OutlierEjectionSettings returns the parsed outlier ejection settings with defaults applied,
+// nil is returned if the outlier ejection is not enabled
+func (b *Backend) OutlierEjectionSettings() (*OutlierEjectionSettings, error) {
+	return outlierEjectionSettings(b.Settings.(HTTPBackendSettings))
+}
+
+func outlierEjectionSettings(s HTTPBackendSettings) (*OutlierEjectionSettings, error) {
+	if s.OutlierEjection == nil {
+		return nil, nil
+	}
+	e := s.OutlierEjection
+	o := &OutlierEjectionSettings{
+		Interval:           DefaultOutlierInterval,
+		BaseEjectionTime:   DefaultBaseEjectionTime,
+		MaxEjectionTime:    DefaultMaxEjectionTime,
+		MaxEjectionPercent: DefaultMaxEjectionPercent,
+	}
+	var err error
+	if len(e.Interval) != 0 {
+		if o.Interval, err = time.ParseDuration(e.Interval); err != nil {
+			return nil, fmt.Errorf("invalid outlier detection interval: %s", err)
+		}
+		if o.Interval <= 0 {
+			return nil, fmt.Errorf("outlier detection interval should be > 0, got %s", e.Interval)
+		}
+	}
+	if len(e.BaseEjectionTime) != 0 {
+		if o.BaseEjectionTime, err = time.ParseDuration(e.BaseEjectionTime); err != nil {
+			return nil, fmt.Errorf("invalid base ejection time: %s", err)
+		}
+	}
+	if len(e.MaxEjectionTime) != 0 {
+		if o.MaxEjectionTime, err = time.ParseDuration(e.MaxEjectionTime); err != nil {
+			return nil, fmt.Errorf("invalid max ejection time: %s", err)
+		}
+	}
+	if o.BaseEjectionTime <= 0 || o.MaxEjectionTime < o.BaseEjectionTime {
+		return nil, fmt.Errorf("ejection time should be > 0 and <= max ejection time, got %s and %s", o.BaseEjectionTime, o.MaxEjectionTime)
+	}
+	if e.MaxEjectionPercent < 0 || e.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("max ejection percent should be in range 0-100, got %d", e.MaxEjectionPercent)
+	}
+	if e.MaxEjectionPercent != 0 {
+		o.MaxEjectionPercent = e.MaxEjectionPercent
+	}
+	return o, nil
+}
+
+func checkStickySession(s *HTTPBackendStickySession) error {
+	if s == nil {
+		return nil
+	}
+	if s.CookieName == "" {
+		return fmt.Errorf("sticky session cookie name can not be empty")
+	}
+	if !isToken(s.CookieName) {
+		return fmt.Errorf("sticky session cookie name '%s' contains invalid characters", s.CookieName)
+	}
+	return nil
+}
+
+// isToken returns true if the value is a token as defined by RFC 2616, e.g. valid header or cookie name
+func isToken(v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, r := range v {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkLoadBalancer(l HTTPBackendLoadBalancer) error {
+	switch l.Strategy {
+	case "", RoundRobinLB, LeastConnLB, PowerOfTwoLB:
+		if l.Variable != "" {
+			return fmt.Errorf("variable is supported only by the %s load balancer", HashLB)
+		}
+		return nil
+	case HashLB:
+		if _, err := utils.NewExtractor(l.Variable); err != nil {
+			return fmt.Errorf("invalid hash variable: %s", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported load balancer: '%s'", l.Strategy)
+}
+
 // Server is a final destination of the request
 type Server struct {
 	Id    string
 	URL   string
 	Stats *RoundTripStats `json:",omitempty"`
+	// Weight sets the share of the traffic the server gets relative to the other servers of the backend,
+	// zero means the default weight of 1
+	Weight  int    `json:",omitempty"`
+	Version uint64 `json:",omitempty"`
 }
 
 func NewServer(id, u string) (*Server, error) {
@@ -460,6 +1695,19 @@ func NewServer(id, u string) (*Server, error) {
 	}, nil
 }
 
+// NewWeightedServer returns the server getting the share of the traffic proportional to the weight
+func NewWeightedServer(id, u string, weight int) (*Server, error) {
+	if weight < 0 {
+		return nil, fmt.Errorf("server weight should be >= 0, got %d", weight)
+	}
+	s, err := NewServer(id, u)
+	if err != nil {
+		return nil, err
+	}
+	s.Weight = weight
+	return s, nil
+}
+
 func (e *Server) String() string {
 	return fmt.Sprintf("HTTPServer(%s, %s, %s)", e.Id, e.URL, e.Stats)
 }
@@ -488,6 +1736,63 @@ type RoundTripStats struct {
 	Verdict         Verdict
 	Counters        Counters
 	LatencyBrackets LatencyBrackets
+	// Health is the state reported by the active health checks, set only for the servers
+	// of the backends with the health checks enabled
+	Health *ServerHealth `json:",omitempty"`
+	// Ejection is the state reported by the outlier ejection, set only for the servers
+	// of the backends with the outlier ejection enabled
+	Ejection *ServerEjection `json:",omitempty"`
+	// Splits contain the stats of every backend, set only for the frontends splitting the traffic
+	Splits []SplitStats `json:",omitempty"`
+	// Mirror contains the stats of the requests copied to the shadow backend, set only for the frontends
+	// mirroring the requests. Weight is the percentage of the copied requests.
+	Mirror *SplitStats `json:",omitempty"`
+	// Retries counts the retried requests, set only for the frontends with the retry settings
+	Retries *RetryStats `json:",omitempty"`
+	// Timeouts counts the timed out requests, set only for the frontends with the timeouts
+	Timeouts *TimeoutStats `json:",omitempty"`
+}
+
+// TimeoutStats count the frontend requests timed out by every timeout
+type TimeoutStats struct {
+	ResponseHeader int64
+	Total          int64
+	BodyIdle       int64
+}
+
+// RetryStats are the retry counters of the frontend
+type RetryStats struct {
+	// Retries is the number of the attempts sent after the first one
+	Retries int64
+	// BudgetExhausted is the number of the retries denied by the retry budget
+	BudgetExhausted int64
+}
+
+// SplitStats are the stats of the frontend requests sent to one of the backends
+type SplitStats struct {
+	BackendId string
+	Weight    int
+	Stats     RoundTripStats
+}
+
+// ServerEjection is the state of the server reported by the outlier ejection
+type ServerEjection struct {
+	Ejected bool
+	// Until is the time the ejected server gets back to the rotation
+	Until time.Time
+	// Ejections is the number of the recent consecutive ejections defining the ejection period
+	Ejections int
+	// Reason lists the anomalies the server has been ejected for
+	Reason string `json:",omitempty"`
+}
+
+// ServerHealth is the state of the server reported by the active health checks
+type ServerHealth struct {
+	Healthy bool
+	// Checked is the time of the last check, zero if the server has not been checked yet
+	Checked time.Time
+	// Error describes the last failed check
+	Error string `json:",omitempty"`
 }
 
 func NewRoundTripStats(m *memmetrics.RTMetrics) (*RoundTripStats, error) {
@@ -610,6 +1915,28 @@ func (n *AlreadyExistsError) Error() string {
 	return n.Message
 }
 
+// ConflictError is returned when the version passed to upsert or delete does not match the current version of the object
+type ConflictError struct {
+	Message string
+}
+
+func (n *ConflictError) Error() string {
+	if n.Message != "" {
+		return n.Message
+	} else {
+		return "Version conflict"
+	}
+}
+
+// CheckVersion returns ConflictError if the version is not zero and does not match the current version of the object
+// identified by the key. Current version of the missing object is 0.
+func CheckVersion(key interface{}, version, current uint64) error {
+	if version == 0 || version == current {
+		return nil
+	}
+	return &ConflictError{Message: fmt.Sprintf("%v version %d does not match the current version %d", key, version, current)}
+}
+
 type Counters struct {
 	Period      time.Duration
 	NetErrors   int64
@@ -689,6 +2016,189 @@ const (
 	NoTTL = 0
 )
 
+// HTTP protocols spoken to the backend servers
+const (
+	// HTTP1Protocol is HTTP/1.1, the default
+	HTTP1Protocol = "http/1.1"
+	// H2Protocol is HTTP/2 negotiated with ALPN over TLS, the plain text connections use HTTP/1.1
+	H2Protocol = "h2"
+	// H2CProtocol is HTTP/2 over TLS and plain text HTTP/2 with prior knowledge, the servers must support it
+	H2CProtocol = "h2c"
+)
+
+// PROXY protocol versions sent to the backend servers
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// DefaultTCPIdleTimeout closes the tcp connections with no data sent in either direction
+const DefaultTCPIdleTimeout = 10 * time.Minute
+
+// DefaultUpgradeIdleTimeout closes the upgraded connections with no data sent in either direction
+const DefaultUpgradeIdleTimeout = 10 * time.Minute
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthyThreshold    = 2
+	DefaultUnhealthyThreshold  = 3
+)
+
+// HealthCheckSettings are the health check parameters parsed from HTTPBackendHealthCheck
+type HealthCheckSettings struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	MinStatus          int
+	MaxStatus          int
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+const (
+	DefaultOutlierInterval    = 10 * time.Second
+	DefaultBaseEjectionTime   = 30 * time.Second
+	DefaultMaxEjectionTime    = 5 * time.Minute
+	DefaultMaxEjectionPercent = 50
+)
+
+const (
+	// MaxRetryAttempts caps the attempts of the frontend requests
+	MaxRetryAttempts             = 10
+	DefaultRetryBackoff          = 25 * time.Millisecond
+	DefaultRetryMaxBackoff       = 250 * time.Millisecond
+	DefaultRetryBudgetPercent    = 20
+	DefaultRetryBudgetMinRetries = 3
+)
+
+// RetrySettings are the retry parameters parsed from HTTPFrontendRetry
+type RetrySettings struct {
+	Attempts         int
+	TryTimeout       time.Duration
+	Backoff          time.Duration
+	MaxBackoff       time.Duration
+	Methods          []string
+	StatusCodes      []int
+	BudgetPercent    int
+	BudgetMinRetries int
+}
+
+// HTTPSRedirectSettings are the parsed settings of the HTTPS redirect
+type HTTPSRedirectSettings struct {
+	StatusCode   int
+	Port         int
+	ExcludePaths []string
+	// HSTS is the value of the Strict-Transport-Security header, empty if not set
+	HSTS string
+}
+
+// Excluded returns true if the path is served over plain HTTP
+func (s *HTTPSRedirectSettings) Excluded(path string) bool {
+	for _, p := range s.ExcludePaths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceSettings are the parsed settings of the enabled maintenance
+type MaintenanceSettings struct {
+	StatusCode   int
+	ContentType  string
+	Body         string
+	RetryAfter   string
+	AllowNets    []*net.IPNet
+	AllowHeaders map[string]string
+}
+
+// Bypass returns true if the request is allowed to bypass the maintenance
+func (s *MaintenanceSettings) Bypass(req *http.Request) bool {
+	for k, v := range s.AllowHeaders {
+		if got := req.Header.Get(k); got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(v)) == 1 {
+			return true
+		}
+	}
+	if len(s.AllowNets) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.AllowNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorPageSettings are the error pages parsed from ErrorPages
+type ErrorPageSettings struct {
+	Pages         []ParsedErrorPage
+	BackendErrors bool
+}
+
+// Page returns the first page matching the status code, nil if none matches
+func (s *ErrorPageSettings) Page(code int) *ParsedErrorPage {
+	for i := range s.Pages {
+		for _, r := range s.Pages[i].Codes {
+			if code >= r.From && code <= r.To {
+				return &s.Pages[i]
+			}
+		}
+	}
+	return nil
+}
+
+// ParsedErrorPage is the error page with the parsed codes and body template
+type ParsedErrorPage struct {
+	Codes       []StatusCodeRange
+	ContentType string
+	Template    ErrorPageTemplate
+}
+
+// ErrorPageTemplate is implemented by both text and html templates
+type ErrorPageTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// ErrorPageData is passed to the error page templates
+type ErrorPageData struct {
+	StatusCode int
+	StatusText string
+	Method     string
+	Host       string
+	Path       string
+}
+
+// StatusCodeRange includes the status codes From through To
+type StatusCodeRange struct {
+	From int
+	To   int
+}
+
+// FrontendTimeouts are the timeouts parsed from HTTPFrontendTimeouts, zero timeout is not set
+type FrontendTimeouts struct {
+	ResponseHeader time.Duration
+	Total          time.Duration
+	BodyIdle       time.Duration
+}
+
+// OutlierEjectionSettings are the outlier ejection parameters parsed from HTTPBackendOutlierEjection
+type OutlierEjectionSettings struct {
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int
+}
+
 type TransportTimeouts struct {
 	// Socket read timeout (before we receive the first reply header)
 	Read time.Duration
@@ -696,6 +2206,8 @@ type TransportTimeouts struct {
 	Dial time.Duration
 	// TLS handshake timeout
 	TLSHandshake time.Duration
+	// Idle timeout of the upgraded connections
+	UpgradeIdle time.Duration
 }
 
 type TransportKeepAlive struct {
@@ -705,8 +2217,24 @@ type TransportKeepAlive struct {
 	MaxIdleConnsPerHost int
 }
 
+type TCPTransportTimeouts struct {
+	Dial time.Duration
+	Idle time.Duration
+}
+
+// TCPTransportSettings are the tcp backend settings parsed from TCPBackendSettings
+type TCPTransportSettings struct {
+	Timeouts TCPTransportTimeouts
+	// ProxyProtocol is the PROXY protocol version sent to the servers, empty if it is turned off
+	ProxyProtocol string
+}
+
 type TransportSettings struct {
 	Timeouts  TransportTimeouts
 	KeepAlive TransportKeepAlive
 	TLS       *tls.Config
+	// Protocol is one of HTTP1Protocol, H2Protocol or H2CProtocol
+	Protocol string
+	// ProxyProtocol is the PROXY protocol version sent to the servers, empty if it is turned off
+	ProxyProtocol string
 }
@@ -1,8 +1,10 @@
 package engine
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"net/http"
 	"testing"
 	"time"
 
@@ -32,6 +34,213 @@ func (s *BackendSuite) TestHostBad(c *C) {
 	c.Assert(h, IsNil)
 }
 
+func (s *BackendSuite) TestHostPassthrough(c *C) {
+	h, err := NewHost("localhost", HostSettings{Passthrough: &HostPassthrough{BackendId: "b1"}})
+	c.Assert(err, IsNil)
+	c.Assert(h.String(), Equals, "Host(localhost, passthrough=b1)")
+
+	bad := []HostSettings{
+		{Passthrough: &HostPassthrough{}},
+		{Passthrough: &HostPassthrough{BackendId: "b1"}, KeyPair: &KeyPair{Key: []byte("a"), Cert: []byte("b")}},
+		{Passthrough: &HostPassthrough{BackendId: "b1"}, OCSP: OCSPSettings{Enabled: true}},
+	}
+	for _, settings := range bad {
+		_, err := NewHost("localhost", settings)
+		c.Assert(err, NotNil)
+	}
+
+	h, err = HostFromJSON([]byte(`{"Name": "localhost", "Settings": {"Passthrough": {"BackendId": "b1"}}}`))
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.Passthrough.BackendId, Equals, "b1")
+}
+
+func (s *BackendSuite) TestHostWildcard(c *C) {
+	h, err := NewHost("*.example.com", HostSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(h.Name, Equals, "*.example.com")
+
+	for _, name := range []string{"*", "*.com", "a.*.example.com", "*a.example.com", "*.*.example.com", "*.example.com."} {
+		_, err := NewHost(name, HostSettings{})
+		c.Assert(err, NotNil, Commentf("%s", name))
+	}
+
+	c.Assert(WildcardHostname("a.example.com"), Equals, "*.example.com")
+	c.Assert(WildcardHostname("b.a.example.com"), Equals, "*.a.example.com")
+	c.Assert(WildcardHostname("example.com"), Equals, "")
+	c.Assert(WildcardHostname("localhost"), Equals, "")
+}
+
+func (s *BackendSuite) TestHostKeyPairs(c *C) {
+	kp := KeyPair{Key: []byte("a"), Cert: []byte("b")}
+	rsa := KeyPair{Key: []byte("c"), Cert: []byte("d")}
+
+	h, err := NewHost("localhost", HostSettings{KeyPair: &kp, KeyPairs: []KeyPair{rsa}})
+	c.Assert(err, IsNil)
+	c.Assert(h.KeyPairs(), DeepEquals, []KeyPair{kp, rsa})
+	c.Assert(h.String(), Equals, "Host(localhost, keyPairs=2, ocsp=false)")
+
+	h, err = NewHost("localhost", HostSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(h.KeyPairs(), IsNil)
+
+	// Additional key pairs go along with the key pair
+	_, err = NewHost("localhost", HostSettings{KeyPairs: []KeyPair{rsa}})
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestHostACME(c *C) {
+	h, err := NewHost("example.com", HostSettings{ACME: &HostACME{Enabled: true}})
+	c.Assert(err, IsNil)
+	c.Assert(h.ACMEEnabled(), Equals, true)
+	h.ACME = &ACMEState{Challenges: map[string]string{"token": "token.thumbprint"}}
+	keyAuth, ok := h.ACMEChallenge("token")
+	c.Assert(ok, Equals, true)
+	c.Assert(keyAuth, Equals, "token.thumbprint")
+	_, ok = h.ACMEChallenge("other")
+	c.Assert(ok, Equals, false)
+
+	h, err = NewHost("example.com", HostSettings{})
+	c.Assert(err, IsNil)
+	_, ok = h.ACMEChallenge("token")
+	c.Assert(ok, Equals, false)
+
+	// HTTP-01 challenges validate the exact hostnames only, the servers terminate TLS of the passthrough hosts
+	_, err = NewHost("*.example.com", HostSettings{ACME: &HostACME{Enabled: true}})
+	c.Assert(err, NotNil)
+	_, err = NewHost("example.com", HostSettings{ACME: &HostACME{Enabled: true}, Passthrough: &HostPassthrough{BackendId: "b1"}})
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestErrorPages(c *C) {
+	pages := &ErrorPages{Pages: []ErrorPage{
+		{Codes: []string{"404"}, ContentType: "text/html", Body: "<h1>{{.Path}} not found</h1>"},
+		{Codes: []string{"500-503", "504"}, ContentType: "application/json", Body: `{"error": {{json .StatusText}}}`},
+	}}
+	h, err := NewHost("localhost", HostSettings{ErrorPages: pages})
+	c.Assert(err, IsNil)
+	p, err := h.ErrorPageSettings()
+	c.Assert(err, IsNil)
+	c.Assert(p.Page(403), IsNil)
+	c.Assert(p.Page(404).Codes, DeepEquals, []StatusCodeRange{{From: 404, To: 404}})
+	c.Assert(p.Page(504).Codes, DeepEquals, []StatusCodeRange{{From: 500, To: 503}, {From: 504, To: 504}})
+
+	// HTML pages are escaped, JSON values are quoted
+	out := &bytes.Buffer{}
+	c.Assert(p.Page(404).Template.Execute(out, ErrorPageData{Path: "/<script>"}), IsNil)
+	c.Assert(out.String(), Equals, "<h1>/&lt;script&gt; not found</h1>")
+	out.Reset()
+	c.Assert(p.Page(502).Template.Execute(out, ErrorPageData{StatusText: `Bad "Gateway"`}), IsNil)
+	c.Assert(out.String(), Equals, `{"error": "Bad \"Gateway\""}`)
+
+	f, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{ErrorPages: pages})
+	c.Assert(err, IsNil)
+	p, err = f.ErrorPageSettings()
+	c.Assert(err, IsNil)
+	c.Assert(p.Pages, HasLen, 2)
+
+	bad := []*ErrorPages{
+		{},
+		{Pages: []ErrorPage{{ContentType: "text/html"}}},
+		{Pages: []ErrorPage{{Codes: []string{"404"}}}},
+		{Pages: []ErrorPage{{Codes: []string{"200"}, ContentType: "text/html"}}},
+		{Pages: []ErrorPage{{Codes: []string{"599-500"}, ContentType: "text/html"}}},
+		{Pages: []ErrorPage{{Codes: []string{"5xx"}, ContentType: "text/html"}}},
+		{Pages: []ErrorPage{{Codes: []string{"404"}, ContentType: "text/html", Body: "{{.Path"}}},
+	}
+	for _, pages := range bad {
+		_, err := NewHost("localhost", HostSettings{ErrorPages: pages})
+		c.Assert(err, NotNil, Commentf("%v", pages))
+		_, err = NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{ErrorPages: pages})
+		c.Assert(err, NotNil, Commentf("%v", pages))
+	}
+}
+
+func (s *BackendSuite) TestMaintenance(c *C) {
+	m := &Maintenance{
+		Enabled:      true,
+		Body:         "back soon",
+		RetryAfter:   "120",
+		AllowIPs:     []string{"10.0.0.0/8", "192.168.1.1"},
+		AllowHeaders: map[string]string{"X-Maintenance-Bypass": "secret"},
+	}
+	h, err := NewHost("localhost", HostSettings{Maintenance: m})
+	c.Assert(err, IsNil)
+	ms, err := h.MaintenanceSettings()
+	c.Assert(err, IsNil)
+	c.Assert(ms.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(ms.ContentType, Equals, "text/plain; charset=utf-8")
+	c.Assert(ms.Body, Equals, "back soon")
+
+	bypass := func(remoteAddr string, header http.Header) bool {
+		req := &http.Request{RemoteAddr: remoteAddr, Header: header}
+		return ms.Bypass(req)
+	}
+	c.Assert(bypass("10.1.2.3:5000", http.Header{}), Equals, true)
+	c.Assert(bypass("192.168.1.1:5000", http.Header{}), Equals, true)
+	c.Assert(bypass("192.168.1.2:5000", http.Header{}), Equals, false)
+	c.Assert(bypass("192.168.1.2:5000", http.Header{"X-Maintenance-Bypass": []string{"secret"}}), Equals, true)
+	c.Assert(bypass("192.168.1.2:5000", http.Header{"X-Maintenance-Bypass": []string{"wrong"}}), Equals, false)
+
+	// Disabled maintenance keeps the settings
+	m.Enabled = false
+	f, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{Maintenance: m})
+	c.Assert(err, IsNil)
+	ms, err = f.MaintenanceSettings()
+	c.Assert(err, IsNil)
+	c.Assert(ms, IsNil)
+
+	bad := []*Maintenance{
+		{StatusCode: 700},
+		{RetryAfter: "soon"},
+		{AllowIPs: []string{"10.0.0.300"}},
+		{AllowIPs: []string{"10.0.0.0/40"}},
+		{AllowHeaders: map[string]string{"X-Bypass": ""}},
+	}
+	for _, m := range bad {
+		_, err := NewHost("localhost", HostSettings{Maintenance: m})
+		c.Assert(err, NotNil, Commentf("%v", m))
+		_, err = NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{Maintenance: m})
+		c.Assert(err, NotNil, Commentf("%v", m))
+	}
+
+	_, err = NewHost("localhost", HostSettings{Maintenance: &Maintenance{Enabled: true, RetryAfter: "Wed, 21 Oct 2026 07:28:00 GMT"}})
+	c.Assert(err, IsNil)
+}
+
+func (s *BackendSuite) TestHTTPSRedirect(c *C) {
+	keyPair := &KeyPair{Key: []byte("a"), Cert: []byte("b")}
+	h, err := NewHost("localhost", HostSettings{KeyPair: keyPair, HTTPSRedirect: &HTTPSRedirect{
+		ExcludePaths: []string{"/.well-known/acme-challenge/"},
+		HSTS:         &HSTS{MaxAge: 31536000, IncludeSubdomains: true, Preload: true},
+	}})
+	c.Assert(err, IsNil)
+	r, err := h.HTTPSRedirectSettings()
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, http.StatusMovedPermanently)
+	c.Assert(r.HSTS, Equals, "max-age=31536000; includeSubDomains; preload")
+	c.Assert(r.Excluded("/.well-known/acme-challenge/token"), Equals, true)
+	c.Assert(r.Excluded("/home"), Equals, false)
+
+	// Redirect applies to the hosts with the key pair only
+	h, err = NewHost("localhost", HostSettings{HTTPSRedirect: &HTTPSRedirect{}})
+	c.Assert(err, IsNil)
+	r, err = h.HTTPSRedirectSettings()
+	c.Assert(err, IsNil)
+	c.Assert(r, IsNil)
+
+	bad := []*HTTPSRedirect{
+		{StatusCode: 200},
+		{Port: 70000},
+		{ExcludePaths: []string{"acme"}},
+		{HSTS: &HSTS{}},
+		{HSTS: &HSTS{MaxAge: 100, Preload: true}},
+	}
+	for _, redirect := range bad {
+		_, err := NewHost("localhost", HostSettings{KeyPair: keyPair, HTTPSRedirect: redirect})
+		c.Assert(err, NotNil, Commentf("%v", redirect))
+	}
+}
+
 func (s *BackendSuite) TestFrontendDefaults(c *C) {
 	f, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
 	c.Assert(err, IsNil)
@@ -87,12 +296,243 @@ func (s *BackendSuite) TestFrontendBadOptions(c *C) {
 	}
 }
 
+func (s *BackendSuite) TestFrontendTrafficSplit(c *C) {
+	split := func(splits ...HTTPFrontendSplit) HTTPFrontendSettings {
+		return HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: splits, Header: "X-Backend"}}
+	}
+	f, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, split(HTTPFrontendSplit{"b2", 10}, HTTPFrontendSplit{"b3", 0}))
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendIds(), DeepEquals, []string{"b1", "b2", "b3"})
+	c.Assert(f.UsesBackend("b3"), Equals, true)
+	c.Assert(f.UsesBackend("b4"), Equals, false)
+
+	bad := []HTTPFrontendSettings{
+		split(),
+		split(HTTPFrontendSplit{"", 10}),
+		split(HTTPFrontendSplit{"b1", 10}),
+		split(HTTPFrontendSplit{"b2", 10}, HTTPFrontendSplit{"b2", 10}),
+		split(HTTPFrontendSplit{"b2", -1}),
+		split(HTTPFrontendSplit{"b2", 60}, HTTPFrontendSplit{"b3", 50}),
+		HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}, Cookie: "bad cookie"}},
+	}
+	for _, settings := range bad {
+		_, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, settings)
+		c.Assert(err, NotNil, Commentf("%v", settings.TrafficSplit))
+	}
+}
+
+func (s *BackendSuite) TestFrontendMirror(c *C) {
+	settings := HTTPFrontendSettings{
+		TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}},
+		Mirror:       &HTTPFrontendMirror{BackendId: "b3", Percent: 5},
+	}
+	f, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendIds(), DeepEquals, []string{"b1", "b2", "b3"})
+
+	bad := []HTTPFrontendSettings{
+		{Mirror: &HTTPFrontendMirror{Percent: 5}},
+		{Mirror: &HTTPFrontendMirror{BackendId: "b1", Percent: 5}},
+		{Mirror: &HTTPFrontendMirror{BackendId: "b3", Percent: 101}},
+		{
+			TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}},
+			Mirror:       &HTTPFrontendMirror{BackendId: "b2", Percent: 5},
+		},
+	}
+	for _, settings := range bad {
+		_, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, settings)
+		c.Assert(err, NotNil, Commentf("%v", settings.Mirror))
+	}
+}
+
+func (s *BackendSuite) TestFrontendRetry(c *C) {
+	settings := HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 3, Methods: []string{"get", "post"}}}
+	f, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+	r, err := f.RetrySettings()
+	c.Assert(err, IsNil)
+	c.Assert(r, DeepEquals, &RetrySettings{
+		Attempts:         3,
+		Backoff:          DefaultRetryBackoff,
+		MaxBackoff:       DefaultRetryMaxBackoff,
+		Methods:          []string{"GET", "POST"},
+		BudgetPercent:    DefaultRetryBudgetPercent,
+		BudgetMinRetries: DefaultRetryBudgetMinRetries,
+	})
+
+	settings.Retry = &HTTPFrontendRetry{
+		Attempts:    2,
+		TryTimeout:  "2s",
+		Backoff:     "10ms",
+		MaxBackoff:  "1s",
+		StatusCodes: []int{503},
+		Budget:      HTTPFrontendRetryBudget{Percent: 50, MinRetries: 1},
+	}
+	f, err = NewHTTPFrontend("f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+	r, err = f.RetrySettings()
+	c.Assert(err, IsNil)
+	c.Assert(r.TryTimeout, Equals, 2*time.Second)
+	c.Assert(r.Backoff, Equals, 10*time.Millisecond)
+	c.Assert(r.MaxBackoff, Equals, time.Second)
+	c.Assert(r.Methods, DeepEquals, []string{"GET", "HEAD", "OPTIONS"})
+	c.Assert(r.BudgetPercent, Equals, 50)
+	c.Assert(r.BudgetMinRetries, Equals, 1)
+
+	f, err = NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	r, err = f.RetrySettings()
+	c.Assert(err, IsNil)
+	c.Assert(r, IsNil)
+
+	bad := []HTTPFrontendSettings{
+		{Retry: &HTTPFrontendRetry{}},
+		{Retry: &HTTPFrontendRetry{Attempts: MaxRetryAttempts + 1}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2, TryTimeout: "bad"}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2, TryTimeout: "-1s"}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2, Backoff: "1s", MaxBackoff: "10ms"}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2, Methods: []string{""}}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2, StatusCodes: []int{700}}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2, Budget: HTTPFrontendRetryBudget{Percent: 101}}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2, Budget: HTTPFrontendRetryBudget{MinRetries: -1}}},
+		{Retry: &HTTPFrontendRetry{Attempts: 2}, FailoverPredicate: "IsNetworkError()"},
+	}
+	for _, settings := range bad {
+		_, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, settings)
+		c.Assert(err, NotNil, Commentf("%v", settings.Retry))
+	}
+}
+
+func (s *BackendSuite) TestFrontendTimeouts(c *C) {
+	settings := HTTPFrontendSettings{Timeouts: &HTTPFrontendTimeouts{ResponseHeader: "5s", BodyIdle: "30s"}}
+	f, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+	t, err := f.TimeoutSettings()
+	c.Assert(err, IsNil)
+	c.Assert(t, DeepEquals, &FrontendTimeouts{ResponseHeader: 5 * time.Second, BodyIdle: 30 * time.Second})
+
+	f, err = NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	t, err = f.TimeoutSettings()
+	c.Assert(err, IsNil)
+	c.Assert(t, IsNil)
+
+	bad := []HTTPFrontendTimeouts{
+		{ResponseHeader: "bad"},
+		{Total: "0s"},
+		{BodyIdle: "-1s"},
+	}
+	for _, timeouts := range bad {
+		timeouts := timeouts
+		_, err := NewHTTPFrontend("f1", "b1", `Path("/home")`, HTTPFrontendSettings{Timeouts: &timeouts})
+		c.Assert(err, NotNil, Commentf("%v", timeouts))
+	}
+}
+
+func (s *BackendSuite) TestFrontendSettingsEq(c *C) {
+	options := []struct {
+		a HTTPFrontendSettings
+		b HTTPFrontendSettings
+		e bool
+	}{
+		{HTTPFrontendSettings{}, HTTPFrontendSettings{}, true},
+		{HTTPFrontendSettings{Hostname: "a"}, HTTPFrontendSettings{Hostname: "b"}, false},
+		{
+			HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}}},
+			HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}}},
+			true,
+		},
+		{
+			HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}}},
+			HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 20}}}},
+			false,
+		},
+		{
+			HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}}},
+			HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{Splits: []HTTPFrontendSplit{{"b2", 10}}, Header: "X-Backend"}},
+			false,
+		},
+		{HTTPFrontendSettings{TrafficSplit: &HTTPFrontendTrafficSplit{}}, HTTPFrontendSettings{}, false},
+		{
+			HTTPFrontendSettings{Mirror: &HTTPFrontendMirror{BackendId: "b3", Percent: 5}},
+			HTTPFrontendSettings{Mirror: &HTTPFrontendMirror{BackendId: "b3", Percent: 5}},
+			true,
+		},
+		{
+			HTTPFrontendSettings{Mirror: &HTTPFrontendMirror{BackendId: "b3", Percent: 5}},
+			HTTPFrontendSettings{Mirror: &HTTPFrontendMirror{BackendId: "b3", Percent: 10}},
+			false,
+		},
+		{HTTPFrontendSettings{Mirror: &HTTPFrontendMirror{BackendId: "b3"}}, HTTPFrontendSettings{}, false},
+		{
+			HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 2, StatusCodes: []int{503}}},
+			HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 2, StatusCodes: []int{503}}},
+			true,
+		},
+		{
+			HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 2, StatusCodes: []int{503}}},
+			HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 2, StatusCodes: []int{502}}},
+			false,
+		},
+		{
+			HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 2, Budget: HTTPFrontendRetryBudget{Percent: 10}}},
+			HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 2}},
+			false,
+		},
+		{HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 2}}, HTTPFrontendSettings{}, false},
+		{
+			HTTPFrontendSettings{Timeouts: &HTTPFrontendTimeouts{Total: "1m"}},
+			HTTPFrontendSettings{Timeouts: &HTTPFrontendTimeouts{Total: "1m"}},
+			true,
+		},
+		{
+			HTTPFrontendSettings{Timeouts: &HTTPFrontendTimeouts{Total: "1m"}},
+			HTTPFrontendSettings{Timeouts: &HTTPFrontendTimeouts{Total: "2m"}},
+			false,
+		},
+		{HTTPFrontendSettings{Timeouts: &HTTPFrontendTimeouts{Total: "1m"}}, HTTPFrontendSettings{}, false},
+		{
+			HTTPFrontendSettings{Maintenance: &Maintenance{Enabled: true, AllowHeaders: map[string]string{"X-Bypass": "a"}}},
+			HTTPFrontendSettings{Maintenance: &Maintenance{Enabled: true, AllowHeaders: map[string]string{"X-Bypass": "a"}}},
+			true,
+		},
+		{
+			HTTPFrontendSettings{Maintenance: &Maintenance{Enabled: true}},
+			HTTPFrontendSettings{Maintenance: &Maintenance{Enabled: false}},
+			false,
+		},
+		{
+			HTTPFrontendSettings{Maintenance: &Maintenance{Enabled: true, AllowHeaders: map[string]string{"X-Bypass": "a"}}},
+			HTTPFrontendSettings{Maintenance: &Maintenance{Enabled: true, AllowHeaders: map[string]string{"X-Other": "a"}}},
+			false,
+		},
+		{
+			HTTPFrontendSettings{ErrorPages: &ErrorPages{Pages: []ErrorPage{{Codes: []string{"404"}, ContentType: "text/html", Body: "a"}}}},
+			HTTPFrontendSettings{ErrorPages: &ErrorPages{Pages: []ErrorPage{{Codes: []string{"404"}, ContentType: "text/html", Body: "a"}}}},
+			true,
+		},
+		{
+			HTTPFrontendSettings{ErrorPages: &ErrorPages{Pages: []ErrorPage{{Codes: []string{"404"}, ContentType: "text/html", Body: "a"}}}},
+			HTTPFrontendSettings{ErrorPages: &ErrorPages{Pages: []ErrorPage{{Codes: []string{"404"}, ContentType: "text/html", Body: "b"}}}},
+			false,
+		},
+	}
+	for i, o := range options {
+		c.Assert(o.a.Equals(o.b), Equals, o.e, Commentf("Test case %d failed", i))
+	}
+}
+
 func (s *BackendSuite) TestBackendNew(c *C) {
 	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
 	c.Assert(err, IsNil)
 	c.Assert(b.Type, Equals, HTTP)
 	c.Assert(b.GetId(), Equals, "b1")
 	c.Assert(b.String(), Not(Equals), "")
+
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.Timeouts.UpgradeIdle, Equals, DefaultUpgradeIdleTimeout)
+	c.Assert(o.Protocol, Equals, HTTP1Protocol)
 }
 
 func (s *BackendSuite) TestNewBackendWithOptions(c *C) {
@@ -101,6 +541,7 @@ func (s *BackendSuite) TestNewBackendWithOptions(c *C) {
 			Read:         "1s",
 			Dial:         "2s",
 			TLSHandshake: "3s",
+			UpgradeIdle:  "5s",
 		},
 		KeepAlive: HTTPBackendKeepAlive{
 			Period:              "4s",
@@ -117,6 +558,7 @@ func (s *BackendSuite) TestNewBackendWithOptions(c *C) {
 	c.Assert(o.Timeouts.Read, Equals, time.Second)
 	c.Assert(o.Timeouts.Dial, Equals, 2*time.Second)
 	c.Assert(o.Timeouts.TLSHandshake, Equals, 3*time.Second)
+	c.Assert(o.Timeouts.UpgradeIdle, Equals, 5*time.Second)
 
 	c.Assert(o.KeepAlive.Period, Equals, 4*time.Second)
 	c.Assert(o.KeepAlive.MaxIdleConnsPerHost, Equals, 3)
@@ -154,6 +596,21 @@ func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 			b: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{TLSHandshake: "1s"}},
 			e: false,
 		},
+		{
+			a: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{UpgradeIdle: "2s"}},
+			b: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{UpgradeIdle: "1s"}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{Protocol: H2Protocol},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{ProxyProtocol: ProxyProtocolV1},
+			b: HTTPBackendSettings{ProxyProtocol: ProxyProtocolV2},
+			e: false,
+		},
 
 		{
 			a: HTTPBackendSettings{KeepAlive: HTTPBackendKeepAlive{Period: "2s"}},
@@ -176,12 +633,183 @@ func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 			b: HTTPBackendSettings{TLS: &TLSSettings{SessionTicketsDisabled: true}},
 			e: false,
 		},
+
+		{
+			a: HTTPBackendSettings{LoadBalancer: HTTPBackendLoadBalancer{Strategy: HashLB, Variable: "client.ip"}},
+			b: HTTPBackendSettings{LoadBalancer: HTTPBackendLoadBalancer{Strategy: HashLB, Variable: "client.ip"}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{LoadBalancer: HTTPBackendLoadBalancer{Strategy: LeastConnLB}},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
+
+		{
+			a: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+			b: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+			b: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health", Interval: "1s"}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
 	}
 	for _, o := range options {
 		c.Assert(o.a.Equals(o.b), Equals, o.e)
 	}
 }
 
+func (s *BackendSuite) TestHealthCheckSettings(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}})
+	c.Assert(err, IsNil)
+	h, err := b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(h, DeepEquals, &HealthCheckSettings{
+		Path:               "/health",
+		Interval:           DefaultHealthCheckInterval,
+		Timeout:            DefaultHealthCheckTimeout,
+		MinStatus:          200,
+		MaxStatus:          399,
+		HealthyThreshold:   DefaultHealthyThreshold,
+		UnhealthyThreshold: DefaultUnhealthyThreshold,
+	})
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{
+		Path:               "/health",
+		Interval:           "1s",
+		Timeout:            "100ms",
+		MinStatus:          200,
+		MaxStatus:          200,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 5,
+	}})
+	c.Assert(err, IsNil)
+	h, err = b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(h, DeepEquals, &HealthCheckSettings{
+		Path:               "/health",
+		Interval:           time.Second,
+		Timeout:            100 * time.Millisecond,
+		MinStatus:          200,
+		MaxStatus:          200,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 5,
+	})
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	h, err = b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(h, IsNil)
+}
+
+func (s *BackendSuite) TestHealthCheckSettingsBad(c *C) {
+	options := []HTTPBackendHealthCheck{
+		{Path: ""},
+		{Path: "health"},
+		{Path: "/health", Interval: "bla"},
+		{Path: "/health", Interval: "0s"},
+		{Path: "/health", Timeout: "bla"},
+		{Path: "/health", MinStatus: 500, MaxStatus: 200},
+		{Path: "/health", HealthyThreshold: -1},
+	}
+	for _, o := range options {
+		hc := o
+		_, err := NewHTTPBackend("b1", HTTPBackendSettings{HealthCheck: &hc})
+		c.Assert(err, NotNil, Commentf("%v", o))
+	}
+}
+
+func (s *BackendSuite) TestOutlierEjectionSettings(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{OutlierEjection: &HTTPBackendOutlierEjection{}})
+	c.Assert(err, IsNil)
+	o, err := b.OutlierEjectionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o, DeepEquals, &OutlierEjectionSettings{
+		Interval:           DefaultOutlierInterval,
+		BaseEjectionTime:   DefaultBaseEjectionTime,
+		MaxEjectionTime:    DefaultMaxEjectionTime,
+		MaxEjectionPercent: DefaultMaxEjectionPercent,
+	})
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{OutlierEjection: &HTTPBackendOutlierEjection{
+		Interval:           "1s",
+		BaseEjectionTime:   "2s",
+		MaxEjectionTime:    "3s",
+		MaxEjectionPercent: 10,
+	}})
+	c.Assert(err, IsNil)
+	o, err = b.OutlierEjectionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o, DeepEquals, &OutlierEjectionSettings{
+		Interval:           time.Second,
+		BaseEjectionTime:   2 * time.Second,
+		MaxEjectionTime:    3 * time.Second,
+		MaxEjectionPercent: 10,
+	})
+
+	options := []HTTPBackendOutlierEjection{
+		{Interval: "bla"},
+		{Interval: "0s"},
+		{BaseEjectionTime: "bla"},
+		{MaxEjectionTime: "bla"},
+		{BaseEjectionTime: "2m", MaxEjectionTime: "1m"},
+		{MaxEjectionPercent: 101},
+		{MaxEjectionPercent: -1},
+	}
+	for _, o := range options {
+		oe := o
+		_, err := NewHTTPBackend("b1", HTTPBackendSettings{OutlierEjection: &oe})
+		c.Assert(err, NotNil, Commentf("%v", o))
+	}
+}
+
+func (s *BackendSuite) TestNewBackendStickySession(c *C) {
+	options := []struct {
+		s  *HTTPBackendStickySession
+		ok bool
+	}{
+		{nil, true},
+		{&HTTPBackendStickySession{CookieName: "session_server"}, true},
+		{&HTTPBackendStickySession{CookieName: "srv", Secure: true, HTTPOnly: true}, true},
+		{&HTTPBackendStickySession{}, false},
+		{&HTTPBackendStickySession{CookieName: "bad name"}, false},
+		{&HTTPBackendStickySession{CookieName: "bad;name"}, false},
+	}
+	for _, o := range options {
+		_, err := NewHTTPBackend("b1", HTTPBackendSettings{StickySession: o.s})
+		c.Assert(err == nil, Equals, o.ok, Commentf("%v: %v", o.s, err))
+	}
+}
+
+func (s *BackendSuite) TestNewBackendLoadBalancer(c *C) {
+	options := []struct {
+		lb HTTPBackendLoadBalancer
+		ok bool
+	}{
+		{HTTPBackendLoadBalancer{}, true},
+		{HTTPBackendLoadBalancer{Strategy: RoundRobinLB}, true},
+		{HTTPBackendLoadBalancer{Strategy: LeastConnLB}, true},
+		{HTTPBackendLoadBalancer{Strategy: PowerOfTwoLB}, true},
+		{HTTPBackendLoadBalancer{Strategy: HashLB, Variable: "request.header.X-User"}, true},
+		{HTTPBackendLoadBalancer{Strategy: HashLB}, false},
+		{HTTPBackendLoadBalancer{Strategy: HashLB, Variable: "bla"}, false},
+		{HTTPBackendLoadBalancer{Strategy: LeastConnLB, Variable: "client.ip"}, false},
+		{HTTPBackendLoadBalancer{Strategy: "random"}, false},
+	}
+	for _, o := range options {
+		_, err := NewHTTPBackend("b1", HTTPBackendSettings{LoadBalancer: o.lb})
+		c.Assert(err == nil, Equals, o.ok, Commentf("%v: %v", o.lb, err))
+	}
+}
+
 func (s *BackendSuite) TestOCSPSettingsEq(c *C) {
 	options := []struct {
 		a *OCSPSettings
@@ -252,6 +880,36 @@ func (s *BackendSuite) TestListenerSettingsEq(c *C) {
 			e: false,
 			c: "session tickets",
 		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{HTTP2: true}},
+			b: Listener{Settings: &HTTPSListenerSettings{}},
+			e: false,
+			c: "http2",
+		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{SNIPassthrough: true}},
+			b: Listener{Settings: &HTTPSListenerSettings{}},
+			e: false,
+			c: "sni passthrough",
+		},
+		{
+			a: Listener{ProxyProtocol: &ListenerProxyProtocol{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			b: Listener{ProxyProtocol: &ListenerProxyProtocol{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			e: true,
+			c: "same proxy protocol",
+		},
+		{
+			a: Listener{ProxyProtocol: &ListenerProxyProtocol{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			b: Listener{ProxyProtocol: &ListenerProxyProtocol{TrustedCIDRs: []string{"10.0.0.0/16"}}},
+			e: false,
+			c: "proxy protocol sources",
+		},
+		{
+			a: Listener{ProxyProtocol: &ListenerProxyProtocol{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			b: Listener{},
+			e: false,
+			c: "proxy protocol off",
+		},
 	}
 	for _, o := range options {
 		c.Assert((&o.a).SettingsEquals(&o.b), Equals, o.e, Commentf("TC: %v", o.c))
@@ -275,11 +933,26 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 				TLSHandshake: "1what?",
 			},
 		},
+		HTTPBackendSettings{
+			Timeouts: HTTPBackendTimeouts{
+				UpgradeIdle: "1what?",
+			},
+		},
 		HTTPBackendSettings{
 			KeepAlive: HTTPBackendKeepAlive{
 				Period: "1what?",
 			},
 		},
+		HTTPBackendSettings{
+			Protocol: "spdy",
+		},
+		HTTPBackendSettings{
+			ProxyProtocol: "v3",
+		},
+		HTTPBackendSettings{
+			Protocol:      H2Protocol,
+			ProxyProtocol: ProxyProtocolV1,
+		},
 	}
 	for _, o := range options {
 		b, err := NewHTTPBackend("b1", o)
@@ -300,11 +973,59 @@ func (s *BackendSuite) TestNewServerBadParams(c *C) {
 	c.Assert(err, NotNil)
 }
 
+func (s *BackendSuite) TestNewWeightedServer(c *C) {
+	sv, err := NewWeightedServer("s1", "http://falhost", 3)
+	c.Assert(err, IsNil)
+	c.Assert(sv.Weight, Equals, 3)
+
+	_, err = NewWeightedServer("s1", "http://falhost", -1)
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) TestNewListener(c *C) {
 	_, err := NewListener("id", "http", "tcp", "127.0.0.1:4000", "", nil)
 	c.Assert(err, IsNil)
 }
 
+func (s *BackendSuite) TestNewTCPListener(c *C) {
+	l, err := NewListener("id", "tcp", "tcp", "127.0.0.1:4000", "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(l.Protocol, Equals, TCP)
+
+	// Routes do not apply to raw tcp connections
+	_, err = NewListener("id", "tcp", "tcp", "127.0.0.1:4000", `Host("localhost")`, nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewListener("id", "udp", "tcp", "127.0.0.1:4000", "", nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestListenerProxyProtocol(c *C) {
+	l, err := NewListener("id", "http", "tcp", "127.0.0.1:4000", "", nil)
+	c.Assert(err, IsNil)
+	l.ProxyProtocol, err = NewListenerProxyProtocol([]string{"10.0.0.0/8", "::1/128"})
+	c.Assert(err, IsNil)
+
+	nets, err := l.ProxyProtocol.TrustedNets()
+	c.Assert(err, IsNil)
+	c.Assert(len(nets), Equals, 2)
+
+	bytes, err := json.Marshal(l)
+	c.Assert(err, IsNil)
+	out, err := ListenerFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, l)
+
+	_, err = NewListenerProxyProtocol(nil)
+	c.Assert(err, NotNil)
+
+	_, err = NewListenerProxyProtocol([]string{"10.0.0.0"})
+	c.Assert(err, NotNil)
+
+	_, err = ListenerFromJSON([]byte(`{"Id": "l1", "Protocol": "http", "Address": {"Network": "tcp", "Address": "127.0.0.1:4000"}, "ProxyProtocol": {"TrustedCIDRs": ["bad"]}}`))
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) TestNewListenerBadParams(c *C) {
 	_, err := NewListener("id", "http", "tcp", "", "", nil)
 	c.Assert(err, NotNil)
@@ -335,6 +1056,28 @@ func (s *BackendSuite) TestFrontendsFromJSON(c *C) {
 	c.Assert(out, DeepEquals, fs)
 }
 
+func (s *BackendSuite) TestTCPFrontendFromJSON(c *C) {
+	f, err := NewTCPFrontend("f1", "b1", TCPFrontendSettings{ListenerId: "l1"})
+	c.Assert(err, IsNil)
+	c.Assert(f.Type, Equals, TCP)
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+
+	out, err := FrontendFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	c.Assert(out.TCPSettings().ListenerId, Equals, "l1")
+	c.Assert(out.BackendIds(), DeepEquals, []string{"b1"})
+
+	// Listener is required
+	_, err = NewTCPFrontend("f1", "b1", TCPFrontendSettings{})
+	c.Assert(err, NotNil)
+
+	_, err = FrontendFromJSON([]byte(`{"Id": "f1", "Type": "udp", "BackendId": "b1"}`))
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) MiddlewareFromJSON(c *C) {
 	cl, err := connlimit.NewConnLimit(10, "client.ip")
 	c.Assert(err, IsNil)
@@ -364,8 +1107,53 @@ func (s *BackendSuite) TestBackendFromJSON(c *C) {
 	c.Assert(out, DeepEquals, b)
 }
 
+func (s *BackendSuite) TestTCPBackend(c *C) {
+	b, err := NewTCPBackend("b1", TCPBackendSettings{Timeouts: TCPBackendTimeouts{Dial: "2s", Idle: "1m"}})
+	c.Assert(err, IsNil)
+	c.Assert(b.Type, Equals, TCP)
+
+	t, err := b.TCPTransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(t.Timeouts.Dial, Equals, 2*time.Second)
+	c.Assert(t.Timeouts.Idle, Equals, time.Minute)
+
+	bytes, err := json.Marshal(b)
+	c.Assert(err, IsNil)
+
+	out, err := BackendFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, b)
+
+	// Idle timeout is on by default
+	b, err = NewTCPBackend("b1", TCPBackendSettings{})
+	c.Assert(err, IsNil)
+	t, err = b.TCPTransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(t.Timeouts.Dial, Equals, time.Duration(0))
+	c.Assert(t.Timeouts.Idle, Equals, DefaultTCPIdleTimeout)
+
+	_, err = NewTCPBackend("b1", TCPBackendSettings{Timeouts: TCPBackendTimeouts{Idle: "forever"}})
+	c.Assert(err, NotNil)
+
+	b, err = NewTCPBackend("b1", TCPBackendSettings{ProxyProtocol: ProxyProtocolV2})
+	c.Assert(err, IsNil)
+	t, err = b.TCPTransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(t.ProxyProtocol, Equals, ProxyProtocolV2)
+
+	_, err = NewTCPBackend("b1", TCPBackendSettings{ProxyProtocol: "v3"})
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestTCPBackendSettingsEq(c *C) {
+	a := TCPBackendSettings{Timeouts: TCPBackendTimeouts{Dial: "1s", Idle: "1m"}}
+	c.Assert(a.Equals(TCPBackendSettings{Timeouts: TCPBackendTimeouts{Dial: "1s", Idle: "1m"}}), Equals, true)
+	c.Assert(a.Equals(TCPBackendSettings{Timeouts: TCPBackendTimeouts{Dial: "1s"}}), Equals, false)
+	c.Assert(a.Equals(TCPBackendSettings{Timeouts: TCPBackendTimeouts{Dial: "1s", Idle: "1m"}, ProxyProtocol: ProxyProtocolV1}), Equals, false)
+}
+
 func (s *BackendSuite) TestServerFromJSON(c *C) {
-	e, err := NewServer("sv1", "http://localhost")
+	e, err := NewWeightedServer("sv1", "http://localhost", 2)
 	c.Assert(err, IsNil)
 
 	bytes, err := json.Marshal(e)
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"reflect"
+
+	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+// VersionedEquals checks that the objects returned by the engine have the version set
+// and are deeply equal to the expected ones otherwise, e.g.
+//
+//	c.Assert(out, VersionedEquals, &listener)
+//
+// Objects, pointers to objects and slices of objects are supported.
+var VersionedEquals Checker = &versionedEqualsChecker{
+	&CheckerInfo{Name: "VersionedEquals", Params: []string{"obtained", "expected"}},
+}
+
+type versionedEqualsChecker struct {
+	*CheckerInfo
+}
+
+func (checker *versionedEqualsChecker) Check(params []interface{}, names []string) (bool, string) {
+	obtained, ok := withoutVersion(reflect.ValueOf(params[0]))
+	if !ok {
+		return false, "obtained value has no version set"
+	}
+	return reflect.DeepEqual(obtained, params[1]), ""
+}
+
+// withoutVersion returns the copy of the value with zero versions, false is returned if any version is not set
+func withoutVersion(v reflect.Value) (interface{}, bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v.Interface(), true
+		}
+		elem, ok := withoutVersion(v.Elem())
+		if !ok {
+			return nil, false
+		}
+		out := reflect.New(v.Elem().Type())
+		out.Elem().Set(reflect.ValueOf(elem))
+		return out.Interface(), true
+	case reflect.Slice:
+		if v.IsNil() {
+			return v.Interface(), true
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			elem, ok := withoutVersion(v.Index(i))
+			if !ok {
+				return nil, false
+			}
+			out.Index(i).Set(reflect.ValueOf(elem))
+		}
+		return out.Interface(), true
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		version := out.FieldByName("Version")
+		if !version.IsValid() || version.Kind() != reflect.Uint64 || version.Uint() == 0 {
+			return nil, false
+		}
+		version.SetUint(0)
+		return out.Interface(), true
+	}
+	return v.Interface(), true
+}
@@ -53,23 +53,23 @@ func (s *EngineSuite) makeConnLimit(id, variable string, conns int64) engine.Mid
 func (s *EngineSuite) EmptyParams(c *C) {
 	// Empty host operations
 	c.Assert(s.Engine.UpsertHost(engine.Host{}), FitsTypeOf, &engine.InvalidFormatError{})
-	c.Assert(s.Engine.DeleteHost(engine.HostKey{}), FitsTypeOf, &engine.InvalidFormatError{})
+	c.Assert(s.Engine.DeleteHost(engine.HostKey{}, 0), FitsTypeOf, &engine.InvalidFormatError{})
 
 	// Empty listener operations
 	c.Assert(s.Engine.UpsertListener(engine.Listener{}), FitsTypeOf, &engine.InvalidFormatError{})
-	c.Assert(s.Engine.DeleteListener(engine.ListenerKey{}), FitsTypeOf, &engine.InvalidFormatError{})
+	c.Assert(s.Engine.DeleteListener(engine.ListenerKey{}, 0), FitsTypeOf, &engine.InvalidFormatError{})
 
 	// Empty backend operations
 	c.Assert(s.Engine.UpsertBackend(engine.Backend{}), FitsTypeOf, &engine.InvalidFormatError{})
-	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{}), FitsTypeOf, &engine.InvalidFormatError{})
+	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{}, 0), FitsTypeOf, &engine.InvalidFormatError{})
 
 	// Empty server operations
 	c.Assert(s.Engine.UpsertServer(engine.BackendKey{}, engine.Server{}, 0), FitsTypeOf, &engine.InvalidFormatError{})
-	c.Assert(s.Engine.DeleteServer(engine.ServerKey{}), FitsTypeOf, &engine.InvalidFormatError{})
+	c.Assert(s.Engine.DeleteServer(engine.ServerKey{}, 0), FitsTypeOf, &engine.InvalidFormatError{})
 
 	// Empty frontend operations
 	c.Assert(s.Engine.UpsertFrontend(engine.Frontend{}, 0), FitsTypeOf, &engine.InvalidFormatError{})
-	c.Assert(s.Engine.DeleteFrontend(engine.FrontendKey{}), FitsTypeOf, &engine.InvalidFormatError{})
+	c.Assert(s.Engine.DeleteFrontend(engine.FrontendKey{}, 0), FitsTypeOf, &engine.InvalidFormatError{})
 }
 
 func (s *EngineSuite) HostCRUD(c *C) {
@@ -80,10 +80,10 @@ func (s *EngineSuite) HostCRUD(c *C) {
 
 	hs, err := s.Engine.GetHosts()
 	c.Assert(err, IsNil)
-	c.Assert(hs, DeepEquals, []engine.Host{host})
+	c.Assert(hs, VersionedEquals, []engine.Host{host})
 
 	hk := engine.HostKey{Name: "localhost"}
-	c.Assert(s.Engine.DeleteHost(hk), IsNil)
+	c.Assert(s.Engine.DeleteHost(hk, 0), IsNil)
 
 	s.expectChanges(c, &engine.HostDeleted{HostKey: hk})
 }
@@ -101,13 +101,104 @@ func (s *EngineSuite) HostWithKeyPair(c *C) {
 	s.expectChanges(c, &engine.HostUpserted{Host: host})
 
 	hk := engine.HostKey{Name: host.Name}
-	c.Assert(s.Engine.DeleteHost(hk), IsNil)
+	c.Assert(s.Engine.DeleteHost(hk, 0), IsNil)
 
 	s.expectChanges(c, &engine.HostDeleted{
 		HostKey: hk,
 	})
 }
 
+func (s *EngineSuite) HostWithKeyPairs(c *C) {
+	host := engine.Host{Name: "*.example.com"}
+
+	host.Settings.KeyPair = &engine.KeyPair{
+		Key:  []byte("hello"),
+		Cert: []byte("world"),
+	}
+	host.Settings.KeyPairs = []engine.KeyPair{
+		{Key: []byte("rsa key"), Cert: []byte("rsa cert")},
+		{Key: []byte("other key"), Cert: []byte("other cert")},
+	}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	hk := engine.HostKey{Name: host.Name}
+	out, err := s.Engine.GetHost(hk)
+	c.Assert(err, IsNil)
+	c.Assert(out, VersionedEquals, &host)
+
+	c.Assert(s.Engine.DeleteHost(hk, 0), IsNil)
+	s.expectChanges(c, &engine.HostDeleted{
+		HostKey: hk,
+	})
+}
+
+func (s *EngineSuite) HostWithACME(c *C) {
+	host := engine.Host{Name: "example.com"}
+	host.Settings.ACME = &engine.HostACME{
+		Enabled: true,
+		Email:   "admin@example.com",
+	}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	hk := engine.HostKey{Name: host.Name}
+	retryAt := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	st := engine.ACMEState{
+		KeyPair:    &engine.KeyPair{Key: []byte("hello"), Cert: []byte("world")},
+		AccountURL: "https://acme.example.com/account/1",
+		AccountKey: []byte("sealed"),
+		Lease:      &engine.ACMELease{Owner: "vulcand-1", Expires: retryAt.Add(-time.Hour)},
+		Challenges: map[string]string{"token": "token.thumbprint"},
+		LastError:  "validation failed",
+		RetryAt:    &retryAt,
+	}
+	c.Assert(s.Engine.UpsertACMEState(hk, st), IsNil)
+
+	out, err := s.Engine.GetHost(hk)
+	c.Assert(err, IsNil)
+	c.Assert(out.ACME, NotNil)
+	c.Assert(out.ACME.Version, Not(Equals), uint64(0))
+	st.Version = out.ACME.Version
+	c.Assert(out.ACME, DeepEquals, &st)
+	// The certificate issued is the KeyPair of the host
+	c.Assert(out.Settings.KeyPair, DeepEquals, st.KeyPair)
+	expected := *out
+	expected.Version = 0
+	s.expectChanges(c, &engine.HostUpserted{Host: expected})
+
+	// Zero version creates the state only, non zero version has to match
+	c.Assert(s.Engine.UpsertACMEState(hk, engine.ACMEState{}), FitsTypeOf, &engine.ConflictError{})
+	c.Assert(s.Engine.UpsertACMEState(hk, engine.ACMEState{Version: st.Version + 1}), FitsTypeOf, &engine.ConflictError{})
+
+	// Host updates keep the state and the certificate issued, the KeyPair supplied is ignored
+	host.Settings.ACME.Email = "ops@example.com"
+	host.Settings.KeyPair = &engine.KeyPair{Key: []byte("key"), Cert: []byte("cert")}
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	out, err = s.Engine.GetHost(hk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.ACME.Email, Equals, "ops@example.com")
+	c.Assert(out.ACME, DeepEquals, &st)
+	c.Assert(out.Settings.KeyPair, DeepEquals, st.KeyPair)
+	expected = *out
+	expected.Version = 0
+	s.expectChanges(c, &engine.HostUpserted{Host: expected})
+
+	// The state is deleted along with the host
+	c.Assert(s.Engine.DeleteHost(hk, 0), IsNil)
+	s.expectChanges(c, &engine.HostDeleted{
+		HostKey: hk,
+	})
+	c.Assert(s.Engine.UpsertHost(engine.Host{Name: host.Name}), IsNil)
+	out, err = s.Engine.GetHost(hk)
+	c.Assert(err, IsNil)
+	c.Assert(out.ACME, IsNil)
+	c.Assert(s.Engine.DeleteHost(hk, 0), IsNil)
+	c.Assert(s.Engine.UpsertACMEState(hk, st), FitsTypeOf, &engine.NotFoundError{})
+}
+
 func (s *EngineSuite) HostWithOCSP(c *C) {
 	host := engine.Host{Name: "localhost"}
 
@@ -130,7 +221,69 @@ func (s *EngineSuite) HostWithOCSP(c *C) {
 	hk := engine.HostKey{Name: host.Name}
 	h2, err := s.Engine.GetHost(hk)
 	c.Assert(err, IsNil)
-	c.Assert(h2, DeepEquals, &host)
+	c.Assert(h2, VersionedEquals, &host)
+}
+
+func (s *EngineSuite) HostWithPassthrough(c *C) {
+	host := engine.Host{Name: "secure.example.com"}
+	host.Settings.Passthrough = &engine.HostPassthrough{BackendId: "b1"}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	h2, err := s.Engine.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(h2, VersionedEquals, &host)
+}
+
+func (s *EngineSuite) HostWithErrorPages(c *C) {
+	host := engine.Host{Name: "localhost"}
+	host.Settings.ErrorPages = &engine.ErrorPages{
+		Pages:         []engine.ErrorPage{{Codes: []string{"500-599"}, ContentType: "text/html", Body: "<h1>{{.StatusText}}</h1>"}},
+		BackendErrors: true,
+	}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	h2, err := s.Engine.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(h2, VersionedEquals, &host)
+}
+
+func (s *EngineSuite) HostWithMaintenance(c *C) {
+	host := engine.Host{Name: "localhost"}
+	host.Settings.Maintenance = &engine.Maintenance{
+		Enabled:      true,
+		Body:         "back soon",
+		RetryAfter:   "120",
+		AllowIPs:     []string{"10.0.0.0/8"},
+		AllowHeaders: map[string]string{"X-Maintenance-Bypass": "secret"},
+	}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	h2, err := s.Engine.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(h2, VersionedEquals, &host)
+}
+
+func (s *EngineSuite) HostWithHTTPSRedirect(c *C) {
+	host := engine.Host{Name: "localhost"}
+	host.Settings.KeyPair = &engine.KeyPair{Key: []byte("hello"), Cert: []byte("world")}
+	host.Settings.HTTPSRedirect = &engine.HTTPSRedirect{
+		StatusCode:   308,
+		ExcludePaths: []string{"/.well-known/acme-challenge/"},
+		HSTS:         &engine.HSTS{MaxAge: 3600},
+	}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	h2, err := s.Engine.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(h2, VersionedEquals, &host)
 }
 
 func (s *EngineSuite) HostUpsertKeyPair(c *C) {
@@ -166,16 +319,16 @@ func (s *EngineSuite) ListenerCRUD(c *C) {
 
 	out, err := s.Engine.GetListener(lk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &listener)
+	c.Assert(out, VersionedEquals, &listener)
 
 	ls, err := s.Engine.GetListeners()
 	c.Assert(err, IsNil)
-	c.Assert(ls, DeepEquals, []engine.Listener{listener})
+	c.Assert(ls, VersionedEquals, []engine.Listener{listener})
 
 	s.expectChanges(c,
 		&engine.ListenerUpserted{Listener: listener},
 	)
-	c.Assert(s.Engine.DeleteListener(lk), IsNil)
+	c.Assert(s.Engine.DeleteListener(lk, 0), IsNil)
 
 	s.expectChanges(c,
 		&engine.ListenerDeleted{ListenerKey: lk},
@@ -205,16 +358,16 @@ func (s *EngineSuite) ListenerSettingsCRUD(c *C) {
 
 	out, err := s.Engine.GetListener(lk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &listener)
+	c.Assert(out, VersionedEquals, &listener)
 
 	ls, err := s.Engine.GetListeners()
 	c.Assert(err, IsNil)
-	c.Assert(ls, DeepEquals, []engine.Listener{listener})
+	c.Assert(ls, VersionedEquals, []engine.Listener{listener})
 
 	s.expectChanges(c,
 		&engine.ListenerUpserted{Listener: listener},
 	)
-	c.Assert(s.Engine.DeleteListener(lk), IsNil)
+	c.Assert(s.Engine.DeleteListener(lk, 0), IsNil)
 
 	s.expectChanges(c,
 		&engine.ListenerDeleted{ListenerKey: lk},
@@ -232,11 +385,11 @@ func (s *EngineSuite) BackendCRUD(c *C) {
 
 	out, err := s.Engine.GetBackend(bk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &b)
+	c.Assert(out, VersionedEquals, &b)
 
 	bs, err := s.Engine.GetBackends()
 	c.Assert(len(bs), Equals, 1)
-	c.Assert(bs[0], DeepEquals, b)
+	c.Assert(bs[0], VersionedEquals, b)
 
 	b.Settings = engine.HTTPBackendSettings{Timeouts: engine.HTTPBackendTimeouts{Read: "1s"}}
 	c.Assert(s.Engine.UpsertBackend(b), IsNil)
@@ -251,7 +404,7 @@ func (s *EngineSuite) BackendCRUD(c *C) {
 
 	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
 
-	err = s.Engine.DeleteBackend(bk)
+	err = s.Engine.DeleteBackend(bk, 0)
 	c.Assert(err, IsNil)
 
 	s.expectChanges(c, &engine.BackendDeleted{
@@ -274,7 +427,7 @@ func (s *EngineSuite) BackendDeleteUsed(c *C) {
 
 	s.collectChanges(c, 2)
 
-	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{Id: b.Id}), NotNil)
+	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{Id: b.Id}, 0), NotNil)
 }
 
 func (s *EngineSuite) BackendDeleteUnused(c *C) {
@@ -294,8 +447,8 @@ func (s *EngineSuite) BackendDeleteUnused(c *C) {
 
 	s.collectChanges(c, 2)
 
-	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{Id: b.Id}), NotNil)
-	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{Id: b1.Id}), IsNil)
+	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{Id: b.Id}, 0), NotNil)
+	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{Id: b1.Id}, 0), IsNil)
 }
 
 func (s *EngineSuite) ServerCRUD(c *C) {
@@ -305,7 +458,7 @@ func (s *EngineSuite) ServerCRUD(c *C) {
 
 	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
 
-	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000", Weight: 2}
 	bk := engine.BackendKey{Id: b.Id}
 	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
 
@@ -313,18 +466,18 @@ func (s *EngineSuite) ServerCRUD(c *C) {
 
 	srvo, err := s.Engine.GetServer(sk)
 	c.Assert(err, IsNil)
-	c.Assert(srvo, DeepEquals, &srv)
+	c.Assert(srvo, VersionedEquals, &srv)
 
 	srvs, err := s.Engine.GetServers(bk)
 	c.Assert(err, IsNil)
-	c.Assert(srvs, DeepEquals, []engine.Server{srv})
+	c.Assert(srvs, VersionedEquals, []engine.Server{srv})
 
 	s.expectChanges(c, &engine.ServerUpserted{
 		BackendKey: bk,
 		Server:     srv,
 	})
 
-	err = s.Engine.DeleteServer(sk)
+	err = s.Engine.DeleteServer(sk, 0)
 	c.Assert(err, IsNil)
 
 	s.expectChanges(c, &engine.ServerDeleted{
@@ -370,7 +523,7 @@ func (s *EngineSuite) FrontendCRUD(c *C) {
 	fk := engine.FrontendKey{Id: f.Id}
 	out, err := s.Engine.GetFrontend(fk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &f)
+	c.Assert(out, VersionedEquals, &f)
 
 	s.expectChanges(c, &engine.FrontendUpserted{
 		Frontend: f,
@@ -389,14 +542,14 @@ func (s *EngineSuite) FrontendCRUD(c *C) {
 
 	out, err = s.Engine.GetFrontend(fk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &f)
+	c.Assert(out, VersionedEquals, &f)
 
 	s.expectChanges(c, &engine.FrontendUpserted{
 		Frontend: f,
 	})
 
 	// Delete
-	c.Assert(s.Engine.DeleteFrontend(fk), IsNil)
+	c.Assert(s.Engine.DeleteFrontend(fk, 0), IsNil)
 	s.expectChanges(c, &engine.FrontendDeleted{
 		FrontendKey: fk,
 	})
@@ -437,6 +590,70 @@ func (s *EngineSuite) FrontendBadBackend(c *C) {
 		NotNil)
 }
 
+func (s *EngineSuite) FrontendSplitBackends(c *C) {
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+	s.collectChanges(c, 1)
+
+	f := engine.Frontend{
+		Id:        "f1",
+		Route:     `Path("/hello")`,
+		BackendId: b.Id,
+		Type:      engine.HTTP,
+		Settings: engine.HTTPFrontendSettings{
+			TrafficSplit: &engine.HTTPFrontendTrafficSplit{
+				Splits: []engine.HTTPFrontendSplit{{BackendId: "b1", Weight: 10}},
+			},
+		},
+	}
+	// All the split backends have to exist
+	c.Assert(s.Engine.UpsertFrontend(f, 0), NotNil)
+
+	b1 := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b1), IsNil)
+	c.Assert(s.Engine.UpsertFrontend(f, 0), IsNil)
+	s.collectChanges(c, 2)
+
+	out, err := s.Engine.GetFrontend(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out.HTTPSettings().TrafficSplit, DeepEquals, f.HTTPSettings().TrafficSplit)
+
+	// Split backend is in use by the frontend
+	c.Assert(s.Engine.DeleteBackend(engine.BackendKey{Id: b1.Id}, 0), NotNil)
+}
+
+func (s *EngineSuite) TCPFrontendCRUD(c *C) {
+	l, err := engine.NewListener("l1", engine.TCP, "tcp", "127.0.0.1:5432", "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.Engine.UpsertListener(*l), IsNil)
+	s.collectChanges(c, 1)
+
+	b, err := engine.NewTCPBackend("b1", engine.TCPBackendSettings{Timeouts: engine.TCPBackendTimeouts{Idle: "1m"}})
+	c.Assert(err, IsNil)
+	c.Assert(s.Engine.UpsertBackend(*b), IsNil)
+	s.expectChanges(c, &engine.BackendUpserted{Backend: *b})
+
+	srv := engine.Server{Id: "srv1", URL: "tcp://127.0.0.1:6432"}
+	c.Assert(s.Engine.UpsertServer(engine.BackendKey{Id: b.Id}, srv, 0), IsNil)
+	s.collectChanges(c, 1)
+
+	f, err := engine.NewTCPFrontend("f1", b.Id, engine.TCPFrontendSettings{ListenerId: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(s.Engine.UpsertFrontend(*f, 0), IsNil)
+	s.expectChanges(c, &engine.FrontendUpserted{Frontend: *f})
+
+	out, err := s.Engine.GetFrontend(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, VersionedEquals, f)
+
+	ob, err := s.Engine.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(ob, VersionedEquals, b)
+
+	c.Assert(s.Engine.DeleteFrontend(engine.FrontendKey{Id: f.Id}, 0), IsNil)
+	s.expectChanges(c, &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: f.Id}})
+}
+
 func (s *EngineSuite) MiddlewareCRUD(c *C) {
 	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 	c.Assert(s.Engine.UpsertBackend(b), IsNil)
@@ -462,7 +679,7 @@ func (s *EngineSuite) MiddlewareCRUD(c *C) {
 	mk := engine.MiddlewareKey{Id: m.Id, FrontendKey: fk}
 	out, err := s.Engine.GetMiddleware(mk)
 	c.Assert(err, IsNil)
-	c.Assert(out, DeepEquals, &m)
+	c.Assert(out, VersionedEquals, &m)
 
 	// Let us upsert middleware
 	m.Middleware.(*connlimit.ConnLimit).Connections = 100
@@ -474,9 +691,9 @@ func (s *EngineSuite) MiddlewareCRUD(c *C) {
 
 	ms, err := s.Engine.GetMiddlewares(fk)
 	c.Assert(err, IsNil)
-	c.Assert(ms, DeepEquals, []engine.Middleware{m})
+	c.Assert(ms, VersionedEquals, []engine.Middleware{m})
 
-	c.Assert(s.Engine.DeleteMiddleware(mk), IsNil)
+	c.Assert(s.Engine.DeleteMiddleware(mk, 0), IsNil)
 
 	s.expectChanges(c, &engine.MiddlewareDeleted{
 		MiddlewareKey: mk,
@@ -536,3 +753,113 @@ func (s *EngineSuite) MiddlewareBadType(c *C) {
 	m.Type = "blabla"
 	c.Assert(s.Engine.UpsertMiddleware(fk, m, 0), NotNil)
 }
+
+func (s *EngineSuite) VersionConflict(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}, Version: 1}
+	bk := engine.BackendKey{Id: b.Id}
+
+	// object that does not exist yet can not be upserted with the version
+	c.Assert(s.Engine.UpsertBackend(b), FitsTypeOf, &engine.ConflictError{})
+
+	b.Version = 0
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
+
+	out, err := s.Engine.GetBackend(bk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Version, Not(Equals), uint64(0))
+
+	out.Settings = engine.HTTPBackendSettings{Timeouts: engine.HTTPBackendTimeouts{Read: "1s"}}
+	c.Assert(s.Engine.UpsertBackend(*out), IsNil)
+	b.Settings = out.Settings
+	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
+
+	// the version is stale now
+	c.Assert(s.Engine.UpsertBackend(*out), FitsTypeOf, &engine.ConflictError{})
+	c.Assert(s.Engine.DeleteBackend(bk, out.Version), FitsTypeOf, &engine.ConflictError{})
+
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+	c.Assert(s.Engine.UpsertServer(bk, srv, 0), IsNil)
+	s.expectChanges(c, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+
+	srvo, err := s.Engine.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(s.Engine.DeleteServer(sk, srvo.Version+1), FitsTypeOf, &engine.ConflictError{})
+	c.Assert(s.Engine.DeleteServer(sk, srvo.Version), IsNil)
+	s.expectChanges(c, &engine.ServerDeleted{ServerKey: sk})
+
+	out, err = s.Engine.GetBackend(bk)
+	c.Assert(err, IsNil)
+	c.Assert(s.Engine.DeleteBackend(bk, out.Version), IsNil)
+	s.expectChanges(c, &engine.BackendDeleted{BackendKey: bk})
+}
+
+func (s *EngineSuite) BatchCRUD(c *C) {
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	bk := engine.BackendKey{Id: b.Id}
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	f := engine.Frontend{
+		Id:        "f1",
+		BackendId: b.Id,
+		Route:     `Path("/hello")`,
+		Type:      engine.HTTP,
+		Settings:  engine.HTTPFrontendSettings{},
+	}
+	fk := engine.FrontendKey{Id: f.Id}
+
+	changes := []interface{}{
+		&engine.BackendUpserted{Backend: b},
+		&engine.ServerUpserted{BackendKey: bk, Server: srv},
+		&engine.FrontendUpserted{Frontend: f},
+	}
+	c.Assert(s.Engine.ApplyBatch(changes), IsNil)
+	s.expectChanges(c, &engine.BatchApplied{Changes: changes})
+
+	srvo, err := s.Engine.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+	c.Assert(srvo, VersionedEquals, &srv)
+
+	fo, err := s.Engine.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(fo, VersionedEquals, &f)
+
+	changes = []interface{}{
+		&engine.FrontendDeleted{FrontendKey: fk},
+		&engine.BackendDeleted{BackendKey: bk},
+	}
+	c.Assert(s.Engine.ApplyBatch(changes), IsNil)
+	s.expectChanges(c, &engine.BatchApplied{Changes: changes})
+
+	_, err = s.Engine.GetBackend(bk)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *EngineSuite) BatchRollback(c *C) {
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+	s.expectChanges(c, &engine.BackendUpserted{Backend: b})
+
+	bk := engine.BackendKey{Id: b.Id}
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	f := engine.Frontend{
+		Id:        "f1",
+		BackendId: "missing",
+		Route:     `Path("/hello")`,
+		Type:      engine.HTTP,
+		Settings:  engine.HTTPFrontendSettings{},
+	}
+
+	// The frontend refers to the missing backend, so the server upserted before it is deleted
+	err := s.Engine.ApplyBatch([]interface{}{
+		&engine.ServerUpserted{BackendKey: bk, Server: srv},
+		&engine.FrontendUpserted{Frontend: f},
+	})
+	c.Assert(err, NotNil)
+
+	_, err = s.Engine.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	_, err = s.Engine.GetFrontend(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
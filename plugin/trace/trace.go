@@ -2,14 +2,20 @@ package trace
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/syslog"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
 	oxytrace "github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/trace"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
 	"github.com/mailgun/vulcand/plugin"
 )
 
@@ -47,12 +53,121 @@ func (t *Trace) String() string {
 	return fmt.Sprintf("addr=%v, reqHeaders=%v, respHeaders=%v", t.Addr, t.ReqHeaders, t.RespHeaders)
 }
 
-func newTraceHandler(next http.Handler, t *Trace) (*oxytrace.Tracer, error) {
+func newTraceHandler(next http.Handler, t *Trace) (http.Handler, error) {
 	writer, err := newWriter(t.Addr)
 	if err != nil {
 		return nil, err
 	}
-	return oxytrace.New(next, writer, oxytrace.RequestHeaders(t.ReqHeaders...), oxytrace.ResponseHeaders(t.RespHeaders...))
+	return &tracer{next: next, writer: writer, reqHeaders: t.ReqHeaders, respHeaders: t.RespHeaders}, nil
+}
+
+// tracer records the request and the response the same way oxy tracer does, and adds the request protocols
+// to the record. The record of oxy tracer can not be extended, so the tracer builds its own record with the
+// oxy record types.
+type tracer struct {
+	next        http.Handler
+	writer      io.Writer
+	reqHeaders  []string
+	respHeaders []string
+}
+
+func (t *tracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	pw := &utils.ProxyWriter{W: w}
+	t.next.ServeHTTP(pw, req)
+
+	r := t.newRecord(req, pw, time.Since(start))
+	if err := json.NewEncoder(t.writer).Encode(r); err != nil {
+		log.Errorf("failed to write trace record: %v", err)
+	}
+}
+
+func (t *tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, diff time.Duration) *Record {
+	return &Record{
+		Request: Request{
+			Request: oxytrace.Request{
+				Method:    req.Method,
+				URL:       req.URL.String(),
+				BodyBytes: bodyBytes(req.Header),
+				Headers:   captureHeaders(req.Header, t.reqHeaders),
+			},
+			Proto: req.Proto,
+			TLS:   newTLS(req),
+		},
+		Response: oxytrace.Response{
+			Code:      pw.StatusCode(),
+			BodyBytes: bodyBytes(pw.Header()),
+			Roundtrip: float64(diff) / float64(time.Millisecond),
+			Headers:   captureHeaders(pw.Header(), t.respHeaders),
+		},
+	}
+}
+
+// Record is the record of the oxy tracer extended with the request protocols
+type Record struct {
+	Request  Request           `json:"request"`
+	Response oxytrace.Response `json:"response"`
+}
+
+type Request struct {
+	oxytrace.Request
+	Proto string `json:"proto"`         // Proto - request protocol, e.g. HTTP/1.1 or HTTP/2.0
+	TLS   *TLS   `json:"tls,omitempty"` // TLS - optional TLS record, will be recorded if it's a TLS connection
+}
+
+type TLS struct {
+	oxytrace.TLS
+	Protocol string `json:"protocol"` // Protocol - application protocol negotiated with ALPN, e.g. h2
+}
+
+func newTLS(req *http.Request) *TLS {
+	if req.TLS == nil {
+		return nil
+	}
+	return &TLS{
+		TLS: oxytrace.TLS{
+			Version:     versionToString(req.TLS.Version),
+			Resume:      req.TLS.DidResume,
+			CipherSuite: tls.CipherSuiteName(req.TLS.CipherSuite),
+			Server:      req.TLS.ServerName,
+		},
+		Protocol: req.TLS.NegotiatedProtocol,
+	}
+}
+
+func versionToString(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS10"
+	case tls.VersionTLS11:
+		return "TLS11"
+	case tls.VersionTLS12:
+		return "TLS12"
+	case tls.VersionTLS13:
+		return "TLS13"
+	}
+	return fmt.Sprintf("unknown: %x", v)
+}
+
+func captureHeaders(in http.Header, headers []string) http.Header {
+	if len(headers) == 0 || in == nil {
+		return nil
+	}
+	out := make(http.Header, len(headers))
+	for _, h := range headers {
+		if vals, ok := in[h]; ok && len(out[h]) == 0 {
+			out[h] = append([]string(nil), vals...)
+		}
+	}
+	return out
+}
+
+func bodyBytes(h http.Header) int64 {
+	bytes, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return bytes
 }
 
 // FromOther creates and validates Trace plugin instance from serialized format
@@ -12,7 +12,6 @@ import (
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/testutils"
-	oxytrace "github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/trace"
 	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
 	"github.com/mailgun/vulcand/plugin"
 )
@@ -122,9 +121,10 @@ func (s *TraceSuite) TestHandler(c *C) {
 	}
 
 	vals := strings.Split(string(buf), SyslogPrefix)
-	var r *oxytrace.Record
+	var r *Record
 	c.Assert(json.Unmarshal([]byte(vals[1]), &r), IsNil)
 	c.Assert(r.Request.URL, Equals, "/hello")
+	c.Assert(r.Request.Proto, Equals, "HTTP/1.1")
 	c.Assert(r.Request.Headers, DeepEquals, http.Header{"X-Req-A": []string{"yo"}})
 	c.Assert(r.Response.Headers, DeepEquals, http.Header{"X-Resp-A": []string{"h2"}})
 }
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/mailgun/vulcand/engine"
 )
 
@@ -15,6 +17,12 @@ type backend struct {
 	frontends map[engine.FrontendKey]*frontend
 	servers   []engine.Server
 	transport *http.Transport
+	// checker runs active health checks, nil if the health checks are disabled
+	checker *healthChecker
+	// detector ejects the anomalous servers, nil if the outlier ejection is disabled
+	detector *outlierDetector
+	// budget limits the retries of the frontends with the retry settings
+	budget *retryBudget
 }
 
 func newBackend(m *mux, b engine.Backend) (*backend, error) {
@@ -22,13 +30,18 @@ func newBackend(m *mux, b engine.Backend) (*backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &backend{
+	be := &backend{
 		mux:       m,
 		backend:   b,
 		transport: newTransport(s),
 		servers:   []engine.Server{},
 		frontends: make(map[engine.FrontendKey]*frontend),
-	}, nil
+		budget:    &retryBudget{},
+	}
+	if err := be.startChecks(); err != nil {
+		return nil, err
+	}
+	return be, nil
 }
 
 func (b *backend) String() string {
@@ -44,35 +57,126 @@ func (b *backend) unlinkFrontend(key engine.FrontendKey) {
 }
 
 func (b *backend) Close() error {
+	b.stopChecks()
 	b.transport.CloseIdleConnections()
 	return nil
 }
 
-func (b *backend) update(be engine.Backend) error {
-	if err := b.updateSettings(be); err != nil {
+// startChecks starts the health checks and the outlier detection if they are enabled
+func (b *backend) startChecks() error {
+	s, err := b.backend.HealthCheckSettings()
+	if err != nil {
 		return err
 	}
-	b.backend = be
+	o, err := b.backend.OutlierEjectionSettings()
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		var checker *healthChecker
+		checker = newHealthChecker(*s, b.transport, func() { b.healthChanged(checker) })
+		checker.update(b.servers)
+		b.checker = checker
+	}
+	if o != nil {
+		b.detector = newOutlierDetector(*o, b)
+		b.detector.start()
+	}
 	return nil
 }
 
+func (b *backend) stopChecks() {
+	if b.checker != nil {
+		b.checker.close()
+		b.checker = nil
+	}
+	if b.detector != nil {
+		b.detector.stop()
+		b.detector = nil
+	}
+}
+
+// healthChanged is called by the health checker when any of the servers becomes healthy or unhealthy
+func (b *backend) healthChanged(checker *healthChecker) {
+	b.mux.mtx.Lock()
+	defer b.mux.mtx.Unlock()
+
+	// The checker has been replaced while waiting for the lock
+	if b.checker != checker {
+		return
+	}
+	if err := b.updateFrontends(); err != nil {
+		log.Errorf("%v failed to update frontends: %v", b, err)
+	}
+}
+
+// isAvailable returns true if the server should be in the rotation: it is healthy and has not been ejected
+func (b *backend) isAvailable(s engine.Server) bool {
+	if b.detector != nil && b.detector.isEjected(s.URL) {
+		return false
+	}
+	return b.isHealthy(s)
+}
+
+// isHealthy returns true if the server passes health checks or the health checks are disabled
+func (b *backend) isHealthy(s engine.Server) bool {
+	if b.checker == nil {
+		return true
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return true
+	}
+	return b.checker.isHealthy(u.String())
+}
+
+// serverEjection returns the ejection state of the server or nil if the outlier ejection is disabled
+func (b *backend) serverEjection(s engine.Server) *engine.ServerEjection {
+	if b.detector == nil {
+		return nil
+	}
+	return b.detector.ejection(s.URL)
+}
+
+// serverHealth returns the health of the server or nil if the health checks are disabled
+func (b *backend) serverHealth(u *url.URL) *engine.ServerHealth {
+	if b.checker == nil {
+		return nil
+	}
+	return b.checker.health(u.String())
+}
+
+func (b *backend) update(be engine.Backend) error {
+	return b.updateSettings(be)
+}
+
 func (b *backend) updateSettings(be engine.Backend) error {
 	olds := b.backend.HTTPSettings()
 	news := be.HTTPSettings()
 
-	// Nothing changed in transport options
+	// Nothing changed in transport and load balancer options
 	if news.Equals(olds) {
+		b.backend = be
 		return nil
 	}
 	s, err := b.mux.transportSettings(be)
 	if err != nil {
 		return err
 	}
+	// Frontends are rebuilt with the new settings, e.g. load balancing strategy
+	b.backend = be
 	t := newTransport(s)
 	b.transport.CloseIdleConnections()
 	b.transport = t
+	// Health checks and outlier detection are restarted with the new settings and transport
+	b.stopChecks()
+	if err := b.startChecks(); err != nil {
+		return err
+	}
 	for _, f := range b.frontends {
-		f.updateTransport(t)
+		if err := f.updateTransport(t); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -100,6 +204,9 @@ func (b *backend) upsertServer(s engine.Server) error {
 	} else {
 		b.servers = append(b.servers, s)
 	}
+	if b.checker != nil {
+		b.checker.update(b.servers)
+	}
 	return b.updateFrontends()
 }
 
@@ -109,6 +216,9 @@ func (b *backend) deleteServer(sk engine.ServerKey) error {
 		return fmt.Errorf("%v not found %v", b, sk)
 	}
 	b.servers = append(b.servers[:i], b.servers[i+1:]...)
+	if b.checker != nil {
+		b.checker.update(b.servers)
+	}
 	return b.updateFrontends()
 }
 
@@ -122,14 +232,40 @@ func (b *backend) updateFrontends() error {
 }
 
 func newTransport(s *engine.TransportSettings) *http.Transport {
-	return &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout:   s.Timeouts.Dial,
-			KeepAlive: s.KeepAlive.Period,
-		}).Dial,
+	dialer := &net.Dialer{
+		Timeout:   s.Timeouts.Dial,
+		KeepAlive: s.KeepAlive.Period,
+	}
+	t := &http.Transport{
+		Dial:                  dialer.Dial,
 		ResponseHeaderTimeout: s.Timeouts.Read,
 		TLSHandshakeTimeout:   s.Timeouts.TLSHandshake,
 		MaxIdleConnsPerHost:   s.KeepAlive.MaxIdleConnsPerHost,
 		TLSClientConfig:       s.TLS,
+		Protocols:             transportProtocols(s.Protocol),
+	}
+	if s.ProxyProtocol != "" {
+		t.DialContext = proxyDialer(dialer, s.ProxyProtocol)
+		// PROXY protocol header carries the address of one client, so the connections are not reused
+		t.DisableKeepAlives = true
+	}
+	return t
+}
+
+// transportProtocols returns the protocols the transport speaks to the servers
+func transportProtocols(protocol string) *http.Protocols {
+	p := &http.Protocols{}
+	switch protocol {
+	case engine.H2Protocol:
+		// HTTP/2 is negotiated on the TLS connections, HTTP/1.1 is used if the server does not support it
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+	case engine.H2CProtocol:
+		// Without HTTP/1.1 the plain text connections use HTTP/2 with prior knowledge
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	default:
+		p.SetHTTP1(true)
 	}
+	return p
 }
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/roundrobin"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// balancer distributes the requests among the backend servers
+type balancer interface {
+	http.Handler
+	Servers() []*url.URL
+	UpsertServer(u *url.URL, weight int) error
+	RemoveServer(u *url.URL) error
+}
+
+// newBalancer creates the balancer implementing the strategy and session affinity from the backend settings,
+// the requests are passed to the next handler with the URL of the selected server
+func newBalancer(s engine.HTTPBackendSettings, next http.Handler, log utils.Logger) (balancer, error) {
+	if s.StickySession != nil {
+		return newStickyBalancer(*s.StickySession, s.LoadBalancer, next, log)
+	}
+	return newStrategy(s.LoadBalancer, next, log)
+}
+
+func newStrategy(s engine.HTTPBackendLoadBalancer, next http.Handler, log utils.Logger) (balancer, error) {
+	switch s.Strategy {
+	case "", engine.RoundRobinLB:
+		rr, err := roundrobin.New(next)
+		if err != nil {
+			return nil, err
+		}
+		// Rebalancer will readjust load balancer weights based on error ratios
+		rb, err := roundrobin.NewRebalancer(rr, roundrobin.RebalancerLogger(log))
+		if err != nil {
+			return nil, err
+		}
+		return &rebalancer{Rebalancer: rb}, nil
+	case engine.LeastConnLB:
+		return newPool(next, &leastConn{}), nil
+	case engine.PowerOfTwoLB:
+		return newPool(next, &powerOfTwo{}), nil
+	case engine.HashLB:
+		extract, err := utils.NewExtractor(s.Variable)
+		if err != nil {
+			return nil, err
+		}
+		return newPool(next, &hashRing{extract: extract}), nil
+	}
+	return nil, fmt.Errorf("unsupported load balancer: '%s'", s.Strategy)
+}
+
+// rebalancer adapts oxy's rebalancing round robin to the balancer interface
+type rebalancer struct {
+	*roundrobin.Rebalancer
+}
+
+func (r *rebalancer) UpsertServer(u *url.URL, weight int) error {
+	return r.Rebalancer.UpsertServer(u, roundrobin.Weight(weight))
+}
+
+type poolServer struct {
+	url    *url.URL
+	weight int
+	// inflight is the number of requests being processed by the server, accessed atomically
+	inflight int64
+}
+
+// picker is the strategy selecting the server from the pool
+type picker interface {
+	// pick returns the server for the request, it is called with the pool read lock held
+	pick(req *http.Request, servers []*poolServer) (*poolServer, error)
+	// reset is called with the pool write lock held every time the set of servers changes
+	reset(servers []*poolServer)
+}
+
+// pool keeps the servers and their in-flight request counters for the strategies that need them
+type pool struct {
+	mtx     *sync.RWMutex
+	next    http.Handler
+	picker  picker
+	servers []*poolServer
+}
+
+func newPool(next http.Handler, p picker) *pool {
+	return &pool{
+		mtx:     &sync.RWMutex{},
+		next:    next,
+		picker:  p,
+		servers: []*poolServer{},
+	}
+}
+
+func (p *pool) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	srv, err := p.nextServer(req)
+	if err != nil {
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+	atomic.AddInt64(&srv.inflight, 1)
+	defer atomic.AddInt64(&srv.inflight, -1)
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.URL = utils.CopyURL(srv.url)
+	p.next.ServeHTTP(w, &newReq)
+}
+
+func (p *pool) nextServer(req *http.Request) (*poolServer, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if len(p.servers) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+	return p.picker.pick(req, p.servers)
+}
+
+func (p *pool) Servers() []*url.URL {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	out := make([]*url.URL, len(p.servers))
+	for i, s := range p.servers {
+		out[i] = utils.CopyURL(s.url)
+	}
+	return out
+}
+
+func (p *pool) UpsertServer(u *url.URL, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("weight should be >= 0")
+	}
+	if weight == 0 {
+		weight = 1
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if i := p.indexOf(u); i != -1 {
+		p.servers[i].weight = weight
+	} else {
+		p.servers = append(p.servers, &poolServer{url: utils.CopyURL(u), weight: weight})
+	}
+	p.picker.reset(p.servers)
+	return nil
+}
+
+func (p *pool) RemoveServer(u *url.URL) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	i := p.indexOf(u)
+	if i == -1 {
+		return fmt.Errorf("server not found")
+	}
+	p.servers = append(p.servers[:i], p.servers[i+1:]...)
+	p.picker.reset(p.servers)
+	return nil
+}
+
+func (p *pool) indexOf(u *url.URL) int {
+	for i, s := range p.servers {
+		if s.url.String() == u.String() {
+			return i
+		}
+	}
+	return -1
+}
+
+// lessLoaded returns true if the server a has less in-flight requests per weight than b
+func lessLoaded(a, b *poolServer) bool {
+	return atomic.LoadInt64(&a.inflight)*int64(b.weight) < atomic.LoadInt64(&b.inflight)*int64(a.weight)
+}
+
+// leastConn selects the server with the least in-flight requests per weight,
+// the search starts from the next server every time, so the ties are broken in round robin fashion
+type leastConn struct {
+	offset uint32
+}
+
+func (l *leastConn) pick(req *http.Request, servers []*poolServer) (*poolServer, error) {
+	start := int(atomic.AddUint32(&l.offset, 1) % uint32(len(servers)))
+	best := servers[start]
+	for i := 1; i < len(servers); i++ {
+		if s := servers[(start+i)%len(servers)]; lessLoaded(s, best) {
+			best = s
+		}
+	}
+	return best, nil
+}
+
+func (l *leastConn) reset(servers []*poolServer) {
+}
+
+// powerOfTwo picks two random servers in proportion to their weights and selects the less loaded one
+type powerOfTwo struct {
+	total int
+}
+
+func (p *powerOfTwo) pick(req *http.Request, servers []*poolServer) (*poolServer, error) {
+	a, b := p.random(servers), p.random(servers)
+	if lessLoaded(b, a) {
+		return b, nil
+	}
+	return a, nil
+}
+
+func (p *powerOfTwo) random(servers []*poolServer) *poolServer {
+	n := rand.Intn(p.total)
+	for _, s := range servers {
+		if n < s.weight {
+			return s
+		}
+		n -= s.weight
+	}
+	return servers[len(servers)-1]
+}
+
+func (p *powerOfTwo) reset(servers []*poolServer) {
+	p.total = 0
+	for _, s := range servers {
+		p.total += s.weight
+	}
+}
+
+// replicasPerWeight is the number of points every unit of the server weight gets on the hash ring
+const replicasPerWeight = 100
+
+type ringPoint struct {
+	hash   uint32
+	server *poolServer
+}
+
+// hashRing selects the server by the consistent hash of the request variable, adding or removing a server
+// only moves the requests mapped to the points of this server on the ring
+type hashRing struct {
+	extract utils.SourceExtractor
+	points  []ringPoint
+}
+
+func (h *hashRing) pick(req *http.Request, servers []*poolServer) (*poolServer, error) {
+	token, _, err := h.extract.Extract(req)
+	if err != nil {
+		return nil, err
+	}
+	hash := hashOf(token)
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i].hash >= hash })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.points[i].server, nil
+}
+
+func (h *hashRing) reset(servers []*poolServer) {
+	h.points = []ringPoint{}
+	for _, s := range servers {
+		for i := 0; i < s.weight*replicasPerWeight; i++ {
+			h.points = append(h.points, ringPoint{hash: hashOf(strconv.Itoa(i) + s.url.String()), server: s})
+		}
+	}
+	sort.Sort(ringPoints(h.points))
+}
+
+type ringPoints []ringPoint
+
+func (p ringPoints) Len() int           { return len(p) }
+func (p ringPoints) Less(i, j int) bool { return p[i].hash < p[j].hash }
+func (p ringPoints) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func hashOf(val string) uint32 {
+	return crc32.ChecksumIEEE([]byte(val))
+}
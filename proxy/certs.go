@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/golang.org/x/crypto/ocsp"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// certificates selects the certificate of the TLS connection by the server name sent by the client, in order:
+//
+//   - the certificates of the host named as the server name, e.g. a.example.com
+//   - the certificates of the wildcard host matching the server name, e.g. *.example.com
+//   - the certificates with the subject alternative name matching the server name, exact names take
+//     precedence over the wildcard names, the certificates of the default host go first
+//   - the certificates of the default host, the first certificate if there is no default host
+//
+// The host may have several certificates, the first one supported by the client is used, e.g. the ECDSA
+// certificate followed by the RSA certificate for the clients not supporting ECDSA.
+type certificates struct {
+	hosts map[string][]*tls.Certificate
+	names map[string][]*tls.Certificate
+	// fallback are the certificates of the connections not matched by the server name
+	fallback []*tls.Certificate
+}
+
+// newCertificates loads the key pairs of the hosts, the first key pair of the host gets the OCSP staple
+func newCertificates(s *srv, hosts map[engine.HostKey]engine.Host, defaultHost string) (*certificates, error) {
+	c := &certificates{
+		hosts: make(map[string][]*tls.Certificate),
+		names: make(map[string][]*tls.Certificate),
+	}
+
+	// Hosts are sorted so the certificates sharing the names are selected in the same order by every reload
+	names := make([]string, 0, len(hosts))
+	for hk, h := range hosts {
+		if hk.Name != defaultHost && h.Settings.KeyPair != nil {
+			names = append(names, hk.Name)
+		}
+	}
+	sort.Strings(names)
+	if defaultHost != "" {
+		names = append([]string{defaultHost}, names...)
+	}
+
+	for _, name := range names {
+		host, ok := hosts[engine.HostKey{Name: name}]
+		if !ok || host.Settings.KeyPair == nil {
+			return nil, fmt.Errorf("default host '%s' certificate is not passed", name)
+		}
+		certs := make([]*tls.Certificate, 0, len(host.Settings.KeyPairs)+1)
+		for i, kp := range host.KeyPairs() {
+			cert, err := tls.X509KeyPair(kp.Cert, kp.Key)
+			if err != nil {
+				return nil, err
+			}
+			if cert.Leaf == nil {
+				if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+					return nil, err
+				}
+			}
+			if i == 0 && host.Settings.OCSP.Enabled {
+				cert.OCSPStaple = stapleHost(s, host)
+			}
+			certs = append(certs, &cert)
+		}
+		c.hosts[strings.ToLower(name)] = certs
+		c.addNames(certs)
+		if len(c.fallback) == 0 {
+			c.fallback = certs
+		}
+	}
+	return c, nil
+}
+
+// addNames indexes the certificates by the subject alternative names, the common name is used
+// by the certificates without the DNS names
+func (c *certificates) addNames(certs []*tls.Certificate) {
+	for _, cert := range certs {
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			c.names[name] = append(c.names[name], cert)
+		}
+	}
+}
+
+// GetCertificate is the tls.Config callback choosing the certificate of the connection
+func (c *certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return chooseCertificate(hello, c.match(strings.ToLower(strings.TrimSuffix(hello.ServerName, ".")))), nil
+}
+
+// match returns the certificates matching the server name by the precedence of certificates
+func (c *certificates) match(serverName string) []*tls.Certificate {
+	if serverName == "" {
+		return c.fallback
+	}
+	wildcard := engine.WildcardHostname(serverName)
+	if certs, ok := c.hosts[serverName]; ok {
+		return certs
+	}
+	if certs, ok := c.hosts[wildcard]; ok && wildcard != "" {
+		return certs
+	}
+	if certs, ok := c.names[serverName]; ok {
+		return certs
+	}
+	if certs, ok := c.names[wildcard]; ok && wildcard != "" {
+		return certs
+	}
+	return c.fallback
+}
+
+// chooseCertificate returns the first certificate supported by the client, the first certificate is returned
+// if the client supports none of them, so the client gets the handshake error it expects
+func chooseCertificate(hello *tls.ClientHelloInfo, certs []*tls.Certificate) *tls.Certificate {
+	if len(certs) == 0 {
+		return nil
+	}
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert
+		}
+	}
+	return certs[0]
+}
+
+// stapleHost returns the OCSP staple of the host, nil if the staple is not available
+func stapleHost(s *srv, host engine.Host) []byte {
+	log.Infof("%v OCSP is enabled for %v, resolvers: %v", s, &host, host.Settings.OCSP.Responders)
+	r, err := s.mux.stapler.StapleHost(&host)
+	if err != nil {
+		log.Warningf("%v failed to staple %v, error %v", s, &host, err)
+		return nil
+	}
+	if r.Response.Status == ocsp.Good || r.Response.Status == ocsp.Revoked {
+		return r.Staple
+	}
+	log.Warningf("%s got undefined status from OCSP responder: %v", s, r.Response.Status)
+	return nil
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"sync"
@@ -12,14 +13,25 @@ type connTracker struct {
 	new    map[string]int64
 	active map[string]int64
 	idle   map[string]int64
+	// hijacked are the upgraded connections, e.g. WebSockets, they are counted until the tunnel is closed
+	hijacked map[string]int64
+
+	// protocols are the open connections by the protocol negotiated with the client
+	protocols map[string]map[string]int64
+	// conns are the protocols of the open connections
+	conns map[net.Conn]string
 }
 
 func newConnTracker() *connTracker {
 	return &connTracker{
-		mtx:    &sync.Mutex{},
-		new:    make(map[string]int64),
-		active: make(map[string]int64),
-		idle:   make(map[string]int64),
+		mtx:      &sync.Mutex{},
+		new:      make(map[string]int64),
+		active:   make(map[string]int64),
+		idle:     make(map[string]int64),
+		hijacked: make(map[string]int64),
+
+		protocols: make(map[string]map[string]int64),
+		conns:     make(map[net.Conn]string),
 	}
 }
 
@@ -27,15 +39,64 @@ func (c *connTracker) onStateChange(conn net.Conn, prev http.ConnState, cur http
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
-	if cur == http.StateNew || cur == http.StateIdle || cur == http.StateActive {
+	if cur == http.StateNew || cur == http.StateIdle || cur == http.StateActive || cur == http.StateHijacked {
 		c.inc(conn, cur, 1)
 	}
 
 	if cur != http.StateNew {
 		c.inc(conn, prev, -1)
 	}
+
+	// Protocol is known once the handshake is complete and the first request is read
+	if _, ok := c.conns[conn]; !ok && (cur == http.StateActive || cur == http.StateIdle) {
+		c.addProtocol(conn)
+	}
+	if cur == http.StateClosed {
+		c.removeProtocol(conn)
+	}
 }
 
+// onHijackedClose is called when the hijacked connection is closed, as the server does not track it any more
+func (c *connTracker) onHijackedClose(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.inc(conn, http.StateHijacked, -1)
+	c.removeProtocol(conn)
+}
+
+func (c *connTracker) addProtocol(conn net.Conn) {
+	addr, proto := conn.LocalAddr().String(), connProtocol(conn)
+	c.conns[conn] = proto
+	if c.protocols[addr] == nil {
+		c.protocols[addr] = make(map[string]int64)
+	}
+	c.protocols[addr][proto] += 1
+}
+
+func (c *connTracker) removeProtocol(conn net.Conn) {
+	proto, ok := c.conns[conn]
+	if !ok {
+		return
+	}
+	delete(c.conns, conn)
+	c.protocols[conn.LocalAddr().String()][proto] -= 1
+}
+
+// connProtocol returns the protocol negotiated with ALPN, HTTP/1.1 is used if nothing was negotiated
+func connProtocol(conn net.Conn) string {
+	if tc, ok := conn.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == "h2" {
+		return protocolHTTP2
+	}
+	return protocolHTTP1
+}
+
+// Names of the protocols negotiated with the clients
+const (
+	protocolHTTP1 = "http1"
+	protocolHTTP2 = "http2"
+)
+
 func (c *connTracker) inc(conn net.Conn, state http.ConnState, v int64) {
 	addr := conn.LocalAddr().String()
 	var m map[string]int64
@@ -47,6 +108,8 @@ func (c *connTracker) inc(conn net.Conn, state http.ConnState, v int64) {
 		m = c.active
 	case http.StateIdle:
 		m = c.idle
+	case http.StateHijacked:
+		m = c.hijacked
 	default:
 		return
 	}
@@ -59,12 +122,25 @@ func (c *connTracker) counts() connStats {
 	defer c.mtx.Unlock()
 
 	return connStats{
-		http.StateNew:    c.copy(c.new),
-		http.StateActive: c.copy(c.active),
-		http.StateIdle:   c.copy(c.idle),
+		http.StateNew:      c.copy(c.new),
+		http.StateActive:   c.copy(c.active),
+		http.StateIdle:     c.copy(c.idle),
+		http.StateHijacked: c.copy(c.hijacked),
 	}
 }
 
+// protocolCounts returns the open connections by the listener address and the protocol
+func (c *connTracker) protocolCounts() map[string]map[string]int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	out := make(map[string]map[string]int64, len(c.protocols))
+	for addr, counts := range c.protocols {
+		out[addr] = c.copy(counts)
+	}
+	return out
+}
+
 func (c *connTracker) copy(s map[string]int64) map[string]int64 {
 	out := make(map[string]int64, len(s))
 	for k, v := range s {
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// errorPageKey is the context key of the errorPageState of the request
+type errorPageKey struct{}
+
+// errorPageState is shared by the handlers of the request, it is accessed by the request goroutine only
+type errorPageState struct {
+	// pages are the error pages of the host, replaced by the frontend error pages if the frontend has them
+	pages *engine.ErrorPageSettings
+	// backendCode is the status code of the last server response, zero if the last round trip has failed
+	backendCode int
+}
+
+// frontendErrorPages makes the error pages of the frontend take precedence over the host error pages
+type frontendErrorPages struct {
+	next  http.Handler
+	pages *engine.ErrorPageSettings
+}
+
+func (f *frontendErrorPages) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if st, ok := req.Context().Value(errorPageKey{}).(*errorPageState); ok {
+		st.pages = f.pages
+	}
+	f.next.ServeHTTP(w, req)
+}
+
+// backendTransport records the status codes of the server responses, so the error pages
+// could tell them from the errors generated by the proxy
+type backendTransport struct {
+	http.RoundTripper
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	st, _ := req.Context().Value(errorPageKey{}).(*errorPageState)
+	if st != nil {
+		st.backendCode = 0
+	}
+	re, err := t.RoundTripper.RoundTrip(req)
+	if st != nil && err == nil {
+		st.backendCode = re.StatusCode
+	}
+	return re, err
+}
+
+// errorPageWriter writes the error page instead of the response if the page matches the status code,
+// the body of the replaced response is discarded
+type errorPageWriter struct {
+	w     http.ResponseWriter
+	req   *http.Request
+	state *errorPageState
+
+	wrote    bool
+	replaced bool
+}
+
+func (e *errorPageWriter) Header() http.Header {
+	return e.w.Header()
+}
+
+func (e *errorPageWriter) WriteHeader(code int) {
+	if e.wrote {
+		return
+	}
+	e.wrote = true
+	page := e.page(code)
+	if page == nil {
+		e.w.WriteHeader(code)
+		return
+	}
+	e.replaced = true
+
+	body := &bytes.Buffer{}
+	data := engine.ErrorPageData{
+		StatusCode: code,
+		StatusText: http.StatusText(code),
+		Method:     e.req.Method,
+		Host:       e.req.Host,
+		Path:       e.req.URL.Path,
+	}
+	h := e.w.Header()
+	h.Del("Content-Encoding")
+	if err := page.Template.Execute(body, data); err != nil {
+		log.Errorf("failed to render error page for %v %v: %v", e.req.Method, e.req.URL, err)
+		body.Reset()
+		body.WriteString(http.StatusText(code))
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		h.Set("Content-Type", page.ContentType)
+	}
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	e.w.WriteHeader(code)
+	e.w.Write(body.Bytes())
+}
+
+// page returns the error page for the response, nil if the response is passed as is
+func (e *errorPageWriter) page(code int) *engine.ParsedErrorPage {
+	pages := e.state.pages
+	if pages == nil || code < http.StatusBadRequest {
+		return nil
+	}
+	if e.state.backendCode == code && !pages.BackendErrors {
+		return nil
+	}
+	return pages.Page(code)
+}
+
+func (e *errorPageWriter) Write(b []byte) (int, error) {
+	if !e.wrote {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.replaced {
+		return len(b), nil
+	}
+	return e.w.Write(b)
+}
+
+// Flush lets the streaming responses reach the client
+func (e *errorPageWriter) Flush() {
+	if e.replaced {
+		return
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the writer of the connection
+func (e *errorPageWriter) Unwrap() http.ResponseWriter {
+	return e.w
+}
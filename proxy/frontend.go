@@ -7,39 +7,48 @@ import (
 	"sort"
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
-	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/forward"
-	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/roundrobin"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/stream"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
 	"github.com/mailgun/vulcand/engine"
 )
 
 type frontend struct {
-	key         engine.FrontendKey
-	mux         *mux
-	frontend    engine.Frontend
-	lb          *roundrobin.Rebalancer
-	handler     http.Handler
-	watcher     *RTWatcher
-	backend     *backend
+	key      engine.FrontendKey
+	mux      *mux
+	frontend engine.Frontend
+	handler  http.Handler
+	splitter *splitter
+	// mirror copies the requests to the shadow backend, nil if the mirroring is disabled
+	mirror *mirror
+	// backends used by the frontend, the frontend backend goes first followed by the split backends
+	// and the shadow backend
+	backends    []*backend
 	middlewares map[engine.MiddlewareKey]engine.Middleware
 	log         utils.Logger
+	// retries count the retried requests of the frontends with the retry settings
+	retries *retryCounters
+	// timeouts count the timed out requests of the frontends with the timeouts
+	timeouts *timeoutCounters
+	// maintenance serves the maintenance page while the frontend is in maintenance
+	maintenance *maintenance
 }
 
-func newFrontend(m *mux, f engine.Frontend, b *backend) (*frontend, error) {
+func newFrontend(m *mux, f engine.Frontend, backends []*backend) (*frontend, error) {
 	fr := &frontend{
 		key:         engine.FrontendKey{Id: f.Id},
 		frontend:    f,
 		mux:         m,
-		backend:     b,
+		backends:    backends,
 		middlewares: make(map[engine.MiddlewareKey]engine.Middleware),
 		log:         log.GetLogger(),
+		retries:     &retryCounters{},
+		timeouts:    &timeoutCounters{},
 	}
 
 	if err := fr.rebuild(); err != nil {
 		return nil, err
 	}
-	b.linkFrontend(engine.FrontendKey{f.Id}, fr)
+	fr.linkBackends()
 	return fr, nil
 }
 
@@ -47,16 +56,22 @@ func (f *frontend) String() string {
 	return fmt.Sprintf("%v frontend(wrap=%v)", f.mux, &f.frontend)
 }
 
-// syncs backend servers and rebalancer state
-func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatcher) error {
+// syncs backend servers and rebalancer state, weights keeps the weights of the servers added to the rebalancer
+func syncServers(m *mux, rb balancer, backend *backend, w *RTWatcher, weights map[string]int) error {
 	// First, collect and parse servers to add
 	newServers := map[string]*url.URL{}
+	newWeights := map[string]int{}
 	for _, s := range backend.servers {
+		// Servers failing health checks or ejected as outliers are taken out of the rotation
+		if !backend.isAvailable(s) {
+			continue
+		}
 		u, err := url.Parse(s.URL)
 		if err != nil {
 			return fmt.Errorf("failed to parse url %v", s.URL)
 		}
 		newServers[s.URL] = u
+		newWeights[u.String()] = s.Weight
 	}
 
 	// Memorize what endpoints exist in load balancer at the moment
@@ -67,14 +82,24 @@ func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatch
 
 	// First, add endpoints, that should be added and are not in lb
 	for _, s := range newServers {
-		if _, exists := existingServers[s.String()]; !exists {
-			if err := rb.UpsertServer(s); err != nil {
-				log.Errorf("%v failed to add %v, err: %s", m, s, err)
-			} else {
-				log.Infof("%v add %v", m, s)
+		weight := newWeights[s.String()]
+		if _, exists := existingServers[s.String()]; exists {
+			if weights[s.String()] == weight {
+				continue
+			}
+			// Rebalancer does not update the weight of the existing server, so it has to be re-added
+			if err := rb.RemoveServer(s); err != nil {
+				log.Errorf("%v failed to remove %v, err: %v", m, s, err)
+				continue
 			}
-			w.upsertServer(s)
 		}
+		if err := rb.UpsertServer(s, weight); err != nil {
+			log.Errorf("%v failed to add %v, err: %s", m, s, err)
+		} else {
+			log.Infof("%v add %v, weight: %d", m, s, weight)
+		}
+		weights[s.String()] = weight
+		w.upsertServer(s)
 	}
 
 	// Second, remove endpoints that should not be there any more
@@ -85,6 +110,7 @@ func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatch
 			} else {
 				log.Infof("%v removed %v", m, v)
 			}
+			delete(weights, k)
 			w.removeServer(v)
 		}
 	}
@@ -104,35 +130,46 @@ func (f *frontend) sortedMiddlewares() []engine.Middleware {
 	return vals
 }
 
+func (f *frontend) linkBackends() {
+	for _, b := range f.backends {
+		b.linkFrontend(f.key, f)
+	}
+}
+
+func (f *frontend) unlinkBackends() {
+	for _, b := range f.backends {
+		b.unlinkFrontend(f.key)
+	}
+}
+
 func (f *frontend) rebuild() error {
 	settings := f.frontend.HTTPSettings()
 
-	// set up forwarder
-	fwd, err := forward.New(
-		forward.Logger(f.log),
-		forward.RoundTripper(f.backend.transport),
-		forward.Rewriter(
-			&forward.HeaderRewriter{
-				Hostname:           settings.Hostname,
-				TrustForwardHeader: settings.TrustForwardHeader,
-			}))
-
-	// rtwatcher will be observing and aggregating metrics
-	watcher, err := NewWatcher(fwd)
-	if err != nil {
-		return err
+	backends := f.backends
+	if settings.Mirror != nil {
+		backends = f.backends[:len(f.backends)-1]
 	}
 
-	// Create a load balancer
-	rr, err := roundrobin.New(watcher)
-	if err != nil {
-		return err
+	// Every backend gets its own load balancer, splitter distributes the requests between them
+	splits := make([]*split, len(backends))
+	for i, b := range backends {
+		sp, err := f.newSplit(b)
+		if err != nil {
+			return err
+		}
+		splits[i] = sp
 	}
+	sr := newSplitter(splits, settings.TrafficSplit)
 
-	// Rebalancer will readjust load balancer weights based on error ratios
-	rb, err := roundrobin.NewRebalancer(rr, roundrobin.RebalancerLogger(f.log))
-	if err != nil {
-		return err
+	var rb http.Handler = sr
+	var mr *mirror
+	if settings.Mirror != nil {
+		shadow, err := f.newSplit(f.backends[len(f.backends)-1])
+		if err != nil {
+			return err
+		}
+		mr = newMirror(sr, shadow, *settings.Mirror)
+		rb = mr
 	}
 
 	// create middlewares sorted by priority and chain them
@@ -159,34 +196,73 @@ func (f *frontend) rebuild() error {
 		next = rb
 	}
 
-	// stream will retry and replay requests, fix encodings
-	if settings.FailoverPredicate == "" {
-		settings.FailoverPredicate = `IsNetworkError() && RequestMethod() == "GET" && Attempts() < 2`
+	timeouts, err := f.frontend.TimeoutSettings()
+	if err != nil {
+		return err
 	}
-	str, err := stream.New(next,
-		stream.Logger(f.log),
-		stream.Retry(settings.FailoverPredicate),
-		stream.MaxRequestBodyBytes(settings.Limits.MaxBodyBytes),
-		stream.MemRequestBodyBytes(settings.Limits.MaxMemBodyBytes))
+	var str http.Handler = next
+	if timeouts != nil && (timeouts.ResponseHeader > 0 || timeouts.BodyIdle > 0) {
+		// Every attempt gets its own response header and body idle timeouts
+		str = newTimeoutHandler(str, engine.FrontendTimeouts{ResponseHeader: timeouts.ResponseHeader, BodyIdle: timeouts.BodyIdle}, f.timeouts, f.mux.options.WriteTimeout)
+	}
+	if str, err = f.newStream(str, settings); err != nil {
+		return err
+	}
+	if timeouts != nil && timeouts.Total > 0 {
+		str = newTimeoutHandler(str, engine.FrontendTimeouts{Total: timeouts.Total}, f.timeouts, f.mux.options.WriteTimeout)
+	}
+
+	// Upgrade requests bypass the stream and the timeouts and go straight to the middlewares
+	var handler http.Handler = &upgradeSwitch{upgrade: next, next: str}
+
+	pages, err := f.frontend.ErrorPageSettings()
 	if err != nil {
 		return err
 	}
+	if pages != nil {
+		handler = &frontendErrorPages{next: handler, pages: pages}
+	}
 
-	if err := syncServers(f.mux, rb, f.backend, watcher); err != nil {
+	mts, err := f.frontend.MaintenanceSettings()
+	if err != nil {
 		return err
 	}
+	mt := newMaintenance(handler, mts)
+	handler = mt
 
 	// Add the frontend to the router
-	if err := f.mux.router.Handle(f.frontend.Route, str); err != nil {
+	if err := f.mux.router.Handle(f.frontend.Route, handler); err != nil {
 		return err
 	}
 
-	f.lb = rb
-	f.handler = str
-	f.watcher = watcher
+	f.splitter = sr
+	f.mirror = mr
+	f.maintenance = mt
+	f.handler = handler
 	return nil
 }
 
+// newStream returns the handler buffering and replaying the requests, the retrier is used
+// if the frontend has the retry settings
+func (f *frontend) newStream(next http.Handler, settings engine.HTTPFrontendSettings) (http.Handler, error) {
+	rs, err := f.frontend.RetrySettings()
+	if err != nil {
+		return nil, err
+	}
+	if rs != nil {
+		return newRetrier(next, *rs, settings.Limits, f.backends[0].budget, f.retries, f.log), nil
+	}
+	// stream will retry and replay requests, fix encodings
+	if settings.FailoverPredicate == "" {
+		settings.FailoverPredicate = `IsNetworkError() && RequestMethod() == "GET" && Attempts() < 2`
+	}
+	return stream.New(next,
+		stream.Logger(f.log),
+		stream.Retry(settings.FailoverPredicate),
+		stream.MaxRequestBodyBytes(settings.Limits.MaxBodyBytes),
+		stream.MemRequestBodyBytes(settings.Limits.MaxMemBodyBytes))
+}
+
 func (f *frontend) upsertMiddleware(fk engine.FrontendKey, mi engine.Middleware) error {
 	f.middlewares[engine.MiddlewareKey{FrontendKey: fk, Id: mi.Id}] = mi
 	return f.rebuild()
@@ -197,31 +273,92 @@ func (f *frontend) deleteMiddleware(mk engine.MiddlewareKey) error {
 	return f.rebuild()
 }
 
+// splits returns the splits of all the backends used by the frontend, including the shadow backend
+func (f *frontend) splits() []*split {
+	if f.splitter == nil {
+		return nil
+	}
+	if f.mirror == nil {
+		return f.splitter.splits
+	}
+	return append(append([]*split{}, f.splitter.splits...), f.mirror.shadow)
+}
+
+// rtStats returns the stats of the frontend requests with the stats of the splits and the mirror
+func (f *frontend) rtStats() (*engine.RoundTripStats, error) {
+	stats, err := f.splitter.rtStats()
+	if err != nil {
+		return nil, err
+	}
+	if f.mirror != nil {
+		if stats.Mirror, err = f.mirror.rtStats(); err != nil {
+			return nil, err
+		}
+	}
+	if f.frontend.HTTPSettings().Retry != nil {
+		stats.Retries = f.retries.stats()
+	}
+	if f.frontend.HTTPSettings().Timeouts != nil {
+		stats.Timeouts = f.timeouts.stats()
+	}
+	return stats, nil
+}
+
+// updateBackend syncs the servers of the backend with the load balancer of its split
 func (f *frontend) updateBackend(b *backend) error {
-	oldb := f.backend
-	f.backend = b
+	for _, sp := range f.splits() {
+		if sp.backend != b {
+			continue
+		}
+		if err := syncServers(f.mux, sp.lb, b, sp.watcher, sp.weights); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Switching backends, set the new transport and perform switch
-	if b.backend.Id != oldb.backend.Id {
-		log.Infof("%v updating backend from %v to %v", f, &oldb, &f.backend)
-		oldb.unlinkFrontend(f.key)
-		b.linkFrontend(f.key, f)
-		return f.rebuild()
+// updateBackends switches the frontend to the new backends and returns true if the frontend has been rebuilt
+func (f *frontend) updateBackends(backends []*backend) (bool, error) {
+	if sameBackends(f.backends, backends) {
+		for _, b := range backends {
+			if err := f.updateBackend(b); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
 	}
-	return syncServers(f.mux, f.lb, f.backend, f.watcher)
+	// Switching backends, set the new transports and perform switch
+	log.Infof("%v updating backends from %v to %v", f, f.backends, backends)
+	f.unlinkBackends()
+	f.backends = backends
+	f.linkBackends()
+	return true, f.rebuild()
+}
+
+func sameBackends(a, b []*backend) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // TODO: implement rollback in case of suboperation failure
-func (f *frontend) update(ef engine.Frontend, b *backend) error {
+func (f *frontend) update(ef engine.Frontend, backends []*backend) error {
 	oldf := f.frontend
 	f.frontend = ef
 
-	if err := f.updateBackend(b); err != nil {
+	rebuilt, err := f.updateBackends(backends)
+	if err != nil {
 		return err
 	}
 
 	if oldf.Route != ef.Route {
-		log.Infof("%v updating route from %v to %v", oldf.Route, ef.Route)
+		log.Infof("%v updating route from %v to %v", f, oldf.Route, ef.Route)
 		if err := f.mux.router.Handle(ef.Route, f.handler); err != nil {
 			return err
 		}
@@ -232,17 +369,35 @@ func (f *frontend) update(ef engine.Frontend, b *backend) error {
 
 	olds := oldf.HTTPSettings()
 	news := ef.HTTPSettings()
-	if !olds.Equals(news) {
-		if err := f.rebuild(); err != nil {
+	if rebuilt || olds.Equals(news) {
+		return nil
+	}
+	// Shifting the traffic between the same backends and toggling the maintenance keep the load balancers
+	// and the stats of the splits
+	shifted := news
+	shifted.TrafficSplit, shifted.Mirror, shifted.Maintenance = olds.TrafficSplit, olds.Mirror, olds.Maintenance
+	if shifted.Equals(olds) {
+		log.Infof("%v updating traffic split and maintenance", f)
+		mts, err := ef.MaintenanceSettings()
+		if err != nil {
 			return err
 		}
+		f.splitter.update(news.TrafficSplit)
+		if f.mirror != nil {
+			f.mirror.update(*news.Mirror)
+		}
+		f.maintenance.update(mts)
+		return nil
+	}
+	if err := f.rebuild(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func (f *frontend) remove() error {
-	f.backend.unlinkFrontend(f.key)
+	f.unlinkBackends()
 	return f.mux.router.Remove(f.frontend.Route)
 }
 
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// healthChecker periodically checks the servers of the backend and notifies the backend
+// when any of the servers becomes healthy or unhealthy
+type healthChecker struct {
+	settings engine.HealthCheckSettings
+	client   *http.Client
+	onChange func()
+
+	mtx    *sync.Mutex
+	states map[string]*serverState
+	closed bool
+}
+
+type serverState struct {
+	url     *url.URL
+	stopC   chan struct{}
+	healthy bool
+	// passed and failed count consecutive checks results
+	passed  int
+	failed  int
+	checked time.Time
+	err     string
+}
+
+func newHealthChecker(s engine.HealthCheckSettings, t http.RoundTripper, onChange func()) *healthChecker {
+	return &healthChecker{
+		settings: s,
+		client: &http.Client{
+			Transport: t,
+			Timeout:   s.Timeout,
+			// Redirects are reported as is, so they can be matched against the expected status range
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		onChange: onChange,
+		mtx:      &sync.Mutex{},
+		states:   map[string]*serverState{},
+	}
+}
+
+// update starts checking the new servers and stops checking the removed ones. New servers are considered
+// healthy until they fail the checks.
+func (h *healthChecker) update(servers []engine.Server) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	keep := map[string]bool{}
+	for _, s := range servers {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			continue
+		}
+		keep[u.String()] = true
+		if _, ok := h.states[u.String()]; ok {
+			continue
+		}
+		st := &serverState{url: u, stopC: make(chan struct{}), healthy: true}
+		h.states[u.String()] = st
+		go h.run(st)
+	}
+	for k, st := range h.states {
+		if !keep[k] {
+			close(st.stopC)
+			delete(h.states, k)
+		}
+	}
+}
+
+// isHealthy returns false only for the servers that failed the checks
+func (h *healthChecker) isHealthy(u string) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	st, ok := h.states[u]
+	return !ok || st.healthy
+}
+
+func (h *healthChecker) health(u string) *engine.ServerHealth {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	st, ok := h.states[u]
+	if !ok {
+		return nil
+	}
+	return &engine.ServerHealth{Healthy: st.healthy, Checked: st.checked, Error: st.err}
+}
+
+// close stops all the checks, it does not wait for the checks in progress to finish
+func (h *healthChecker) close() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.closed = true
+	for k, st := range h.states {
+		close(st.stopC)
+		delete(h.states, k)
+	}
+}
+
+func (h *healthChecker) run(st *serverState) {
+	ticker := time.NewTicker(h.settings.Interval)
+	defer ticker.Stop()
+	for {
+		err := h.check(st.url)
+		if h.record(st, err) {
+			h.onChange()
+		}
+		select {
+		case <-st.stopC:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) check(u *url.URL) error {
+	checkURL := *u
+	checkURL.Path = h.settings.Path
+	re, err := h.client.Get(checkURL.String())
+	if err != nil {
+		return err
+	}
+	// Drain the body so the connection could be reused
+	io.Copy(ioutil.Discard, re.Body)
+	re.Body.Close()
+	if re.StatusCode < h.settings.MinStatus || re.StatusCode > h.settings.MaxStatus {
+		return fmt.Errorf("unexpected status code: %d", re.StatusCode)
+	}
+	return nil
+}
+
+// record updates the server state with the check result and returns true if the server health has changed
+func (h *healthChecker) record(st *serverState, err error) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	select {
+	case <-st.stopC:
+		// The server has been removed while the check was in progress
+		return false
+	default:
+	}
+
+	st.checked = time.Now().UTC()
+	if err == nil {
+		st.passed, st.failed, st.err = st.passed+1, 0, ""
+		if !st.healthy && st.passed >= h.settings.HealthyThreshold {
+			log.Infof("%v passed %d health checks, putting it back", st.url, st.passed)
+			st.healthy = true
+			return true
+		}
+		return false
+	}
+	st.passed, st.failed, st.err = 0, st.failed+1, err.Error()
+	if st.healthy && st.failed >= h.settings.UnhealthyThreshold {
+		log.Warningf("%v failed %d health checks, taking it out, last error: %v", st.url, st.failed, err)
+		st.healthy = false
+		return true
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mailgun/vulcand/engine"
+)
+
+// hostOptions are the parsed settings of the host applied to the requests, nil settings are not set
+type hostOptions struct {
+	errorPages  *engine.ErrorPageSettings
+	maintenance *engine.MaintenanceSettings
+	redirect    *engine.HTTPSRedirectSettings
+	// host answers the pending ACME challenges
+	host engine.Host
+	// httpsPort is the port the plain HTTP requests are redirected to, set along with the redirect
+	httpsPort int
+}
+
+func newHostOptions(h engine.Host) (*hostOptions, error) {
+	pages, err := h.ErrorPageSettings()
+	if err != nil {
+		return nil, err
+	}
+	mt, err := h.MaintenanceSettings()
+	if err != nil {
+		return nil, err
+	}
+	redirect, err := h.HTTPSRedirectSettings()
+	if err != nil {
+		return nil, err
+	}
+	return &hostOptions{errorPages: pages, maintenance: mt, redirect: redirect, host: h}, nil
+}
+
+// hostHandler answers the ACME challenges and applies the HTTPS redirect, the maintenance and the error pages
+// of the host to the requests. Upgrade requests get the redirect and the maintenance response but not
+// the error pages, as the tunnel hijacks the connection.
+type hostHandler struct {
+	mux  *mux
+	next http.Handler
+}
+
+func newHostHandler(m *mux, next http.Handler) *hostHandler {
+	return &hostHandler{mux: m, next: next}
+}
+
+func (h *hostHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	opts := h.mux.requestHostOptions(req.Host)
+	if strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		if keyAuth, ok := opts.host.ACMEChallenge(strings.TrimPrefix(req.URL.Path, acmeChallengePath)); ok {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(keyAuth))
+			return
+		}
+	}
+	if r := opts.redirect; r != nil {
+		if req.TLS == nil && !r.Excluded(req.URL.Path) {
+			redirectToHTTPS(w, req, r.StatusCode, opts.httpsPort)
+			return
+		}
+		if req.TLS != nil && r.HSTS != "" {
+			w.Header().Set("Strict-Transport-Security", r.HSTS)
+		}
+	}
+	if mt := opts.maintenance; mt != nil && !mt.Bypass(req) {
+		serveMaintenance(w, req, mt)
+		return
+	}
+	if isUpgrade(req) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	st := &errorPageState{pages: opts.errorPages}
+	ew := &errorPageWriter{w: w, req: req, state: st}
+	h.next.ServeHTTP(ew, req.WithContext(context.WithValue(req.Context(), errorPageKey{}, st)))
+	if !ew.wrote {
+		ew.WriteHeader(http.StatusOK)
+	}
+}
+
+// acmeChallengePath is the path prefix of the ACME HTTP-01 challenges, see RFC 8555 section 8.3
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// redirectToHTTPS redirects the request to the same URL over HTTPS, the standard port is omitted
+func redirectToHTTPS(w http.ResponseWriter, req *http.Request, code, port int) {
+	hostname := req.Host
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		hostname = h
+	}
+	if port != 443 {
+		hostname = net.JoinHostPort(hostname, strconv.Itoa(port))
+	}
+	http.Redirect(w, req, fmt.Sprintf("https://%s%s", hostname, req.URL.RequestURI()), code)
+}
+
+// matchHost returns the key of the host named as the hostname, or the key of the wildcard host matching it,
+// e.g. *.example.com for a.example.com. Callers hold the mux lock.
+func (m *mux) matchHost(hostname string) (engine.HostKey, bool) {
+	hk := engine.HostKey{Name: hostname}
+	if _, ok := m.hosts[hk]; ok {
+		return hk, true
+	}
+	if w := engine.WildcardHostname(hostname); w != "" {
+		hk = engine.HostKey{Name: w}
+		if _, ok := m.hosts[hk]; ok {
+			return hk, true
+		}
+	}
+	return engine.HostKey{}, false
+}
+
+// requestHostOptions returns the options of the host of the request, the options of the wildcard host
+// matching the request host are used next, the default host options are used for the unknown hosts
+func (m *mux) requestHostOptions(hostname string) hostOptions {
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	hk, ok := m.matchHost(hostname)
+	if !ok {
+		for k, h := range m.hosts {
+			if h.Settings.Default {
+				hk = k
+				break
+			}
+		}
+	}
+	opts, ok := m.hostOptions[hk]
+	if !ok {
+		return hostOptions{}
+	}
+	out := *opts
+	if out.redirect != nil {
+		out.httpsPort = out.redirect.Port
+		if out.httpsPort == 0 {
+			out.httpsPort = m.httpsPort()
+		}
+	}
+	return out
+}
+
+// httpsPort returns the port of the HTTPS listener if the mux has exactly one, 443 otherwise
+func (m *mux) httpsPort() int {
+	port := 0
+	for _, s := range m.servers {
+		if !s.isTLS() {
+			continue
+		}
+		if port != 0 {
+			return 443
+		}
+		_, p, err := net.SplitHostPort(s.listener.Address.Address)
+		if err != nil {
+			return 443
+		}
+		if port, err = strconv.Atoi(p); err != nil {
+			return 443
+		}
+	}
+	if port == 0 {
+		return 443
+	}
+	return port
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/mailgun/vulcand/engine"
+)
+
+// maintenance responds to the frontend requests with the maintenance page while the maintenance is on,
+// the maintenance is toggled without rebuilding the frontend
+type maintenance struct {
+	next http.Handler
+
+	mtx      *sync.RWMutex
+	settings *engine.MaintenanceSettings
+}
+
+func newMaintenance(next http.Handler, s *engine.MaintenanceSettings) *maintenance {
+	return &maintenance{next: next, mtx: &sync.RWMutex{}, settings: s}
+}
+
+// update turns the maintenance on with the settings or off if the settings are nil
+func (m *maintenance) update(s *engine.MaintenanceSettings) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.settings = s
+}
+
+func (m *maintenance) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.mtx.RLock()
+	s := m.settings
+	m.mtx.RUnlock()
+
+	if s == nil || s.Bypass(req) {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+	serveMaintenance(w, req, s)
+}
+
+// serveMaintenance writes the maintenance page, error pages are not applied to it
+func serveMaintenance(w http.ResponseWriter, req *http.Request, s *engine.MaintenanceSettings) {
+	if st, ok := req.Context().Value(errorPageKey{}).(*errorPageState); ok {
+		st.pages = nil
+	}
+	h := w.Header()
+	h.Set("Content-Type", s.ContentType)
+	h.Set("Content-Length", strconv.Itoa(len(s.Body)))
+	h.Set("Cache-Control", "no-store")
+	if s.RetryAfter != "" {
+		h.Set("Retry-After", s.RetryAfter)
+	}
+	w.WriteHeader(s.StatusCode)
+	w.Write([]byte(s.Body))
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// maxMirroredRequests limits the shadow requests in flight, the requests over the limit are not copied,
+// so the slow shadow backend does not pile up the goroutines and buffered bodies
+const maxMirroredRequests = 256
+
+// mirror copies the percentage of the requests to the shadow backend. Copies are sent asynchronously
+// and their responses are discarded, so the shadow backend does not affect the clients.
+type mirror struct {
+	next   http.Handler
+	shadow *split
+	// percent of the copied requests, accessed atomically
+	percent  int32
+	inflight chan struct{}
+}
+
+func newMirror(next http.Handler, shadow *split, m engine.HTTPFrontendMirror) *mirror {
+	return &mirror{
+		next:     next,
+		shadow:   shadow,
+		percent:  int32(m.Percent),
+		inflight: make(chan struct{}, maxMirroredRequests),
+	}
+}
+
+func (m *mirror) update(s engine.HTTPFrontendMirror) {
+	atomic.StoreInt32(&m.percent, int32(s.Percent))
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Upgraded connections can not be copied
+	if isUpgrade(req) || rand.Intn(100) >= int(atomic.LoadInt32(&m.percent)) {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		log.Warningf("%v mirror is busy, not copying %v %v", m.shadow.backend, req.Method, req.URL)
+		m.next.ServeHTTP(w, req)
+		return
+	}
+
+	// Body is buffered by the stream, so it is read to memory and replayed for both requests
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		<-m.inflight
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// Copy is detached from the client request, so it is not canceled when the client is served
+	shadowReq := req.WithContext(context.Background())
+	shadowReq.URL = utils.CopyURL(req.URL)
+	shadowReq.Header = make(http.Header)
+	utils.CopyHeaders(shadowReq.Header, req.Header)
+	shadowReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	go func() {
+		defer func() { <-m.inflight }()
+		m.shadow.lb.ServeHTTP(&discardWriter{header: make(http.Header)}, shadowReq)
+	}()
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	m.next.ServeHTTP(w, &newReq)
+}
+
+// discardWriter discards the shadow responses
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (d *discardWriter) WriteHeader(code int) {
+}
+
+// rtStats returns the stats of the requests copied to the shadow backend
+func (m *mirror) rtStats() (*engine.SplitStats, error) {
+	st, err := m.shadow.watcher.rtStats()
+	if err != nil {
+		return nil, err
+	}
+	return &engine.SplitStats{BackendId: m.shadow.id, Weight: int(atomic.LoadInt32(&m.percent)), Stats: *st}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -30,6 +31,17 @@ type mux struct {
 
 	hosts map[engine.HostKey]engine.Host
 
+	// TCP listeners, frontends and backends proxy the raw connections
+	tcpServers   map[engine.ListenerKey]*tcpSrv
+	tcpBackends  map[engine.BackendKey]*tcpBackend
+	tcpFrontends map[engine.FrontendKey]*tcpFrontend
+
+	// Connection stats of the hosts proxied by the listeners in SNI passthrough mode
+	passthroughStats map[engine.HostKey]*tcpStats
+
+	// Parsed settings of the hosts applied to the requests
+	hostOptions map[engine.HostKey]*hostOptions
+
 	// Options hold parameters that are used to initialize http servers
 	options Options
 
@@ -79,6 +91,13 @@ func New(id int, st stapler.Stapler, o Options) (*mux, error) {
 		frontends: make(map[engine.FrontendKey]*frontend),
 		hosts:     make(map[engine.HostKey]engine.Host),
 
+		tcpServers:   make(map[engine.ListenerKey]*tcpSrv),
+		tcpBackends:  make(map[engine.BackendKey]*tcpBackend),
+		tcpFrontends: make(map[engine.FrontendKey]*tcpFrontend),
+
+		passthroughStats: make(map[engine.HostKey]*tcpStats),
+		hostOptions:      make(map[engine.HostKey]*hostOptions),
+
 		stapleUpdatesC: make(chan *stapler.StapleUpdated),
 		stopC:          make(chan struct{}),
 		stapler:        st,
@@ -145,6 +164,15 @@ func (m *mux) GetFiles() ([]*FileDescriptor, error) {
 			fds = append(fds, fd)
 		}
 	}
+	for _, srv := range m.tcpServers {
+		fd, err := srv.GetFile()
+		if err != nil {
+			return nil, err
+		}
+		if fd != nil {
+			fds = append(fds, fd)
+		}
+	}
 	return fds, nil
 }
 
@@ -219,6 +247,16 @@ func (m *mux) TakeFiles(files []*FileDescriptor) error {
 			return err
 		}
 	}
+	for _, srv := range m.tcpServers {
+		file, exists := fMap[srv.listener.Address]
+		if !exists {
+			log.Infof("%s skipping take of files from address %s, has no passed files", m, srv.listener.Address)
+			continue
+		}
+		if err := srv.takeFile(file); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -239,6 +277,11 @@ func (m *mux) Start() error {
 			return err
 		}
 	}
+	for _, s := range m.tcpServers {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
 
 	log.Infof("%s started", m)
 	return nil
@@ -269,6 +312,10 @@ func (m *mux) stopServers() {
 	m.state = stateShuttingDown
 	close(m.stopC)
 
+	for _, b := range m.backends {
+		b.stopChecks()
+	}
+
 	// init state has no running servers, no need to close them
 	if prevState == stateInit {
 		return
@@ -277,6 +324,9 @@ func (m *mux) stopServers() {
 	for _, s := range m.servers {
 		s.shutdown()
 	}
+	for _, s := range m.tcpServers {
+		s.shutdown()
+	}
 }
 
 func (m *mux) UpsertHost(host engine.Host) error {
@@ -285,7 +335,23 @@ func (m *mux) UpsertHost(host engine.Host) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	m.hosts[engine.HostKey{Name: host.Name}] = host
+	return m.upsertHost(host)
+}
+
+func (m *mux) upsertHost(host engine.Host) error {
+	hk := engine.HostKey{Name: host.Name}
+	opts, err := newHostOptions(host)
+	if err != nil {
+		return err
+	}
+	m.hosts[hk] = host
+	m.hostOptions[hk] = opts
+
+	if host.Settings.Passthrough == nil {
+		delete(m.passthroughStats, hk)
+	} else if _, ok := m.passthroughStats[hk]; !ok {
+		m.passthroughStats[hk] = &tcpStats{}
+	}
 
 	for _, s := range m.servers {
 		if s.isTLS() {
@@ -301,6 +367,10 @@ func (m *mux) DeleteHost(hk engine.HostKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteHost(hk)
+}
+
+func (m *mux) deleteHost(hk engine.HostKey) error {
 	host, exists := m.hosts[hk]
 	if !exists {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", hk)}
@@ -308,6 +378,8 @@ func (m *mux) DeleteHost(hk engine.HostKey) error {
 
 	// delete host from the hosts list
 	delete(m.hosts, hk)
+	delete(m.passthroughStats, hk)
+	delete(m.hostOptions, hk)
 
 	// delete staple from the cache
 	m.stapler.DeleteHost(hk)
@@ -335,6 +407,15 @@ func (m *mux) DeleteListener(lk engine.ListenerKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteListener(lk)
+}
+
+func (m *mux) deleteListener(lk engine.ListenerKey) error {
+	if ts, exists := m.tcpServers[lk]; exists {
+		delete(m.tcpServers, lk)
+		ts.shutdown()
+		return nil
+	}
 	s, exists := m.servers[lk]
 	if !exists {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", lk)}
@@ -347,6 +428,9 @@ func (m *mux) DeleteListener(lk engine.ListenerKey) error {
 
 func (m *mux) upsertListener(l engine.Listener) error {
 	lk := engine.ListenerKey{Id: l.Id}
+	if ts, exists := m.tcpServers[lk]; exists {
+		return ts.updateListener(l)
+	}
 	s, exists := m.servers[lk]
 	if exists {
 		return s.updateListener(l)
@@ -358,6 +442,23 @@ func (m *mux) upsertListener(l engine.Listener) error {
 			return &engine.AlreadyExistsError{Message: fmt.Sprintf("%v conflicts with existing %v", l, srv.listener)}
 		}
 	}
+	for _, srv := range m.tcpServers {
+		if srv.listener.Address == l.Address {
+			return &engine.AlreadyExistsError{Message: fmt.Sprintf("%v conflicts with existing %v", l, srv.listener)}
+		}
+	}
+
+	if l.Protocol == engine.TCP {
+		ts := newTCPSrv(m, l)
+		m.tcpServers[lk] = ts
+		if m.state == stateActive {
+			log.Infof("Mux is in active state, starting the TCP server")
+			if err := ts.start(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
 	var err error
 	if s, err = newSrv(m, l); err != nil {
@@ -380,11 +481,37 @@ func (m *mux) UpsertBackend(b engine.Backend) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	_, err := m.upsertBackend(b)
+	return m.upsertBackend(b)
+}
+
+func (m *mux) upsertBackend(be engine.Backend) error {
+	bk := engine.BackendKey{Id: be.Id}
+	_, isHTTP := m.backends[bk]
+	_, isTCP := m.tcpBackends[bk]
+	if (isHTTP && be.Type != engine.HTTP) || (isTCP && be.Type != engine.TCP) {
+		return fmt.Errorf("%v can not change the type to %v", bk, be.Type)
+	}
+	if be.Type == engine.TCP {
+		return m.upsertTCPBackend(be)
+	}
+	_, err := m.upsertHTTPBackend(be)
 	return err
 }
 
-func (m *mux) upsertBackend(be engine.Backend) (*backend, error) {
+func (m *mux) upsertTCPBackend(be engine.Backend) error {
+	bk := engine.BackendKey{Id: be.Id}
+	if b, ok := m.tcpBackends[bk]; ok {
+		return b.update(be)
+	}
+	b, err := newTCPBackend(m, be)
+	if err != nil {
+		return err
+	}
+	m.tcpBackends[bk] = b
+	return nil
+}
+
+func (m *mux) upsertHTTPBackend(be engine.Backend) (*backend, error) {
 	bk := engine.BackendKey{Id: be.Id}
 	b, ok := m.backends[bk]
 	if ok {
@@ -404,6 +531,17 @@ func (m *mux) DeleteBackend(bk engine.BackendKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteBackend(bk)
+}
+
+func (m *mux) deleteBackend(bk engine.BackendKey) error {
+	if tb, ok := m.tcpBackends[bk]; ok {
+		if len(tb.frontends) != 0 {
+			return fmt.Errorf("%v is used by frontends: %v", tb, tb.frontends)
+		}
+		delete(m.tcpBackends, bk)
+		return nil
+	}
 	b, ok := m.backends[bk]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
@@ -423,23 +561,75 @@ func (m *mux) UpsertFrontend(f engine.Frontend) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	_, err := m.upsertFrontend(f)
+	return m.upsertFrontend(f)
+}
+
+func (m *mux) upsertFrontend(fe engine.Frontend) error {
+	fk := engine.FrontendKey{Id: fe.Id}
+	_, isHTTP := m.frontends[fk]
+	_, isTCP := m.tcpFrontends[fk]
+	if (isHTTP && fe.Type != engine.HTTP) || (isTCP && fe.Type != engine.TCP) {
+		return fmt.Errorf("%v can not change the type to %v", fk, fe.Type)
+	}
+	if fe.Type == engine.TCP {
+		return m.upsertTCPFrontend(fe)
+	}
+	_, err := m.upsertHTTPFrontend(fe)
 	return err
 }
 
-func (m *mux) upsertFrontend(fe engine.Frontend) (*frontend, error) {
+func (m *mux) upsertTCPFrontend(fe engine.Frontend) error {
 	bk := engine.BackendKey{Id: fe.BackendId}
-	b, ok := m.backends[bk]
+	b, ok := m.tcpBackends[bk]
+	if !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
+	}
+	fk := engine.FrontendKey{Id: fe.Id}
+	// Every connection accepted by the listener goes to the one frontend
+	lid := fe.TCPSettings().ListenerId
+	if other := m.tcpFrontendOf(lid); other != nil && other.frontend.Id != fe.Id {
+		return &engine.AlreadyExistsError{Message: fmt.Sprintf("%v conflicts with existing %v on listener %v", fk, &other.frontend, lid)}
+	}
+	f, ok := m.tcpFrontends[fk]
 	if !ok {
-		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
+		f = &tcpFrontend{mux: m}
+		m.tcpFrontends[fk] = f
+	} else {
+		delete(f.backend.frontends, fk)
+	}
+	f.frontend = fe
+	f.backend = b
+	b.frontends[fk] = f
+	return nil
+}
+
+// tcpFrontendOf returns the tcp frontend bound to the listener or nil if there is none
+func (m *mux) tcpFrontendOf(listenerId string) *tcpFrontend {
+	for _, f := range m.tcpFrontends {
+		if f.listenerId() == listenerId {
+			return f
+		}
+	}
+	return nil
+}
+
+func (m *mux) upsertHTTPFrontend(fe engine.Frontend) (*frontend, error) {
+	backends := []*backend{}
+	for _, id := range fe.BackendIds() {
+		bk := engine.BackendKey{Id: id}
+		b, ok := m.backends[bk]
+		if !ok {
+			return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
+		}
+		backends = append(backends, b)
 	}
 	fk := engine.FrontendKey{Id: fe.Id}
 	f, ok := m.frontends[fk]
 	if ok {
-		return f, f.update(fe, b)
+		return f, f.update(fe, backends)
 	}
 
-	f, err := newFrontend(m, fe, b)
+	f, err := newFrontend(m, fe, backends)
 	if err != nil {
 		return nil, err
 	}
@@ -458,6 +648,11 @@ func (m *mux) DeleteFrontend(fk engine.FrontendKey) error {
 }
 
 func (m *mux) deleteFrontend(fk engine.FrontendKey) error {
+	if tf, ok := m.tcpFrontends[fk]; ok {
+		delete(tf.backend.frontends, fk)
+		delete(m.tcpFrontends, fk)
+		return nil
+	}
 	f, ok := m.frontends[fk]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", fk)}
@@ -479,6 +674,9 @@ func (m *mux) UpsertMiddleware(fk engine.FrontendKey, mi engine.Middleware) erro
 }
 
 func (m *mux) upsertMiddleware(fk engine.FrontendKey, mi engine.Middleware) error {
+	if _, ok := m.tcpFrontends[fk]; ok {
+		return fmt.Errorf("%v is a tcp frontend, middlewares are not supported", fk)
+	}
 	f, ok := m.frontends[fk]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", fk)}
@@ -487,11 +685,15 @@ func (m *mux) upsertMiddleware(fk engine.FrontendKey, mi engine.Middleware) erro
 }
 
 func (m *mux) DeleteMiddleware(mk engine.MiddlewareKey) error {
-	log.Infof("%v DeleteMiddleware(%v %v)", m, &mk)
+	log.Infof("%v DeleteMiddleware(%v)", m, &mk)
 
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteMiddleware(mk)
+}
+
+func (m *mux) deleteMiddleware(mk engine.MiddlewareKey) error {
 	f, ok := m.frontends[mk.FrontendKey]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", mk)}
@@ -506,14 +708,21 @@ func (m *mux) UpsertServer(bk engine.BackendKey, srv engine.Server) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.upsertServer(bk, srv)
+}
+
+func (m *mux) upsertServer(bk engine.BackendKey, srv engine.Server) error {
 	if _, err := url.ParseRequestURI(srv.URL); err != nil {
 		return fmt.Errorf("failed to parse %v, error: %v", srv, err)
 	}
 
+	if tb, ok := m.tcpBackends[bk]; ok {
+		return tb.upsertServer(srv)
+	}
 	b, ok := m.backends[bk]
 	if !ok {
 		var err error
-		if b, err = m.upsertBackend(engine.Backend{Id: bk.Id, Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}); err != nil {
+		if b, err = m.upsertHTTPBackend(engine.Backend{Id: bk.Id, Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}); err != nil {
 			return err
 		}
 	}
@@ -527,6 +736,13 @@ func (m *mux) DeleteServer(sk engine.ServerKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteServer(sk)
+}
+
+func (m *mux) deleteServer(sk engine.ServerKey) error {
+	if tb, ok := m.tcpBackends[sk.BackendKey]; ok {
+		return tb.deleteServer(sk)
+	}
 	b, ok := m.backends[sk.BackendKey]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", sk.BackendKey)}
@@ -535,6 +751,56 @@ func (m *mux) DeleteServer(sk engine.ServerKey) error {
 	return b.deleteServer(sk)
 }
 
+// ApplyBatch applies the group of changes under one lock, so requests never see the intermediate state.
+// It applies all changes even if some of them fail, so the state differs from the batch by the failed changes only.
+func (m *mux) ApplyBatch(changes []interface{}) error {
+	log.Infof("%v ApplyBatch %d changes", m, len(changes))
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var errors []string
+	for i, ch := range changes {
+		if err := m.applyChange(ch); err != nil {
+			errors = append(errors, fmt.Sprintf("change %d %v: %v", i+1, ch, err))
+		}
+	}
+	if len(errors) != 0 {
+		return fmt.Errorf("failed to apply %d of %d changes: %s", len(errors), len(changes), strings.Join(errors, ", "))
+	}
+	return nil
+}
+
+func (m *mux) applyChange(ch interface{}) error {
+	switch change := ch.(type) {
+	case *engine.HostUpserted:
+		return m.upsertHost(change.Host)
+	case *engine.HostDeleted:
+		return m.deleteHost(change.HostKey)
+	case *engine.ListenerUpserted:
+		return m.upsertListener(change.Listener)
+	case *engine.ListenerDeleted:
+		return m.deleteListener(change.ListenerKey)
+	case *engine.FrontendUpserted:
+		return m.upsertFrontend(change.Frontend)
+	case *engine.FrontendDeleted:
+		return m.deleteFrontend(change.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		return m.upsertMiddleware(change.FrontendKey, change.Middleware)
+	case *engine.MiddlewareDeleted:
+		return m.deleteMiddleware(change.MiddlewareKey)
+	case *engine.BackendUpserted:
+		return m.upsertBackend(change.Backend)
+	case *engine.BackendDeleted:
+		return m.deleteBackend(change.BackendKey)
+	case *engine.ServerUpserted:
+		return m.upsertServer(change.BackendKey, change.Server)
+	case *engine.ServerDeleted:
+		return m.deleteServer(change.ServerKey)
+	}
+	return fmt.Errorf("unsupported change: %#v", ch)
+}
+
 func (m *mux) transportSettings(b engine.Backend) (*engine.TransportSettings, error) {
 	s, err := b.TransportSettings()
 	if err != nil {
@@ -550,6 +816,18 @@ func (m *mux) transportSettings(b engine.Backend) (*engine.TransportSettings, er
 	return s, nil
 }
 
+func (m *mux) tcpTransportSettings(b engine.Backend) (*engine.TCPTransportSettings, error) {
+	s, err := b.TCPTransportSettings()
+	if err != nil {
+		return nil, err
+	}
+	// Apply global defaults if options are not set
+	if s.Timeouts.Dial == 0 {
+		s.Timeouts.Dial = m.options.DialTimeout
+	}
+	return s, nil
+}
+
 func (m *mux) processStapleUpdate(e *stapler.StapleUpdated) error {
 	log.Infof("%v processStapleUpdate event: %v", m, e)
 	m.mtx.Lock()
@@ -594,6 +872,8 @@ const (
 	PerfMon = "_perfMon"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func setDefaults(o Options) Options {
 	if o.MetricsClient == nil {
 		o.MetricsClient = metrics.NewNop()
@@ -601,6 +881,9 @@ func setDefaults(o Options) Options {
 	if o.TimeProvider == nil {
 		o.TimeProvider = &timetools.RealTime{}
 	}
+	if o.ShutdownTimeout == 0 {
+		o.ShutdownTimeout = defaultShutdownTimeout
+	}
 	return o
 }
 
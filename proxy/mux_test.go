@@ -2,17 +2,32 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"net/url"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/testutils"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
 	. "github.com/mailgun/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
 	"github.com/mailgun/vulcand/engine"
 	"github.com/mailgun/vulcand/stapler"
@@ -90,6 +105,32 @@ func (s *ServerSuite) TestServerCRUD(c *C) {
 	c.Assert(err, NotNil)
 }
 
+func (s *ServerSuite) TestApplyBatch(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+	c.Assert(s.mux.ApplyBatch([]interface{}{
+		&engine.BackendUpserted{Backend: b.B},
+		&engine.ServerUpserted{BackendKey: b.BK, Server: b.S},
+		&engine.FrontendUpserted{Frontend: b.F},
+		&engine.ListenerUpserted{Listener: b.L},
+	}), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+
+	// Failed change does not stop the batch, the changes following it are applied
+	err := s.mux.ApplyBatch([]interface{}{
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: b.BK, Id: "missing"}},
+		&engine.FrontendDeleted{FrontendKey: b.FK},
+	})
+	c.Assert(err, NotNil)
+
+	c.Assert(len(s.mux.frontends), Equals, 0)
+}
+
 func (s *ServerSuite) TestServerUpsertSame(c *C) {
 	e := testutils.NewResponder("Hi, I'm endpoint")
 	defer e.Close()
@@ -129,6 +170,45 @@ func (s *ServerSuite) TestServerDefaultListener(c *C) {
 	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
 }
 
+// Requests in progress longer than the shutdown timeout do not block the stop
+func (s *ServerSuite) TestStopShutdownTimeout(c *C) {
+	m, err := New(s.lastId, s.st, Options{ShutdownTimeout: 100 * time.Millisecond})
+	c.Assert(err, IsNil)
+	s.mux = m
+
+	startedC := make(chan bool, 1)
+	e := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startedC <- true
+		<-r.Context().Done()
+	}))
+	defer e.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:41000", Route: `Path("/")`, URL: e.URL})
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	c.Assert(s.mux.Start(), IsNil)
+
+	errC := make(chan error, 1)
+	go func() {
+		_, _, err := testutils.Get(b.FrontendURL("/"))
+		errC <- err
+	}()
+	<-startedC
+
+	stoppedC := make(chan bool)
+	go func() {
+		s.mux.Stop(true)
+		close(stoppedC)
+	}()
+	select {
+	case <-stoppedC:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timeout waiting for the stop")
+	}
+	c.Assert(<-errC, NotNil)
+}
+
 // Test case when you have two hosts on the same socket
 func (s *ServerSuite) TestTwoHosts(c *C) {
 	e := testutils.NewResponder("Hi, I'm endpoint 1")
@@ -279,9 +359,7 @@ func (s *ServerSuite) TestServerHTTPS(c *C) {
 }
 
 func (s *ServerSuite) TestServerUpdateHTTPS(c *C) {
-	var req *http.Request
 	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
-		req = r
 		w.Write([]byte("hi https"))
 	})
 	defer e.Close()
@@ -364,6 +442,103 @@ func (s *ServerSuite) TestBackendHTTPS(c *C) {
 	c.Assert(string(body), Equals, "hi https")
 }
 
+func (s *ServerSuite) TestServerHTTP2(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi " + r.Proto))
+	})
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  newKeyPair(c),
+	})
+	b.L.Settings = &engine.HTTPSListenerSettings{HTTP2: true}
+
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	// HTTP/2 is negotiated with the client, the backend is spoken to with HTTP/1.1
+	re, body, addr := getHTTP2(c, client, b.FrontendURL("/"))
+	c.Assert(re.Proto, Equals, "HTTP/2.0")
+	c.Assert(body, Equals, "hi HTTP/1.1")
+	c.Assert(s.mux.connTracker.protocolCounts()[addr][protocolHTTP2], Equals, int64(1))
+
+	// Idle HTTP/2 connections are closed when the listener is reloaded
+	b.L.Settings = nil
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	for i := 0; i < 100 && s.mux.connTracker.protocolCounts()[addr][protocolHTTP2] != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.mux.connTracker.protocolCounts()[addr][protocolHTTP2], Equals, int64(0))
+
+	// Clients supporting HTTP/2 fall back to HTTP/1.1
+	re, body, addr = getHTTP2(c, client, b.FrontendURL("/"))
+	c.Assert(re.Proto, Equals, "HTTP/1.1")
+	c.Assert(body, Equals, "hi HTTP/1.1")
+	c.Assert(s.mux.connTracker.protocolCounts()[addr][protocolHTTP1], Equals, int64(1))
+}
+
+func (s *ServerSuite) TestBackendHTTP2(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi " + r.Proto))
+	})
+	h2c := httptest.NewUnstartedServer(handler)
+	h2c.Config.Protocols = &http.Protocols{}
+	h2c.Config.Protocols.SetHTTP1(true)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:41000",
+		Route: `Path("/")`,
+		URL:   h2c.URL,
+	})
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hi HTTP/1.1")
+
+	// Plain text HTTP/2 with prior knowledge
+	b.B.Settings = engine.HTTPBackendSettings{Protocol: engine.H2CProtocol}
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hi HTTP/2.0")
+
+	// HTTP/2 negotiated over TLS
+	b.B.Settings = engine.HTTPBackendSettings{Protocol: engine.H2Protocol, TLS: &engine.TLSSettings{InsecureSkipVerify: true}}
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	b.S.URL = h2.URL
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hi HTTP/2.0")
+
+	// Plain text servers are spoken to with HTTP/1.1 unless the prior knowledge is set
+	b.S.URL = h2c.URL
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hi HTTP/1.1")
+}
+
 func (s *ServerSuite) TestHostKeyPairUpdate(c *C) {
 	e := testutils.NewResponder("Hi, I'm endpoint")
 	defer e.Close()
@@ -720,41 +895,87 @@ func (s *ServerSuite) TestFrontendSwitchBackend(c *C) {
 	c.Assert(responseSet, DeepEquals, map[string]bool{"2": true, "3": true})
 }
 
-func (s *ServerSuite) TestFrontendUpdateRoute(c *C) {
+func (s *ServerSuite) TestFrontendTrafficSplit(c *C) {
 	c.Assert(s.mux.Start(), IsNil)
 
-	e := testutils.NewResponder("hola")
-	defer e.Close()
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
 
 	b := MakeBatch(Batch{
 		Addr:  "localhost:31000",
 		Route: `Path("/")`,
-		URL:   e.URL,
+		URL:   e1.URL,
 	})
-
 	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+
+	b2 := MakeBackend()
+	b2k := engine.BackendKey{Id: b2.Id}
+	c.Assert(s.mux.UpsertServer(b2k, MakeServer(e2.URL)), IsNil)
+
+	settings := b.F.HTTPSettings()
+	settings.TrafficSplit = &engine.HTTPFrontendTrafficSplit{
+		Splits: []engine.HTTPFrontendSplit{{BackendId: b2.Id, Weight: 100}},
+		Header: "X-Backend",
+	}
+	b.F.Settings = settings
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hola")
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
 
-	b.F.Route = `Path("/new")`
+	// Header forces the backend regardless of the weights
+	_, body, err := testutils.Get(b.FrontendURL("/"), testutils.Header("X-Backend", b.BK.Id))
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "1")
 
+	// Split backends can not be deleted while used
+	c.Assert(s.mux.DeleteBackend(b2k), NotNil)
+
+	// Shifting the weights keeps the stats of the splits
+	settings.TrafficSplit = &engine.HTTPFrontendTrafficSplit{
+		Splits: []engine.HTTPFrontendSplit{{BackendId: b2.Id, Weight: 0}},
+	}
+	b.F.Settings = settings
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
-	c.Assert(GETResponse(c, b.FrontendURL("/new")), Equals, "hola")
 
-	response, _, err := testutils.Get(MakeURL(b.L, "/"))
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+
+	stats, err := s.mux.FrontendStats(b.FK)
 	c.Assert(err, IsNil)
-	c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(stats.Counters.Total, Equals, int64(4))
+	c.Assert(len(stats.Splits), Equals, 2)
+	c.Assert(stats.Splits[0].BackendId, Equals, b.BK.Id)
+	c.Assert(stats.Splits[0].Weight, Equals, 100)
+	c.Assert(stats.Splits[0].Stats.Counters.Total, Equals, int64(2))
+	c.Assert(stats.Splits[1].BackendId, Equals, b2.Id)
+	c.Assert(stats.Splits[1].Weight, Equals, 0)
+	c.Assert(stats.Splits[1].Stats.Counters.Total, Equals, int64(2))
+
+	// Removing the split releases the backend
+	settings.TrafficSplit = nil
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+	c.Assert(s.mux.DeleteBackend(b2k), IsNil)
 }
 
-func (s *ServerSuite) TestBackendUpdate(c *C) {
+func (s *ServerSuite) TestFrontendMirror(c *C) {
 	c.Assert(s.mux.Start(), IsNil)
 
 	e1 := testutils.NewResponder("1")
 	defer e1.Close()
 
-	e2 := testutils.NewResponder("2")
+	copies := make(chan string, 10)
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		copies <- string(body)
+		// Shadow responses do not affect the clients
+		w.WriteHeader(http.StatusInternalServerError)
+	})
 	defer e2.Close()
 
 	b := MakeBatch(Batch{
@@ -762,134 +983,1142 @@ func (s *ServerSuite) TestBackendUpdate(c *C) {
 		Route: `Path("/")`,
 		URL:   e1.URL,
 	})
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
 
-	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
-
-	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
-	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+	b2 := MakeBackend()
+	b2k := engine.BackendKey{Id: b2.Id}
+	c.Assert(s.mux.UpsertServer(b2k, MakeServer(e2.URL)), IsNil)
 
+	settings := b.F.HTTPSettings()
+	settings.Mirror = &engine.HTTPFrontendMirror{BackendId: b2.Id, Percent: 100}
+	b.F.Settings = settings
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	responseSet := make(map[string]bool)
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	re, body, err := testutils.MakeRequest(b.FrontendURL("/"), testutils.Method("POST"), testutils.Body("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "1")
 
-	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+	select {
+	case body := <-copies:
+		c.Assert(body, Equals, "hello")
+	case <-time.After(time.Second):
+		c.Fatalf("request has not been copied")
+	}
 
-	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
-	c.Assert(s.mux.DeleteServer(sk2), IsNil)
+	// Shadow stats are recorded once the copy gets the response
+	var stats *engine.RoundTripStats
+	for i := 0; i < 100; i++ {
+		stats, err = s.mux.FrontendStats(b.FK)
+		c.Assert(err, IsNil)
+		if stats.Mirror != nil && stats.Mirror.Stats.Counters.Total == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(stats.Counters.Total, Equals, int64(1))
+	c.Assert(stats.Mirror.BackendId, Equals, b2.Id)
+	c.Assert(stats.Mirror.Stats.Counters.Total, Equals, int64(1))
+	c.Assert(stats.Mirror.Stats.Counters.StatusCodes, DeepEquals, []engine.StatusCode{{Code: http.StatusInternalServerError, Count: 1}})
 
-	responseSet = make(map[string]bool)
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	// Shadow backend can not be deleted while used
+	c.Assert(s.mux.DeleteBackend(b2k), NotNil)
 
-	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true})
-}
+	// Mirroring stops with zero percent
+	settings.Mirror = &engine.HTTPFrontendMirror{BackendId: b2.Id, Percent: 0}
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 
-func (s *ServerSuite) TestServerAddBad(c *C) {
-	e := testutils.NewResponder("Hi, I'm endpoint")
-	defer e.Close()
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+	select {
+	case <-copies:
+		c.Fatalf("request should not be copied")
+	case <-time.After(50 * time.Millisecond):
+	}
 
+	stats, err = s.mux.FrontendStats(b.FK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Mirror.Weight, Equals, 0)
+	c.Assert(stats.Mirror.Stats.Counters.Total, Equals, int64(1))
+}
+
+func (s *ServerSuite) TestFrontendRetry(c *C) {
 	c.Assert(s.mux.Start(), IsNil)
 
-	b := MakeBatch(Batch{Addr: "localhost:11500", Route: `Path("/")`, URL: e.URL})
+	// Every request fails until the server gets the number of the failures set by the test
+	var calls, failures int64
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) <= atomic.LoadInt64(&failures) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("unavailable"))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok " + string(body)))
+	})
+	defer e.Close()
 
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e.URL,
+	})
+	settings := b.F.HTTPSettings()
+	settings.Retry = &engine.HTTPFrontendRetry{
+		Attempts:    3,
+		Backoff:     "1ms",
+		Methods:     []string{"GET", "POST"},
+		StatusCodes: []int{http.StatusServiceUnavailable},
+	}
+	b.F.Settings = settings
 	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	// The body is replayed on every attempt
+	atomic.StoreInt64(&failures, 2)
+	re, body, err := testutils.MakeRequest(b.FrontendURL("/"), testutils.Method("POST"), testutils.Body("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "ok hello")
 
-	bad := engine.Server{Id: UID("srv"), URL: ""}
-	c.Assert(s.mux.UpsertServer(b.BK, bad), NotNil)
+	// The last attempt is returned to the client as is
+	atomic.StoreInt64(&calls, 0)
+	atomic.StoreInt64(&failures, 3)
+	re, body, err = testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), Equals, "unavailable")
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
-}
+	stats, err := s.mux.FrontendStats(b.FK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Retries, DeepEquals, &engine.RetryStats{Retries: 4})
 
-func (s *ServerSuite) TestServerUpsertURL(c *C) {
-	c.Assert(s.mux.Start(), IsNil)
+	// Methods not listed in the settings are not retried
+	settings.Retry = &engine.HTTPFrontendRetry{Attempts: 3, StatusCodes: []int{http.StatusServiceUnavailable}}
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	atomic.StoreInt64(&calls, 0)
+	atomic.StoreInt64(&failures, 1)
+	re, _, err = testutils.MakeRequest(b.FrontendURL("/"), testutils.Method("POST"), testutils.Body("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
 
-	e1 := testutils.NewResponder("Hi, I'm endpoint 1")
-	defer e1.Close()
+	// Counters are kept when the frontend is rebuilt
+	stats, err = s.mux.FrontendStats(b.FK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Retries.Retries, Equals, int64(4))
+}
 
-	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
-	defer e2.Close()
+func (s *ServerSuite) TestFrontendRetryTryTimeout(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
 
-	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	var calls int64
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+	defer e.Close()
 
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e.URL,
+	})
+	settings := b.F.HTTPSettings()
+	settings.Retry = &engine.HTTPFrontendRetry{Attempts: 2, TryTimeout: "50ms"}
+	b.F.Settings = settings
 	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
-
-	b.S.URL = e2.URL
-	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
-
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 2")
+	start := time.Now()
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "ok")
+	c.Assert(time.Since(start) < time.Second, Equals, true)
 }
 
-func (s *ServerSuite) TestBackendUpdateOptions(c *C) {
+func (s *ServerSuite) TestFrontendTimeouts(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
 	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(10 * time.Millisecond)
-		w.Write([]byte("slow server"))
+		d, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		if r.URL.Query().Get("body") != "" {
+			// Response header is sent right away, the body is delayed
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(d):
+		}
+		w.Write([]byte("ok"))
 	})
 	defer e.Close()
 
-	c.Assert(s.mux.Start(), IsNil)
-
-	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
-
-	settings := b.B.HTTPSettings()
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
-	b.B.Settings = settings
-
-	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `PathRegexp("/.*")`,
+		URL:   e.URL,
+	})
+	settings := b.F.HTTPSettings()
+	settings.Timeouts = &engine.HTTPFrontendTimeouts{ResponseHeader: "50ms", BodyIdle: "50ms", Total: "200ms"}
+	b.F.Settings = settings
 	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	re, _, err := testutils.Get(MakeURL(b.L, "/"))
+	// Requests served in time are not affected
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "ok")
+
+	// Response header timeout, the default failover retries the timed out GET once
+	start := time.Now()
+	re, _, err := testutils.Get(b.FrontendURL("/?delay=1s"))
 	c.Assert(err, IsNil)
-	c.Assert(re, NotNil)
 	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
 
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
-	b.B.Settings = settings
+	// Body idle timeout closes the connection as the response has been started
+	_, _, err = testutils.Get(b.FrontendURL("/?delay=1s&body=1"))
+	c.Assert(err, NotNil)
 
-	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	stats, err := s.mux.FrontendStats(b.FK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Timeouts, DeepEquals, &engine.TimeoutStats{ResponseHeader: 2, BodyIdle: 1})
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "slow server")
+	// Total timeout covers the retries
+	settings.Timeouts = &engine.HTTPFrontendTimeouts{Total: "100ms"}
+	settings.Retry = &engine.HTTPFrontendRetry{Attempts: 5, TryTimeout: "60ms"}
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+
+	start = time.Now()
+	re, _, err = testutils.Get(b.FrontendURL("/?delay=1s"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(time.Since(start) < 250*time.Millisecond, Equals, true)
+
+	stats, err = s.mux.FrontendStats(b.FK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Timeouts, DeepEquals, &engine.TimeoutStats{ResponseHeader: 2, Total: 1, BodyIdle: 1})
 }
 
-func (s *ServerSuite) TestSwitchBackendOptions(c *C) {
+func (s *ServerSuite) TestErrorPages(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
 	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(10 * time.Millisecond)
-		w.Write([]byte("slow server"))
+		if r.URL.Path == "/app/unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("backend unavailable"))
+			return
+		}
+		w.Write([]byte("ok"))
 	})
 	defer e.Close()
 
-	c.Assert(s.mux.Start(), IsNil)
-
-	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
-
-	settings := b.B.HTTPSettings()
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
-	b.B.Settings = settings
-
-	b2 := MakeBackend()
-	settings = b2.HTTPSettings()
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
-	b2.Settings = settings
-
-	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `PathRegexp("/app.*")`,
+		URL:   e.URL,
+	})
+	// Server of this frontend is down, so the proxy responds with 502
+	dead := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/dead")`,
+		URL:   "http://localhost:31001",
+	})
+	host := b.H
+	host.Settings.ErrorPages = &engine.ErrorPages{Pages: []engine.ErrorPage{
+		{Codes: []string{"404", "500-599"}, ContentType: "application/json", Body: `{"code": {{.StatusCode}}, "path": {{json .Path}}}`},
+	}}
+	c.Assert(s.mux.UpsertHost(host), IsNil)
 	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
-
-	c.Assert(s.mux.UpsertBackend(b2), IsNil)
-	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b2.Id}, b.S), IsNil)
-
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertServer(dead.BK, dead.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(dead.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	expectPage := func(path string, code int, contentType, body string) {
+		re, out, err := testutils.Get(b.FrontendURL(path))
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, code)
+		c.Assert(re.Header.Get("Content-Type"), Equals, contentType)
+		c.Assert(string(out), Equals, body)
+	}
+
+	c.Assert(GETResponse(c, b.FrontendURL("/app")), Equals, "ok")
+	expectPage("/other", http.StatusNotFound, "application/json", `{"code": 404, "path": "/other"}`)
+	expectPage("/dead", http.StatusBadGateway, "application/json", `{"code": 502, "path": "/dead"}`)
+
+	// Errors of the servers are passed as is unless the pages apply to the backend errors
+	expectPage("/app/unavailable", http.StatusServiceUnavailable, "text/plain; charset=utf-8", "backend unavailable")
+	host.Settings.ErrorPages.BackendErrors = true
+	c.Assert(s.mux.UpsertHost(host), IsNil)
+	expectPage("/app/unavailable", http.StatusServiceUnavailable, "application/json", `{"code": 503, "path": "/app/unavailable"}`)
+
+	// Frontend error pages take precedence over the host error pages
+	settings := b.F.HTTPSettings()
+	settings.ErrorPages = &engine.ErrorPages{
+		Pages:         []engine.ErrorPage{{Codes: []string{"503"}, ContentType: "text/html", Body: "<h1>{{.Path}} is down</h1>"}},
+		BackendErrors: true,
+	}
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	expectPage("/app/unavailable", http.StatusServiceUnavailable, "text/html", "<h1>/app/unavailable is down</h1>")
+}
+
+func (s *ServerSuite) TestMaintenance(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e := testutils.NewResponder("ok")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e.URL,
+	})
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "ok")
+
+	expectMaintenance := func(body string) {
+		re, out, err := testutils.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+		c.Assert(re.Header.Get("Retry-After"), Equals, "120")
+		c.Assert(string(out), Equals, body)
+	}
+
+	// Turning the frontend maintenance on and off keeps the load balancers
+	splitter := s.mux.frontends[b.FK].splitter
+	settings := b.F.HTTPSettings()
+	settings.Maintenance = &engine.Maintenance{
+		Enabled:      true,
+		Body:         "frontend maintenance",
+		RetryAfter:   "120",
+		AllowHeaders: map[string]string{"X-Maintenance-Bypass": "secret"},
+	}
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	expectMaintenance("frontend maintenance")
+	c.Assert(GETResponse(c, b.FrontendURL("/"), testutils.Header("X-Maintenance-Bypass", "secret")), Equals, "ok")
+
+	settings.Maintenance = &engine.Maintenance{Enabled: false, Body: "frontend maintenance"}
+	b.F.Settings = settings
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "ok")
+	c.Assert(s.mux.frontends[b.FK].splitter, Equals, splitter)
+
+	// Host maintenance covers all the frontends of the host
+	host := b.H
+	host.Settings.Maintenance = &engine.Maintenance{Enabled: true, Body: "host maintenance", RetryAfter: "120", AllowIPs: []string{"10.0.0.0/8"}}
+	c.Assert(s.mux.UpsertHost(host), IsNil)
+	expectMaintenance("host maintenance")
+
+	host.Settings.Maintenance.AllowIPs = []string{"127.0.0.1"}
+	c.Assert(s.mux.UpsertHost(host), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "ok")
+
+	host.Settings.Maintenance = nil
+	c.Assert(s.mux.UpsertHost(host), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "ok")
+}
+
+func (s *ServerSuite) TestSNICertificates(c *C) {
+	e := testutils.NewResponder("ok")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `PathRegexp("/.*")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  newKeyPair(c),
+	})
+	b.H.Settings.Default = true
+	plain := MakeListener("localhost:31000", engine.HTTP)
+
+	// Wildcard host has the ECDSA certificate and the RSA certificate for the clients not supporting ECDSA
+	wildcard := MakeHost("*.example.com", newSANKeyPair(c, false, "*.example.com"))
+	wildcard.Settings.KeyPairs = []engine.KeyPair{*newSANKeyPair(c, true, "*.example.com")}
+	wildcard.Settings.Maintenance = &engine.Maintenance{Enabled: true, Body: "maintenance"}
+	// Exact host name takes precedence over the wildcard host
+	exact := MakeHost("exact.example.com", newSANKeyPair(c, false, "exact.example.com"))
+	// Certificate serves the names without hosts by the subject alternative names
+	shared := MakeHost("multi.org", newSANKeyPair(c, false, "multi.org", "www.multi.org", "*.shared.org"))
+
+	for _, h := range []engine.Host{b.H, wildcard, exact, shared} {
+		c.Assert(s.mux.UpsertHost(h), IsNil)
+	}
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	c.Assert(s.mux.UpsertListener(plain), IsNil)
+	c.Assert(s.mux.Start(), IsNil)
+
+	cert := peerCertificate(c, "localhost:41000", "exact.example.com", false)
+	c.Assert(cert.DNSNames, DeepEquals, []string{"exact.example.com"})
+
+	cert = peerCertificate(c, "localhost:41000", "a.example.com", false)
+	c.Assert(cert.DNSNames, DeepEquals, []string{"*.example.com"})
+	c.Assert(cert.PublicKeyAlgorithm, Equals, x509.ECDSA)
+
+	cert = peerCertificate(c, "localhost:41000", "a.example.com", true)
+	c.Assert(cert.DNSNames, DeepEquals, []string{"*.example.com"})
+	c.Assert(cert.PublicKeyAlgorithm, Equals, x509.RSA)
+
+	// Wildcard matches one label only
+	cert = peerCertificate(c, "localhost:41000", "b.a.example.com", false)
+	c.Assert(cert.DNSNames, DeepEquals, []string{"localhost"})
+
+	for _, name := range []string{"www.multi.org", "a.shared.org"} {
+		cert = peerCertificate(c, "localhost:41000", name, false)
+		c.Assert(cert.DNSNames[0], Equals, "multi.org")
+	}
+
+	// Unknown names and the clients without SNI get the certificate of the default host
+	for _, name := range []string{"unknown.net", ""} {
+		cert = peerCertificate(c, "127.0.0.1:41000", name, false)
+		c.Assert(cert.DNSNames, DeepEquals, []string{"localhost"})
+	}
+
+	// Settings of the wildcard host apply to the matching hosts
+	re, body, err := testutils.Get("http://localhost:31000/", testutils.Host("a.example.com"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), Equals, "maintenance")
+	c.Assert(GETResponse(c, "http://localhost:31000/", testutils.Host("exact.example.com")), Equals, "ok")
+}
+
+func (s *ServerSuite) TestACMEChallenge(c *C) {
+	e := testutils.NewResponder("ok")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `PathRegexp("/.*")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  newKeyPair(c),
+	})
+	plain := MakeListener("localhost:31000", engine.HTTP)
+	host := b.H
+	// Challenges are answered before the HTTPS redirect and the maintenance
+	host.Settings.HTTPSRedirect = &engine.HTTPSRedirect{}
+	host.Settings.Maintenance = &engine.Maintenance{Enabled: true}
+	host.Settings.ACME = &engine.HostACME{Enabled: true}
+	host.ACME = &engine.ACMEState{
+		Challenges: map[string]string{"token": "token.thumbprint"},
+	}
+
+	c.Assert(s.mux.UpsertHost(host), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	c.Assert(s.mux.UpsertListener(plain), IsNil)
+	c.Assert(s.mux.Start(), IsNil)
+
+	re, body, err := testutils.Get("http://localhost:31000/.well-known/acme-challenge/token")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "token.thumbprint")
+
+	re, _, err = testutils.Get("http://localhost:31000/.well-known/acme-challenge/other")
+	c.Assert(err, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusMovedPermanently)
+}
+
+func (s *ServerSuite) TestHTTPSRedirect(c *C) {
+	e := testutils.NewResponder("ok")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `PathRegexp("/.*")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  newKeyPair(c),
+	})
+	plain := MakeListener("localhost:31000", engine.HTTP)
+	host := b.H
+	host.Settings.HTTPSRedirect = &engine.HTTPSRedirect{
+		ExcludePaths: []string{"/.well-known/acme-challenge/"},
+		HSTS:         &engine.HSTS{MaxAge: 31536000, IncludeSubdomains: true},
+	}
+	// Status code and the port of the redirect are configurable
+	custom := MakeHost("custom.example.com", b.H.Settings.KeyPair)
+	custom.Settings.HTTPSRedirect = &engine.HTTPSRedirect{StatusCode: http.StatusPermanentRedirect, Port: 443}
+	// Hosts without the key pair are not redirected
+	noKeyPair := MakeHost("nokeypair.example.com", nil)
+	noKeyPair.Settings.HTTPSRedirect = &engine.HTTPSRedirect{}
+
+	for _, h := range []engine.Host{host, custom, noKeyPair} {
+		c.Assert(s.mux.UpsertHost(h), IsNil)
+	}
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	c.Assert(s.mux.UpsertListener(plain), IsNil)
+	c.Assert(s.mux.Start(), IsNil)
+
+	// Plain HTTP requests are redirected to the HTTPS listener
+	re, _, err := testutils.Get("http://localhost:31000/path?a=b")
+	c.Assert(err, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusMovedPermanently)
+	c.Assert(re.Header.Get("Location"), Equals, "https://localhost:41000/path?a=b")
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "")
+
+	c.Assert(GETResponse(c, "http://localhost:31000/.well-known/acme-challenge/token"), Equals, "ok")
+
+	re, body, err := testutils.Get("https://localhost:41000/path")
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "ok")
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000; includeSubDomains")
+
+	re, _, err = testutils.Get("http://localhost:31000/path", testutils.Host("custom.example.com"))
+	c.Assert(err, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusPermanentRedirect)
+	c.Assert(re.Header.Get("Location"), Equals, "https://custom.example.com/path")
+
+	c.Assert(GETResponse(c, "http://localhost:31000/path", testutils.Host("nokeypair.example.com")), Equals, "ok")
+}
+
+func (s *ServerSuite) TestRetryBudget(c *C) {
+	// 20% of 10 requests in flight
+	b := &retryBudget{active: 10}
+	c.Assert(b.acquire(20, 1), Equals, true)
+	c.Assert(b.acquire(20, 1), Equals, true)
+	c.Assert(b.acquire(20, 1), Equals, false)
+	b.release()
+	c.Assert(b.acquire(20, 1), Equals, true)
+
+	// Min retries are allowed under the low load
+	b = &retryBudget{active: 1}
+	c.Assert(b.acquire(20, 2), Equals, true)
+	c.Assert(b.acquire(20, 2), Equals, true)
+	c.Assert(b.acquire(20, 2), Equals, false)
+}
+
+func (s *ServerSuite) TestUpgrade(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e := newEchoServer()
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/ws")`,
+		URL:   e.URL,
+	})
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	conn, br, re := dialUpgrade(c, b.L.Address.Address, "echo")
+	defer conn.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Assert(re.Header.Get("Upgrade"), Equals, "echo")
+
+	for _, msg := range []string{"hello\n", "bye\n"} {
+		_, err := conn.Write([]byte(msg))
+		c.Assert(err, IsNil)
+		line, err := br.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, msg)
+	}
+	c.Assert(s.mux.connTracker.counts()[http.StateHijacked][conn.RemoteAddr().String()], Equals, int64(1))
+
+	// Server refusing to switch the protocol
+	conn2, _, re := dialUpgrade(c, b.L.Address.Address, "unknown")
+	defer conn2.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+
+	// Plain requests are served as usual
+	c.Assert(GETResponse(c, b.FrontendURL("/ws")), Equals, "plain")
+
+	// Stopping the mux closes the upgraded connections
+	s.mux.Stop(true)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := br.ReadString('\n')
+	c.Assert(err, NotNil)
+	c.Assert(s.mux.connTracker.counts()[http.StateHijacked][conn.RemoteAddr().String()], Equals, int64(0))
+}
+
+func (s *ServerSuite) TestUpgradeIdleTimeout(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e := newEchoServer()
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/ws")`,
+		URL:   e.URL,
+	})
+	settings := b.B.HTTPSettings()
+	settings.Timeouts.UpgradeIdle = "100ms"
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	conn, br, re := dialUpgrade(c, b.L.Address.Address, "echo")
+	defer conn.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	// Idle connection is closed by the proxy
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err := br.ReadString('\n')
+	c.Assert(err, NotNil)
+	c.Assert(time.Now().Sub(start) < time.Second, Equals, true)
+}
+
+// newEchoServer switches to the 'echo' protocol and echoes the lines back, other protocols are refused
+func newEchoServer() *httptest.Server {
+	return testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			w.Write([]byte("plain"))
+			return
+		}
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	})
+}
+
+func dialUpgrade(c *C, addr, protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+	br := bufio.NewReader(conn)
+	re, err := http.ReadResponse(br, nil)
+	c.Assert(err, IsNil)
+	return conn, br, re
+}
+
+func (s *ServerSuite) TestFrontendUpdateRoute(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e := testutils.NewResponder("hola")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e.URL,
+	})
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hola")
+
+	b.F.Route = `Path("/new")`
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/new")), Equals, "hola")
+
+	response, _, err := testutils.Get(MakeURL(b.L, "/"))
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ServerSuite) TestBackendUpdate(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	responseSet := make(map[string]bool)
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+
+	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
+	c.Assert(s.mux.DeleteServer(sk2), IsNil)
+
+	responseSet = make(map[string]bool)
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true})
+}
+
+func (s *ServerSuite) TestServerWeights(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	s1.Weight = 3
+
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	responses := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] += 1
+	}
+	c.Assert(responses, DeepEquals, map[string]int{"1": 3, "2": 1})
+
+	// Weight update is applied to the existing server
+	s1.Weight, s2.Weight = 1, 3
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	responses = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] += 1
+	}
+	c.Assert(responses, DeepEquals, map[string]int{"1": 1, "2": 3})
+}
+
+func (s *ServerSuite) TestLoadBalancerStrategies(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	settings := b.B.HTTPSettings()
+	settings.LoadBalancer = engine.HTTPBackendLoadBalancer{Strategy: engine.HashLB, Variable: "request.header.X-User"}
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(e1.URL)), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(e2.URL)), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// The same user always gets to the same server, different users are spread among the servers
+	responses := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		user := fmt.Sprintf("user%d", i)
+		response := GETResponse(c, b.FrontendURL("/"), testutils.Header("X-User", user))
+		c.Assert(GETResponse(c, b.FrontendURL("/"), testutils.Header("X-User", user)), Equals, response)
+		responses[response] = true
+	}
+	c.Assert(responses, DeepEquals, map[string]bool{"1": true, "2": true})
+
+	// Switching the strategy rebuilds the balancer keeping the servers
+	for _, strategy := range []string{engine.LeastConnLB, engine.PowerOfTwoLB, engine.RoundRobinLB} {
+		settings.LoadBalancer = engine.HTTPBackendLoadBalancer{Strategy: strategy}
+		b.B.Settings = settings
+		c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+		responses = make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			responses[GETResponse(c, b.FrontendURL("/"))] = true
+		}
+		c.Assert(responses, DeepEquals, map[string]bool{"1": true, "2": true}, Commentf("strategy %v", strategy))
+	}
+}
+
+func (s *ServerSuite) TestHealthChecks(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	var failing int32 = 1
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("2"))
+	})
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	settings := b.B.HTTPSettings()
+	settings.HealthCheck = &engine.HTTPBackendHealthCheck{
+		Path:               "/health",
+		Interval:           "10ms",
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
+	waitHealth := func(healthy bool) {
+		for i := 0; i < 100; i++ {
+			stats, err := s.mux.ServerStats(sk2)
+			c.Assert(err, IsNil)
+			if stats.Health != nil && !stats.Health.Checked.IsZero() && stats.Health.Healthy == healthy {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Fatalf("server has not become healthy=%v", healthy)
+	}
+
+	// The failing server is taken out of the rotation
+	waitHealth(false)
+	stats, err := s.mux.ServerStats(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Health.Error, Matches, ".*503.*")
+
+	responses := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responses, DeepEquals, map[string]bool{"1": true})
+
+	// And gets back once it passes the checks
+	atomic.StoreInt32(&failing, 0)
+	waitHealth(true)
+
+	responses = make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responses, DeepEquals, map[string]bool{"1": true, "2": true})
+
+	servers, err := s.mux.TopServers(&b.BK)
+	c.Assert(err, IsNil)
+	c.Assert(len(servers), Equals, 2)
+	for _, srv := range servers {
+		c.Assert(srv.Stats.Health, NotNil)
+		c.Assert(srv.Stats.Health.Healthy, Equals, true)
+	}
+}
+
+func (s *ServerSuite) TestOutlierEjection(c *C) {
+	tm := &timetools.FreezedTime{CurrentTime: time.Date(2015, 5, 1, 12, 0, 0, 0, time.UTC)}
+	m, err := New(s.lastId, s.st, Options{TimeProvider: tm})
+	c.Assert(err, IsNil)
+	defer m.Stop(true)
+	c.Assert(m.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	// App error rate is the ratio of 500 to 2xx responses, so the server fails every other request
+	var requests int32
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%2 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("2"))
+	})
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	settings := b.B.HTTPSettings()
+	settings.OutlierEjection = &engine.HTTPBackendOutlierEjection{
+		// Detection is triggered manually
+		Interval:         "1h",
+		BaseEjectionTime: "10s",
+		MaxEjectionTime:  "15s",
+	}
+	b.B.Settings = settings
+	c.Assert(m.UpsertBackend(b.B), IsNil)
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	c.Assert(m.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(m.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(m.UpsertFrontend(b.F), IsNil)
+	c.Assert(m.UpsertListener(b.L), IsNil)
+
+	get := func() map[string]bool {
+		responses := make(map[string]bool)
+		for i := 0; i < 10; i++ {
+			_, body, err := testutils.Get(b.FrontendURL("/"))
+			c.Assert(err, IsNil)
+			responses[string(body)] = true
+		}
+		return responses
+	}
+	c.Assert(get(), DeepEquals, map[string]bool{"1": true, "2": true})
+
+	// Server returning errors is ejected
+	m.backends[b.BK].detector.detect()
+	c.Assert(get(), DeepEquals, map[string]bool{"1": true})
+
+	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
+	stats, err := m.ServerStats(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Ejection, NotNil)
+	c.Assert(stats.Ejection.Ejected, Equals, true)
+	c.Assert(stats.Ejection.Ejections, Equals, 1)
+	c.Assert(stats.Ejection.Until, Equals, tm.UtcNow().Add(10*time.Second))
+	c.Assert(stats.Ejection.Reason, Matches, ".*error rate.*")
+
+	sk1 := engine.ServerKey{BackendKey: b.BK, Id: s1.Id}
+	stats, err = m.ServerStats(sk1)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Ejection.Ejected, Equals, false)
+
+	// The server gets back once the ejection period expires
+	detector := m.backends[b.BK].detector
+	tm.Sleep(11 * time.Second)
+	detector.detect()
+	stats, err = m.ServerStats(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Ejection.Ejected, Equals, false)
+	c.Assert(get(), DeepEquals, map[string]bool{"1": true, "2": true})
+
+	// Consecutive ejection doubles the period capped by the max ejection time
+	detector.detect()
+	stats, err = m.ServerStats(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Ejection.Ejected, Equals, true)
+	c.Assert(stats.Ejection.Ejections, Equals, 2)
+	c.Assert(stats.Ejection.Until, Equals, tm.UtcNow().Add(15*time.Second))
+}
+
+func (s *ServerSuite) TestStickySessions(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	settings := b.B.HTTPSettings()
+	settings.StickySession = &engine.HTTPBackendStickySession{CookieName: "srv", HTTPOnly: true}
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// The first request pins the client to the server
+	re, body, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	cookies := re.Cookies()
+	c.Assert(len(cookies), Equals, 1)
+	c.Assert(cookies[0].Name, Equals, "srv")
+	c.Assert(cookies[0].HttpOnly, Equals, true)
+	cookie := cookies[0]
+	pinned := string(body)
+
+	for i := 0; i < 4; i++ {
+		re, body, err := testutils.Get(b.FrontendURL("/"), testutils.Header("Cookie", cookie.String()))
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, pinned)
+		// The cookie is not set again for the pinned client
+		c.Assert(len(re.Cookies()), Equals, 0)
+	}
+
+	// Once the server is removed, the client is pinned to another one
+	sk := engine.ServerKey{BackendKey: b.BK, Id: s1.Id}
+	other := "2"
+	if pinned == "2" {
+		sk.Id, other = s2.Id, "1"
+	}
+	c.Assert(s.mux.DeleteServer(sk), IsNil)
+
+	re, body, err = testutils.Get(b.FrontendURL("/"), testutils.Header("Cookie", cookie.String()))
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, other)
+	cookies = re.Cookies()
+	c.Assert(len(cookies), Equals, 1)
+	c.Assert(cookies[0].Value, Not(Equals), cookie.Value)
+}
+
+func (s *ServerSuite) TestServerAddBad(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11500", Route: `Path("/")`, URL: e.URL})
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+
+	bad := engine.Server{Id: UID("srv"), URL: ""}
+	c.Assert(s.mux.UpsertServer(b.BK, bad), NotNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+}
+
+func (s *ServerSuite) TestServerUpsertURL(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("Hi, I'm endpoint 1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
+
+	b.S.URL = e2.URL
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 2")
+}
+
+func (s *ServerSuite) TestBackendUpdateOptions(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("slow server"))
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+
+	settings := b.B.HTTPSettings()
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	re, _, err := testutils.Get(MakeURL(b.L, "/"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "slow server")
+}
+
+func (s *ServerSuite) TestSwitchBackendOptions(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("slow server"))
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+
+	settings := b.B.HTTPSettings()
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
+	b.B.Settings = settings
+
+	b2 := MakeBackend()
+	settings = b2.HTTPSettings()
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
+	b2.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+
+	c.Assert(s.mux.UpsertBackend(b2), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b2.Id}, b.S), IsNil)
+
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
@@ -980,7 +2209,7 @@ func (s *ServerSuite) TestPerfMon(c *C) {
 	c.Assert(err, IsNil)
 
 	// Make sure server has been added to the performance monitor
-	c.Assert(s.mux.frontends[b.FK].watcher.hasServer(sURL), Equals, true)
+	c.Assert(s.mux.frontends[b.FK].splitter.splits[0].watcher.hasServer(sURL), Equals, true)
 
 	c.Assert(s.mux.DeleteFrontend(b.FK), IsNil)
 
@@ -1053,6 +2282,356 @@ func (s *ServerSuite) TestCustomNotFound(c *C) {
 	c.Assert(t.String(), Equals, "*proxy.appender")
 }
 
+func (s *ServerSuite) TestTCP(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	a := newTCPServer(c, "a")
+	defer a.Close()
+	b := newTCPServer(c, "b")
+	defer b.Close()
+
+	l, err := engine.NewListener("l1", engine.TCP, "tcp", "localhost:33400", "", nil)
+	c.Assert(err, IsNil)
+	be, err := engine.NewTCPBackend("bk1", engine.TCPBackendSettings{})
+	c.Assert(err, IsNil)
+	f, err := engine.NewTCPFrontend("f1", be.Id, engine.TCPFrontendSettings{ListenerId: l.Id})
+	c.Assert(err, IsNil)
+
+	bk := engine.BackendKey{Id: be.Id}
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(bk, engine.Server{Id: "a", URL: "tcp://" + a.Addr().String()}), IsNil)
+	c.Assert(s.mux.UpsertServer(bk, engine.Server{Id: "b", URL: "tcp://" + b.Addr().String()}), IsNil)
+	c.Assert(s.mux.UpsertFrontend(*f), IsNil)
+
+	// Connections are balanced in round robin
+	replies := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		replies[sendTCP(c, l.Address.Address, "hello")] = true
+	}
+	c.Assert(replies, DeepEquals, map[string]bool{"a:hello": true, "b:hello": true})
+
+	// Servers that refuse the connections are skipped
+	closed := newTCPServer(c, "closed")
+	closed.Close()
+	c.Assert(s.mux.UpsertServer(bk, engine.Server{Id: "b", URL: "tcp://" + closed.Addr().String()}), IsNil)
+	for i := 0; i < 2; i++ {
+		c.Assert(sendTCP(c, l.Address.Address, "hello"), Equals, "a:hello")
+	}
+
+	st := s.mux.tcpFrontendStats()[f.Id]
+	c.Assert(st.Total, Equals, int64(4))
+	c.Assert(st.DialErrors, Equals, int64(1))
+
+	// Frontend can not bind the listener that is already taken
+	f2, err := engine.NewTCPFrontend("f2", be.Id, engine.TCPFrontendSettings{ListenerId: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertFrontend(*f2), FitsTypeOf, &engine.AlreadyExistsError{})
+
+	// Backend is in use by the frontend
+	c.Assert(s.mux.DeleteBackend(bk), NotNil)
+
+	// Connections are closed once the frontend is deleted
+	c.Assert(s.mux.DeleteFrontend(engine.FrontendKey{Id: f.Id}), IsNil)
+	c.Assert(sendTCP(c, l.Address.Address, "hello"), Equals, "")
+	c.Assert(s.mux.DeleteBackend(bk), IsNil)
+
+	// Listener stops accepting the connections once deleted
+	c.Assert(s.mux.DeleteListener(engine.ListenerKey{Id: l.Id}), IsNil)
+	_, err = net.Dial("tcp", l.Address.Address)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestTCPIdleTimeout(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	a := newTCPServer(c, "a")
+	defer a.Close()
+
+	l, err := engine.NewListener("l1", engine.TCP, "tcp", "localhost:33400", "", nil)
+	c.Assert(err, IsNil)
+	be, err := engine.NewTCPBackend("bk1", engine.TCPBackendSettings{Timeouts: engine.TCPBackendTimeouts{Idle: "100ms"}})
+	c.Assert(err, IsNil)
+	f, err := engine.NewTCPFrontend("f1", be.Id, engine.TCPFrontendSettings{ListenerId: l.Id})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: be.Id}, engine.Server{Id: "a", URL: "tcp://" + a.Addr().String()}), IsNil)
+	c.Assert(s.mux.UpsertFrontend(*f), IsNil)
+
+	conn, err := net.Dial("tcp", l.Address.Address)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	// Idle connection is closed by the proxy
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, NotNil)
+	c.Assert(time.Now().Sub(start) < time.Second, Equals, true)
+}
+
+func (s *ServerSuite) TestTCPTypeConflicts(c *C) {
+	b := MakeBatch(Batch{Addr: "localhost:33400", Route: `Path("/")`, URL: "http://localhost:5000"})
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// HTTP backend and listener can not become tcp ones
+	be, err := engine.NewTCPBackend(b.B.Id, engine.TCPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertBackend(*be), NotNil)
+
+	l, err := engine.NewListener(b.L.Id, engine.TCP, "tcp", "localhost:33400", "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertListener(*l), NotNil)
+
+	// Addresses can not be shared between http and tcp listeners
+	l.Id = "l2"
+	c.Assert(s.mux.UpsertListener(*l), FitsTypeOf, &engine.AlreadyExistsError{})
+
+	// TCP frontend needs the tcp backend
+	f, err := engine.NewTCPFrontend("f1", b.B.Id, engine.TCPFrontendSettings{ListenerId: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertFrontend(*f), NotNil)
+}
+
+// newTCPServer reads the connection until the client stops sending and replies with the name and the data
+func newTCPServer(c *C, name string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(name + ":" + string(data)))
+			}()
+		}
+	}()
+	return l
+}
+
+// sendTCP sends the data and closes the sending side of the connection, it returns the reply
+func sendTCP(c *C, addr, data string) string {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte(data))
+	c.Assert(conn.(*net.TCPConn).CloseWrite(), IsNil)
+	out, _ := ioutil.ReadAll(conn)
+	return string(out)
+}
+
+func (s *ServerSuite) TestProxyProtocolListener(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	})
+	defer e.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:31000", Route: `Path("/")`, URL: e.URL})
+	trusted, err := engine.NewListenerProxyProtocol([]string{"127.0.0.0/8"})
+	c.Assert(err, IsNil)
+	b.L.ProxyProtocol = trusted
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Address from the header becomes the client address
+	v1 := "PROXY TCP4 1.2.3.4 127.0.0.1 5000 31000\r\n"
+	c.Assert(getWithHeader(c, b.L.Address.Address, v1), Equals, "1.2.3.4")
+
+	v2 := &bytes.Buffer{}
+	writeProxyHeader(v2, engine.ProxyProtocolV2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 31000})
+	c.Assert(getWithHeader(c, b.L.Address.Address, v2.String()), Equals, "2001:db8::1")
+
+	// Header is required from the trusted sources
+	c.Assert(getWithHeader(c, b.L.Address.Address, ""), Equals, "")
+
+	// Headers from the other sources are not trusted
+	b.L.ProxyProtocol, err = engine.NewListenerProxyProtocol([]string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	c.Assert(GETResponse(c, MakeURL(b.L, "/")), Equals, "127.0.0.1")
+	c.Assert(getWithHeader(c, b.L.Address.Address, v1), Equals, "")
+
+	// Listening socket is passed to the other process without the PROXY protocol listener
+	mux2, err := New(s.lastId, s.st, Options{})
+	c.Assert(err, IsNil)
+	b.L.ProxyProtocol = trusted
+	c.Assert(mux2.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(mux2.UpsertFrontend(b.F), IsNil)
+	c.Assert(mux2.UpsertListener(b.L), IsNil)
+
+	files, err := s.mux.GetFiles()
+	c.Assert(err, IsNil)
+	c.Assert(mux2.TakeFiles(files), IsNil)
+	c.Assert(mux2.Start(), IsNil)
+	s.mux.Stop(true)
+	defer mux2.Stop(true)
+
+	c.Assert(getWithHeader(c, b.L.Address.Address, v1), Equals, "1.2.3.4")
+}
+
+func (s *ServerSuite) TestProxyProtocolBackend(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	// Server reads the header sent by the proxy
+	e := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	e.Listener = newProxyListener(e.Listener, []*net.IPNet{loopback})
+	e.Start()
+	defer e.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:31000", Route: `Path("/")`, URL: e.URL})
+	b.B.Settings = engine.HTTPBackendSettings{ProxyProtocol: engine.ProxyProtocolV2}
+	trusted, err := engine.NewListenerProxyProtocol([]string{"127.0.0.0/8"})
+	c.Assert(err, IsNil)
+	b.L.ProxyProtocol = trusted
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Client address is passed along for every request
+	for _, ip := range []string{"1.2.3.4", "5.6.7.8"} {
+		header := fmt.Sprintf("PROXY TCP4 %s 127.0.0.1 5000 31000\r\n", ip)
+		c.Assert(getWithHeader(c, b.L.Address.Address, header), Equals, ip+":5000")
+	}
+}
+
+func (s *ServerSuite) TestProxyProtocolTCP(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	a := newTCPServer(c, "a")
+	defer a.Close()
+
+	l, err := engine.NewListener("l1", engine.TCP, "tcp", "127.0.0.1:33400", "", nil)
+	c.Assert(err, IsNil)
+	be, err := engine.NewTCPBackend("bk1", engine.TCPBackendSettings{ProxyProtocol: engine.ProxyProtocolV1})
+	c.Assert(err, IsNil)
+	f, err := engine.NewTCPFrontend("f1", be.Id, engine.TCPFrontendSettings{ListenerId: l.Id})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: be.Id}, engine.Server{Id: "a", URL: "tcp://" + a.Addr().String()}), IsNil)
+	c.Assert(s.mux.UpsertFrontend(*f), IsNil)
+
+	// Without the listener PROXY protocol the server gets the proxy client address
+	c.Assert(sendTCP(c, l.Address.Address, "hello"), Matches, `a:PROXY TCP4 127\.0\.0\.1 127\.0\.0\.1 \d+ 33400\r\nhello`)
+
+	l.ProxyProtocol, err = engine.NewListenerProxyProtocol([]string{"127.0.0.1/32"})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+
+	header := &bytes.Buffer{}
+	writeProxyHeader(header, engine.ProxyProtocolV2, &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432})
+	c.Assert(sendTCP(c, l.Address.Address, header.String()+"hello"), Equals, "a:PROXY TCP4 1.2.3.4 10.0.0.1 5000 5432\r\nhello")
+}
+
+func (s *ServerSuite) TestSNIPassthrough(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e := testutils.NewResponder("Hi, I'm endpoint 1")
+	defer e.Close()
+
+	// The passthrough server terminates TLS itself
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hi, I'm secure"))
+	}))
+	defer secure.Close()
+
+	b := MakeBatch(Batch{
+		Host:     "localhost",
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  newKeyPair(c),
+	})
+	b.L.Settings = &engine.HTTPSListenerSettings{SNIPassthrough: true}
+
+	be, err := engine.NewTCPBackend("bk2", engine.TCPBackendSettings{})
+	c.Assert(err, IsNil)
+	h, err := engine.NewHost("secure.example.com", engine.HostSettings{Passthrough: &engine.HostPassthrough{BackendId: be.Id}})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertHost(*h), IsNil)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: be.Id}, engine.Server{Id: "s", URL: "tcp://" + secure.Listener.Addr().String()}), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Both hosts are served on the same port, the passthrough client gets the certificate of the server
+	body, cert := getSNI(c, b.FrontendURL("/"), "localhost")
+	c.Assert(body, Equals, "Hi, I'm endpoint 1")
+	c.Assert(cert.Equal(secure.Certificate()), Equals, false)
+
+	body, cert = getSNI(c, b.FrontendURL("/"), "secure.example.com")
+	c.Assert(body, Equals, "Hi, I'm secure")
+	c.Assert(cert.Equal(secure.Certificate()), Equals, true)
+	c.Assert(s.mux.passthroughHostStats()["secure.example.com"].Total, Equals, int64(1))
+
+	// Without the passthrough settings the host is terminated by the listener
+	h.Settings.Passthrough = nil
+	h.Settings.KeyPair = newKeyPair(c)
+	c.Assert(s.mux.UpsertHost(*h), IsNil)
+	body, cert = getSNI(c, b.FrontendURL("/"), "secure.example.com")
+	c.Assert(body, Equals, "Hi, I'm endpoint 1")
+	c.Assert(cert.Equal(secure.Certificate()), Equals, false)
+	c.Assert(s.mux.passthroughHostStats(), HasLen, 0)
+}
+
+// getSNI requests the url sending the server name, it returns the body and the certificate of the server
+func getSNI(c *C, url, serverName string) (string, *x509.Certificate) {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: serverName},
+		DisableKeepAlives: true,
+	}}
+	re, err := client.Get(url)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(body), re.TLS.PeerCertificates[0]
+}
+
+// getWithHeader sends the raw request preceded by the PROXY protocol header, it returns the response body
+// or an empty string if the request has failed
+func getWithHeader(c *C, addr, header string) string {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", header)
+	re, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return ""
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return ""
+	}
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(body)
+}
+
 func GETResponse(c *C, url string, opts ...testutils.ReqOption) string {
 	response, body, err := testutils.Get(url, opts...)
 	c.Assert(err, IsNil)
@@ -1060,6 +2639,97 @@ func GETResponse(c *C, url string, opts ...testutils.ReqOption) string {
 	return string(body)
 }
 
+// getHTTP2 requests the url with the client supporting HTTP/2, it returns the response, the body
+// and the address of the proxy connection
+func getHTTP2(c *C, client *http.Client, url string) (*http.Response, string, string) {
+	addr := ""
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { addr = info.Conn.RemoteAddr().String() },
+	}))
+	re, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return re, string(body), addr
+}
+
+// newKeyPair generates the self signed key pair for localhost
+// newSANKeyPair returns the self signed ECDSA or RSA certificate for the DNS names
+func newSANKeyPair(c *C, useRSA bool, names ...string) *engine.KeyPair {
+	var (
+		key   crypto.Signer
+		block *pem.Block
+	)
+	if useRSA {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		c.Assert(err, IsNil)
+		key, block = k, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	} else {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		c.Assert(err, IsNil)
+		der, err := x509.MarshalECPrivateKey(k)
+		c.Assert(err, IsNil)
+		key, block = k, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Acme Co"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     names,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	c.Assert(err, IsNil)
+	return &engine.KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		Key:  pem.EncodeToMemory(block),
+	}
+}
+
+// peerCertificate returns the certificate presented by the server to the client sending the server name,
+// the client supporting RSA only uses TLS 1.2 with RSA cipher suites
+func peerCertificate(c *C, addr, serverName string, rsaOnly bool) *x509.Certificate {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+	if rsaOnly {
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func newKeyPair(c *C) *engine.KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Acme Co"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		DNSNames:              []string{"localhost"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	der, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return &engine.KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+	}
+}
+
 // localhostCert is a PEM-encoded TLS cert with SAN IPs
 // "127.0.0.1" and "[::1]", expiring at the last second of 2049 (the end
 // of ASN.1 time).
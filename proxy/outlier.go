@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/memmetrics"
+	"github.com/mailgun/vulcand/anomaly"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// outlierDetector periodically runs the anomaly detection on the servers of the backend and ejects
+// the anomalous ones. The detector state is accessed with the mux lock held.
+type outlierDetector struct {
+	settings engine.OutlierEjectionSettings
+	backend  *backend
+	// ejections are keyed by the server URL
+	ejections map[string]*ejection
+	stopC     chan struct{}
+}
+
+type ejection struct {
+	ejected bool
+	until   time.Time
+	// count is the number of the recent ejections, it grows with every ejection and decays when the server behaves
+	count  int
+	reason string
+}
+
+func newOutlierDetector(s engine.OutlierEjectionSettings, b *backend) *outlierDetector {
+	return &outlierDetector{
+		settings:  s,
+		backend:   b,
+		ejections: map[string]*ejection{},
+		stopC:     make(chan struct{}),
+	}
+}
+
+func (d *outlierDetector) start() {
+	go func() {
+		ticker := time.NewTicker(d.settings.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stopC:
+				return
+			case <-ticker.C:
+				d.detect()
+			}
+		}
+	}()
+}
+
+// stop stops the detection, it does not wait for the detection in progress to finish
+func (d *outlierDetector) stop() {
+	close(d.stopC)
+}
+
+func (d *outlierDetector) detect() {
+	m := d.backend.mux
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// The detector has been replaced while waiting for the lock
+	if d.backend.detector != d {
+		return
+	}
+	changed, err := d.run(m.options.TimeProvider.UtcNow())
+	if err != nil {
+		log.Errorf("%v outlier detection failed: %v", d.backend, err)
+	}
+	if changed {
+		if err := d.backend.updateFrontends(); err != nil {
+			log.Errorf("%v failed to update frontends: %v", d.backend, err)
+		}
+	}
+}
+
+// run returns the expired ejections back, marks anomalies and ejects the anomalous servers.
+// It returns true if any of the servers has been ejected or returned.
+func (d *outlierDetector) run(now time.Time) (bool, error) {
+	b := d.backend
+	changed := false
+
+	// Forget the servers that have been removed
+	current := map[string]bool{}
+	for _, s := range b.servers {
+		current[s.URL] = true
+	}
+	for u := range d.ejections {
+		if !current[u] {
+			delete(d.ejections, u)
+		}
+	}
+
+	ejected := 0
+	for u, e := range d.ejections {
+		if !e.ejected {
+			continue
+		}
+		if now.Before(e.until) {
+			ejected += 1
+			continue
+		}
+		e.ejected = false
+		changed = true
+		log.Infof("%v returning %v after ejection", b, u)
+	}
+
+	// Only the servers in rotation that got traffic are compared
+	candidates := []engine.Server{}
+	for _, s := range b.servers {
+		if d.isEjected(s.URL) || !b.isHealthy(s) {
+			continue
+		}
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			continue
+		}
+		stats, err := b.serverRoundTripStats(u)
+		if err != nil {
+			return changed, err
+		}
+		if stats.Counters.Total == 0 {
+			continue
+		}
+		s.Stats = stats
+		candidates = append(candidates, s)
+	}
+	if err := anomaly.MarkServerAnomalies(candidates); err != nil {
+		return changed, err
+	}
+
+	maxEjected := len(b.servers) * d.settings.MaxEjectionPercent / 100
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	for _, s := range candidates {
+		e, ok := d.ejections[s.URL]
+		if !ok {
+			e = &ejection{}
+			d.ejections[s.URL] = e
+		}
+		if !s.Stats.Verdict.IsBad {
+			if e.count > 0 {
+				e.count -= 1
+			}
+			continue
+		}
+		if ejected >= maxEjected {
+			log.Warningf("%v not ejecting anomalous %v, %d of %d servers are already ejected", b, s.URL, ejected, len(b.servers))
+			continue
+		}
+		period := d.settings.BaseEjectionTime << uint(e.count)
+		if period > d.settings.MaxEjectionTime || period <= 0 {
+			period = d.settings.MaxEjectionTime
+		}
+		e.ejected, e.until, e.count, e.reason = true, now.Add(period), e.count+1, anomaliesToString(s.Stats.Verdict)
+		ejected += 1
+		changed = true
+		log.Warningf("%v ejecting %v for %v, ejections: %d, reason: %v", b, s.URL, period, e.count, e.reason)
+	}
+	return changed, nil
+}
+
+func (d *outlierDetector) isEjected(u string) bool {
+	e, ok := d.ejections[u]
+	return ok && e.ejected
+}
+
+func (d *outlierDetector) ejection(u string) *engine.ServerEjection {
+	e, ok := d.ejections[u]
+	if !ok {
+		return &engine.ServerEjection{}
+	}
+	return &engine.ServerEjection{Ejected: e.ejected, Until: e.until, Ejections: e.count, Reason: e.reason}
+}
+
+func anomaliesToString(v engine.Verdict) string {
+	out := make([]string, len(v.Anomalies))
+	for i, a := range v.Anomalies {
+		out[i] = a.Message
+	}
+	return strings.Join(out, ", ")
+}
+
+// serverRoundTripStats aggregates the stats of the server collected by the frontends using the backend
+func (b *backend) serverRoundTripStats(u *url.URL) (*engine.RoundTripStats, error) {
+	m, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		return nil, err
+	}
+	if err := b.collectServerMetrics(m, u); err != nil {
+		return nil, fmt.Errorf("failed to collect %v metrics: %v", u, err)
+	}
+	return engine.NewRoundTripStats(m)
+}
+
+// collectServerMetrics collects the metrics of the server from the splits of the frontends sending requests to the backend
+func (b *backend) collectServerMetrics(m *memmetrics.RTMetrics, u *url.URL) error {
+	for _, f := range b.frontends {
+		for _, sp := range f.splits() {
+			if sp.backend != b {
+				continue
+			}
+			if err := sp.watcher.collectServerMetrics(m, u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -33,6 +33,11 @@ type Proxy interface {
 	UpsertServer(engine.BackendKey, engine.Server) error
 	DeleteServer(engine.ServerKey) error
 
+	// ApplyBatch applies the group of upsert and delete events under one lock, so the requests are not served
+	// with the group applied partially. The change that fails does not stop the group: the changes following it
+	// are applied as well, and the errors of all failed changes are returned, so the caller can resync the proxy.
+	ApplyBatch([]interface{}) error
+
 	// TakeFiles takes file descriptors representing sockets in listening state to start serving on them
 	// instead of binding. This is nessesary if the child process needs to inherit sockets from the parent
 	// (e.g. for graceful restarts)
@@ -47,11 +52,14 @@ type Proxy interface {
 }
 
 type Options struct {
-	MetricsClient      metrics.Client
-	DialTimeout        time.Duration
-	ReadTimeout        time.Duration
-	WriteTimeout       time.Duration
-	MaxHeaderBytes     int
+	MetricsClient  metrics.Client
+	DialTimeout    time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	MaxHeaderBytes int
+	// ShutdownTimeout limits the time of waiting for the requests in progress when the server stops,
+	// 30 seconds if omitted
+	ShutdownTimeout    time.Duration
 	DefaultListener    *engine.Listener
 	Files              []*FileDescriptor
 	TimeProvider       timetools.TimeProvider
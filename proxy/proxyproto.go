@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcand/engine"
+)
+
+// proxyHeaderTimeout limits the time the trusted sources have to send the PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts the binary PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener reads the PROXY protocol headers on the connections from the trusted sources,
+// see http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+type proxyListener struct {
+	net.Listener
+
+	mtx     *sync.RWMutex
+	trusted []*net.IPNet
+}
+
+func newProxyListener(l net.Listener, trusted []*net.IPNet) *proxyListener {
+	return &proxyListener{Listener: l, mtx: &sync.RWMutex{}, trusted: trusted}
+}
+
+// setTrusted updates the trusted sources, nil turns off the PROXY protocol for the new connections
+func (l *proxyListener) setTrusted(trusted []*net.IPNet) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.trusted = trusted
+}
+
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	// Header is read on the first use of the connection, so slow clients do not block the accept loop
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), once: &sync.Once{}}, nil
+}
+
+// proxyConn reports the client address from the PROXY protocol header as its remote address
+type proxyConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once *sync.Once
+	err  error
+	src  net.Addr
+	dst  net.Addr
+}
+
+// readHeader reads the header once, the connection fails if the header is missing or malformed
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("bad PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() != nil || c.src == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.src
+}
+
+// clientAddrs returns the addresses of the client and the address it has connected to,
+// the addresses from the PROXY protocol header are used if there is one
+func clientAddrs(conn net.Conn) (net.Addr, net.Addr) {
+	if c, ok := conn.(*proxyConn); ok && c.readHeader() == nil && c.src != nil {
+		return c.src, c.dst
+	}
+	return conn.RemoteAddr(), conn.LocalAddr()
+}
+
+// readProxyHeader reads the v1 or v2 header, nil addresses are returned if the header has no client address,
+// e.g. the load balancer health checks
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, fmt.Errorf("no PROXY protocol header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The longest header is 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("header is not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, nil, fmt.Errorf("malformed header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("unsupported protocol %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("malformed header")
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return nil, fmt.Errorf("invalid address %s", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL command is sent by the load balancer itself, the connection addresses are used
+	if hdr[12]&0x0F == 0 {
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("short address block")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// writeProxyHeader sends the header of the version with the client address, the header without
+// addresses is sent if the client address is not known, e.g. for the health checks
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	s, d := tcpAddr(src), tcpAddr(dst)
+	known := s != nil && d != nil
+	ipv4 := known && s.IP.To4() != nil && d.IP.To4() != nil
+
+	if version == engine.ProxyProtocolV1 {
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port)
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(proxyV2Signature)
+	switch {
+	case !known:
+		// LOCAL command without the address block
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+	case ipv4:
+		buf.Write([]byte{0x21, 0x11, 0x00, 12})
+		buf.Write(s.IP.To4())
+		buf.Write(d.IP.To4())
+	default:
+		buf.Write([]byte{0x21, 0x21, 0x00, 36})
+		buf.Write(s.IP.To16())
+		buf.Write(d.IP.To16())
+	}
+	if known {
+		binary.Write(buf, binary.BigEndian, uint16(s.Port))
+		binary.Write(buf, binary.BigEndian, uint16(d.Port))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// tcpAddr returns the tcp address or nil, the addresses wrapped by the other listeners are parsed
+func tcpAddr(a net.Addr) *net.TCPAddr {
+	if a == nil || a.Network() != "tcp" {
+		return nil
+	}
+	if t, ok := a.(*net.TCPAddr); ok {
+		return t
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil
+	}
+	t, err := parseProxyAddr(host, port)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// clientConnKey is the context key of the client connection the request was received on
+type clientConnKey struct{}
+
+// withClientConn stores the client connection in the context, see http.Server.ConnContext
+func withClientConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, conn)
+}
+
+// proxyDialer returns the dial function sending the PROXY protocol header with the address of the client
+// that has sent the request
+func proxyDialer(d *net.Dialer, version string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeRequestProxyHeader(ctx, conn, version); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// writeRequestProxyHeader sends the header with the address of the client connection from the context
+func writeRequestProxyHeader(ctx context.Context, conn net.Conn, version string) error {
+	var src, dst net.Addr
+	if cc, ok := ctx.Value(clientConnKey{}).(net.Conn); ok {
+		src, dst = clientAddrs(cc)
+	}
+	return writeProxyHeader(conn, version, src, dst)
+}
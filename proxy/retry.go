@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/multibuf"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/stream"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// retryBudget counts the requests of the backend in flight and the retries among them,
+// it is shared by all the frontends of the backend
+type retryBudget struct {
+	active  int64
+	retries int64
+}
+
+// acquire reserves the retry if the retries in flight stay within the percent of the active requests
+func (b *retryBudget) acquire(percent, minRetries int) bool {
+	limit := atomic.LoadInt64(&b.active) * int64(percent) / 100
+	if limit < int64(minRetries) {
+		limit = int64(minRetries)
+	}
+	if atomic.AddInt64(&b.retries, 1) > limit {
+		atomic.AddInt64(&b.retries, -1)
+		return false
+	}
+	return true
+}
+
+func (b *retryBudget) release() {
+	atomic.AddInt64(&b.retries, -1)
+}
+
+// retryCounters are updated atomically by the requests, they are kept by the frontend across the rebuilds
+type retryCounters struct {
+	retries         int64
+	budgetExhausted int64
+}
+
+func (c *retryCounters) stats() *engine.RetryStats {
+	return &engine.RetryStats{
+		Retries:         atomic.LoadInt64(&c.retries),
+		BudgetExhausted: atomic.LoadInt64(&c.budgetExhausted),
+	}
+}
+
+// retrier replaces the stream retries for the frontends with the retry settings. The request body is buffered
+// to be sent again, the response of the failed attempt is discarded as soon as the status code is known,
+// so the response of the last attempt is streamed to the client as is.
+type retrier struct {
+	next     http.Handler
+	settings engine.RetrySettings
+	limits   engine.HTTPFrontendLimits
+	budget   *retryBudget
+	counters *retryCounters
+	log      utils.Logger
+}
+
+func newRetrier(next http.Handler, s engine.RetrySettings, limits engine.HTTPFrontendLimits, budget *retryBudget, counters *retryCounters, log utils.Logger) *retrier {
+	return &retrier{
+		next:     next,
+		settings: s,
+		limits:   limits,
+		budget:   budget,
+		counters: counters,
+		log:      log,
+	}
+}
+
+func (r *retrier) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&r.budget.active, 1)
+	defer atomic.AddInt64(&r.budget.active, -1)
+
+	if r.limits.MaxBodyBytes > 0 && req.ContentLength > r.limits.MaxBodyBytes {
+		(&stream.SizeErrHandler{}).ServeHTTP(w, req, &multibuf.MaxSizeReachedError{MaxSize: r.limits.MaxBodyBytes})
+		return
+	}
+	body, err := multibuf.New(req.Body, multibuf.MaxBytes(r.limits.MaxBodyBytes), multibuf.MemBytes(r.limits.MaxMemBodyBytes))
+	if err != nil || body == nil {
+		(&stream.SizeErrHandler{}).ServeHTTP(w, req, err)
+		return
+	}
+	defer body.Close()
+	size, err := body.Size()
+	if err != nil {
+		r.log.Errorf("failed to get size, err %v", err)
+		(&stream.SizeErrHandler{}).ServeHTTP(w, req, err)
+		return
+	}
+
+	// reserved is set while the retry budget is held, the budget is released even if the attempt panics
+	reserved := false
+	defer func() {
+		if reserved {
+			r.budget.release()
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		aw := &attemptWriter{
+			w:      w,
+			header: make(http.Header),
+			retry:  func(code int) bool { return r.shouldRetry(req, attempt, code) },
+		}
+		r.serveAttempt(aw, copyRequest(req, body, size))
+		if !aw.wrote {
+			aw.WriteHeader(http.StatusOK)
+		}
+		if reserved {
+			r.budget.release()
+		}
+		reserved = aw.retried
+		if !aw.retried {
+			return
+		}
+		atomic.AddInt64(&r.counters.retries, 1)
+		if !sleepContext(req.Context(), r.backoff(attempt)) {
+			return
+		}
+		if _, err := body.Seek(0, 0); err != nil {
+			r.log.Errorf("failed to rewind: error: %v", err)
+			utils.DefaultHandler.ServeHTTP(w, req, err)
+			return
+		}
+		r.log.Infof("retry Request(%v %v) attempt %v", req.Method, req.URL, attempt+1)
+	}
+}
+
+// serveAttempt sends the request to the backend, the attempt is limited by the try timeout if set
+func (r *retrier) serveAttempt(w http.ResponseWriter, req *http.Request) {
+	if r.settings.TryTimeout == 0 {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), r.settings.TryTimeout)
+	defer cancel()
+	r.next.ServeHTTP(w, req.WithContext(ctx))
+}
+
+func (r *retrier) isRetryableMethod(method string) bool {
+	for _, m := range r.settings.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *retrier) isRetryableCode(code int) bool {
+	// Proxy responds with these codes on the network errors and the timed out attempts
+	if code == http.StatusBadGateway || code == http.StatusGatewayTimeout {
+		return true
+	}
+	for _, c := range r.settings.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRetry reserves the retry budget if the attempt should be retried
+func (r *retrier) shouldRetry(req *http.Request, attempt, code int) bool {
+	if attempt >= r.settings.Attempts || !r.isRetryableMethod(req.Method) || !r.isRetryableCode(code) || req.Context().Err() != nil {
+		return false
+	}
+	if !r.budget.acquire(r.settings.BudgetPercent, r.settings.BudgetMinRetries) {
+		atomic.AddInt64(&r.counters.budgetExhausted, 1)
+		r.log.Warningf("retry budget exhausted, Request(%v %v) is not retried", req.Method, req.URL)
+		return false
+	}
+	return true
+}
+
+// backoff returns the delay after the failed attempt, the delay doubles with every retry
+func (r *retrier) backoff(attempt int) time.Duration {
+	d := r.settings.Backoff
+	for i := 1; i < attempt && d < r.settings.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.settings.MaxBackoff {
+		d = r.settings.MaxBackoff
+	}
+	return d
+}
+
+// sleepContext waits for the delay, false is returned if the context is done before
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d == 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// copyRequest returns the copy of the request replaying the buffered body, see stream
+func copyRequest(req *http.Request, body multibuf.MultiReader, size int64) *http.Request {
+	o := *req
+	o.URL = utils.CopyURL(req.URL)
+	o.Header = make(http.Header)
+	utils.CopyHeaders(o.Header, req.Header)
+	o.ContentLength = size
+	o.TransferEncoding = []string{}
+	// Transport closes the body on errors, the body is closed by the retrier once all attempts are done
+	o.Body = ioutil.NopCloser(body)
+	return &o
+}
+
+// attemptWriter passes the response of the attempt to the client unless the attempt is retried,
+// the response of the retried attempt is discarded
+type attemptWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	retry  func(code int) bool
+
+	wrote   bool
+	retried bool
+}
+
+func (a *attemptWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *attemptWriter) WriteHeader(code int) {
+	if a.wrote {
+		return
+	}
+	a.wrote = true
+	if a.retry(code) {
+		a.retried = true
+		return
+	}
+	utils.CopyHeaders(a.w.Header(), a.header)
+	a.w.WriteHeader(code)
+}
+
+func (a *attemptWriter) Write(b []byte) (int, error) {
+	if !a.wrote {
+		a.WriteHeader(http.StatusOK)
+	}
+	if a.retried {
+		return len(b), nil
+	}
+	return a.w.Write(b)
+}
+
+// Flush lets the streaming responses reach the client
+func (a *attemptWriter) Flush() {
+	if !a.wrote || a.retried {
+		return
+	}
+	if f, ok := a.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcand/engine"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+// sniPeekTimeout limits the time the clients have to send the TLS ClientHello
+const sniPeekTimeout = 5 * time.Second
+
+// errHelloPeeked stops the handshake once the ClientHello is parsed
+var errHelloPeeked = errors.New("client hello peeked")
+
+// sniListener peeks at the server name of the TLS connections. Connections to the passthrough hosts are
+// proxied to the host backends still encrypted, the rest are returned by Accept to be terminated by the TLS listener.
+type sniListener struct {
+	net.Listener
+	mux *mux
+
+	once  *sync.Once
+	connC chan net.Conn
+	// doneC is closed when the wrapped listener fails, err is the failure returned by Accept
+	doneC chan struct{}
+	err   error
+}
+
+func newSNIListener(m *mux, l net.Listener) *sniListener {
+	return &sniListener{
+		Listener: l,
+		mux:      m,
+		once:     &sync.Once{},
+		connC:    make(chan net.Conn),
+		doneC:    make(chan struct{}),
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	// Connections are accepted in the background, so the slow clients do not block the others while peeking
+	l.once.Do(func() { go l.acceptLoop() })
+	select {
+	case conn := <-l.connC:
+		return conn, nil
+	case <-l.doneC:
+		return nil, l.err
+	}
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warningf("%v sni listener accept error: %v", l.mux, err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.doneC)
+			return
+		}
+		l.mux.wg.Add(1)
+		go l.route(conn)
+	}
+}
+
+// route proxies the connection to the passthrough host or hands it over to Accept
+func (l *sniListener) route(conn net.Conn) {
+	defer l.mux.wg.Done()
+
+	if pc, ok := conn.(*proxyConn); ok {
+		if err := pc.readHeader(); err != nil {
+			log.Warningf("%v %v", l.mux, err)
+			conn.Close()
+			return
+		}
+	}
+	serverName, hello := peekServerName(conn)
+	// Peeked bytes are replayed, so the TLS listener sees the whole handshake
+	conn = &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	if serverName != "" && l.mux.servePassthrough(serverName, conn) {
+		return
+	}
+	select {
+	case l.connC <- conn:
+	case <-l.doneC:
+		conn.Close()
+	}
+}
+
+// peekServerName reads the ClientHello and returns the server name requested by the client and the bytes read.
+// Empty name is returned if the client has not sent the name or the connection is not TLS,
+// the TLS listener reports the errors then.
+func peekServerName(conn net.Conn) (string, []byte) {
+	buf := &bytes.Buffer{}
+	var serverName string
+
+	conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	tls.Server(&readOnlyConn{r: io.TeeReader(conn, buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	return serverName, buf.Bytes()
+}
+
+// readOnlyConn lets the TLS server parse the ClientHello without replying to the client
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn returns the peeked bytes before reading from the connection
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite passes the end of stream to the client, see halfClose
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// passthroughHost is the label of the proxied connections in the logs
+type passthroughHost struct {
+	mux  *mux
+	host engine.Host
+}
+
+func (h *passthroughHost) String() string {
+	return fmt.Sprintf("%v passthroughHost(wrap=%v)", h.mux, &h.host)
+}
+
+// servePassthrough proxies the connection to the backend of the host if the host has passthrough settings,
+// returns false if the connection should be terminated by the listener
+func (m *mux) servePassthrough(serverName string, conn net.Conn) bool {
+	m.mtx.RLock()
+	hk, _ := m.matchHost(serverName)
+	host, ok := m.hosts[hk]
+	if !ok || host.Settings.Passthrough == nil {
+		m.mtx.RUnlock()
+		return false
+	}
+	stats := m.passthroughStats[hk]
+	b := m.tcpBackends[engine.BackendKey{Id: host.Settings.Passthrough.BackendId}]
+	var servers []engine.Server
+	var settings *engine.TCPTransportSettings
+	if b != nil {
+		servers, settings = b.servers, b.settings
+	}
+	m.mtx.RUnlock()
+
+	defer conn.Close()
+	h := &passthroughHost{mux: m, host: host}
+	if b == nil {
+		log.Warningf("%v tcp backend %v not found, closing connection from %v", h, host.Settings.Passthrough.BackendId, conn.RemoteAddr())
+		return true
+	}
+	m.proxyTCP(h, conn, b, servers, settings, stats)
+	return true
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/forward"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/memmetrics"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// split is the share of the frontend requests served by one of the backends, every split has its own
+// load balancer and watcher, so the stats of the backends are kept apart
+type split struct {
+	id      string
+	backend *backend
+	// weight is the percentage of the requests, accessed with the splitter lock held
+	weight  int
+	lb      balancer
+	weights map[string]int
+	watcher *RTWatcher
+}
+
+func (f *frontend) newSplit(b *backend) (*split, error) {
+	settings := f.frontend.HTTPSettings()
+	rewriter := &forward.HeaderRewriter{
+		Hostname:           settings.Hostname,
+		TrustForwardHeader: settings.TrustForwardHeader,
+	}
+
+	// set up forwarder
+	fwd, err := forward.New(
+		forward.Logger(f.log),
+		forward.RoundTripper(&backendTransport{RoundTripper: b.transport}),
+		forward.Rewriter(rewriter))
+	if err != nil {
+		return nil, err
+	}
+
+	// rtwatcher will be observing and aggregating metrics
+	watcher, err := NewWatcher(fwd)
+	if err != nil {
+		return nil, err
+	}
+
+	// tunnel proxies the upgraded connections to the selected server, they are not watched
+	// as their latency is the lifetime of the connection
+	ts, err := f.mux.transportSettings(b.backend)
+	if err != nil {
+		return nil, err
+	}
+	tn := &tunnel{mux: f.mux, settings: ts, rewriter: rewriter, next: watcher}
+
+	// Create a load balancer using the strategy and session affinity of the backend
+	rb, err := newBalancer(b.backend.HTTPSettings(), tn, f.log)
+	if err != nil {
+		return nil, err
+	}
+
+	weights := map[string]int{}
+	if err := syncServers(f.mux, rb, b, watcher, weights); err != nil {
+		return nil, err
+	}
+	return &split{id: b.backend.Id, backend: b, lb: rb, weights: weights, watcher: watcher}, nil
+}
+
+// splitter sends the requests to the splits in proportion to their weights, unless the request
+// header or cookie forces the backend
+type splitter struct {
+	mtx    *sync.RWMutex
+	splits []*split
+	header string
+	cookie string
+}
+
+func newSplitter(splits []*split, t *engine.HTTPFrontendTrafficSplit) *splitter {
+	s := &splitter{mtx: &sync.RWMutex{}, splits: splits}
+	s.update(t)
+	return s
+}
+
+// update sets the weights of the splits, the first split gets the requests not sent to the other ones
+func (s *splitter) update(t *engine.HTTPFrontendTrafficSplit) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.header, s.cookie = "", ""
+	s.splits[0].weight = 100
+	if t == nil {
+		return
+	}
+	s.header, s.cookie = t.Header, t.Cookie
+	for i, sp := range t.Splits {
+		s.splits[i+1].weight = sp.Weight
+		s.splits[0].weight -= sp.Weight
+	}
+}
+
+func (s *splitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.pick(req).lb.ServeHTTP(w, req)
+}
+
+func (s *splitter) pick(req *http.Request) *split {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if len(s.splits) == 1 {
+		return s.splits[0]
+	}
+	if sp := s.forced(req); sp != nil {
+		return sp
+	}
+	n := rand.Intn(100)
+	for _, sp := range s.splits {
+		if n < sp.weight {
+			return sp
+		}
+		n -= sp.weight
+	}
+	return s.splits[0]
+}
+
+// forced returns the split of the backend set by the override header or cookie
+func (s *splitter) forced(req *http.Request) *split {
+	id := ""
+	if s.header != "" {
+		id = req.Header.Get(s.header)
+	}
+	if id == "" && s.cookie != "" {
+		if c, err := req.Cookie(s.cookie); err == nil {
+			id = c.Value
+		}
+	}
+	if id == "" {
+		return nil
+	}
+	for _, sp := range s.splits {
+		if sp.id == id {
+			return sp
+		}
+	}
+	return nil
+}
+
+// rtStats returns the stats of all the requests, with the stats of every split if the traffic is split
+func (s *splitter) rtStats() (*engine.RoundTripStats, error) {
+	m, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range s.splits {
+		if err := sp.watcher.collectMetrics(m); err != nil {
+			return nil, err
+		}
+	}
+	stats, err := engine.NewRoundTripStats(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.splits) == 1 {
+		return stats, nil
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, sp := range s.splits {
+		st, err := sp.watcher.rtStats()
+		if err != nil {
+			return nil, err
+		}
+		stats.Splits = append(stats.Splits, engine.SplitStats{BackendId: sp.id, Weight: sp.weight, Stats: *st})
+	}
+	return stats, nil
+}
@@ -1,12 +1,15 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 
 	"fmt"
-	"github.com/mailgun/vulcand/Godeps/_workspace/src/golang.org/x/crypto/ocsp"
 	"net"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/mailgun/vulcand/engine"
 
@@ -21,17 +24,25 @@ type srv struct {
 	defaultHost string
 	mux         *mux
 	srv         *manners.GracefulServer
-	proxy       http.Handler
-	listener    engine.Listener
-	options     Options
-	state       int
+	// socket is the listening socket of the server, the listener of the server wraps it with the PROXY protocol,
+	// the SNI passthrough and the TLS
+	socket   net.Listener
+	proxy    http.Handler
+	listener engine.Listener
+	options  Options
+	state    int
+
+	// closeTimers close the connections of the servers being shut down after the shutdown timeout,
+	// the timer of the server is stopped once the server stops
+	closeTimers map[*manners.GracefulServer]*time.Timer
+	timersMtx   sync.Mutex
 }
 
 func (s *srv) GetFile() (*FileDescriptor, error) {
 	if !s.hasListeners() || s.srv == nil {
 		return nil, nil
 	}
-	file, err := s.srv.GetFile()
+	file, err := listenerFile(s.socket)
 	if err != nil {
 		return nil, err
 	}
@@ -62,10 +73,11 @@ func newSrv(m *mux, l engine.Listener) (*srv, error) {
 	}
 	return &srv{
 		mux:         m,
-		proxy:       h,
+		proxy:       newHostHandler(m, h),
 		listener:    l,
 		defaultHost: defaultHost,
 		state:       srvStateInit,
+		closeTimers: make(map[*manners.GracefulServer]*time.Timer),
 	}, nil
 }
 
@@ -87,7 +99,7 @@ func (s *srv) updateListener(l engine.Listener) error {
 	if err != nil {
 		return err
 	}
-	s.proxy = handler
+	s.proxy = newHostHandler(s.mux, handler)
 	s.listener = l
 
 	return s.reload()
@@ -110,17 +122,14 @@ func (s *srv) takeFile(f *FileDescriptor) error {
 	}
 
 	if s.isTLS() {
-		tcpListener, ok := listener.(*net.TCPListener)
-		if !ok {
+		if _, ok := listener.(*net.TCPListener); !ok {
 			return fmt.Errorf(`%s failed to take file descriptor - it is running in TLS mode so I need a TCP listener, 
 but the file descriptor that was given corresponded to a listener of type %T. More about file descriptor: %s`, listener, s, f)
 		}
-		config, err := s.newTLSConfig()
-		if err != nil {
-			return err
-		}
-		listener = manners.NewTLSListener(
-			manners.TCPKeepAliveListener{tcpListener}, config)
+	}
+	s.socket = listener
+	if listener, err = s.wrapListener(listener); err != nil {
+		return err
 	}
 
 	s.srv = manners.NewWithOptions(
@@ -133,13 +142,56 @@ but the file descriptor that was given corresponded to a listener of type %T. Mo
 	return nil
 }
 
+// listenerFile returns the duplicated file of the listening socket, so the socket can be passed to the other process
+func listenerFile(l net.Listener) (*os.File, error) {
+	switch t := l.(type) {
+	case *net.TCPListener:
+		return t.File()
+	case *net.UnixListener:
+		return t.File()
+	}
+	return nil, fmt.Errorf("unsupported listener: %T", l)
+}
+
+// wrapListener adds the PROXY protocol, the SNI passthrough and the TLS to the listening socket
+func (s *srv) wrapListener(listener net.Listener) (net.Listener, error) {
+	if s.isTLS() {
+		listener = manners.TCPKeepAliveListener{listener.(*net.TCPListener)}
+	}
+	if s.listener.ProxyProtocol != nil {
+		trusted, err := s.listener.ProxyProtocol.TrustedNets()
+		if err != nil {
+			return nil, err
+		}
+		listener = newProxyListener(listener, trusted)
+	}
+	if s.listener.SNIPassthrough() {
+		listener = newSNIListener(s.mux, listener)
+	}
+	if s.isTLS() {
+		config, err := s.newTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		listener = manners.NewTLSListener(listener, config)
+	}
+	return listener, nil
+}
+
 func (s *srv) newHTTPServer() *http.Server {
-	return &http.Server{
+	server := &http.Server{
 		Handler:        s.proxy,
 		ReadTimeout:    s.options.ReadTimeout,
 		WriteTimeout:   s.options.WriteTimeout,
 		MaxHeaderBytes: s.options.MaxHeaderBytes,
+		// Backends sending the PROXY protocol header need the client connection
+		ConnContext: withClientConn,
 	}
+	if !s.listener.HTTP2() {
+		// Non nil map turns off the HTTP/2 support of the server
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return server
 }
 
 func (s *srv) reload() error {
@@ -147,30 +199,59 @@ func (s *srv) reload() error {
 		return nil
 	}
 
-	var config *tls.Config
-
-	if s.isTLS() {
-		cfg, err := s.newTLSConfig()
-		if err != nil {
-			return err
-		}
-		config = cfg
+	// The listening socket is duplicated, so the connections accepted by the old server keep running
+	file, err := listenerFile(s.socket)
+	if err != nil {
+		return err
 	}
-
-	gracefulServer, err := s.srv.HijackListener(s.newHTTPServer(), config)
+	fl, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	listener, err := s.wrapListener(fl)
 	if err != nil {
+		fl.Close()
 		return err
 	}
+	gracefulServer := manners.NewWithOptions(
+		manners.Options{
+			Server:       s.newHTTPServer(),
+			Listener:     listener,
+			StateHandler: s.mux.connTracker.onStateChange,
+		})
 	go s.serve(gracefulServer)
 
-	s.srv.Close()
+	s.closeServer(s.srv)
 	s.srv = gracefulServer
+	s.socket = fl
 	return nil
 }
 
 func (s *srv) shutdown() {
 	if s.srv != nil {
-		s.srv.Close()
+		s.closeServer(s.srv)
+	}
+}
+
+// closeServer stops the server accepting connections and lets the requests in progress complete. The connections
+// still serving the requests after the shutdown timeout are closed, so long lived requests, e.g. streaming
+// or HTTP/2 requests, do not block the stop and the reload of the proxy.
+func (s *srv) closeServer(gs *manners.GracefulServer) {
+	s.timersMtx.Lock()
+	s.closeTimers[gs] = time.AfterFunc(s.mux.options.ShutdownTimeout, func() {
+		gs.Server.Close()
+	})
+	s.timersMtx.Unlock()
+	gs.Close()
+}
+
+func (s *srv) stopCloseTimer(gs *manners.GracefulServer) {
+	s.timersMtx.Lock()
+	defer s.timersMtx.Unlock()
+	if t, ok := s.closeTimers[gs]; ok {
+		t.Stop()
+		delete(s.closeTimers, gs)
 	}
 }
 
@@ -181,49 +262,18 @@ func (s *srv) newTLSConfig() (*tls.Config, error) {
 	}
 
 	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
-	}
-
-	pairs := map[string]tls.Certificate{}
-	for _, host := range s.mux.hosts {
-		c := host.Settings.KeyPair
-		if c == nil {
-			continue
+		if s.listener.HTTP2() {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		} else {
+			config.NextProtos = []string{"http/1.1"}
 		}
-		keyPair, err := tls.X509KeyPair(c.Cert, c.Key)
-		if err != nil {
-			return nil, err
-		}
-		if host.Settings.OCSP.Enabled {
-			log.Infof("%v OCSP is enabled for %v, resolvers: %v", s, host, host.Settings.OCSP.Responders)
-			r, err := s.mux.stapler.StapleHost(&host)
-			if err != nil {
-				log.Warningf("%v failed to staple %v, error %v", s, host, err)
-			} else if r.Response.Status == ocsp.Good || r.Response.Status == ocsp.Revoked {
-				keyPair.OCSPStaple = r.Staple
-			} else {
-				log.Warningf("%s got undefined status from OCSP responder: %v", s, r.Response.Status)
-			}
-		}
-		pairs[host.Name] = keyPair
 	}
 
-	config.Certificates = make([]tls.Certificate, 0, len(pairs))
-	if s.defaultHost != "" {
-		keyPair, exists := pairs[s.defaultHost]
-		if !exists {
-			return nil, fmt.Errorf("default host '%s' certificate is not passed", s.defaultHost)
-		}
-		config.Certificates = append(config.Certificates, keyPair)
-	}
-
-	for h, keyPair := range pairs {
-		if h != s.defaultHost {
-			config.Certificates = append(config.Certificates, keyPair)
-		}
+	certs, err := newCertificates(s, s.mux.hosts, s.defaultHost)
+	if err != nil {
+		return nil, err
 	}
-
-	config.BuildNameToCertificate()
+	config.GetCertificate = certs.GetCertificate
 	return config, nil
 }
 
@@ -231,18 +281,14 @@ func (s *srv) start() error {
 	log.Infof("%s start", s)
 	switch s.state {
 	case srvStateInit:
-		listener, err := net.Listen(s.listener.Address.Network, s.listener.Address.Address)
+		l, err := net.Listen(s.listener.Address.Network, s.listener.Address.Address)
 		if err != nil {
 			return err
 		}
-
-		if s.isTLS() {
-			config, err := s.newTLSConfig()
-			if err != nil {
-				return err
-			}
-			listener = manners.NewTLSListener(
-				manners.TCPKeepAliveListener{listener.(*net.TCPListener)}, config)
+		listener, err := s.wrapListener(l)
+		if err != nil {
+			l.Close()
+			return err
 		}
 		s.srv = manners.NewWithOptions(
 			manners.Options{
@@ -250,6 +296,7 @@ func (s *srv) start() error {
 				Listener:     listener,
 				StateHandler: s.mux.connTracker.onStateChange,
 			})
+		s.socket = l
 		s.state = srvStateActive
 		go s.serve(s.srv)
 		return nil
@@ -266,9 +313,19 @@ func (s *srv) serve(srv *manners.GracefulServer) {
 
 	s.mux.wg.Add(1)
 	defer s.mux.wg.Done()
+	defer s.stopCloseTimer(srv)
 
 	srv.ListenAndServe()
 
+	// Graceful server closes the idle HTTP/1.1 connections only, the idle HTTP/2 connections
+	// are sent GOAWAY and closed by the shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), s.mux.options.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Server.Shutdown(ctx); err != nil {
+		log.Warningf("%v failed to shutdown gracefully: %v, closing connections", s, err)
+		srv.Server.Close()
+	}
+
 	log.Infof("%v stop", s)
 }
 
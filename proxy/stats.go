@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/metrics"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/memmetrics"
 	"github.com/mailgun/vulcand/engine"
 )
@@ -23,6 +24,11 @@ func (mx *mux) emitMetrics() error {
 			c.Gauge(c.Metric("conns", addr, state.String()), count, 1)
 		}
 	}
+	for addr, values := range mx.connTracker.protocolCounts() {
+		for proto, count := range values {
+			c.Gauge(c.Metric("protocols", addr, proto), count, 1)
+		}
+	}
 
 	// Emit frontend metrics stats
 	frontends, err := mx.topFrontends(nil)
@@ -46,17 +52,69 @@ func (mx *mux) emitMetrics() error {
 		for _, b := range s.LatencyBrackets {
 			c.Gauge(m.Metric("rtt", strconv.Itoa(int(b.Quantile*10.0))), int64(b.Value/time.Microsecond), 1)
 		}
+
+		if r := s.Retries; r != nil {
+			c.Gauge(m.Metric("retries"), r.Retries, 1)
+			c.Gauge(m.Metric("retries", "budgetexhausted"), r.BudgetExhausted, 1)
+		}
+		if t := s.Timeouts; t != nil {
+			c.Gauge(m.Metric("timeouts", "responseheader"), t.ResponseHeader, 1)
+			c.Gauge(m.Metric("timeouts", "total"), t.Total, 1)
+			c.Gauge(m.Metric("timeouts", "bodyidle"), t.BodyIdle, 1)
+		}
+	}
+
+	// Emit tcp frontend connection stats
+	for id, st := range mx.tcpFrontendStats() {
+		emitTCPStats(c, c.Metric("frontend", strings.Replace(id, ".", "_", -1)), st)
+	}
+
+	// Emit connection stats of the SNI passthrough hosts
+	for name, st := range mx.passthroughHostStats() {
+		emitTCPStats(c, c.Metric("passthrough", strings.Replace(name, ".", "_", -1)), st)
 	}
 
 	return nil
 }
 
+func emitTCPStats(c metrics.Client, m metrics.Metric, st tcpStats) {
+	c.Gauge(m.Metric("conns", "active"), st.Active, 1)
+	c.Gauge(m.Metric("conns", "total"), st.Total, 1)
+	c.Gauge(m.Metric("dialerr"), st.DialErrors, 1)
+	c.Gauge(m.Metric("bytes", "in"), st.BytesIn, 1)
+	c.Gauge(m.Metric("bytes", "out"), st.BytesOut, 1)
+}
+
+// tcpFrontendStats returns the connection stats of the tcp frontends by the frontend id
+func (mx *mux) tcpFrontendStats() map[string]tcpStats {
+	mx.mtx.RLock()
+	defer mx.mtx.RUnlock()
+
+	out := make(map[string]tcpStats, len(mx.tcpFrontends))
+	for fk, f := range mx.tcpFrontends {
+		out[fk.Id] = f.stats.snapshot()
+	}
+	return out
+}
+
+// passthroughHostStats returns the connection stats of the SNI passthrough hosts by the host name
+func (mx *mux) passthroughHostStats() map[string]tcpStats {
+	mx.mtx.RLock()
+	defer mx.mtx.RUnlock()
+
+	out := make(map[string]tcpStats, len(mx.passthroughStats))
+	for hk, st := range mx.passthroughStats {
+		out[hk.Name] = st.snapshot()
+	}
+	return out
+}
+
 func (mx *mux) frontendStats(key engine.FrontendKey) (*engine.RoundTripStats, error) {
 	f, ok := mx.frontends[key]
 	if !ok {
 		return nil, fmt.Errorf("%v not found", key)
 	}
-	return f.watcher.rtStats()
+	return f.rtStats()
 }
 
 func (mx *mux) backendStats(key engine.BackendKey) (*engine.RoundTripStats, error) {
@@ -65,11 +123,13 @@ func (mx *mux) backendStats(key engine.BackendKey) (*engine.RoundTripStats, erro
 		return nil, err
 	}
 	for _, f := range mx.frontends {
-		if f.backend.backend.Id != key.Id {
-			continue
-		}
-		if err := f.watcher.collectMetrics(m); err != nil {
-			return nil, err
+		for _, sp := range f.splits() {
+			if sp.id != key.Id {
+				continue
+			}
+			if err := sp.watcher.collectMetrics(m); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return engine.NewRoundTripStats(m)
@@ -94,25 +154,26 @@ func (mx *mux) serverStats(key engine.ServerKey) (*engine.RoundTripStats, error)
 	if err != nil {
 		return nil, err
 	}
-	for _, f := range mx.frontends {
-		if f.backend.backend.Id != key.BackendKey.Id {
-			continue
-		}
-		if err := f.watcher.collectServerMetrics(m, u); err != nil {
-			return nil, err
-		}
+	if err := b.collectServerMetrics(m, u); err != nil {
+		return nil, err
 	}
-	return engine.NewRoundTripStats(m)
+	stats, err := engine.NewRoundTripStats(m)
+	if err != nil {
+		return nil, err
+	}
+	stats.Health = b.serverHealth(u)
+	stats.Ejection = b.serverEjection(*srv)
+	return stats, nil
 }
 
 func (mx *mux) topFrontends(key *engine.BackendKey) ([]engine.Frontend, error) {
 	frontends := []engine.Frontend{}
 	for _, m := range mx.frontends {
-		if key != nil && key.Id != m.backend.backend.Id {
+		if key != nil && !m.frontend.UsesBackend(key.Id) {
 			continue
 		}
 		f := m.frontend
-		stats, err := m.watcher.rtStats()
+		stats, err := m.rtStats()
 		if err != nil {
 			return nil, err
 		}
@@ -126,21 +187,25 @@ func (mx *mux) topFrontends(key *engine.BackendKey) ([]engine.Frontend, error) {
 func (mx *mux) topServers(key *engine.BackendKey) ([]engine.Server, error) {
 	metrics := map[string]*sval{}
 	for _, f := range mx.frontends {
-		if key != nil && key.Id != f.backend.backend.Id {
-			continue
-		}
-		for _, s := range f.backend.servers {
-			val, ok := metrics[s.URL]
-			if !ok {
-				sval, err := newSval(s)
-				if err != nil {
+		for _, sp := range f.splits() {
+			if key != nil && key.Id != sp.id {
+				continue
+			}
+			for _, s := range sp.backend.servers {
+				val, ok := metrics[s.URL]
+				if !ok {
+					sval, err := newSval(s)
+					if err != nil {
+						return nil, err
+					}
+					sval.health = sp.backend.serverHealth(sval.u)
+					sval.ejection = sp.backend.serverEjection(s)
+					metrics[s.URL] = sval
+					val = sval
+				}
+				if err := sp.watcher.collectServerMetrics(val.m, val.u); err != nil {
 					return nil, err
 				}
-				metrics[s.URL] = sval
-				val = sval
-			}
-			if err := f.watcher.collectServerMetrics(val.m, val.u); err != nil {
-				return nil, err
 			}
 		}
 	}
@@ -150,6 +215,8 @@ func (mx *mux) topServers(key *engine.BackendKey) ([]engine.Server, error) {
 		if err != nil {
 			return nil, err
 		}
+		stats.Health = v.health
+		stats.Ejection = v.ejection
 		v.srv.Stats = stats
 		servers = append(servers, *v.srv)
 	}
@@ -158,9 +225,11 @@ func (mx *mux) topServers(key *engine.BackendKey) ([]engine.Server, error) {
 }
 
 type sval struct {
-	u   *url.URL
-	srv *engine.Server
-	m   *memmetrics.RTMetrics
+	u        *url.URL
+	srv      *engine.Server
+	m        *memmetrics.RTMetrics
+	health   *engine.ServerHealth
+	ejection *engine.ServerEjection
 }
 
 func newSval(s engine.Server) (*sval, error) {
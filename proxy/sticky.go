@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// stickyBalancer pins the client to the server with a cookie. The clients without the cookie or pinned to the server
+// that is no longer in the rotation are balanced using the strategy and pinned to the chosen server.
+type stickyBalancer struct {
+	balancer
+	settings engine.HTTPBackendStickySession
+	next     http.Handler
+
+	mtx *sync.RWMutex
+	// servers are keyed by the cookie values
+	servers map[string]*url.URL
+}
+
+func newStickyBalancer(s engine.HTTPBackendStickySession, lb engine.HTTPBackendLoadBalancer, next http.Handler, log utils.Logger) (*stickyBalancer, error) {
+	sb := &stickyBalancer{
+		settings: s,
+		next:     next,
+		mtx:      &sync.RWMutex{},
+		servers:  map[string]*url.URL{},
+	}
+	// The strategy passes the requests to setCookie, so the client is pinned to the chosen server
+	b, err := newStrategy(lb, http.HandlerFunc(sb.setCookie), log)
+	if err != nil {
+		return nil, err
+	}
+	sb.balancer = b
+	return sb, nil
+}
+
+func (s *stickyBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if u := s.pinnedServer(req); u != nil {
+		// make shallow copy of request before changing anything to avoid side effects
+		newReq := *req
+		newReq.URL = u
+		s.next.ServeHTTP(w, &newReq)
+		return
+	}
+	s.balancer.ServeHTTP(w, req)
+}
+
+func (s *stickyBalancer) setCookie(w http.ResponseWriter, req *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.settings.CookieName,
+		Value:    serverCookieValue(req.URL),
+		Path:     "/",
+		Secure:   s.settings.Secure,
+		HttpOnly: s.settings.HTTPOnly,
+	})
+	s.next.ServeHTTP(w, req)
+}
+
+// pinnedServer returns the server the client is pinned to or nil if the server is not in the rotation
+func (s *stickyBalancer) pinnedServer(req *http.Request) *url.URL {
+	c, err := req.Cookie(s.settings.CookieName)
+	if err != nil {
+		return nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	u, ok := s.servers[c.Value]
+	if !ok {
+		return nil
+	}
+	return utils.CopyURL(u)
+}
+
+func (s *stickyBalancer) UpsertServer(u *url.URL, weight int) error {
+	if err := s.balancer.UpsertServer(u, weight); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.servers[serverCookieValue(u)] = utils.CopyURL(u)
+	return nil
+}
+
+func (s *stickyBalancer) RemoveServer(u *url.URL) error {
+	s.mtx.Lock()
+	delete(s.servers, serverCookieValue(u))
+	s.mtx.Unlock()
+
+	return s.balancer.RemoveServer(u)
+}
+
+// serverCookieValue identifies the server in the cookie without disclosing its address
+func serverCookieValue(u *url.URL) string {
+	sum := sha1.Sum([]byte(u.String()))
+	return hex.EncodeToString(sum[:8])
+}
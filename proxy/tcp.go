@@ -0,0 +1,426 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/vulcand/engine"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+// tcpSrv accepts the connections on the tcp listener and proxies them to the servers of the tcp frontend
+// bound to the listener. Connections accepted while no frontend is bound to the listener are closed.
+type tcpSrv struct {
+	mux      *mux
+	listener engine.Listener
+	l        *proxyListener
+	state    int
+}
+
+func newTCPSrv(m *mux, l engine.Listener) *tcpSrv {
+	return &tcpSrv{
+		mux:      m,
+		listener: l,
+		state:    srvStateInit,
+	}
+}
+
+func (s *tcpSrv) String() string {
+	return fmt.Sprintf("%s->tcpSrv(%v, %v)", s.mux, s.state, &s.listener)
+}
+
+func (s *tcpSrv) GetFile() (*FileDescriptor, error) {
+	if s.l == nil {
+		return nil, nil
+	}
+	file, err := listenerFile(s.l.Listener)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDescriptor{
+		File:    file,
+		Address: s.listener.Address,
+	}, nil
+}
+
+func (s *tcpSrv) takeFile(f *FileDescriptor) error {
+	log.Infof("%s takeFile %v", s, f)
+
+	listener, err := f.ToListener()
+	if err != nil {
+		return err
+	}
+	if s.l, err = s.newProxyListener(listener); err != nil {
+		listener.Close()
+		return err
+	}
+	s.state = srvStateHijacked
+	return nil
+}
+
+// newProxyListener wraps the listening socket, PROXY protocol can be turned on and off by the listener updates
+func (s *tcpSrv) newProxyListener(l net.Listener) (*proxyListener, error) {
+	trusted, err := s.trustedNets(s.listener)
+	if err != nil {
+		return nil, err
+	}
+	return newProxyListener(l, trusted), nil
+}
+
+func (s *tcpSrv) trustedNets(l engine.Listener) ([]*net.IPNet, error) {
+	if l.ProxyProtocol == nil {
+		return nil, nil
+	}
+	return l.ProxyProtocol.TrustedNets()
+}
+
+func (s *tcpSrv) updateListener(l engine.Listener) error {
+	// We can not listen for different protocols on the same socket
+	if s.listener.Protocol != l.Protocol {
+		return fmt.Errorf("conflicting protocol %s and %s", s.listener.Protocol, l.Protocol)
+	}
+	trusted, err := s.trustedNets(l)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	if s.l != nil {
+		s.l.setTrusted(trusted)
+	}
+	return nil
+}
+
+func (s *tcpSrv) start() error {
+	log.Infof("%s start", s)
+	switch s.state {
+	case srvStateInit:
+		listener, err := net.Listen(s.listener.Address.Network, s.listener.Address.Address)
+		if err != nil {
+			return err
+		}
+		if s.l, err = s.newProxyListener(listener); err != nil {
+			listener.Close()
+			return err
+		}
+		s.state = srvStateActive
+		go s.serve(s.l)
+		return nil
+	case srvStateHijacked:
+		s.state = srvStateActive
+		go s.serve(s.l)
+		return nil
+	}
+	return fmt.Errorf("%v Calling start in unsupported state", s)
+}
+
+func (s *tcpSrv) serve(l net.Listener) {
+	log.Infof("%s serve", s)
+
+	s.mux.wg.Add(1)
+	defer s.mux.wg.Done()
+
+	id := s.listener.Id
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warningf("%v accept error: %v", s, err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			break
+		}
+		s.mux.wg.Add(1)
+		go func() {
+			defer s.mux.wg.Done()
+			s.mux.serveTCP(id, conn)
+		}()
+	}
+
+	log.Infof("%v stop", s)
+}
+
+// shutdown stops accepting the new connections, the open connections are closed by the clients,
+// the servers or when the mux stops
+func (s *tcpSrv) shutdown() {
+	if s.l != nil {
+		s.l.Close()
+	}
+}
+
+// serveTCP proxies the connection accepted by the listener to the server of the frontend bound to it
+func (m *mux) serveTCP(listenerId string, conn net.Conn) {
+	defer conn.Close()
+
+	m.mtx.RLock()
+	f := m.tcpFrontendOf(listenerId)
+	var b *tcpBackend
+	var servers []engine.Server
+	var settings *engine.TCPTransportSettings
+	if f != nil {
+		b = f.backend
+		servers, settings = b.servers, b.settings
+	}
+	m.mtx.RUnlock()
+
+	if f == nil {
+		log.Warningf("%v no tcp frontend is bound to listener %v, closing connection from %v", m, listenerId, conn.RemoteAddr())
+		return
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		if err := pc.readHeader(); err != nil {
+			log.Warningf("%v %v", f, err)
+			return
+		}
+	}
+
+	m.proxyTCP(f, conn, b, servers, settings, &f.stats)
+}
+
+// proxyTCP connects the client to one of the backend servers and copies the data both ways until
+// either side closes the connection or it stays idle, owner is the frontend or host the connection is logged for
+func (m *mux) proxyTCP(owner fmt.Stringer, conn net.Conn, b *tcpBackend, servers []engine.Server, settings *engine.TCPTransportSettings, stats *tcpStats) {
+	atomic.AddInt64(&stats.Total, 1)
+	atomic.AddInt64(&stats.Active, 1)
+	defer atomic.AddInt64(&stats.Active, -1)
+
+	sconn, err := b.dial(servers, settings, stats)
+	if err != nil {
+		log.Errorf("%v failed to connect %v: %v", owner, conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+
+	if settings.ProxyProtocol != "" {
+		src, dst := clientAddrs(conn)
+		sconn.SetWriteDeadline(time.Now().Add(settings.Timeouts.Idle))
+		if err := writeProxyHeader(sconn, settings.ProxyProtocol, src, dst); err != nil {
+			log.Errorf("%v failed to send PROXY protocol header: %v", owner, err)
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-m.stopC:
+			// Closing the connections stops the copying
+			log.Infof("%v closing the connection from %v, the mux is stopping", owner, conn.RemoteAddr())
+			conn.Close()
+			sconn.Close()
+		case <-done:
+		}
+	}()
+
+	idle := settings.Timeouts.Idle
+	deadline := time.Now().Add(idle)
+	conn.SetDeadline(deadline)
+	sconn.SetDeadline(deadline)
+
+	errC := make(chan error, 2)
+	go func() {
+		errC <- halfClose(sconn, copyIdle(sconn, conn, idle, conn, sconn, &stats.BytesIn))
+	}()
+	go func() {
+		errC <- halfClose(conn, copyIdle(conn, sconn, idle, conn, sconn, &stats.BytesOut))
+	}()
+	// Connection is closed once both sides are done sending or right away on errors, e.g. idle timeout
+	for i := 0; i < 2; i++ {
+		if err := <-errC; err != nil {
+			return
+		}
+	}
+}
+
+// halfClose passes the end of stream to the other side of the connection, so protocols that
+// stop sending before reading the reply keep working
+func halfClose(dst net.Conn, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	if cw, ok := dst.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// copyIdle copies the data from src to dst, every read or write extends the deadlines of both connections,
+// so the copying stops only when no data is sent in either direction for the idle timeout.
+// The copied bytes are added to the counter if it is not nil.
+func copyIdle(dst io.Writer, src io.Reader, idle time.Duration, a, b net.Conn, counter *int64) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			deadline := time.Now().Add(idle)
+			a.SetDeadline(deadline)
+			b.SetDeadline(deadline)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if counter != nil {
+				atomic.AddInt64(counter, int64(n))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tcpStats are the connection counters updated atomically by the proxied connections
+type tcpStats struct {
+	// Active is the number of the open connections
+	Active int64
+	// Total is the number of the accepted connections
+	Total int64
+	// DialErrors is the number of the failed connections to the servers
+	DialErrors int64
+	// BytesIn are sent by the clients to the servers, BytesOut are sent back
+	BytesIn  int64
+	BytesOut int64
+}
+
+func (s *tcpStats) snapshot() tcpStats {
+	return tcpStats{
+		Active:     atomic.LoadInt64(&s.Active),
+		Total:      atomic.LoadInt64(&s.Total),
+		DialErrors: atomic.LoadInt64(&s.DialErrors),
+		BytesIn:    atomic.LoadInt64(&s.BytesIn),
+		BytesOut:   atomic.LoadInt64(&s.BytesOut),
+	}
+}
+
+type tcpFrontend struct {
+	mux      *mux
+	frontend engine.Frontend
+	backend  *tcpBackend
+	stats    tcpStats
+}
+
+func (f *tcpFrontend) String() string {
+	return fmt.Sprintf("%v tcpFrontend(wrap=%v)", f.mux, &f.frontend)
+}
+
+func (f *tcpFrontend) listenerId() string {
+	return f.frontend.TCPSettings().ListenerId
+}
+
+// tcpBackend balances the connections between its servers in round robin
+type tcpBackend struct {
+	mux      *mux
+	backend  engine.Backend
+	settings *engine.TCPTransportSettings
+
+	frontends map[engine.FrontendKey]*tcpFrontend
+	// servers and settings are replaced on updates, so the connections can use them after releasing the mux lock
+	servers []engine.Server
+	// next is the round robin counter
+	next uint64
+}
+
+func newTCPBackend(m *mux, b engine.Backend) (*tcpBackend, error) {
+	s, err := m.tcpTransportSettings(b)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpBackend{
+		mux:       m,
+		backend:   b,
+		settings:  s,
+		servers:   []engine.Server{},
+		frontends: make(map[engine.FrontendKey]*tcpFrontend),
+	}, nil
+}
+
+func (b *tcpBackend) String() string {
+	return fmt.Sprintf("%v tcpBackend(wrap=%v)", b.mux, &b.backend)
+}
+
+func (b *tcpBackend) update(be engine.Backend) error {
+	s, err := b.mux.tcpTransportSettings(be)
+	if err != nil {
+		return err
+	}
+	b.backend = be
+	b.settings = s
+	return nil
+}
+
+func (b *tcpBackend) indexOfServer(id string) int {
+	for i := range b.servers {
+		if b.servers[i].Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *tcpBackend) upsertServer(s engine.Server) error {
+	if _, err := tcpServerAddress(s); err != nil {
+		return err
+	}
+	servers := make([]engine.Server, 0, len(b.servers)+1)
+	servers = append(servers, b.servers...)
+	if i := b.indexOfServer(s.Id); i != -1 {
+		servers[i] = s
+	} else {
+		servers = append(servers, s)
+	}
+	b.servers = servers
+	return nil
+}
+
+func (b *tcpBackend) deleteServer(sk engine.ServerKey) error {
+	i := b.indexOfServer(sk.Id)
+	if i == -1 {
+		return fmt.Errorf("%v not found %v", b, sk)
+	}
+	servers := make([]engine.Server, 0, len(b.servers)-1)
+	servers = append(servers, b.servers[:i]...)
+	b.servers = append(servers, b.servers[i+1:]...)
+	return nil
+}
+
+// dial connects to the next server in round robin, the following servers are tried if it fails
+func (b *tcpBackend) dial(servers []engine.Server, settings *engine.TCPTransportSettings, stats *tcpStats) (net.Conn, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%v has no servers", b)
+	}
+	start := int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(servers)))
+	var err error
+	for i := 0; i < len(servers); i++ {
+		s := servers[(start+i)%len(servers)]
+		var addr string
+		if addr, err = tcpServerAddress(s); err != nil {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", addr, settings.Timeouts.Dial); err == nil {
+			return conn, nil
+		}
+		atomic.AddInt64(&stats.DialErrors, 1)
+		log.Warningf("%v failed to connect to %v: %v", b, s.URL, err)
+	}
+	return nil, err
+}
+
+// tcpServerAddress returns the host and port of the server url, e.g. tcp://10.0.0.1:5432
+func tcpServerAddress(s engine.Server) (string, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", fmt.Errorf("%v should have host and port: %v", s, err)
+	}
+	return u.Host, nil
+}
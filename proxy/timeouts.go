@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// timeoutError is reported for the timed out requests, it is a net.Error so the error handlers respond with 504
+type timeoutError struct {
+	kind string
+}
+
+func (e *timeoutError) Error() string   { return e.kind + " timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return false }
+
+var (
+	errResponseHeaderTimeout = &timeoutError{kind: "response header"}
+	errTotalTimeout          = &timeoutError{kind: "total"}
+	errBodyIdleTimeout       = &timeoutError{kind: "body idle"}
+)
+
+// timeoutCounters are updated atomically by the requests, they are kept by the frontend across the rebuilds
+type timeoutCounters struct {
+	responseHeader int64
+	total          int64
+	bodyIdle       int64
+}
+
+func (c *timeoutCounters) add(err error) {
+	switch err {
+	case errResponseHeaderTimeout:
+		atomic.AddInt64(&c.responseHeader, 1)
+	case errTotalTimeout:
+		atomic.AddInt64(&c.total, 1)
+	case errBodyIdleTimeout:
+		atomic.AddInt64(&c.bodyIdle, 1)
+	}
+}
+
+func (c *timeoutCounters) stats() *engine.TimeoutStats {
+	return &engine.TimeoutStats{
+		ResponseHeader: atomic.LoadInt64(&c.responseHeader),
+		Total:          atomic.LoadInt64(&c.total),
+		BodyIdle:       atomic.LoadInt64(&c.bodyIdle),
+	}
+}
+
+// timeoutHandler cancels the requests running out of time. The frontend uses two of them: the total timeout
+// wraps the stream or the retrier and covers all the attempts, the response header and the body idle
+// timeouts wrap the middlewares and cover every attempt. Zero timeouts are not set.
+type timeoutHandler struct {
+	next     http.Handler
+	timeouts engine.FrontendTimeouts
+	counters *timeoutCounters
+	// writeTimeout is the write timeout of the server, the total timeout extends it if longer
+	writeTimeout time.Duration
+}
+
+func newTimeoutHandler(next http.Handler, t engine.FrontendTimeouts, counters *timeoutCounters, writeTimeout time.Duration) *timeoutHandler {
+	return &timeoutHandler{next: next, timeouts: t, counters: counters, writeTimeout: writeTimeout}
+}
+
+func (t *timeoutHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	tw := &timeoutWriter{w: w, header: make(http.Header)}
+	expire := func(err error, beforeHeader bool) {
+		if tw.expire(err, beforeHeader) {
+			cancel()
+		}
+	}
+
+	var timers []*time.Timer
+	if d := t.timeouts.Total; d > 0 {
+		if t.writeTimeout > 0 && d > t.writeTimeout {
+			// Server resets the write deadline for the next request on the connection. The errors are ignored
+			// as the wrapped writers may not support the deadlines.
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d))
+		}
+		timers = append(timers, time.AfterFunc(d, func() { expire(errTotalTimeout, false) }))
+	}
+	if d := t.timeouts.ResponseHeader; d > 0 {
+		timers = append(timers, time.AfterFunc(d, func() { expire(errResponseHeaderTimeout, true) }))
+	}
+	if d := t.timeouts.BodyIdle; d > 0 {
+		// Idle timer starts with the response header and is reset by every write
+		timer := time.AfterFunc(d, func() { expire(errBodyIdleTimeout, false) })
+		timer.Stop()
+		tw.onWrite = func() { timer.Reset(d) }
+		timers = append(timers, timer)
+	}
+
+	func() {
+		// Timers are stopped before finishing, so the request served in time is not expired afterwards.
+		// Panics of the aborted handlers are passed on to the server.
+		defer func() {
+			for _, timer := range timers {
+				timer.Stop()
+			}
+		}()
+		t.next.ServeHTTP(tw, req.WithContext(ctx))
+	}()
+	tw.finish(req, t.counters)
+}
+
+// timeoutWriter drops the writes of the handler once the request has timed out
+type timeoutWriter struct {
+	w       http.ResponseWriter
+	header  http.Header
+	onWrite func()
+
+	mtx   sync.Mutex
+	wrote bool
+	err   error
+}
+
+// expire marks the request as timed out, returns false if the request has already timed out or
+// the timeout is for the response header and the header has been written
+func (t *timeoutWriter) expire(err error, beforeHeader bool) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.err != nil || (beforeHeader && t.wrote) {
+		return false
+	}
+	t.err = err
+	return true
+}
+
+// finish responds with 504 to the timed out request, the connection is closed
+// if the response has been started already
+func (t *timeoutWriter) finish(req *http.Request, counters *timeoutCounters) {
+	t.mtx.Lock()
+	err, wrote := t.err, t.wrote
+	t.mtx.Unlock()
+	if err == nil {
+		if !wrote {
+			t.onWrite = nil
+			t.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+	counters.add(err)
+	if wrote {
+		panic(http.ErrAbortHandler)
+	}
+	utils.DefaultHandler.ServeHTTP(t.w, req, err)
+}
+
+func (t *timeoutWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *timeoutWriter) WriteHeader(code int) {
+	t.mtx.Lock()
+	if t.wrote || t.err != nil {
+		t.mtx.Unlock()
+		return
+	}
+	t.wrote = true
+	t.mtx.Unlock()
+
+	utils.CopyHeaders(t.w.Header(), t.header)
+	t.w.WriteHeader(code)
+	if t.onWrite != nil {
+		t.onWrite()
+	}
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	t.WriteHeader(http.StatusOK)
+	t.mtx.Lock()
+	err := t.err
+	t.mtx.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n, err := t.w.Write(b)
+	if t.onWrite != nil {
+		t.onWrite()
+	}
+	return n, err
+}
+
+// Flush lets the streaming responses reach the client
+func (t *timeoutWriter) Flush() {
+	t.mtx.Lock()
+	ok := t.wrote && t.err == nil
+	t.mtx.Unlock()
+	if !ok {
+		return
+	}
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
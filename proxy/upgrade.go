@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/forward"
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/oxy/utils"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// isUpgrade returns true if the client asks to switch the protocol of the connection, e.g. to WebSocket
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientWriterKey is the context key of the writer of the client connection
+type clientWriterKey struct{}
+
+// upgradeSwitch sends the upgrade requests around the stream, as the upgraded connections can not be
+// buffered or retried. The writer of the client connection is passed in the request context, so the tunnel
+// could hijack it, as the middlewares and the balancers wrap the writer.
+type upgradeSwitch struct {
+	upgrade http.Handler
+	next    http.Handler
+}
+
+func (u *upgradeSwitch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isUpgrade(req) {
+		u.next.ServeHTTP(w, req)
+		return
+	}
+	u.upgrade.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clientWriterKey{}, w)))
+}
+
+// tunnel proxies the upgrade requests to the server selected by the balancer. Once the server switches
+// the protocol, the client connection is hijacked and the data is copied in both directions until either side
+// closes the connection, the connection is idle for too long or the mux stops. Other requests are passed
+// to the next handler.
+type tunnel struct {
+	mux      *mux
+	settings *engine.TransportSettings
+	rewriter *forward.HeaderRewriter
+	next     http.Handler
+}
+
+func (t *tunnel) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isUpgrade(req) {
+		t.next.ServeHTTP(w, req)
+		return
+	}
+	cw, _ := req.Context().Value(clientWriterKey{}).(http.ResponseWriter)
+	hj, ok := cw.(http.Hijacker)
+	if !ok {
+		log.Warningf("%v can not hijack the connection for %v %v", t.mux, req.Method, req.URL)
+		t.next.ServeHTTP(w, req)
+		return
+	}
+
+	conn, err := t.dial(req)
+	if err != nil {
+		log.Errorf("%v failed to dial %v: %v", t.mux, req.URL, err)
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+	outReq := t.copyRequest(req)
+	conn.SetDeadline(time.Now().Add(t.settings.Timeouts.UpgradeIdle))
+	if err := outReq.Write(conn); err != nil {
+		conn.Close()
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+	serverBuf := bufio.NewReader(conn)
+	re, err := http.ReadResponse(serverBuf, outReq)
+	if err != nil {
+		conn.Close()
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// Server refused to switch the protocol, the response is passed as is
+	if re.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		defer re.Body.Close()
+		utils.CopyHeaders(w.Header(), re.Header)
+		w.WriteHeader(re.StatusCode)
+		io.Copy(w, re.Body)
+		return
+	}
+
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		conn.Close()
+		log.Errorf("%v failed to hijack the connection for %v %v: %v", t.mux, req.Method, req.URL, err)
+		return
+	}
+	defer t.mux.connTracker.onHijackedClose(clientConn)
+	defer clientConn.Close()
+	defer conn.Close()
+
+	// Headers set by the balancers and the middlewares, e.g. session cookies, are sent along
+	for k, vv := range w.Header() {
+		re.Header[k] = append(re.Header[k], vv...)
+	}
+	clientConn.SetDeadline(time.Now().Add(t.settings.Timeouts.UpgradeIdle))
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", re.Status)
+	re.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	t.mux.wg.Add(1)
+	defer t.mux.wg.Done()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-t.mux.stopC:
+			// Closing the connections stops the copying
+			log.Infof("%v closing the upgraded connection to %v, the mux is stopping", t.mux, req.URL)
+			clientConn.Close()
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	idle := t.settings.Timeouts.UpgradeIdle
+	errC := make(chan error, 2)
+	go func() { errC <- copyIdle(conn, clientBuf.Reader, idle, clientConn, conn, nil) }()
+	go func() { errC <- copyIdle(clientConn, serverBuf, idle, clientConn, conn, nil) }()
+	// The first side to finish closes the tunnel
+	<-errC
+}
+
+func (t *tunnel) dial(req *http.Request) (net.Conn, error) {
+	u := req.URL
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: t.settings.Timeouts.Dial, KeepAlive: t.settings.KeepAlive.Period}
+	var conn net.Conn
+	var err error
+	if t.settings.ProxyProtocol != "" {
+		// PROXY protocol header goes before the TLS handshake
+		conn, err = proxyDialer(dialer, t.settings.ProxyProtocol)(req.Context(), "tcp", host)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+	config := &tls.Config{}
+	if t.settings.TLS != nil {
+		config = t.settings.TLS.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(host)
+	}
+	// Upgrades are defined by HTTP/1.1 only, so it is negotiated even if the backend speaks HTTP/2
+	config.NextProtos = []string{"http/1.1"}
+	tc := tls.Client(conn, config)
+	if t.settings.Timeouts.TLSHandshake != 0 {
+		tc.SetDeadline(time.Now().Add(t.settings.Timeouts.TLSHandshake))
+	}
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// copyRequest prepares the upgrade request for the server, the hop-by-hop headers are removed
+// by the rewriter, so the upgrade headers are set back
+func (t *tunnel) copyRequest(req *http.Request) *http.Request {
+	outReq := new(http.Request)
+	*outReq = *req
+
+	outReq.URL = utils.CopyURL(req.URL)
+	outReq.URL.Opaque = req.RequestURI
+	// raw query is already included in RequestURI, so ignore it to avoid dupes
+	outReq.URL.RawQuery = ""
+
+	outReq.Proto = "HTTP/1.1"
+	outReq.ProtoMajor = 1
+	outReq.ProtoMinor = 1
+
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+	t.rewriter.Rewrite(outReq)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+	return outReq
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/go-etcd/etcd"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/mailgun/vulcand/acme"
 )
 
 type Options struct {
@@ -26,18 +27,33 @@ type Options struct {
 	EtcdKeyFile     string
 	EtcdConsistency string
 
+	ConsulAddr  string
+	ConsulKey   string
+	ConsulToken string
+
+	ConfigDir        string
+	ConfigPollPeriod time.Duration
+
+	HistorySize int
+
 	Log         string
 	LogSeverity severity
 
 	ServerReadTimeout    time.Duration
 	ServerWriteTimeout   time.Duration
 	ServerMaxHeaderBytes int
+	// ServerShutdownTimeout limits the time of waiting for the requests in progress when the listener is stopped
+	ServerShutdownTimeout time.Duration
 
 	EndpointDialTimeout time.Duration
 	EndpointReadTimeout time.Duration
 
 	SealKey string
 
+	ACME          bool
+	ACMEDirectory string
+	ACMEEmail     string
+
 	StatsdAddr   string
 	StatsdPrefix string
 }
@@ -77,6 +93,9 @@ func (o *listOptions) Set(value string) error {
 }
 
 func validateOptions(o Options) (Options, error) {
+	if o.ACME && o.SealKey == "" {
+		return o, fmt.Errorf("ACME needs the seal key to store the keys sealed, supply -sealKey")
+	}
 	if o.EndpointDialTimeout+o.EndpointReadTimeout >= o.ServerWriteTimeout {
 		fmt.Printf("!!!!!! WARN: serverWriteTimout(%s) should be > endpointDialTimeout(%s) + endpointReadTimeout(%s)\n\n",
 			o.ServerWriteTimeout, o.EndpointDialTimeout, o.EndpointReadTimeout)
@@ -99,6 +118,12 @@ func ParseCommandLine() (options Options, err error) {
 	flag.StringVar(&options.EtcdCertFile, "etcdCertFile", "", "Path to cert file for etcd communication")
 	flag.StringVar(&options.EtcdKeyFile, "etcdKeyFile", "", "Path to key file for etcd communication")
 	flag.StringVar(&options.EtcdConsistency, "etcdConsistency", etcd.STRONG_CONSISTENCY, "Etcd consistency")
+	flag.StringVar(&options.ConsulAddr, "consul", "", "Consul agent HTTP API address, replaces etcd as a configuration storage if set")
+	flag.StringVar(&options.ConsulKey, "consulKey", "vulcand", "Consul key for storing configuration")
+	flag.StringVar(&options.ConsulToken, "consulToken", "", "Consul ACL token")
+	flag.StringVar(&options.ConfigDir, "configDir", "", "Directory with configuration files, replaces etcd as a configuration storage if set")
+	flag.DurationVar(&options.ConfigPollPeriod, "configPollPeriod", time.Second, "How often to check configuration files for changes")
+	flag.IntVar(&options.HistorySize, "historySize", 100, "How many configuration revisions to keep for rollback, 0 disables the history")
 	flag.StringVar(&options.PidPath, "pidPath", "", "Path to write PID file to")
 	flag.IntVar(&options.Port, "port", 8181, "Port to listen on")
 	flag.IntVar(&options.ApiPort, "apiPort", 8182, "Port to provide api on")
@@ -116,11 +141,16 @@ func ParseCommandLine() (options Options, err error) {
 	flag.DurationVar(&options.ServerReadTimeout, "serverReadTimeout", time.Duration(60)*time.Second, "HTTP server read timeout")
 	flag.DurationVar(&options.ServerWriteTimeout, "writeTimeout", time.Duration(60)*time.Second, "HTTP server write timeout (deprecated)")
 	flag.DurationVar(&options.ServerWriteTimeout, "serverWriteTimeout", time.Duration(60)*time.Second, "HTTP server write timeout")
+	flag.DurationVar(&options.ServerShutdownTimeout, "serverShutdownTimeout", time.Duration(30)*time.Second, "Time the HTTP server waits for the requests in progress to complete on shutdown")
 	flag.DurationVar(&options.EndpointDialTimeout, "endpointDialTimeout", time.Duration(5)*time.Second, "Endpoint dial timeout")
 	flag.DurationVar(&options.EndpointReadTimeout, "endpointReadTimeout", time.Duration(50)*time.Second, "Endpoint read timeout")
 
 	flag.StringVar(&options.SealKey, "sealKey", "", "Seal key used to store encrypted data in the backend")
 
+	flag.BoolVar(&options.ACME, "acme", false, "Obtain and renew the certificates of the hosts with ACME turned on, needs the seal key")
+	flag.StringVar(&options.ACMEDirectory, "acmeDirectory", acme.LetsEncryptURL, "ACME server directory URL")
+	flag.StringVar(&options.ACMEEmail, "acmeEmail", "", "Contact email of the ACME accounts of the hosts without the email")
+
 	flag.StringVar(&options.StatsdPrefix, "statsdPrefix", "", "Statsd prefix will be appended to the metrics emitted by this instance")
 	flag.StringVar(&options.StatsdAddr, "statsdAddr", "", "Statsd address in form of 'host:port'")
 
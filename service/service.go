@@ -17,9 +17,12 @@ import (
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/manners"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/metrics"
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/mailgun/scroll"
+	"github.com/mailgun/vulcand/acme"
 	"github.com/mailgun/vulcand/api"
 	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/engine/consulng"
 	"github.com/mailgun/vulcand/engine/etcdng"
+	"github.com/mailgun/vulcand/engine/fsng"
 	"github.com/mailgun/vulcand/plugin"
 	"github.com/mailgun/vulcand/proxy"
 	"github.com/mailgun/vulcand/secret"
@@ -54,6 +57,7 @@ type Service struct {
 	apiServer     *manners.GracefulServer
 	ng            engine.Engine
 	stapler       stapler.Stapler
+	acme          *acme.Manager
 }
 
 func NewService(options Options, registry *plugin.Registry) *Service {
@@ -93,6 +97,9 @@ func (s *Service) Start() error {
 	if err := s.newEngine(); err != nil {
 		return err
 	}
+	if s.options.HistorySize > 0 {
+		s.ng = engine.NewVersioned(s.ng, s.options.HistorySize)
+	}
 
 	s.stapler = stapler.New()
 	s.supervisor = supervisor.New(
@@ -103,6 +110,12 @@ func (s *Service) Start() error {
 		return err
 	}
 
+	if s.options.ACME {
+		if err := s.startACME(); err != nil {
+			return err
+		}
+	}
+
 	if err := s.initApi(); err != nil {
 		return err
 	}
@@ -123,6 +136,9 @@ func (s *Service) Start() error {
 			switch signal {
 			case syscall.SIGTERM, syscall.SIGINT:
 				log.Infof("Got signal '%s', shutting down gracefully", signal)
+				if s.acme != nil {
+					s.acme.Stop()
+				}
 				s.supervisor.Stop(true)
 				log.Infof("All servers stopped")
 				return nil
@@ -264,6 +280,27 @@ func (s *Service) newEngine() error {
 	if err != nil {
 		return err
 	}
+	if s.options.ConsulAddr != "" {
+		s.ng, err = consulng.New(
+			s.options.ConsulAddr,
+			s.options.ConsulKey,
+			s.registry,
+			consulng.Options{
+				Token: s.options.ConsulToken,
+				Box:   box,
+			})
+		return err
+	}
+	if s.options.ConfigDir != "" {
+		s.ng, err = fsng.New(
+			s.options.ConfigDir,
+			s.registry,
+			fsng.Options{
+				PollPeriod: s.options.ConfigPollPeriod,
+				Box:        box,
+			})
+		return err
+	}
 	ng, err := etcdng.New(
 		s.options.EtcdNodes,
 		s.options.EtcdKey,
@@ -282,6 +319,23 @@ func (s *Service) newEngine() error {
 	return err
 }
 
+// startACME starts ordering the certificates of the hosts with ACME turned on, the keys are sealed by the seal key
+func (s *Service) startACME() error {
+	box, err := s.newBox()
+	if err != nil {
+		return err
+	}
+	s.acme, err = acme.New(s.ng, box, acme.Options{
+		DirectoryURL: s.options.ACMEDirectory,
+		Email:        s.options.ACMEEmail,
+	})
+	if err != nil {
+		return err
+	}
+	s.acme.Start()
+	return nil
+}
+
 func (s *Service) reportSystemMetrics() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -298,11 +352,12 @@ func (s *Service) reportSystemMetrics() {
 
 func (s *Service) newProxy(id int) (proxy.Proxy, error) {
 	return proxy.New(id, s.stapler, proxy.Options{
-		MetricsClient:  s.metricsClient,
-		DialTimeout:    s.options.EndpointDialTimeout,
-		ReadTimeout:    s.options.ServerReadTimeout,
-		WriteTimeout:   s.options.ServerWriteTimeout,
-		MaxHeaderBytes: s.options.ServerMaxHeaderBytes,
+		MetricsClient:   s.metricsClient,
+		DialTimeout:     s.options.EndpointDialTimeout,
+		ReadTimeout:     s.options.ServerReadTimeout,
+		WriteTimeout:    s.options.ServerWriteTimeout,
+		MaxHeaderBytes:  s.options.ServerMaxHeaderBytes,
+		ShutdownTimeout: s.options.ServerShutdownTimeout,
 		DefaultListener: &engine.Listener{
 			Id:       "DefaultListener",
 			Protocol: "http",
@@ -188,18 +188,30 @@ func (s *Supervisor) init() error {
 	// Watch and configure this instance of server
 	s.setCurrentProxy(proxy)
 	changesC := make(chan interface{})
+	cancelC := make(chan bool)
+	// resyncC carries the reason of the resync requested by the changes goroutine
+	resyncC := make(chan error, 1)
+	var cancelOnce sync.Once
+	cancel := func() {
+		cancelOnce.Do(func() { close(cancelC) })
+	}
 
 	// This goroutine will connect to the backend and emit the changes to the changesC channel.
 	// In case of any error it notifies supervisor of the error by sending an error to the channel triggering reload.
 	go func() {
-		cancelC := make(chan bool)
-		if err := s.engine.Subscribe(changesC, cancelC); err != nil {
+		err := s.engine.Subscribe(changesC, cancelC)
+		if err == nil {
+			select {
+			case err = <-resyncC:
+			default:
+			}
+		}
+		cancel()
+		if err != nil {
 			log.Infof("%v engine watcher got error: '%v' will restart", proxy, err)
-			close(cancelC)
 			close(changesC)
 			s.restartC <- err
 		} else {
-			close(cancelC)
 			// Graceful shutdown without restart
 			log.Infof("%v engine watcher got nil error, gracefully shutdown", proxy)
 			s.restartC <- nil
@@ -216,6 +228,14 @@ func (s *Supervisor) init() error {
 			}
 			if err := processChange(proxy, change); err != nil {
 				log.Errorf("failed to process change %#v, err: %s", change, err)
+				// The proxy has the batch applied partially, restart it with the configuration read from the engine
+				if _, ok := change.(*engine.BatchApplied); ok {
+					select {
+					case resyncC <- err:
+						cancel()
+					default:
+					}
+				}
 			}
 		}
 	}()
@@ -408,6 +428,9 @@ func processChange(p proxy.Proxy, ch interface{}) error {
 		return p.UpsertServer(change.BackendKey, change.Server)
 	case *engine.ServerDeleted:
 		return p.DeleteServer(change.ServerKey)
+
+	case *engine.BatchApplied:
+		return p.ApplyBatch(change.Changes)
 	}
 	return fmt.Errorf("unsupported change: %#v", ch)
 }
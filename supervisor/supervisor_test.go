@@ -135,6 +135,35 @@ func (s *SupervisorSuite) TestRestartOnBackendErrors(c *C) {
 	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
 }
 
+func (s *SupervisorSuite) TestRestartOnBatchErrors(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:11800", Route: `Path("/")`, URL: e.URL})
+
+	c.Assert(s.ng.UpsertBackend(b.B), IsNil)
+	c.Assert(s.ng.UpsertServer(b.BK, b.S, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertFrontend(b.F, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertListener(b.L), IsNil)
+
+	s.sv.Start()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	p := s.sv.getCurrentProxy()
+
+	// The batch is applied partially, so the proxy is replaced with the one configured from the engine
+	s.ng.ChangesC <- &engine.BatchApplied{Changes: []interface{}{
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: b.BK, Id: "missing"}},
+		&engine.FrontendDeleted{FrontendKey: b.FK},
+	}}
+
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(s.sv.getCurrentProxy(), Not(Equals), p)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+}
+
 func (s *SupervisorSuite) TestTransferFiles(c *C) {
 	e := testutils.NewResponder("Hi, I'm endpoint")
 	defer e.Close()
@@ -15,7 +15,8 @@ func NewBackendCommand(cmd *Command) cli.Command {
 				Usage:  "Update or insert a new backend to vulcan",
 				Action: cmd.upsertBackendAction,
 				Flags: append(append([]cli.Flag{
-					cli.StringFlag{Name: "id", Usage: "backend id"}},
+					cli.StringFlag{Name: "id", Usage: "backend id"},
+					cli.StringFlag{Name: "type", Value: engine.HTTP, Usage: "backend type, either http or tcp"}},
 					backendOptions()...),
 					getTLSFlags()...),
 			},
@@ -45,12 +46,7 @@ func NewBackendCommand(cmd *Command) cli.Command {
 }
 
 func (cmd *Command) upsertBackendAction(c *cli.Context) {
-	settings, err := getBackendSettings(c)
-	if err != nil {
-		cmd.printError(err)
-		return
-	}
-	b, err := engine.NewHTTPBackend(c.String("id"), settings)
+	b, err := getBackend(c)
 	if err != nil {
 		cmd.printError(err)
 		return
@@ -59,7 +55,7 @@ func (cmd *Command) upsertBackendAction(c *cli.Context) {
 }
 
 func (cmd *Command) deleteBackendAction(c *cli.Context) {
-	if err := cmd.client.DeleteBackend(engine.BackendKey{Id: c.String("id")}); err != nil {
+	if err := cmd.client.DeleteBackend(engine.BackendKey{Id: c.String("id")}, 0); err != nil {
 		cmd.printError(err)
 	} else {
 		cmd.printOk("backend deleted")
@@ -90,16 +86,77 @@ func (cmd *Command) listBackendsAction(c *cli.Context) {
 	}
 }
 
+func getBackend(c *cli.Context) (*engine.Backend, error) {
+	if c.String("type") == engine.TCP {
+		s := engine.TCPBackendSettings{}
+		s.Timeouts.Dial = c.Duration("dialTimeout").String()
+		s.Timeouts.Idle = c.Duration("idleTimeout").String()
+		s.ProxyProtocol = c.String("proxyProtocol")
+		return engine.NewTCPBackend(c.String("id"), s)
+	}
+	settings, err := getBackendSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	return engine.NewHTTPBackend(c.String("id"), settings)
+}
+
 func getBackendSettings(c *cli.Context) (engine.HTTPBackendSettings, error) {
 	s := engine.HTTPBackendSettings{}
 
 	s.Timeouts.Read = c.Duration("readTimeout").String()
 	s.Timeouts.Dial = c.Duration("dialTimeout").String()
 	s.Timeouts.TLSHandshake = c.Duration("handshakeTimeout").String()
+	s.Timeouts.UpgradeIdle = c.Duration("upgradeIdleTimeout").String()
 
 	s.KeepAlive.Period = c.Duration("keepAlivePeriod").String()
 	s.KeepAlive.MaxIdleConnsPerHost = c.Int("maxIdleConns")
 
+	s.LoadBalancer.Strategy = c.String("lb")
+	s.LoadBalancer.Variable = c.String("lbVar")
+
+	s.Protocol = c.String("protocol")
+	s.ProxyProtocol = c.String("proxyProtocol")
+
+	if c.String("hcPath") != "" {
+		s.HealthCheck = &engine.HTTPBackendHealthCheck{
+			Path:               c.String("hcPath"),
+			MinStatus:          c.Int("hcMinStatus"),
+			MaxStatus:          c.Int("hcMaxStatus"),
+			HealthyThreshold:   c.Int("hcHealthy"),
+			UnhealthyThreshold: c.Int("hcUnhealthy"),
+		}
+		if c.Duration("hcInterval") != 0 {
+			s.HealthCheck.Interval = c.Duration("hcInterval").String()
+		}
+		if c.Duration("hcTimeout") != 0 {
+			s.HealthCheck.Timeout = c.Duration("hcTimeout").String()
+		}
+	}
+
+	if c.String("stickyCookie") != "" {
+		s.StickySession = &engine.HTTPBackendStickySession{
+			CookieName: c.String("stickyCookie"),
+			Secure:     c.Bool("stickySecure"),
+			HTTPOnly:   c.Bool("stickyHttpOnly"),
+		}
+	}
+
+	if c.Bool("ejectOutliers") {
+		s.OutlierEjection = &engine.HTTPBackendOutlierEjection{
+			MaxEjectionPercent: c.Int("oeMaxPercent"),
+		}
+		if c.Duration("oeInterval") != 0 {
+			s.OutlierEjection.Interval = c.Duration("oeInterval").String()
+		}
+		if c.Duration("oeBaseTime") != 0 {
+			s.OutlierEjection.BaseEjectionTime = c.Duration("oeBaseTime").String()
+		}
+		if c.Duration("oeMaxTime") != 0 {
+			s.OutlierEjection.MaxEjectionTime = c.Duration("oeMaxTime").String()
+		}
+	}
+
 	tlsSettings, err := getTLSSettings(c)
 	if err != nil {
 		return s, err
@@ -114,9 +171,40 @@ func backendOptions() []cli.Flag {
 		cli.DurationFlag{Name: "readTimeout", Usage: "read timeout"},
 		cli.DurationFlag{Name: "dialTimeout", Usage: "dial timeout"},
 		cli.DurationFlag{Name: "handshakeTimeout", Usage: "TLS handshake timeout"},
+		cli.DurationFlag{Name: "upgradeIdleTimeout", Usage: "idle timeout of the upgraded connections, e.g. WebSockets"},
+		cli.DurationFlag{Name: "idleTimeout", Usage: "idle timeout of the tcp backend connections"},
 
 		// Keep-alive parameters
 		cli.StringFlag{Name: "keepAlivePeriod", Usage: "keep-alive period"},
 		cli.IntFlag{Name: "maxIdleConns", Usage: "maximum idle connections per host"},
+
+		// Protocol
+		cli.StringFlag{Name: "protocol", Usage: "protocol spoken to the servers: 'http/1.1' (default), 'h2' or 'h2c'"},
+		cli.StringFlag{Name: "proxyProtocol", Usage: "send PROXY protocol header with the client address to the servers: 'v1' or 'v2'"},
+
+		// Load balancing
+		cli.StringFlag{Name: "lb", Usage: "load balancing strategy: 'roundrobin' (default), 'leastconn', 'p2c' or 'hash'"},
+		cli.StringFlag{Name: "lbVar", Usage: "variable the 'hash' strategy uses, e.g. 'client.ip' or 'request.header.X-User'"},
+
+		// Sticky sessions
+		cli.StringFlag{Name: "stickyCookie", Usage: "name of the cookie pinning the client to the server, sticky sessions are disabled if not set"},
+		cli.BoolFlag{Name: "stickySecure", Usage: "set the secure flag of the sticky session cookie"},
+		cli.BoolFlag{Name: "stickyHttpOnly", Usage: "set the httponly flag of the sticky session cookie"},
+
+		// Health checks
+		cli.StringFlag{Name: "hcPath", Usage: "path requested by the health checks, e.g. /health, health checks are disabled if not set"},
+		cli.DurationFlag{Name: "hcInterval", Usage: "interval between the health checks"},
+		cli.DurationFlag{Name: "hcTimeout", Usage: "health check request timeout"},
+		cli.IntFlag{Name: "hcMinStatus", Usage: "minimum response code of the healthy server"},
+		cli.IntFlag{Name: "hcMaxStatus", Usage: "maximum response code of the healthy server"},
+		cli.IntFlag{Name: "hcHealthy", Usage: "consecutive passed checks bringing the server back"},
+		cli.IntFlag{Name: "hcUnhealthy", Usage: "consecutive failed checks taking the server out"},
+
+		// Outlier ejection
+		cli.BoolFlag{Name: "ejectOutliers", Usage: "eject the servers with the error rate or latency standing out"},
+		cli.DurationFlag{Name: "oeInterval", Usage: "interval between the outlier detection runs"},
+		cli.DurationFlag{Name: "oeBaseTime", Usage: "period of the first ejection, doubled with every consecutive ejection"},
+		cli.DurationFlag{Name: "oeMaxTime", Usage: "maximum ejection period"},
+		cli.IntFlag{Name: "oeMaxPercent", Usage: "maximum percent of the backend servers ejected at the same time"},
 	}
 }
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -50,6 +51,11 @@ func (cmd *Command) Run(args []string) error {
 		NewFrontendCommand(cmd),
 		NewServerCommand(cmd),
 		NewListenerCommand(cmd),
+		NewHistoryCommand(cmd),
+		NewRollbackCommand(cmd),
+		NewExportCommand(cmd),
+		NewDiffCommand(cmd),
+		NewApplyCommand(cmd),
 	}
 	app.Commands = append(app.Commands, NewMiddlewareCommands(cmd)...)
 	return app.Run(args)
@@ -115,3 +121,17 @@ func readBox(key string) (*secret.Box, error) {
 	}
 	return secret.NewBox(keyB)
 }
+
+// readErrorPages reads the error pages from the JSON file, e.g.
+// {"Pages": [{"Codes": ["502-504"], "ContentType": "text/html", "Body": "<h1>{{.StatusText}}</h1>"}]}
+func readErrorPages(path string) (*engine.ErrorPages, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pages *engine.ErrorPages
+	if err := json.Unmarshal(data, &pages); err != nil {
+		return nil, fmt.Errorf("failed to parse error pages: %s", err)
+	}
+	return pages, nil
+}
@@ -2,9 +2,12 @@ package command
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -42,7 +45,7 @@ func (s *CmdSuite) SetUpSuite(c *C) {
 }
 
 func (s *CmdSuite) SetUpTest(c *C) {
-	s.ng = memng.New(registry.GetRegistry())
+	s.ng = engine.NewVersioned(memng.New(registry.GetRegistry()), 10)
 
 	newProxy := func(id int) (proxy.Proxy, error) {
 		return proxy.New(id, stapler.New(), proxy.Options{})
@@ -149,6 +152,194 @@ func (s *CmdSuite) TestHTTPSListenerCRUD(c *C) {
 	c.Assert(s.run("listener", "rm", "-id", l), Matches, OK)
 }
 
+func (s *CmdSuite) TestHTTP2(c *C) {
+	l := "l1"
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "https", "-addr", "localhost:11300", "-http2"), Matches, OK)
+	ls, err := s.ng.GetListener(engine.ListenerKey{Id: l})
+	c.Assert(err, IsNil)
+	c.Assert(ls.HTTP2(), Equals, true)
+	c.Assert(s.run("listener", "ls"), Matches, ".*https, h2.*")
+
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-protocol", "h2c"), Matches, OK)
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().Protocol, Equals, engine.H2CProtocol)
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-protocol", "spdy"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestTCP(c *C) {
+	l := "l1"
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "tcp", "-addr", "localhost:11300"), Matches, OK)
+
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-type", "tcp", "-dialTimeout", "2s", "-idleTimeout", "1m"), Matches, OK)
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.Type, Equals, engine.TCP)
+	c.Assert(val.TCPSettings().Timeouts, Equals, engine.TCPBackendTimeouts{Dial: "2s", Idle: "1m0s"})
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", b, "-type", "tcp", "-listener", l), Matches, OK)
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(fr.TCPSettings().ListenerId, Equals, l)
+	c.Assert(s.run("frontend", "ls"), Matches, ".*listener l1.*tcp.*")
+
+	// TCP frontend needs the listener
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", b, "-type", "tcp"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestProxyProtocol(c *C) {
+	l := "l1"
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "http", "-addr", "localhost:11300",
+		"-proxyProtocolTrust", "10.0.0.0/8", "-proxyProtocolTrust", "192.168.0.0/16"), Matches, OK)
+	ls, err := s.ng.GetListener(engine.ListenerKey{Id: l})
+	c.Assert(err, IsNil)
+	c.Assert(ls.ProxyProtocol.TrustedCIDRs, DeepEquals, []string{"10.0.0.0/8", "192.168.0.0/16"})
+	c.Assert(s.run("listener", "ls"), Matches, ".*http, proxy protocol.*")
+
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "http", "-addr", "localhost:11300", "-proxyProtocolTrust", "bad"), Matches, ".*ERROR.*")
+
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-proxyProtocol", "v2"), Matches, OK)
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().ProxyProtocol, Equals, engine.ProxyProtocolV2)
+
+	c.Assert(s.run("backend", "upsert", "-id", "bk2", "-type", "tcp", "-proxyProtocol", "v1"), Matches, OK)
+	val, err = s.ng.GetBackend(engine.BackendKey{Id: "bk2"})
+	c.Assert(err, IsNil)
+	c.Assert(val.TCPSettings().ProxyProtocol, Equals, engine.ProxyProtocolV1)
+}
+
+func (s *CmdSuite) TestSNIPassthrough(c *C) {
+	l := "l1"
+	c.Assert(s.run("listener", "upsert", "-id", l, "-proto", "https", "-addr", "localhost:11300", "-sniPassthrough"), Matches, OK)
+	ls, err := s.ng.GetListener(engine.ListenerKey{Id: l})
+	c.Assert(err, IsNil)
+	c.Assert(ls.SNIPassthrough(), Equals, true)
+	c.Assert(s.run("listener", "ls"), Matches, ".*https, sni passthrough.*")
+
+	h := "secure.example.com"
+	c.Assert(s.run("host", "upsert", "-name", h, "-passthrough", "bk1"), Matches, OK)
+	host, err := s.ng.GetHost(engine.HostKey{Name: h})
+	c.Assert(err, IsNil)
+	c.Assert(host.Settings.Passthrough.BackendId, Equals, "bk1")
+
+	c.Assert(s.run("host", "upsert", "-name", h, "-passthrough", "bk1", "-ocsp"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestErrorPages(c *C) {
+	f, err := ioutil.TempFile("", "vulcand")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.Write([]byte(`{"Pages": [{"Codes": ["502-504"], "ContentType": "text/html", "Body": "<h1>{{.StatusText}}</h1>"}]}`))
+	f.Close()
+	pages := &engine.ErrorPages{Pages: []engine.ErrorPage{{Codes: []string{"502-504"}, ContentType: "text/html", Body: "<h1>{{.StatusText}}</h1>"}}}
+
+	h := "localhost"
+	c.Assert(s.run("host", "upsert", "-name", h, "-errorPages", f.Name()), Matches, OK)
+	host, err := s.ng.GetHost(engine.HostKey{Name: h})
+	c.Assert(err, IsNil)
+	c.Assert(host.Settings.ErrorPages, DeepEquals, pages)
+
+	c.Assert(s.run("backend", "upsert", "-id", "b1"), Matches, OK)
+	c.Assert(s.run("frontend", "upsert", "-id", "fr1", "-b", "b1", "-route", `Path("/")`, "-errorPages", f.Name()), Matches, OK)
+	fr, err := s.ng.GetFrontend(engine.FrontendKey{Id: "fr1"})
+	c.Assert(err, IsNil)
+	c.Assert(fr.HTTPSettings().ErrorPages, DeepEquals, pages)
+
+	c.Assert(s.run("host", "upsert", "-name", h, "-errorPages", "/does/not/exist"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestMaintenance(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "b1"), Matches, OK)
+	c.Assert(s.run("frontend", "upsert", "-id", "fr1", "-b", "b1", "-route", `Path("/")`), Matches, OK)
+
+	c.Assert(s.run("frontend", "maintenance", "on", "-id", "fr1", "-body", "back soon", "-retryAfter", "120",
+		"-allowIP", "10.0.0.0/8", "-allowHeader", "X-Maintenance-Bypass=secret"), Matches, OK)
+	f, err := s.ng.GetFrontend(engine.FrontendKey{Id: "fr1"})
+	c.Assert(err, IsNil)
+	c.Assert(f.HTTPSettings().Maintenance, DeepEquals, &engine.Maintenance{
+		Enabled:      true,
+		Body:         "back soon",
+		RetryAfter:   "120",
+		AllowIPs:     []string{"10.0.0.0/8"},
+		AllowHeaders: map[string]string{"X-Maintenance-Bypass": "secret"},
+	})
+	c.Assert(s.run("frontend", "ls"), Matches, ".*http, maintenance.*")
+
+	// The page is kept for the next maintenance
+	c.Assert(s.run("frontend", "maintenance", "off", "-id", "fr1"), Matches, OK)
+	f, err = s.ng.GetFrontend(engine.FrontendKey{Id: "fr1"})
+	c.Assert(err, IsNil)
+	c.Assert(f.HTTPSettings().Maintenance.Enabled, Equals, false)
+	c.Assert(f.HTTPSettings().Maintenance.Body, Equals, "back soon")
+
+	c.Assert(s.run("frontend", "maintenance", "on", "-id", "fr1", "-retryAfter", "soon"), Matches, ".*ERROR.*")
+
+	c.Assert(s.run("host", "upsert", "-name", "localhost"), Matches, OK)
+	c.Assert(s.run("host", "maintenance", "on", "-name", "localhost", "-status", "502"), Matches, OK)
+	h, err := s.ng.GetHost(engine.HostKey{Name: "localhost"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.Maintenance, DeepEquals, &engine.Maintenance{Enabled: true, StatusCode: 502})
+	c.Assert(s.run("host", "ls"), Matches, ".*localhost, maintenance.*")
+	c.Assert(s.run("host", "maintenance", "off", "-name", "localhost"), Matches, OK)
+}
+
+func (s *CmdSuite) TestHTTPSRedirect(c *C) {
+	c.Assert(s.run("host", "upsert", "-name", "localhost", "-httpsRedirect", "-httpsRedirectStatus", "308",
+		"-httpsRedirectExclude", "/.well-known/acme-challenge/", "-hstsMaxAge", "3600", "-hstsSubdomains"), Matches, OK)
+	h, err := s.ng.GetHost(engine.HostKey{Name: "localhost"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.HTTPSRedirect, DeepEquals, &engine.HTTPSRedirect{
+		StatusCode:   308,
+		ExcludePaths: []string{"/.well-known/acme-challenge/"},
+		HSTS:         &engine.HSTS{MaxAge: 3600, IncludeSubdomains: true},
+	})
+
+	c.Assert(s.run("host", "upsert", "-name", "localhost", "-httpsRedirect", "-httpsRedirectStatus", "200"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestHostACME(c *C) {
+	c.Assert(s.run("host", "upsert", "-name", "example.com", "-acme", "-acmeEmail", "admin@example.com"), Matches, OK)
+	h, err := s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.ACME, DeepEquals, &engine.HostACME{Enabled: true, Email: "admin@example.com"})
+
+	// Account and the certificate obtained by vulcand are kept by the updates
+	st := engine.ACMEState{
+		KeyPair:    &engine.KeyPair{Key: []byte("key"), Cert: []byte("cert")},
+		AccountURL: "https://acme.example.com/account/1",
+		LastError:  "rate limited",
+	}
+	c.Assert(s.ng.UpsertACMEState(engine.HostKey{Name: "example.com"}, st), IsNil)
+	c.Assert(s.run("host", "upsert", "-name", "example.com", "-acme"), Matches, OK)
+	h, err = s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair, DeepEquals, st.KeyPair)
+	c.Assert(h.ACME.AccountURL, Equals, "https://acme.example.com/account/1")
+	c.Assert(s.run("host", "ls"), Matches, ".*example.com, acme \\(last error: rate limited\\).*")
+
+	// State and the certificate are not exported and not compared with the configuration
+	dir, err := ioutil.TempDir("", "vulcand")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	c.Assert(s.run("export", "-f", path), Matches, OK)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "account"), Equals, false)
+	c.Assert(strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte("cert"))), Equals, false)
+	st.Version, st.LastError = h.ACME.Version, ""
+	c.Assert(s.ng.UpsertACMEState(engine.HostKey{Name: "example.com"}, st), IsNil)
+	c.Assert(s.run("diff", "-f", path), Matches, ".*up to date.*")
+
+	c.Assert(s.run("host", "upsert", "-name", "*.example.com", "-acme"), Matches, ".*ERROR.*")
+}
+
 func (s *CmdSuite) TestBackendCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
@@ -158,7 +349,7 @@ func (s *CmdSuite) TestBackendCRUD(c *C) {
 		"backend", "upsert",
 		"-id", b,
 		// Timeouts
-		"-readTimeout", "1s", "-dialTimeout", "2s", "-handshakeTimeout", "3s",
+		"-readTimeout", "1s", "-dialTimeout", "2s", "-handshakeTimeout", "3s", "-upgradeIdleTimeout", "1m0s",
 		// Keep Alive parameters
 		"-keepAlivePeriod", "4s", "-maxIdleConns", "5",
 		// TLS parameters
@@ -176,6 +367,7 @@ func (s *CmdSuite) TestBackendCRUD(c *C) {
 	c.Assert(o.Timeouts.Read, Equals, "1s")
 	c.Assert(o.Timeouts.Dial, Equals, "2s")
 	c.Assert(o.Timeouts.TLSHandshake, Equals, "3s")
+	c.Assert(o.Timeouts.UpgradeIdle, Equals, "1m0s")
 
 	c.Assert(o.KeepAlive.Period, Equals, "4s")
 	c.Assert(o.KeepAlive.MaxIdleConnsPerHost, Equals, 5)
@@ -194,6 +386,157 @@ func (s *CmdSuite) TestBackendCRUD(c *C) {
 	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
 }
 
+func (s *CmdSuite) TestBackendLoadBalancer(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-lb", "hash", "-lbVar", "client.ip"), Matches, OK)
+
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().LoadBalancer, DeepEquals, engine.HTTPBackendLoadBalancer{Strategy: "hash", Variable: "client.ip"})
+	c.Assert(s.run("backend", "show", "-id", b), Matches, ".*hash\\(client.ip\\).*")
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-lb", "leastconn"), Matches, OK)
+	c.Assert(s.run("backend", "ls"), Matches, ".*leastconn.*")
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-lb", "random"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestBackendHealthCheck(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-hcPath", "/health", "-hcInterval", "5s", "-hcUnhealthy", "2"), Matches, OK)
+
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().HealthCheck, DeepEquals, &engine.HTTPBackendHealthCheck{
+		Path:               "/health",
+		Interval:           "5s",
+		UnhealthyThreshold: 2,
+	})
+
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	val, err = s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().HealthCheck, IsNil)
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-hcPath", "health"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestBackendOutlierEjection(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-ejectOutliers", "-oeBaseTime", "10s", "-oeMaxPercent", "20"), Matches, OK)
+
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().OutlierEjection, DeepEquals, &engine.HTTPBackendOutlierEjection{
+		BaseEjectionTime:   "10s",
+		MaxEjectionPercent: 20,
+	})
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-ejectOutliers", "-oeMaxPercent", "200"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestFrontendTrafficSplit(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "stable"), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", "canary"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "stable", "-route", `Path("/")`, "-split", "canary=10", "-splitHeader", "X-Backend"), Matches, OK)
+
+	val, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().TrafficSplit, DeepEquals, &engine.HTTPFrontendTrafficSplit{
+		Splits: []engine.HTTPFrontendSplit{{BackendId: "canary", Weight: 10}},
+		Header: "X-Backend",
+	})
+	c.Assert(s.run("frontend", "show", "-id", f), Matches, ".*stable 90%, canary 10%.*")
+
+	// Shift the weights
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "stable", "-route", `Path("/")`, "-split", "canary=50"), Matches, OK)
+	val, err = s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().TrafficSplit.Splits[0].Weight, Equals, 50)
+
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "stable", "-route", `Path("/")`, "-split", "canary"), Matches, ".*ERROR.*")
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "stable", "-route", `Path("/")`, "-split", "canary=120"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestFrontendRetry(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "b1"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "b1", "-route", `Path("/")`,
+		"-retryAttempts", "3", "-retryTryTimeout", "2s", "-retryMethod", "GET", "-retryMethod", "PUT",
+		"-retryStatus", "503", "-retryBudgetPercent", "10"), Matches, OK)
+
+	val, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().Retry, DeepEquals, &engine.HTTPFrontendRetry{
+		Attempts:    3,
+		TryTimeout:  "2s",
+		Methods:     []string{"GET", "PUT"},
+		StatusCodes: []int{503},
+		Budget:      engine.HTTPFrontendRetryBudget{Percent: 10},
+	})
+
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "b1", "-route", `Path("/")`, "-retryAttempts", "3", "-retryBackoff", "bad"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestFrontendTimeouts(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "b1"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "b1", "-route", `Path("/")`,
+		"-responseHeaderTimeout", "5s", "-totalTimeout", "2m", "-bodyIdleTimeout", "30s"), Matches, OK)
+
+	val, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().Timeouts, DeepEquals, &engine.HTTPFrontendTimeouts{ResponseHeader: "5s", Total: "2m", BodyIdle: "30s"})
+
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "b1", "-route", `Path("/")`, "-totalTimeout", "bad"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestFrontendMirror(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "b1"), Matches, OK)
+	c.Assert(s.run("backend", "upsert", "-id", "shadow"), Matches, OK)
+
+	f := "fr1"
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "b1", "-route", `Path("/")`, "-mirror", "shadow=10"), Matches, OK)
+
+	val, err := s.ng.GetFrontend(engine.FrontendKey{Id: f})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().Mirror, DeepEquals, &engine.HTTPFrontendMirror{BackendId: "shadow", Percent: 10})
+	c.Assert(s.run("frontend", "show", "-id", f), Matches, ".*mirror shadow 10%.*")
+
+	c.Assert(s.run("frontend", "upsert", "-id", f, "-b", "b1", "-route", `Path("/")`, "-mirror", "b1=10"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestBackendStickySession(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b, "-stickyCookie", "srv", "-stickyHttpOnly"), Matches, OK)
+
+	val, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+	c.Assert(val.HTTPSettings().StickySession, DeepEquals, &engine.HTTPBackendStickySession{CookieName: "srv", HTTPOnly: true})
+
+	c.Assert(s.run("backend", "upsert", "-id", b, "-stickyCookie", "bad;name"), Matches, ".*ERROR.*")
+}
+
+func (s *CmdSuite) TestHistoryRollback(c *C) {
+	start := s.ng.(engine.Versioned).GetRevision()
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
+
+	c.Assert(s.run("history", "ls"), Matches, ".*BackendDeleted.*BackendUpserted.*")
+
+	c.Assert(s.run("rollback", "-revision", fmt.Sprintf("%d", start+1)), Matches, OK)
+	_, err := s.ng.GetBackend(engine.BackendKey{Id: b})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.run("rollback", "-revision", fmt.Sprintf("%d", start+100)), Matches, ".*ERROR.*")
+	c.Assert(s.run("rollback", "-revision", "1"), Matches, ".*ERROR.*")
+}
+
 func (s *CmdSuite) TestBackendSessionCacheCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
@@ -234,6 +577,19 @@ func (s *CmdSuite) TestServerCRUD(c *C) {
 	c.Assert(s.run("backend", "rm", "-id", b), Matches, OK)
 }
 
+func (s *CmdSuite) TestServerWeight(c *C) {
+	b := "bk1"
+	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
+	c.Assert(s.run("server", "upsert", "-id", "srv1", "-url", "http://localhost:5000", "-b", b, "-weight", "3"), Matches, OK)
+
+	srv, err := s.ng.GetServer(engine.ServerKey{BackendKey: engine.BackendKey{Id: b}, Id: "srv1"})
+	c.Assert(err, IsNil)
+	c.Assert(srv.Weight, Equals, 3)
+	c.Assert(s.run("backend", "show", "-id", b), Matches, ".*http://localhost:5000\\s+3.*")
+
+	c.Assert(s.run("server", "upsert", "-id", "srv2", "-url", "http://localhost:5001", "-b", b, "-weight", "-1"), Not(Matches), OK)
+}
+
 func (s *CmdSuite) TestFrontendCRUD(c *C) {
 	b := "bk1"
 	c.Assert(s.run("backend", "upsert", "-id", b), Matches, OK)
@@ -348,3 +704,36 @@ func (s *CmdSuite) TestNewKey(c *C) {
 	_, err = secret.NewBoxFromKeyString(string(bytes))
 	c.Assert(err, IsNil)
 }
+
+func (s *CmdSuite) TestExportDiffApply(c *C) {
+	c.Assert(s.run("backend", "upsert", "-id", "bk1"), Matches, OK)
+	c.Assert(s.run("server", "upsert", "-id", "srv1", "-url", "http://localhost:5000", "-b", "bk1"), Matches, OK)
+	c.Assert(s.run("frontend", "upsert", "-id", "fr1", "-b", "bk1", "-route", `Path("/path")`), Matches, OK)
+	c.Assert(s.run("connlimit", "upsert", "-f", "fr1", "-id", "cl1", "-connections", "10", "-variable", "client.ip"), Matches, OK)
+
+	for _, ext := range []string{".json", ".yaml"} {
+		dir, err := ioutil.TempDir("", "vulcand")
+		c.Assert(err, IsNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "config"+ext)
+
+		c.Assert(s.run("export", "-f", path), Matches, OK)
+		c.Assert(s.run("diff", "-f", path), Matches, ".*up to date.*")
+
+		c.Assert(s.ng.DeleteFrontend(engine.FrontendKey{Id: "fr1"}, 0), IsNil)
+		c.Assert(s.ng.UpsertBackend(engine.Backend{Id: "bk2", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}), IsNil)
+
+		c.Assert(s.run("diff", "-f", path), Matches, `.*\+ FrontendUpserted.*\+ MiddlewareUpserted.*`)
+		c.Assert(s.run("diff", "-f", path, "-prune"), Matches, `.*- BackendDeleted.*bk2.*`)
+
+		c.Assert(s.run("apply", "-f", path), Matches, ".*2 changes applied.*")
+		_, err = s.ng.GetMiddleware(engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: "fr1"}, Id: "cl1"})
+		c.Assert(err, IsNil)
+		_, err = s.ng.GetBackend(engine.BackendKey{Id: "bk2"})
+		c.Assert(err, IsNil)
+
+		c.Assert(s.run("apply", "-f", path, "-prune"), Matches, ".*1 changes applied.*")
+		_, err = s.ng.GetBackend(engine.BackendKey{Id: "bk2"})
+		c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	}
+}
@@ -0,0 +1,157 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/engine/fsng"
+)
+
+func NewExportCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "export",
+		Usage:  "Export the whole configuration as a JSON or YAML document",
+		Action: cmd.exportAction,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "file, f", Usage: "file to write the configuration to, stdout if not set"},
+			cli.StringFlag{Name: "format", Usage: "document format, 'json' or 'yaml', detected by the file extension if not set"},
+		},
+	}
+}
+
+func NewDiffCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "diff",
+		Usage:  "Show the changes apply would make to converge the configuration to the file",
+		Action: cmd.diffAction,
+		Flags:  configFileFlags(),
+	}
+}
+
+func NewApplyCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "apply",
+		Usage:  "Converge the configuration to the file, the changes are applied as a single batch",
+		Action: cmd.applyAction,
+		Flags:  configFileFlags(),
+	}
+}
+
+func configFileFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "file, f", Usage: "JSON or YAML file with the configuration"},
+		cli.BoolFlag{Name: "prune", Usage: "delete the objects missing in the file"},
+	}
+}
+
+func (cmd *Command) exportAction(c *cli.Context) {
+	cfg, err := engine.ReadConfig(cmd.client)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	format := c.String("format")
+	if format == "" {
+		format = "json"
+		if fsng.IsYAML(c.String("file")) {
+			format = "yaml"
+		}
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	switch format {
+	case "json":
+	case "yaml":
+		if data, err = fsng.JSONToYAML(data); err != nil {
+			cmd.printError(err)
+			return
+		}
+	default:
+		cmd.printError(fmt.Errorf("unsupported format: %s", format))
+		return
+	}
+	if c.String("file") == "" {
+		fmt.Fprintf(cmd.out, "%s\n", data)
+		return
+	}
+	if err := ioutil.WriteFile(c.String("file"), data, 0644); err != nil {
+		cmd.printError(err)
+		return
+	}
+	cmd.printOk("configuration exported to %s", c.String("file"))
+}
+
+func (cmd *Command) diffAction(c *cli.Context) {
+	changes, err := cmd.configChanges(c)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	if len(changes) == 0 {
+		cmd.printOk("configuration is up to date")
+		return
+	}
+	cmd.printChanges(changes)
+}
+
+func (cmd *Command) applyAction(c *cli.Context) {
+	changes, err := cmd.configChanges(c)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	if len(changes) == 0 {
+		cmd.printOk("configuration is up to date")
+		return
+	}
+	cmd.printChanges(changes)
+	if err := cmd.client.ApplyBatch(changes); err != nil {
+		cmd.printError(err)
+		return
+	}
+	cmd.printOk("%d changes applied", len(changes))
+}
+
+// configChanges returns the changes converging the live configuration to the one in the file
+func (cmd *Command) configChanges(c *cli.Context) ([]interface{}, error) {
+	if c.String("file") == "" {
+		return nil, fmt.Errorf("file is required")
+	}
+	desired, err := cmd.readConfig(c.String("file"))
+	if err != nil {
+		return nil, err
+	}
+	current, err := engine.ReadConfig(cmd.client)
+	if err != nil {
+		return nil, err
+	}
+	return engine.ConfigChanges(current, desired, c.Bool("prune"))
+}
+
+func (cmd *Command) readConfig(path string) (*engine.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if fsng.IsYAML(path) {
+		if data, err = fsng.YAMLToJSON(data); err != nil {
+			return nil, err
+		}
+	}
+	return engine.ConfigFromJSON(data, cmd.registry.GetSpec)
+}
+
+func isDeleteChange(change interface{}) bool {
+	switch change.(type) {
+	case *engine.HostDeleted, *engine.ListenerDeleted, *engine.BackendDeleted,
+		*engine.ServerDeleted, *engine.FrontendDeleted, *engine.MiddlewareDeleted:
+		return true
+	}
+	return false
+}
@@ -1,6 +1,10 @@
 package command
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/mailgun/vulcand/engine"
 )
@@ -32,6 +36,8 @@ func NewFrontendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "route", Usage: "roue, will be matched against request's path"},
 					cli.DurationFlag{Name: "ttl", Usage: "time to live duration, persistent if omitted"},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+					cli.StringFlag{Name: "type", Value: engine.HTTP, Usage: "frontend type, either http or tcp"},
+					cli.StringFlag{Name: "listener", Usage: "id of the tcp listener the tcp frontend accepts the connections on"},
 				}, frontendOptions()...),
 				Action: cmd.upsertFrontendAction,
 			},
@@ -43,6 +49,8 @@ func NewFrontendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "id"},
 				},
 			},
+			newMaintenanceCommand(cli.StringFlag{Name: "id", Usage: "id"},
+				cmd.frontendMaintenanceAction(true), cmd.frontendMaintenanceAction(false)),
 		},
 	}
 }
@@ -73,12 +81,7 @@ func (cmd *Command) printFrontendAction(c *cli.Context) {
 }
 
 func (cmd *Command) upsertFrontendAction(c *cli.Context) {
-	settings, err := getFrontendSettings(c)
-	if err != nil {
-		cmd.printError(err)
-		return
-	}
-	f, err := engine.NewHTTPFrontend(c.String("id"), c.String("b"), c.String("route"), settings)
+	f, err := getFrontend(c)
 	if err != nil {
 		cmd.printError(err)
 		return
@@ -91,7 +94,7 @@ func (cmd *Command) upsertFrontendAction(c *cli.Context) {
 }
 
 func (cmd *Command) deleteFrontendAction(c *cli.Context) {
-	err := cmd.client.DeleteFrontend(engine.FrontendKey{Id: c.String("id")})
+	err := cmd.client.DeleteFrontend(engine.FrontendKey{Id: c.String("id")}, 0)
 	if err != nil {
 		cmd.printError(err)
 		return
@@ -99,6 +102,17 @@ func (cmd *Command) deleteFrontendAction(c *cli.Context) {
 	cmd.printOk("frontend deleted")
 }
 
+func getFrontend(c *cli.Context) (*engine.Frontend, error) {
+	if c.String("type") == engine.TCP {
+		return engine.NewTCPFrontend(c.String("id"), c.String("b"), engine.TCPFrontendSettings{ListenerId: c.String("listener")})
+	}
+	settings, err := getFrontendSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	return engine.NewHTTPFrontend(c.String("id"), c.String("b"), c.String("route"), settings)
+}
+
 func getFrontendSettings(c *cli.Context) (engine.HTTPFrontendSettings, error) {
 	s := engine.HTTPFrontendSettings{}
 
@@ -109,9 +123,76 @@ func getFrontendSettings(c *cli.Context) (engine.HTTPFrontendSettings, error) {
 	s.Hostname = c.String("forwardHost")
 	s.TrustForwardHeader = c.Bool("trustForwardHeader")
 
+	if splits := c.StringSlice("split"); len(splits) != 0 {
+		t := &engine.HTTPFrontendTrafficSplit{
+			Header: c.String("splitHeader"),
+			Cookie: c.String("splitCookie"),
+		}
+		for _, v := range splits {
+			sp, err := parseSplit(v)
+			if err != nil {
+				return s, err
+			}
+			t.Splits = append(t.Splits, *sp)
+		}
+		s.TrafficSplit = t
+	}
+
+	if m := c.String("mirror"); m != "" {
+		sp, err := parseSplit(m)
+		if err != nil {
+			return s, err
+		}
+		s.Mirror = &engine.HTTPFrontendMirror{BackendId: sp.BackendId, Percent: sp.Weight}
+	}
+
+	if c.Int("retryAttempts") != 0 {
+		s.Retry = &engine.HTTPFrontendRetry{
+			Attempts:    c.Int("retryAttempts"),
+			TryTimeout:  c.String("retryTryTimeout"),
+			Backoff:     c.String("retryBackoff"),
+			MaxBackoff:  c.String("retryMaxBackoff"),
+			Methods:     c.StringSlice("retryMethod"),
+			StatusCodes: c.IntSlice("retryStatus"),
+			Budget: engine.HTTPFrontendRetryBudget{
+				Percent:    c.Int("retryBudgetPercent"),
+				MinRetries: c.Int("retryBudgetMinRetries"),
+			},
+		}
+	}
+
+	if c.String("responseHeaderTimeout") != "" || c.String("totalTimeout") != "" || c.String("bodyIdleTimeout") != "" {
+		s.Timeouts = &engine.HTTPFrontendTimeouts{
+			ResponseHeader: c.String("responseHeaderTimeout"),
+			Total:          c.String("totalTimeout"),
+			BodyIdle:       c.String("bodyIdleTimeout"),
+		}
+	}
+
+	if path := c.String("errorPages"); path != "" {
+		pages, err := readErrorPages(path)
+		if err != nil {
+			return s, err
+		}
+		s.ErrorPages = pages
+	}
+
 	return s, nil
 }
 
+// parseSplit parses the split in the form 'backend=weight', e.g. 'canary=10'
+func parseSplit(v string) (*engine.HTTPFrontendSplit, error) {
+	vals := strings.SplitN(v, "=", 2)
+	if len(vals) != 2 {
+		return nil, fmt.Errorf("split should be in the form 'backend=weight', got '%s'", v)
+	}
+	weight, err := strconv.Atoi(vals[1])
+	if err != nil {
+		return nil, fmt.Errorf("split weight should be a percentage, got '%s'", vals[1])
+	}
+	return &engine.HTTPFrontendSplit{BackendId: vals[0], Weight: weight}, nil
+}
+
 func frontendOptions() []cli.Flag {
 	return []cli.Flag{
 		// Frontend limits
@@ -122,5 +203,29 @@ func frontendOptions() []cli.Flag {
 		cli.StringFlag{Name: "failoverPredicate", Usage: "predicate that defines cases when failover is allowed"},
 		cli.StringFlag{Name: "forwardHost", Usage: "hostname to set when forwarding a request"},
 		cli.BoolFlag{Name: "trustForwardHeader", Usage: "allows copying X-Forwarded-For header value from the original request"},
+
+		// Traffic split
+		cli.StringSliceFlag{Name: "split", Usage: "percentage of the requests sent to the other backend, e.g. 'canary=10', the frontend backend gets the rest", Value: &cli.StringSlice{}},
+		cli.StringFlag{Name: "splitHeader", Usage: "request header with the id of the backend forcing the split"},
+		cli.StringFlag{Name: "splitCookie", Usage: "cookie with the id of the backend forcing the split"},
+
+		// Mirroring
+		cli.StringFlag{Name: "mirror", Usage: "percentage of the requests copied to the shadow backend, e.g. 'shadow=10'"},
+
+		// Retries
+		cli.IntFlag{Name: "retryAttempts", Usage: "maximum attempts of the request including the first one, turns on the retries"},
+		cli.StringFlag{Name: "retryTryTimeout", Usage: "timeout of every attempt, e.g. '2s'"},
+		cli.StringFlag{Name: "retryBackoff", Usage: "delay before the first retry doubled before every next one, e.g. '25ms'"},
+		cli.StringFlag{Name: "retryMaxBackoff", Usage: "maximum delay between the retries, e.g. '250ms'"},
+		cli.StringSliceFlag{Name: "retryMethod", Usage: "retried request method, GET, HEAD and OPTIONS if omitted, can be repeated", Value: &cli.StringSlice{}},
+		cli.IntSliceFlag{Name: "retryStatus", Usage: "retried response code in addition to the network errors, e.g. 503, can be repeated", Value: &cli.IntSlice{}},
+		cli.IntFlag{Name: "retryBudgetPercent", Usage: "percentage of the backend requests in flight that can be retries"},
+		cli.IntFlag{Name: "retryBudgetMinRetries", Usage: "retries in flight allowed regardless of the budget percentage"},
+		// Timeouts
+		cli.StringFlag{Name: "responseHeaderTimeout", Usage: "time to wait for the response header of every attempt, e.g. '5s'"},
+		cli.StringFlag{Name: "totalTimeout", Usage: "time limit of the whole request including the retries and the response body, e.g. '2m'"},
+		cli.StringFlag{Name: "bodyIdleTimeout", Usage: "time the response body streaming can stay idle, e.g. '30s'"},
+		// Error pages
+		cli.StringFlag{Name: "errorPages", Usage: "path to the JSON file with the error pages of the frontend"},
 	}
 }
@@ -0,0 +1,54 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+)
+
+func NewHistoryCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:  "history",
+		Usage: "Configuration history",
+		Subcommands: []cli.Command{
+			{
+				Name:   "ls",
+				Usage:  "List configuration revisions",
+				Action: cmd.listHistoryAction,
+			},
+		},
+	}
+}
+
+func NewRollbackCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:   "rollback",
+		Usage:  "Restore configuration as of the given revision",
+		Action: cmd.rollbackAction,
+		Flags: []cli.Flag{
+			cli.IntFlag{Name: "revision, r", Usage: "revision to roll back to"},
+		},
+	}
+}
+
+func (cmd *Command) listHistoryAction(c *cli.Context) {
+	revision, revisions, err := cmd.client.GetHistory()
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	cmd.printHistory(revision, revisions)
+}
+
+func (cmd *Command) rollbackAction(c *cli.Context) {
+	if !c.IsSet("revision") {
+		cmd.printError(fmt.Errorf("revision is required"))
+		return
+	}
+	revision := int64(c.Int("revision"))
+	if err := cmd.client.Rollback(revision); err != nil {
+		cmd.printError(err)
+		return
+	}
+	cmd.printOk("rolled back to revision %d", revision)
+}
@@ -33,11 +33,27 @@ func NewHostCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "name", Usage: "hostname"},
 					cli.StringFlag{Name: "privateKey", Usage: "Path to a private key"},
 					cli.StringFlag{Name: "cert", Usage: "Path to a certificate"},
+					cli.StringSliceFlag{Name: "extraCert", Usage: "Path to an additional certificate, e.g. RSA certificate along with the ECDSA cert, can be repeated", Value: &cli.StringSlice{}},
+					cli.StringSliceFlag{Name: "extraPrivateKey", Usage: "Path to the private key of the additional certificate, in the order of the certificates", Value: &cli.StringSlice{}},
 
 					cli.BoolFlag{Name: "ocsp", Usage: "Turn OCSP on"},
 					cli.BoolFlag{Name: "ocspSkipCheck", Usage: "Insecure: skip signature checking for the OCSP certificate"},
 					cli.DurationFlag{Name: "ocspPeriod", Usage: "optional OCSP period", Value: time.Hour},
 					cli.StringSliceFlag{Name: "ocspResponder", Usage: "Optional list of OCSP responders", Value: &cli.StringSlice{}},
+
+					cli.StringFlag{Name: "passthrough", Usage: "proxy the TLS connections to the tcp backend without terminating TLS, see listener -sniPassthrough"},
+					cli.StringFlag{Name: "errorPages", Usage: "Path to the JSON file with the error pages of the host"},
+
+					cli.BoolFlag{Name: "httpsRedirect", Usage: "Redirect the plain HTTP requests to HTTPS, the host should have the key pair"},
+					cli.IntFlag{Name: "httpsRedirectStatus", Usage: "Status code of the redirect, 301 if omitted"},
+					cli.IntFlag{Name: "httpsPort", Usage: "Port of the HTTPS listener, the port of the only HTTPS listener or 443 if omitted"},
+					cli.StringSliceFlag{Name: "httpsRedirectExclude", Usage: "Path prefix served over plain HTTP, e.g. '/.well-known/acme-challenge/', can be repeated", Value: &cli.StringSlice{}},
+					cli.IntFlag{Name: "hstsMaxAge", Usage: "Add the Strict-Transport-Security header with the max age in seconds to the HTTPS responses"},
+					cli.BoolFlag{Name: "hstsSubdomains", Usage: "Apply the Strict-Transport-Security to the subdomains"},
+					cli.BoolFlag{Name: "hstsPreload", Usage: "Allow preloading the Strict-Transport-Security by the browsers"},
+
+					cli.BoolFlag{Name: "acme", Usage: "Obtain and renew the certificate from the ACME server, see vulcand -acme, the host should be served on port 80"},
+					cli.StringFlag{Name: "acmeEmail", Usage: "Contact email of the ACME account of the host"},
 				},
 				Usage:  "Update or insert a new host to vulcan proxy",
 				Action: cmd.upsertHostAction,
@@ -50,6 +66,8 @@ func NewHostCommand(cmd *Command) cli.Command {
 				Usage:  "Remove a host from vulcan",
 				Action: cmd.deleteHostAction,
 			},
+			newMaintenanceCommand(cli.StringFlag{Name: "name", Usage: "hostname"},
+				cmd.hostMaintenanceAction(true), cmd.hostMaintenanceAction(false)),
 		},
 	}
 }
@@ -73,25 +91,67 @@ func (cmd *Command) printHostAction(c *cli.Context) {
 }
 
 func (cmd *Command) upsertHostAction(c *cli.Context) {
-	host, err := engine.NewHost(c.String("name"), engine.HostSettings{})
-	if err != nil {
-		cmd.printError(err)
-		return
-	}
+	settings := engine.HostSettings{}
 	if c.String("cert") != "" || c.String("privateKey") != "" {
 		keyPair, err := readKeyPair(c.String("cert"), c.String("privateKey"))
 		if err != nil {
 			cmd.printError(fmt.Errorf("failed to read key pair: %s", err))
 			return
 		}
-		host.Settings.KeyPair = keyPair
+		settings.KeyPair = keyPair
+	}
+	certs, keys := c.StringSlice("extraCert"), c.StringSlice("extraPrivateKey")
+	if len(certs) != len(keys) {
+		cmd.printError(fmt.Errorf("supply the private key for every additional certificate"))
+		return
+	}
+	for i := range certs {
+		keyPair, err := readKeyPair(certs[i], keys[i])
+		if err != nil {
+			cmd.printError(fmt.Errorf("failed to read key pair: %s", err))
+			return
+		}
+		settings.KeyPairs = append(settings.KeyPairs, *keyPair)
 	}
-	host.Settings.OCSP = engine.OCSPSettings{
+	settings.OCSP = engine.OCSPSettings{
 		Enabled:            c.Bool("ocsp"),
 		SkipSignatureCheck: c.Bool("ocspSkipCheck"),
 		Period:             c.Duration("ocspPeriod").String(),
 		Responders:         c.StringSlice("ocspResponder"),
 	}
+	if id := c.String("passthrough"); id != "" {
+		settings.Passthrough = &engine.HostPassthrough{BackendId: id}
+	}
+	if path := c.String("errorPages"); path != "" {
+		pages, err := readErrorPages(path)
+		if err != nil {
+			cmd.printError(err)
+			return
+		}
+		settings.ErrorPages = pages
+	}
+	if c.Bool("httpsRedirect") {
+		settings.HTTPSRedirect = &engine.HTTPSRedirect{
+			StatusCode:   c.Int("httpsRedirectStatus"),
+			Port:         c.Int("httpsPort"),
+			ExcludePaths: c.StringSlice("httpsRedirectExclude"),
+		}
+		if maxAge := c.Int("hstsMaxAge"); maxAge != 0 {
+			settings.HTTPSRedirect.HSTS = &engine.HSTS{
+				MaxAge:            maxAge,
+				IncludeSubdomains: c.Bool("hstsSubdomains"),
+				Preload:           c.Bool("hstsPreload"),
+			}
+		}
+	}
+	if c.Bool("acme") {
+		settings.ACME = &engine.HostACME{Enabled: true, Email: c.String("acmeEmail")}
+	}
+	host, err := engine.NewHost(c.String("name"), settings)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
 	if err := cmd.client.UpsertHost(*host); err != nil {
 		cmd.printError(err)
 		return
@@ -100,7 +160,7 @@ func (cmd *Command) upsertHostAction(c *cli.Context) {
 }
 
 func (cmd *Command) deleteHostAction(c *cli.Context) {
-	if err := cmd.client.DeleteHost(engine.HostKey{Name: c.String("name")}); err != nil {
+	if err := cmd.client.DeleteHost(engine.HostKey{Name: c.String("name")}, 0); err != nil {
 		cmd.printError(err)
 		return
 	}
@@ -29,10 +29,13 @@ func NewListenerCommand(cmd *Command) cli.Command {
 				Usage: "Update or insert a listener",
 				Flags: append([]cli.Flag{
 					cli.StringFlag{Name: "id", Usage: "id"},
-					cli.StringFlag{Name: "proto", Usage: "protocol, either http or https"},
+					cli.StringFlag{Name: "proto", Usage: "protocol, either http, https or tcp"},
 					cli.StringFlag{Name: "net", Value: "tcp", Usage: "network, tcp or unix"},
 					cli.StringFlag{Name: "addr", Value: "tcp", Usage: "address to bind to, e.g. 'localhost:31000'"},
 					cli.StringFlag{Name: "scope", Usage: "scope expression limits the listener, e.g. 'Hostname(`myhost`)'"},
+					cli.BoolFlag{Name: "http2", Usage: "negotiate HTTP/2 with the clients, https only"},
+					cli.BoolFlag{Name: "sniPassthrough", Usage: "proxy the TLS connections to the passthrough hosts without terminating TLS, https only"},
+					cli.StringSliceFlag{Name: "proxyProtocolTrust", Usage: "accept PROXY protocol headers from the CIDR, e.g. '10.0.0.0/8', can be repeated", Value: &cli.StringSlice{}},
 				}, getTLSFlags()...),
 				Action: cmd.upsertListenerAction,
 			},
@@ -56,13 +59,19 @@ func (cmd *Command) upsertListenerAction(c *cli.Context) {
 			cmd.printError(err)
 			return
 		}
-		settings = &engine.HTTPSListenerSettings{TLS: *s}
+		settings = &engine.HTTPSListenerSettings{TLS: *s, HTTP2: c.Bool("http2"), SNIPassthrough: c.Bool("sniPassthrough")}
 	}
 	listener, err := engine.NewListener(c.String("id"), c.String("proto"), c.String("net"), c.String("addr"), c.String("scope"), settings)
 	if err != nil {
 		cmd.printError(err)
 		return
 	}
+	if cidrs := c.StringSlice("proxyProtocolTrust"); len(cidrs) != 0 {
+		if listener.ProxyProtocol, err = engine.NewListenerProxyProtocol(cidrs); err != nil {
+			cmd.printError(err)
+			return
+		}
+	}
 	if err := cmd.client.UpsertListener(*listener); err != nil {
 		cmd.printError(err)
 		return
@@ -71,7 +80,7 @@ func (cmd *Command) upsertListenerAction(c *cli.Context) {
 }
 
 func (cmd *Command) deleteListenerAction(c *cli.Context) {
-	if err := cmd.client.DeleteListener(engine.ListenerKey{Id: c.String("id")}); err != nil {
+	if err := cmd.client.DeleteListener(engine.ListenerKey{Id: c.String("id")}, 0); err != nil {
 		cmd.printError(err)
 	}
 	cmd.printOk("listener deleted")
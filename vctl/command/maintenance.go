@@ -0,0 +1,134 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/mailgun/vulcand/engine"
+)
+
+// newMaintenanceCommand returns the command turning the maintenance of the frontend or the host on and off
+func newMaintenanceCommand(keyFlag cli.Flag, on, off func(c *cli.Context)) cli.Command {
+	return cli.Command{
+		Name:  "maintenance",
+		Usage: "Turn the maintenance on and off",
+		Subcommands: []cli.Command{
+			{
+				Name:  "on",
+				Usage: "Respond with the maintenance page, the page of the previous maintenance is used if omitted",
+				Flags: []cli.Flag{
+					keyFlag,
+					cli.IntFlag{Name: "status", Usage: "status code of the maintenance response, 503 if omitted"},
+					cli.StringFlag{Name: "contentType", Usage: "content type of the maintenance page, e.g. 'text/html'"},
+					cli.StringFlag{Name: "body", Usage: "body of the maintenance page"},
+					cli.StringFlag{Name: "retryAfter", Usage: "value of the Retry-After header, seconds or HTTP date, e.g. '120'"},
+					cli.StringSliceFlag{Name: "allowIP", Usage: "client IP or network bypassing the maintenance, e.g. '10.0.0.0/8', can be repeated", Value: &cli.StringSlice{}},
+					cli.StringSliceFlag{Name: "allowHeader", Usage: "request header bypassing the maintenance in the form 'name=value', can be repeated", Value: &cli.StringSlice{}},
+				},
+				Action: on,
+			},
+			{
+				Name:   "off",
+				Usage:  "Proxy the requests again, the maintenance page is kept for the next maintenance",
+				Flags:  []cli.Flag{keyFlag},
+				Action: off,
+			},
+		},
+	}
+}
+
+func (cmd *Command) frontendMaintenanceAction(enabled bool) func(c *cli.Context) {
+	return func(c *cli.Context) {
+		f, err := cmd.client.GetFrontend(engine.FrontendKey{Id: c.String("id")})
+		if err != nil {
+			cmd.printError(err)
+			return
+		}
+		settings := f.HTTPSettings()
+		if settings.Maintenance, err = getMaintenance(c, settings.Maintenance, enabled); err != nil {
+			cmd.printError(err)
+			return
+		}
+		updated, err := engine.NewHTTPFrontend(f.Id, f.BackendId, f.Route, settings)
+		if err != nil {
+			cmd.printError(err)
+			return
+		}
+		if err := cmd.client.UpsertFrontend(*updated, 0); err != nil {
+			cmd.printError(err)
+			return
+		}
+		cmd.printOk("frontend maintenance %s", onOff(enabled))
+	}
+}
+
+func (cmd *Command) hostMaintenanceAction(enabled bool) func(c *cli.Context) {
+	return func(c *cli.Context) {
+		h, err := cmd.client.GetHost(engine.HostKey{Name: c.String("name")})
+		if err != nil {
+			cmd.printError(err)
+			return
+		}
+		settings := h.Settings
+		if settings.Maintenance, err = getMaintenance(c, settings.Maintenance, enabled); err != nil {
+			cmd.printError(err)
+			return
+		}
+		updated, err := engine.NewHost(h.Name, settings)
+		if err != nil {
+			cmd.printError(err)
+			return
+		}
+		if err := cmd.client.UpsertHost(*updated); err != nil {
+			cmd.printError(err)
+			return
+		}
+		cmd.printOk("host maintenance %s", onOff(enabled))
+	}
+}
+
+// getMaintenance returns the copy of the maintenance updated with the flags set on the command line
+func getMaintenance(c *cli.Context, m *engine.Maintenance, enabled bool) (*engine.Maintenance, error) {
+	out := &engine.Maintenance{}
+	if m != nil {
+		*out = *m
+	}
+	out.Enabled = enabled
+	if !enabled {
+		return out, nil
+	}
+	if v := c.Int("status"); v != 0 {
+		out.StatusCode = v
+	}
+	if v := c.String("contentType"); v != "" {
+		out.ContentType = v
+	}
+	if v := c.String("body"); v != "" {
+		out.Body = v
+	}
+	if v := c.String("retryAfter"); v != "" {
+		out.RetryAfter = v
+	}
+	if v := c.StringSlice("allowIP"); len(v) != 0 {
+		out.AllowIPs = v
+	}
+	if v := c.StringSlice("allowHeader"); len(v) != 0 {
+		out.AllowHeaders = make(map[string]string, len(v))
+		for _, h := range v {
+			vals := strings.SplitN(h, "=", 2)
+			if len(vals) != 2 {
+				return nil, fmt.Errorf("allowed header should be in the form 'name=value', got '%s'", h)
+			}
+			out.AllowHeaders[vals[0]] = vals[1]
+		}
+	}
+	return out, nil
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
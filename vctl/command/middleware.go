@@ -68,7 +68,7 @@ func makeUpsertMiddlewareAction(cmd *Command, spec *plugin.MiddlewareSpec) func(
 func makeDeleteMiddlewareAction(cmd *Command, spec *plugin.MiddlewareSpec) func(c *cli.Context) {
 	return func(c *cli.Context) {
 		mk := engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: c.String("frontend")}, Id: c.String("id")}
-		if err := cmd.client.DeleteMiddleware(mk); err != nil {
+		if err := cmd.client.DeleteMiddleware(mk, 0); err != nil {
 			cmd.printError(err)
 			return
 		}
@@ -27,7 +27,7 @@ func frontendsOverview(frontends []engine.Frontend) string {
 
 func serversOverview(servers []engine.Server) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tURL\tReqs/sec\t50ile[ms]\t95ile[ms]\t99ile[ms]\tStatus codes %%\tNet. errors %%\tMessages\n")
+	fmt.Fprint(t, "Id\tURL\tReqs/sec\t50ile[ms]\t95ile[ms]\t99ile[ms]\tStatus codes %%\tNet. errors %%\tHealth\tMessages\n")
 
 	for _, e := range servers {
 		serverOverview(t, e)
@@ -48,6 +48,34 @@ func frontendOverview(w io.Writer, l engine.Frontend) {
 		statusCodesToString(s),
 		errRatioToString(s.NetErrorRatio()),
 	)
+	for _, sp := range s.Splits {
+		splitOverview(w, "", sp)
+	}
+	if s.Mirror != nil {
+		splitOverview(w, "mirror ", *s.Mirror)
+	}
+	if s.Retries != nil {
+		fmt.Fprintf(w, "  retries %d, budget exhausted %d\n", s.Retries.Retries, s.Retries.BudgetExhausted)
+	}
+	if t := s.Timeouts; t != nil {
+		fmt.Fprintf(w, "  timeouts: response header %d, total %d, body idle %d\n", t.ResponseHeader, t.Total, t.BodyIdle)
+	}
+}
+
+func splitOverview(w io.Writer, prefix string, sp engine.SplitStats) {
+	s := &sp.Stats
+
+	fmt.Fprintf(w, "  %s%s %d%%\t\t%0.1f\t%0.2f\t%0.2f\t%0.2f\t%s\t%s\n",
+		prefix,
+		sp.BackendId,
+		sp.Weight,
+		s.RequestsPerSecond(),
+		latencyAtQuantile(50.0, s),
+		latencyAtQuantile(95.0, s),
+		latencyAtQuantile(99.0, s),
+		statusCodesToString(s),
+		errRatioToString(s.NetErrorRatio()),
+	)
 }
 
 func serverOverview(w io.Writer, srv engine.Server) {
@@ -57,8 +85,12 @@ func serverOverview(w io.Writer, srv engine.Server) {
 	if s.Verdict.IsBad {
 		anomalies = fmt.Sprintf("%v", s.Verdict.Anomalies)
 	}
+	if s.Ejection != nil && s.Ejection.Ejected {
+		anomalies = strings.TrimSpace(fmt.Sprintf("%s %s",
+			goterm.Color(fmt.Sprintf("ejected until %s", s.Ejection.Until.Format("15:04:05")), goterm.RED), anomalies))
+	}
 
-	fmt.Fprintf(w, "%s\t%s\t%0.1f\t%0.2f\t%0.2f\t%0.2f\t%s\t%s\t%s\n",
+	fmt.Fprintf(w, "%s\t%s\t%0.1f\t%0.2f\t%0.2f\t%0.2f\t%s\t%s\t%s\t%s\n",
 		srv.Id,
 		srv.URL,
 		s.RequestsPerSecond(),
@@ -67,9 +99,20 @@ func serverOverview(w io.Writer, srv engine.Server) {
 		latencyAtQuantile(99.0, s),
 		statusCodesToString(s),
 		errRatioToString(s.NetErrorRatio()),
+		healthToString(s.Health),
 		anomalies)
 }
 
+func healthToString(h *engine.ServerHealth) string {
+	if h == nil {
+		return "-"
+	}
+	if h.Healthy {
+		return goterm.Color("healthy", goterm.GREEN)
+	}
+	return goterm.Color(fmt.Sprintf("unhealthy (%s)", h.Error), goterm.RED)
+}
+
 func latencyAtQuantile(q float64, s *engine.RoundTripStats) float64 {
 	v, err := s.LatencyBrackets.GetQuantile(q)
 	if err != nil {
@@ -103,6 +103,22 @@ func (cmd *Command) printFrontend(f *engine.Frontend, ms []engine.Middleware) {
 	writeS(cmd.out, middlewaresView(ms))
 }
 
+func (cmd *Command) printHistory(revision int64, revisions []engine.Revision) {
+	fmt.Fprintf(cmd.out, "\n[History] current revision: %d\n", revision)
+	writeS(cmd.out, historyView(revisions))
+}
+
+// printChanges prints upserts with '+' and deletes with '-'
+func (cmd *Command) printChanges(changes []interface{}) {
+	for _, change := range changes {
+		if isDeleteChange(change) {
+			fmt.Fprint(cmd.out, goterm.Color(fmt.Sprintf("- %v", change), goterm.RED)+"\n")
+		} else {
+			fmt.Fprint(cmd.out, goterm.Color(fmt.Sprintf("+ %v", change), goterm.GREEN)+"\n")
+		}
+	}
+}
+
 func writeS(w io.Writer, v string) {
 	w.Write([]byte(v))
 }
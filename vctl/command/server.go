@@ -35,6 +35,7 @@ func NewServerCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "server id"},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
 					cli.StringFlag{Name: "url", Usage: "url in form <scheme>://<host>:<port>"},
+					cli.IntFlag{Name: "weight", Usage: "share of the traffic relative to the other servers of the backend, 1 if not set"},
 					cli.DurationFlag{Name: "ttl", Usage: "ttl"},
 				},
 			},
@@ -52,7 +53,7 @@ func NewServerCommand(cmd *Command) cli.Command {
 }
 
 func (cmd *Command) upsertServerAction(c *cli.Context) {
-	s, err := engine.NewServer(c.String("id"), c.String("url"))
+	s, err := engine.NewWeightedServer(c.String("id"), c.String("url"), c.Int("weight"))
 	if err != nil {
 		cmd.printError(err)
 		return
@@ -66,7 +67,7 @@ func (cmd *Command) upsertServerAction(c *cli.Context) {
 
 func (cmd *Command) deleteServerAction(c *cli.Context) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: c.String("backend")}, Id: c.String("id")}
-	if err := cmd.client.DeleteServer(sk); err != nil {
+	if err := cmd.client.DeleteServer(sk, 0); err != nil {
 		cmd.printError(err)
 		return
 	}
@@ -3,6 +3,8 @@ package command
 import (
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/mailgun/vulcand/Godeps/_workspace/src/github.com/buger/goterm"
 	"github.com/mailgun/vulcand/engine"
@@ -22,7 +24,20 @@ func hostsView(hs []engine.Host) string {
 }
 
 func hostView(h *engine.Host) string {
-	return fmt.Sprintf("%s\t%t\n", h.Name, h.Settings.Default)
+	name := h.Name
+	if n := len(h.KeyPairs()); n > 1 {
+		name += fmt.Sprintf(", %d certificates", n)
+	}
+	if m := h.Settings.Maintenance; m != nil && m.Enabled {
+		name += ", maintenance"
+	}
+	if a := h.Settings.ACME; a != nil && a.Enabled {
+		name += ", acme"
+		if st := h.ACME; st != nil && st.LastError != "" {
+			name += fmt.Sprintf(" (last error: %s)", st.LastError)
+		}
+	}
+	return fmt.Sprintf("%s\t%t\n", name, h.Settings.Default)
 }
 
 func listenersView(ls []engine.Listener) string {
@@ -39,7 +54,17 @@ func listenersView(ls []engine.Listener) string {
 }
 
 func listenerView(l *engine.Listener) string {
-	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", l.Id, l.Protocol, l.Address.Network, l.Address.Address, l.Scope)
+	protocol := l.Protocol
+	if l.HTTP2() {
+		protocol += ", h2"
+	}
+	if l.SNIPassthrough() {
+		protocol += ", sni passthrough"
+	}
+	if l.ProxyProtocol != nil {
+		protocol += ", proxy protocol"
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", l.Id, protocol, l.Address.Network, l.Address.Address, l.Scope)
 }
 
 func frontendsView(fs []engine.Frontend) string {
@@ -56,12 +81,42 @@ func frontendsView(fs []engine.Frontend) string {
 }
 
 func frontendView(f *engine.Frontend) string {
-	return fmt.Sprintf("%s\t%s\t%s\t%s\n", f.Id, f.Route, f.BackendId, f.Type)
+	route := f.Route
+	if s, ok := f.Settings.(engine.TCPFrontendSettings); ok {
+		route = fmt.Sprintf("listener %s", s.ListenerId)
+	}
+	frontendType := f.Type
+	if s, ok := f.Settings.(engine.HTTPFrontendSettings); ok && s.Maintenance != nil && s.Maintenance.Enabled {
+		frontendType += ", maintenance"
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\n", f.Id, route, frontendBackendsView(f), frontendType)
+}
+
+// frontendBackendsView shows the backend of the frontend with the traffic split and the mirror if any,
+// e.g. 'b1 90%, b2 10%, mirror b3 5%'
+func frontendBackendsView(f *engine.Frontend) string {
+	s, ok := f.Settings.(engine.HTTPFrontendSettings)
+	if !ok {
+		return f.BackendId
+	}
+	out := []string{f.BackendId}
+	if s.TrafficSplit != nil {
+		rest := 100
+		for _, sp := range s.TrafficSplit.Splits {
+			rest -= sp.Weight
+			out = append(out, fmt.Sprintf("%s %d%%", sp.BackendId, sp.Weight))
+		}
+		out[0] = fmt.Sprintf("%s %d%%", f.BackendId, rest)
+	}
+	if s.Mirror != nil {
+		out = append(out, fmt.Sprintf("mirror %s %d%%", s.Mirror.BackendId, s.Mirror.Percent))
+	}
+	return strings.Join(out, ", ")
 }
 
 func backendsView(bs []engine.Backend) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tType\n")
+	fmt.Fprint(t, "Id\tType\tLoadBalancer\n")
 
 	if len(bs) == 0 {
 		return t.String()
@@ -73,12 +128,23 @@ func backendsView(bs []engine.Backend) string {
 }
 
 func backendView(b *engine.Backend) string {
-	return fmt.Sprintf("%s\t%s\n", b.Id, b.Type)
+	return fmt.Sprintf("%s\t%s\t%s\n", b.Id, b.Type, loadBalancerView(b))
+}
+
+func loadBalancerView(b *engine.Backend) string {
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if !ok || s.LoadBalancer.Strategy == "" {
+		return engine.RoundRobinLB
+	}
+	if s.LoadBalancer.Variable != "" {
+		return fmt.Sprintf("%s(%s)", s.LoadBalancer.Strategy, s.LoadBalancer.Variable)
+	}
+	return s.LoadBalancer.Strategy
 }
 
 func serversView(srvs []engine.Server) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tURL\n")
+	fmt.Fprint(t, "Id\tURL\tWeight\n")
 	if len(srvs) == 0 {
 		return t.String()
 	}
@@ -89,7 +155,32 @@ func serversView(srvs []engine.Server) string {
 }
 
 func serverView(s *engine.Server) string {
-	return fmt.Sprintf("%s\t%s\n", s.Id, s.URL)
+	weight := s.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	return fmt.Sprintf("%s\t%s\t%d\n", s.Id, s.URL, weight)
+}
+
+func historyView(rs []engine.Revision) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Revision\tTime\tChanges\n")
+	if len(rs) == 0 {
+		return t.String()
+	}
+	// Most recent revisions go first
+	for i := len(rs) - 1; i >= 0; i-- {
+		fmt.Fprint(t, revisionView(&rs[i]))
+	}
+	return t.String()
+}
+
+func revisionView(r *engine.Revision) string {
+	changes := make([]string, len(r.Changes))
+	for i, c := range r.Changes {
+		changes[i] = fmt.Sprintf("%v", c)
+	}
+	return fmt.Sprintf("%d\t%s\t%s\n", r.Id, r.Time.Format(time.RFC3339), strings.Join(changes, ", "))
 }
 
 func middlewaresView(ms []engine.Middleware) string {